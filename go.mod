@@ -7,9 +7,14 @@ require (
 	github.com/oschwald/geoip2-golang v1.11.0
 	github.com/rotisserie/eris v0.5.4
 	github.com/yeka/zip v0.0.0-20231116150916-03d6312748a9
+	go.opentelemetry.io/otel v1.46.0
+	go.opentelemetry.io/otel/trace v1.46.0
+	golang.org/x/net v0.47.0
+	golang.org/x/time v0.14.0
 )
 
 require (
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/oschwald/maxminddb-golang v1.13.0 // indirect
 	golang.org/x/crypto v0.45.0 // indirect
 	golang.org/x/sys v0.38.0 // indirect
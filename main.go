@@ -1,28 +1,60 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/bzip2"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
 	"net"
+	"net/http"
 	"net/mail"
+	"net/textproto"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	_ "github.com/emersion/go-message/charset"
 	"github.com/oschwald/geoip2-golang"
 	"github.com/rotisserie/eris"
 	"github.com/yeka/zip"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+	"golang.org/x/time/rate"
 )
 
 // Security configuration constants
@@ -34,6 +66,21 @@ const (
 	MaxCompressionRatio  = 100               // 100:1 compression ratio limit
 	MaxHeaderSearchBytes = 10000             // Limit for binary header search
 	MaxRegexMatches      = 50                // Limit regex matches to prevent ReDoS
+	DefaultMaxFiles      = 10000             // Default -max-files limit for directory input
+	DefaultMaxDepth      = 32                // Default -max-depth for -recursive
+	WatchPollInterval    = time.Second       // How often -watch checks for new messages
+	DefaultMaxHops       = 15                // Default -max-hops threshold for Received hops
+	DefaultMaxRecipients = 50                // Default -max-recipients threshold for To and Cc
+	DefaultMaxDateSkew   = 24 * time.Hour    // Default -max-date-skew between Date and delivery
+	MaxMIMEDepth         = 10                // Maximum multipart nesting read by -deep
+	MaxAttachments       = 100               // Maximum attachments listed per message
+	DefaultHTTPTimeout   = 10 * time.Second  // Whole-request timeout of the default HTTP client
+	MaxHTTPResponseBytes = 1024 * 1024       // Largest enrichment response body read
+	MaxSocketConns       = 16                // Connections -listen-unix analyzes at once
+	SocketTimeout        = 30 * time.Second  // Deadline for a -listen-unix client to send and receive
+
+	// Compressed mbox limits
+	MaxDecompressedMbox = 4 * 1024 * 1024 * 1024 // 4GB limit for a decompressed .mbox.gz/.mbox.bz2
 
 	// DMARC aggregate report limits
 	MaxDMARCReportSize  = 50 * 1024 * 1024 // 50MB max DMARC report size
@@ -44,19 +91,113 @@ const (
 
 // EmailSecurityReport contains the analysis results of email security headers
 type EmailSecurityReport struct {
-	From         string              `json:"from"`
-	To           string              `json:"to"`
-	Subject      string              `json:"subject"`
-	Date         string              `json:"date"`
-	MessageID    string              `json:"message_id"`
-	SPFResults   []SPFResult         `json:"spf_results"`
-	DKIMResults  []DKIMResult        `json:"dkim_results"`
-	DMARCResults []DMARCResult       `json:"dmarc_results"`
-	AuthResults  []AuthResult        `json:"auth_results"`
-	ARCResults   []ARCResult         `json:"arc_results"`
-	SCL          *SCLResult          `json:"scl,omitempty"`
-	ReceivedSPF  string              `json:"received_spf"`
-	RawHeaders   map[string][]string `json:"raw_headers,omitempty"`
+	File            string                 `json:"file,omitempty"`
+	MessageIndex    int                    `json:"message_index,omitempty"`  // 1-based position within an mbox or records file
+	MessageOffset   *int64                 `json:"message_offset,omitempty"` // Byte offset of the mbox "From " line or of the record
+	From            string                 `json:"from"`
+	To              string                 `json:"to"`
+	Subject         string                 `json:"subject"`
+	Date            string                 `json:"date"`
+	MessageID       string                 `json:"message_id"`
+	SPFResults      []SPFResult            `json:"spf_results"`
+	DKIMResults     []DKIMResult           `json:"dkim_results"`
+	DKIMSignatures  []DKIMSignature        `json:"dkim_signatures,omitempty"`
+	DMARCResults    []DMARCResult          `json:"dmarc_results"`
+	AuthResults     []AuthResult           `json:"auth_results"`
+	ARCResults      []ARCResult            `json:"arc_results"`
+	ARCChain        *ARCChain              `json:"arc_chain,omitempty"`     // ARC-Seal / ARC-Message-Signature structure
+	OriginalAuth    *OriginalAuthResults   `json:"original_auth,omitempty"` // From Authentication-Results-Original
+	SCL             *SCLResult             `json:"scl,omitempty"`
+	Allowlisted     bool                   `json:"allowlisted"` // SCL -1: spam filtering was skipped
+	SpamAssassin    *SpamAssassinResult    `json:"spamassassin,omitempty"`
+	Mimecast        *MimecastResult        `json:"mimecast,omitempty"`
+	Verdict         *ConsolidatedVerdict   `json:"verdict,omitempty"`  // Spam engines combined under the verdict policy
+	Gateways        []string               `json:"gateways,omitempty"` // Security vendors detected from header presence
+	Homograph       *HomographResult       `json:"homograph,omitempty"`
+	ListUnsubscribe *ListUnsubscribeResult `json:"list_unsubscribe,omitempty"`
+	Automation      *AutomationInfo        `json:"automation,omitempty"` // Precedence and Auto-Submitted
+	Thread          *ThreadInfo            `json:"thread,omitempty"`
+	Webmail         *WebmailProvenance     `json:"webmail,omitempty"`
+	WebappOrigin    *WebappOrigin          `json:"webapp_origin,omitempty"`   // Script that sent the mail from a web host
+	Software        *SenderSoftware        `json:"sender_software,omitempty"` // X-Mailer, User-Agent and Organization
+	Tenant          *TenantProvenance      `json:"tenant,omitempty"`          // Microsoft 365 cross-tenant headers
+	SenderID        *SenderIDResult        `json:"sender_id,omitempty"`       // Legacy Sender-ID (X-SID-PRA, X-SID-Result)
+	SenderIP        *SenderIP              `json:"sender_ip,omitempty"`       // Best-effort sending client IP
+	Recipients      *RecipientCount        `json:"recipients,omitempty"`      // To and Cc address counts
+	SenderCountry   string                 `json:"sender_country,omitempty"`  // Forefront CTRY token (ISO 3166 code)
+	CountryName     string                 `json:"country_name,omitempty"`    // English name for SenderCountry ("Unknown" for XX)
+	Reputation      *ReputationResult      `json:"reputation,omitempty"`      // Sender IP reputation (-reputation-api)
+	Attachments     []Attachment           `json:"attachments,omitempty"`     // MIME attachments (-deep only)
+	Baseline        *BaselineResult        `json:"baseline,omitempty"`        // Drift from the sender's -baseline entry
+	ReceivedChain   []ReceivedHop          `json:"received_chain,omitempty"`  // Oldest hop first
+	TransitSeconds  int64                  `json:"transit_seconds,omitempty"` // Earliest to latest parseable hop
+	HopCount        int                    `json:"hop_count"`                 // Received headers, parseable or not
+	ExcessiveHops   bool                   `json:"excessive_hops"`            // HopCount above the -max-hops threshold
+	ReceivedSPF     string                 `json:"received_spf"`
+	// SPFDisagreement is set when Received-SPF and Authentication-Results
+	// report different SPF results
+	SPFDisagreement bool `json:"spf_disagreement,omitempty"`
+	// SPFConsensus reconciles every SPF assertion (Received-SPF,
+	// Authentication-Results, ARC-Authentication-Results) into one result
+	// and lists the sources that disagree with it (see spfConsensus)
+	SPFConsensus *SPFConsensus `json:"spf_consensus,omitempty"`
+	// SPFAligned is set when a passing SPF domain (smtp.mailfrom) shares the
+	// From address's organizational domain, as relaxed DMARC alignment requires
+	SPFAligned bool `json:"spf_aligned"`
+	// SPFUnalignedPass is set when SPF passed but only for domains unrelated to
+	// From: the bounce domain authenticated while the visible sender may be
+	// spoofed
+	SPFUnalignedPass bool `json:"spf_unaligned_pass,omitempty"`
+	// DKIMAligned is set when a passing DKIM signing domain (d=) shares the
+	// From address's organizational domain
+	DKIMAligned bool `json:"dkim_aligned"`
+	// ReturnPathDomain is the envelope sender domain from Return-Path;
+	// ReturnPathMismatch is set when its organizational domain differs from
+	// the From address's
+	ReturnPathDomain   string `json:"return_path_domain,omitempty"`
+	ReturnPathMismatch bool   `json:"return_path_mismatch,omitempty"`
+	// ReplyToDomains lists the distinct domains of every Reply-To address;
+	// ReplyToMismatch is set when any of them belongs to a different
+	// organizational domain than FromDomain, so replies go somewhere other
+	// than the apparent sender (a business email compromise tell)
+	FromDomain      string   `json:"from_domain,omitempty"`
+	ReplyToDomains  []string `json:"reply_to_domains,omitempty"`
+	ReplyToMismatch bool     `json:"reply_to_mismatch,omitempty"`
+	// SCLCategoryConflict is set when the SCL is below the spam band but the
+	// CAT token names a malicious category (see maliciousCategories)
+	SCLCategoryConflict bool `json:"scl_category_conflict,omitempty"`
+	// SuspiciousRouting is set when the Received chain contains a sequence no
+	// real delivery produces; RoutingExplanation says which (see
+	// detectSuspiciousRouting)
+	SuspiciousRouting  bool   `json:"suspicious_routing,omitempty"`
+	RoutingExplanation string `json:"routing_explanation,omitempty"`
+	// DateSkewSeconds is how far the Date header is ahead of (positive) or
+	// behind (negative) delivery, the newest Received timestamp; nil when
+	// either is missing or unparseable. DateAnomaly is set when the skew
+	// exceeds the -max-date-skew threshold in either direction.
+	DateSkewSeconds *int64 `json:"date_skew_seconds,omitempty"`
+	DateAnomaly     bool   `json:"date_anomaly,omitempty"`
+	// SignalFingerprint is a short hash of the Forefront CAT, SFV, SFS rule
+	// IDs and CIP network, shared by messages of one campaign (see
+	// signalFingerprint)
+	SignalFingerprint string `json:"signal_fingerprint,omitempty"`
+	// AnalysisConfidence (0-100) reflects how many independent signals were
+	// parsed; see confidenceWeights
+	AnalysisConfidence int                 `json:"analysis_confidence"`
+	RawHeaders         map[string][]string `json:"raw_headers,omitempty"`
+	// Diagnostics lists each parser and whether it found data (-v only)
+	Diagnostics []ParserRun `json:"diagnostics,omitempty"`
+	// ProcessingDuration is the wall time spent analyzing the message,
+	// including body parsing and enrichment lookups (-v only, so default
+	// output stays byte-stable)
+	ProcessingDuration time.Duration `json:"processing_duration_ns,omitempty"`
+}
+
+// ParserRun records one parser's outcome for a message
+type ParserRun struct {
+	Parser  string `json:"parser"`
+	Matched bool   `json:"matched"`         // The parser produced a result
+	Error   string `json:"error,omitempty"` // Input was present but could not be used
 }
 
 // SPFResult represents SPF authentication result
@@ -64,7 +205,26 @@ type SPFResult struct {
 	Result      string `json:"result"` // pass, fail, softfail, neutral, none, temperror, permerror
 	Domain      string `json:"domain"`
 	Explanation string `json:"explanation"`
+	Reason      string `json:"reason,omitempty"` // Authentication-Results reason= text
 	ClientIP    string `json:"client_ip,omitempty"`
+	Source      string `json:"source,omitempty"` // received-spf or authentication-results
+}
+
+// SPFConsensus is the single SPF answer reconciled from every header that
+// asserts one
+type SPFConsensus struct {
+	Result     string         `json:"result"`               // Dominant result
+	Source     string         `json:"source"`               // Highest-precedence source asserting Result
+	Agreeing   int            `json:"agreeing"`             // Assertions reporting Result
+	Assertions int            `json:"assertions"`           // All SPF assertions considered
+	Dissenting []SPFAssertion `json:"dissenting,omitempty"` // Assertions with another result, in precedence order
+}
+
+// SPFAssertion is one header's SPF result
+type SPFAssertion struct {
+	Source string `json:"source"` // authentication-results, received-spf or arc-authentication-results (i=N)
+	Result string `json:"result"`
+	Domain string `json:"domain,omitempty"`
 }
 
 // DKIMResult represents DKIM signature validation result
@@ -76,6 +236,37 @@ type DKIMResult struct {
 	HeaderD   string `json:"header_d,omitempty"` // d= parameter
 	HeaderS   string `json:"header_s,omitempty"` // s= parameter
 	HeaderA   string `json:"header_a,omitempty"` // a= algorithm
+	Reason    string `json:"reason,omitempty"`   // Authentication-Results reason= text
+	Source    string `json:"source,omitempty"`   // dkim-signature, x-google-dkim-signature or authentication-results
+}
+
+// DKIM result and signature sources. DKIM-Signature is the signature of the
+// author (or sending) domain; Gmail adds X-Google-DKIM-Signature for its own
+// relays, which receivers do not verify against the author domain.
+const (
+	dkimSourceSignature   = "dkim-signature"
+	dkimSourceGoogle      = "x-google-dkim-signature"
+	dkimSourceAuthResults = "authentication-results"
+)
+
+// dkimSignatureHeaders lists the signature headers read, with their source
+var dkimSignatureHeaders = []struct{ name, source string }{
+	{"Dkim-Signature", dkimSourceSignature},
+	{"X-Google-Dkim-Signature", dkimSourceGoogle},
+}
+
+// DKIMSignature holds the tags of a raw DKIM-Signature header (RFC 6376).
+// It is available even when Authentication-Results has been stripped.
+type DKIMSignature struct {
+	Domain        string   `json:"domain"`                   // d=
+	Selector      string   `json:"selector"`                 // s=
+	Algorithm     string   `json:"algorithm,omitempty"`      // a=
+	SignedHeaders []string `json:"signed_headers,omitempty"` // h=
+	BodyHash      string   `json:"body_hash,omitempty"`      // bh=
+	Timestamp     int64    `json:"timestamp,omitempty"`      // t= (Unix seconds)
+	Expiration    int64    `json:"expiration,omitempty"`     // x= (Unix seconds)
+	Expired       bool     `json:"expired"`                  // x= is in the past
+	Source        string   `json:"source"`                   // dkim-signature or x-google-dkim-signature
 }
 
 // DMARCResult represents DMARC policy evaluation result
@@ -87,6 +278,7 @@ type DMARCResult struct {
 	DKIMAlignment   string `json:"dkim_alignment"` // pass, fail
 	Domain          string `json:"domain"`
 	SubdomainPolicy string `json:"subdomain_policy,omitempty"`
+	Reason          string `json:"reason,omitempty"` // Authentication-Results reason= text
 }
 
 // AuthResult represents parsed Authentication-Results header
@@ -98,12 +290,24 @@ type AuthResult struct {
 
 // AuthMethod represents individual authentication method result
 type AuthMethod struct {
-	Method     string            `json:"method"` // spf, dkim, dmarc, arc
+	Method     string            `json:"method"` // spf, dkim, dmarc, arc, compauth
 	Result     string            `json:"result"`
-	Reason     string            `json:"reason,omitempty"`
+	Reason     string            `json:"reason,omitempty"` // reason= text, e.g. "ip allowlisted" or compauth's "100"
 	Properties map[string]string `json:"properties,omitempty"`
 }
 
+// OriginalAuthResults holds the verdicts a forwarder preserved in
+// Authentication-Results-Original, parsed by the same extractors as
+// Authentication-Results
+type OriginalAuthResults struct {
+	SPFResults   []SPFResult   `json:"spf_results,omitempty"`
+	DKIMResults  []DKIMResult  `json:"dkim_results,omitempty"`
+	DMARCResults []DMARCResult `json:"dmarc_results,omitempty"`
+	// Differences lists methods whose best result changed since origin,
+	// e.g. "dmarc: pass originally, fail now"
+	Differences []string `json:"differences,omitempty"`
+}
+
 // ARCResult represents ARC (Authenticated Received Chain) result
 type ARCResult struct {
 	Instance int    `json:"instance"` // i= parameter
@@ -111,12 +315,551 @@ type ARCResult struct {
 	Chain    string `json:"chain"`    // none, fail, pass
 }
 
+// MaxARCInstances is the highest ARC instance RFC 8617 allows
+const MaxARCInstances = 50
+
+// ARCSet is one ARC instance (RFC 8617): the three headers one intermediary
+// adds, numbered by i= from 1 at the first hop
+type ARCSet struct {
+	Instance        int    `json:"instance"`                   // i=
+	ChainValidation string `json:"cv,omitempty"`               // ARC-Seal cv=: none, pass or fail
+	SealDomain      string `json:"seal_domain,omitempty"`      // ARC-Seal d=
+	SignatureDomain string `json:"signature_domain,omitempty"` // ARC-Message-Signature d=
+	HasSeal         bool   `json:"has_seal"`
+	HasSignature    bool   `json:"has_message_signature"`
+	HasResults      bool   `json:"has_authentication_results"`
+}
+
+// ARCChain describes the structure of a message's ARC chain. Signatures are
+// not verified: Status reflects whether every instance from 1 up is present
+// once with all three headers and what each seal's cv= says about the chain
+// before it.
+type ARCChain struct {
+	Status   string   `json:"status"`             // pass, fail, or none when no set is sealed or signed
+	Sets     []ARCSet `json:"sets"`               // By instance
+	Gaps     []int    `json:"gaps,omitempty"`     // Instances missing below the highest
+	Problems []string `json:"problems,omitempty"` // Why Status is fail
+}
+
 // SCLResult represents Microsoft Spam Confidence Level result
 type SCLResult struct {
 	Score        int    `json:"score"`         // -1 to 9 (higher = more likely spam)
 	Description  string `json:"description"`   // Human-readable description
 	HeaderSource string `json:"header_source"` // Source header name
 	RawHeader    string `json:"raw_header"`    // Full header value
+	// Services holds the SRV token classifications (e.g. BULK)
+	Services []ForefrontService `json:"services,omitempty"`
+	// SFV is the spam filter verdict token (e.g. SPM, NSPM, SKS)
+	SFV string `json:"sfv,omitempty"`
+	// CAT is the protection policy category that applied (e.g. SPM, PHSH)
+	CAT string `json:"cat,omitempty"`
+	// IPV is the connecting IP reputation verdict (e.g. CAL, NLI)
+	IPV string `json:"ipv,omitempty"`
+	// OverriddenByRule is set when SFV shows a mail flow rule or allow/block
+	// list decided the verdict, so Score does not reflect content filtering
+	OverriddenByRule bool `json:"overridden_by_rule"`
+}
+
+// SpamAssassinResult holds the verdict stamped by SpamAssassin (or a
+// compatible engine) in the X-Spam-* headers
+type SpamAssassinResult struct {
+	IsSpam        bool     `json:"is_spam"`                  // X-Spam-Flag / X-Spam-Status Yes
+	Score         float64  `json:"score"`                    // score= (or X-Spam-Score)
+	Required      float64  `json:"required,omitempty"`       // required= threshold
+	Tests         []string `json:"tests,omitempty"`          // tests= rule names
+	Engine        string   `json:"engine,omitempty"`         // From X-Spam-Checker-Version
+	EngineVersion string   `json:"engine_version,omitempty"` // From X-Spam-Checker-Version
+	// Rules is the per-rule point breakdown from X-Spam-Report, in header order
+	Rules []SpamAssassinRule `json:"rules,omitempty"`
+}
+
+// SpamAssassinRule is one rule's contribution to the SpamAssassin score
+type SpamAssassinRule struct {
+	Name        string  `json:"name"`
+	Score       float64 `json:"score"` // Points added (negative for ham rules)
+	Description string  `json:"description,omitempty"`
+}
+
+// MimecastResult holds the verdict stamped by a Mimecast gateway in the
+// X-Mimecast-* headers
+type MimecastResult struct {
+	Score     int    `json:"score"`               // X-Mimecast-Spam-Score
+	Signature string `json:"signature,omitempty"` // X-Mimecast-Spam-Signature (e.g. bulk)
+	Verdict   string `json:"verdict"`             // Shared verdict category
+}
+
+// Verdict categories shared by every spam engine, so gateways with different
+// scoring scales can be compared directly
+const (
+	VerdictNotSpam        = "not_spam"
+	VerdictLowSpam        = "low_spam"
+	VerdictSpam           = "spam"
+	VerdictHighConfidence = "high_confidence"
+)
+
+// SpamVerdict is one engine's verdict in the shared categories
+type SpamVerdict struct {
+	Source  string `json:"source"` // scl, spamassassin, mimecast
+	Verdict string `json:"verdict"`
+}
+
+// ConsolidatedVerdict combines the verdicts of every spam engine present
+type ConsolidatedVerdict struct {
+	Verdict      string        `json:"verdict"`
+	Policy       string        `json:"policy"`       // Policy that produced Verdict
+	Contributors []SpamVerdict `json:"contributors"` // Verdicts that decided the result
+	Inputs       []SpamVerdict `json:"inputs"`       // Every verdict considered, in source order
+	Disagreement bool          `json:"disagreement"` // Inputs fall in more than one category
+}
+
+// ScoreBands maps a spam engine's numeric score onto the shared verdict
+// categories: a score at or above LowSpam, Spam or HighConfidence falls in
+// that band, and a lower score is not spam
+type ScoreBands struct {
+	LowSpam        float64 `json:"low_spam"`
+	Spam           float64 `json:"spam"`
+	HighConfidence float64 `json:"high_confidence"`
+}
+
+// verdict returns the shared verdict category for score
+func (b ScoreBands) verdict(score float64) string {
+	switch {
+	case score >= b.HighConfidence:
+		return VerdictHighConfidence
+	case score >= b.Spam:
+		return VerdictSpam
+	case score >= b.LowSpam:
+		return VerdictLowSpam
+	default:
+		return VerdictNotSpam
+	}
+}
+
+// defaultScoreBands are the score bands of each engine without an SCL,
+// overridable with -verdict-map. SpamAssassin's spam band starts at its
+// default required_score of 5. Mimecast does not publish its scale; its
+// bands follow the scores observed on delivered, bulk and held messages.
+var defaultScoreBands = map[string]ScoreBands{
+	"spamassassin": {LowSpam: 3, Spam: 5, HighConfidence: 10},
+	"mimecast":     {LowSpam: 3, Spam: 5, HighConfidence: 10},
+}
+
+// verdictPolicies are the policies accepted by -verdict-policy. most-severe is
+// the default because letting one clean verdict outvote a spam verdict is the
+// riskier mistake.
+var verdictPolicies = []string{"most-severe", "majority", "first"}
+
+// verdictSeverity orders the shared verdict categories from least to most severe
+var verdictSeverity = map[string]int{
+	VerdictNotSpam:        0,
+	VerdictLowSpam:        1,
+	VerdictSpam:           2,
+	VerdictHighConfidence: 3,
+}
+
+// ForefrontService is a service-level classification from the SRV token
+type ForefrontService struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+}
+
+// ListUnsubscribeResult describes RFC 2369 / RFC 8058 unsubscribe headers
+type ListUnsubscribeResult struct {
+	PostPresent         bool     `json:"post_present"`          // List-Unsubscribe-Post header present
+	OneClickUnsubscribe bool     `json:"one_click_unsubscribe"` // RFC 8058 one-click unsubscribe
+	URLs                []string `json:"urls,omitempty"`
+	Mailtos             []string `json:"mailtos,omitempty"`
+	RawHeader           string   `json:"raw_header"`
+}
+
+// AutomationInfo describes the Precedence (RFC 2076) and Auto-Submitted
+// (RFC 3834) headers, which mark bulk and machine-generated mail
+type AutomationInfo struct {
+	Precedence    string `json:"precedence,omitempty"`     // Lowercased, e.g. bulk, list, junk
+	AutoSubmitted string `json:"auto_submitted,omitempty"` // Lowercased keyword, e.g. auto-generated, auto-replied
+	Bulk          bool   `json:"bulk"`                     // Precedence is bulk, list or junk
+	Automated     bool   `json:"automated"`                // Auto-Submitted is present and not "no"
+}
+
+// ThreadInfo describes the conversation a message claims to belong to
+type ThreadInfo struct {
+	InReplyTo           []string `json:"in_reply_to,omitempty"`    // Message-IDs from In-Reply-To
+	References          []string `json:"references,omitempty"`     // Message-IDs from References
+	IsReply             bool     `json:"is_reply"`                 // In-Reply-To is set
+	ThreadDomains       []string `json:"thread_domains,omitempty"` // Domains of referenced Message-IDs
+	ReplyDomainMismatch bool     `json:"reply_domain_mismatch"`    // From domain absent from an established thread
+}
+
+// WebmailProvenance holds origin headers added by webmail providers (older
+// Hotmail/Outlook.com and Yahoo mail in particular). The provider stamps them
+// without authentication, so they are weak signals that can corroborate or
+// contradict the From address.
+type WebmailProvenance struct {
+	OriginatingEmail string `json:"originating_email,omitempty"` // X-Originating-Email
+	OriginatingIP    string `json:"originating_ip,omitempty"`    // X-Originating-IP
+	ApparentlyTo     string `json:"apparently_to,omitempty"`     // X-Apparently-To recipient
+	FromMismatch     bool   `json:"from_mismatch"`               // Originating email differs from From
+}
+
+// WebappOrigin holds the headers PHP's mail() and cPanel's sendmail wrapper
+// add to mail sent by a script on a web host. On spam they name the script,
+// and so the compromised site, that sent it.
+type WebappOrigin struct {
+	Script     string `json:"script,omitempty"`      // X-PHP-Originating-Script file name
+	ScriptUID  string `json:"script_uid,omitempty"`  // X-PHP-Originating-Script UID owning the script
+	PHPScript  string `json:"php_script,omitempty"`  // X-PHP-Script (PHP before 5.3): script URL and client IP
+	Source     string `json:"source,omitempty"`      // X-Source: program that invoked sendmail
+	SourceArgs string `json:"source_args,omitempty"` // X-Source-Args: its command line
+	SourceDir  string `json:"source_dir,omitempty"`  // X-Source-Dir: site and directory it ran in
+}
+
+// SenderSoftware holds the headers naming the program that composed the
+// message and the sender's organization. They are set by the sender and
+// trivially forged, but bulk spam tools leave them at their defaults, which
+// makes them useful for fingerprinting campaigns.
+type SenderSoftware struct {
+	Mailer       string `json:"mailer,omitempty"`       // X-Mailer
+	UserAgent    string `json:"user_agent,omitempty"`   // User-Agent
+	Organization string `json:"organization,omitempty"` // Organization
+	SpamTool     string `json:"spam_tool,omitempty"`    // Matched entry of the spam tool signature list
+}
+
+// defaultSpamTools lists X-Mailer / User-Agent substrings of bulk mailing
+// programs seen almost only on spam, matched case-insensitively. Add entries
+// here as new tools are observed, or replace the list with -spam-tools.
+var defaultSpamTools = []string{
+	"Atomic Mail Sender",
+	"Advanced Mass Sender",
+	"Dark Mailer",
+	"GammaDyne Mailer",
+	"Group Mail",
+	"Mass Mailer",
+	"MaxBulk Mailer",
+	"Send-Safe",
+	"SendBlaster",
+}
+
+// TenantProvenance holds the X-MS-Exchange-CrossTenant-* headers Exchange
+// Online stamps on mail it handles, identifying the Microsoft 365 tenant the
+// message was attributed to
+type TenantProvenance struct {
+	TenantID            string `json:"tenant_id,omitempty"`             // CrossTenant-Id (directory GUID)
+	UserPrincipalName   string `json:"user_principal_name,omitempty"`   // CrossTenant-UserPrincipalName, the attributed sender
+	AuthAs              string `json:"auth_as,omitempty"`               // CrossTenant-AuthAs: Internal, Anonymous, ...
+	AuthSource          string `json:"auth_source,omitempty"`           // CrossTenant-AuthSource server
+	FromEntityHeader    string `json:"from_entity_header,omitempty"`    // CrossTenant-FromEntityHeader: Hosted, Internet
+	NetworkMessageID    string `json:"network_message_id,omitempty"`    // CrossTenant-Network-Message-Id
+	OriginalArrivalTime string `json:"original_arrival_time,omitempty"` // CrossTenant-OriginalArrivalTime
+}
+
+// SenderIDResult is the verdict of Sender-ID (RFC 4406), Microsoft's
+// retired predecessor of DMARC, as older Exchange and Hotmail servers
+// stamped it. Sender-ID checked SPF records against the purported
+// responsible address (PRA, RFC 4407) rather than the envelope sender.
+type SenderIDResult struct {
+	PRA    string `json:"pra,omitempty"`    // X-SID-PRA address
+	Result string `json:"result,omitempty"` // X-SID-Result: pass, fail, softfail, neutral, none, temperror, permerror
+}
+
+// RecipientCount counts the addresses in the To and Cc headers. A huge list
+// is a spam and phishing signal. Malformed lists are counted address by
+// address; ParseErrors holds the entries that did not parse, which are not
+// counted.
+type RecipientCount struct {
+	To          int      `json:"to"`
+	Cc          int      `json:"cc"`
+	Total       int      `json:"total"`
+	Excessive   bool     `json:"excessive,omitempty"` // Total above the -max-recipients threshold
+	ParseErrors []string `json:"parse_errors,omitempty"`
+}
+
+// SenderIP is the best-effort IP of the client that submitted the message
+type SenderIP struct {
+	IP     string `json:"ip"`
+	Source string `json:"source"` // Header the IP came from
+}
+
+// ReputationResult is the reputation API's verdict on the sender IP
+type ReputationResult struct {
+	IP                   string `json:"ip"`
+	AbuseConfidenceScore int    `json:"abuse_confidence_score"` // 0 (clean) to 100 (certainly abusive)
+	TotalReports         int    `json:"total_reports"`
+	LastReportedAt       string `json:"last_reported_at,omitempty"`
+	Error                string `json:"error,omitempty"` // Set when the lookup failed; the score is then meaningless
+}
+
+// senderIPHeaders are the headers gateways use for the sending client IP, in
+// preference order. The Forefront CIP token is checked before all of them.
+var senderIPHeaders = []string{"X-Sender-IP", "X-SenderIP", "X-Source-IP"}
+
+// BaselineEntry holds the values expected for one sending domain. Empty lists
+// are not checked.
+type BaselineEntry struct {
+	CIPRanges     []string `json:"cip_ranges,omitempty"` // CIDRs or bare IPs of the sending infrastructure
+	SPFDomains    []string `json:"spf_domains,omitempty"`
+	DKIMSelectors []string `json:"dkim_selectors,omitempty"`
+	networks      []*net.IPNet
+}
+
+// Baseline maps lowercased From domains to their expected values
+type Baseline map[string]*BaselineEntry
+
+// AssertionRule is one -assert expectation: every message from FromDomain
+// (or one of its subdomains; every message when empty) must meet all the
+// conditions set in Expect
+type AssertionRule struct {
+	Name       string          `json:"name,omitempty"` // Shown when the rule fails; defaults to "rule N"
+	FromDomain string          `json:"from_domain,omitempty"`
+	Expect     AssertionExpect `json:"expect"`
+}
+
+// AssertionExpect lists the conditions of an AssertionRule. Unset fields
+// are not checked. Authentication results are compared case-insensitively
+// with the summary result the CSV output uses (pass if any result passed).
+type AssertionExpect struct {
+	SCL    *int   `json:"scl,omitempty"`     // Exact SCL
+	SCLMax *int   `json:"scl_max,omitempty"` // Highest acceptable SCL
+	SPF    string `json:"spf,omitempty"`
+	DKIM   string `json:"dkim,omitempty"`
+	DMARC  string `json:"dmarc,omitempty"`
+	CAT    string `json:"cat,omitempty"` // Forefront CAT token, e.g. NONE
+}
+
+// BaselineResult compares a message with its sender's baseline entry
+type BaselineResult struct {
+	Domain  string          `json:"domain"` // Baseline key that matched
+	Drifted bool            `json:"drifted"`
+	Drift   []BaselineDrift `json:"drift,omitempty"`
+}
+
+// BaselineDrift is one observed value outside the expected set
+type BaselineDrift struct {
+	Field    string   `json:"field"` // sender_ip, spf_domain, dkim_selector
+	Actual   string   `json:"actual"`
+	Expected []string `json:"expected"`
+}
+
+// Attachment is a MIME part carrying a file. Size is the decoded size in bytes.
+type Attachment struct {
+	Filename     string   `json:"filename,omitempty"`
+	ContentType  string   `json:"content_type"` // Declared media type
+	Size         int64    `json:"size"`
+	Inline       bool     `json:"inline"`        // Content-Disposition: inline
+	Risky        bool     `json:"risky"`         // Executable, disk image, double extension or RTL override
+	TypeMismatch bool     `json:"type_mismatch"` // Declared type contradicts the extension
+	Reasons      []string `json:"reasons,omitempty"`
+}
+
+// riskyExtensions are attachment types that run code or mount as a disk when
+// opened, and are rarely sent legitimately
+var riskyExtensions = map[string]bool{
+	".exe": true, ".scr": true, ".com": true, ".pif": true, ".bat": true, ".cmd": true,
+	".msi": true, ".dll": true, ".cpl": true, ".jar": true, ".js": true, ".jse": true,
+	".vbs": true, ".vbe": true, ".wsf": true, ".hta": true, ".ps1": true, ".lnk": true,
+	".reg": true, ".iso": true, ".img": true, ".vhd": true, ".vhdx": true,
+}
+
+// decoyExtensions are document and image types an attacker puts before the
+// real extension ("invoice.pdf.exe") so the file looks harmless
+var decoyExtensions = map[string]bool{
+	".pdf": true, ".doc": true, ".docx": true, ".xls": true, ".xlsx": true, ".ppt": true,
+	".pptx": true, ".txt": true, ".rtf": true, ".jpg": true, ".jpeg": true, ".png": true,
+	".gif": true, ".zip": true, ".html": true, ".htm": true,
+}
+
+// extensionTypes lists the media types expected for common extensions. A
+// declared type outside the list is a mismatch; generic types such as
+// application/octet-stream are never a mismatch.
+var extensionTypes = map[string][]string{
+	".pdf":  {"application/pdf"},
+	".doc":  {"application/msword"},
+	".docx": {"application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+	".xls":  {"application/vnd.ms-excel"},
+	".xlsx": {"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+	".zip":  {"application/zip", "application/x-zip-compressed"},
+	".jpg":  {"image/jpeg", "image/pjpeg"},
+	".jpeg": {"image/jpeg", "image/pjpeg"},
+	".png":  {"image/png"},
+	".gif":  {"image/gif"},
+	".txt":  {"text/plain"},
+	".htm":  {"text/html"},
+	".html": {"text/html"},
+	".exe":  {"application/x-msdownload", "application/x-dosexec", "application/vnd.microsoft.portable-executable"},
+	".iso":  {"application/x-iso9660-image"},
+}
+
+// genericContentTypes carry no claim about the file type
+var genericContentTypes = map[string]bool{
+	"application/octet-stream": true,
+	"application/binary":       true,
+	"application/unknown":      true,
+}
+
+// ReceivedHop is one Received header, ordered oldest first in the chain.
+// Timestamp is kept exactly as written; TimestampUTC (and TimestampLocal when
+// a display timezone is configured) are empty if the date cannot be parsed.
+type ReceivedHop struct {
+	From           string `json:"from,omitempty"`
+	FromIP         string `json:"from_ip,omitempty"`       // Address literal in the from clause
+	FromIPScope    string `json:"from_ip_scope,omitempty"` // public, private, loopback, link-local or non-routable
+	By             string `json:"by,omitempty"`
+	With           string `json:"with,omitempty"`
+	Timestamp      string `json:"timestamp,omitempty"`       // Original date after the ';'
+	TimestampUTC   string `json:"timestamp_utc,omitempty"`   // RFC 3339 in UTC
+	TimestampLocal string `json:"timestamp_local,omitempty"` // RFC 3339 in the -timezone zone
+	DelaySeconds   int64  `json:"delay_seconds"`             // Since the previous parseable hop
+	parsed         time.Time
+}
+
+// Exit codes returned with -exit-code. Errors always exit 1 and take
+// precedence; in a batch, spam takes precedence over allowlisted. A run cut
+// short by -timeout exits ExitTimeout regardless of -exit-code.
+const (
+	ExitSpam        = 3 // SCL at or above the spam threshold
+	ExitAllowlisted = 4 // SCL -1 (filtering skipped), only with -exit-allowlisted
+	ExitTimeout     = 5 // -timeout elapsed; output covers the messages completed
+)
+
+// ExitAssertion is returned when a message fails an -assert rule. Errors,
+// -timeout and -max-files take precedence; it takes precedence over
+// -exit-code verdicts.
+const ExitAssertion = 6
+
+// SCLThresholds controls how SCL scores are banded and when a message is spam
+type SCLThresholds struct {
+	LowSpam        int // Lowest score described as low spam probability
+	Spam           int // Lowest score described as spam
+	HighConfidence int // Lowest score described as high confidence spam
+	SpamThreshold  int // Score at or above which the message is treated as spam
+}
+
+// sclProfiles are the named threshold presets selectable with -profile.
+// "balanced" matches Microsoft's documented SCL bands.
+var sclProfiles = map[string]SCLThresholds{
+	"strict":   {LowSpam: 2, Spam: 4, HighConfidence: 6, SpamThreshold: 4},
+	"balanced": {LowSpam: 2, Spam: 5, HighConfidence: 7, SpamThreshold: 5},
+	"lenient":  {LowSpam: 3, Spam: 6, HighConfidence: 8, SpamThreshold: 7},
+}
+
+// defaultSCLSources lists the headers consulted for SCL, trusted first
+var defaultSCLSources = []string{
+	"X-Forefront-Antispam-Report",
+	"X-Forefront-Antispam-Report-Untrusted",
+}
+
+// Analyzer holds analysis configuration. Configure it once and call Analyze
+// for each message; it is safe for concurrent use as long as its fields are
+// not modified after the first call.
+type Analyzer struct {
+	Thresholds        SCLThresholds         // SCL bands and spam threshold
+	SCLSources        []string              // SCL headers consulted, in preferred order
+	IncludeRawHeaders bool                  // Copy every header into the report
+	NoTruncate        bool                  // Keep SCL headers longer than MaxHeaderLength intact
+	InputFormat       string                // Forced parser (see inputFormats); "" detects by extension
+	ZipPassword       string                // Decrypts encrypted zip entries; "" rejects them
+	RecordSeparator   string                // Line separating header blocks in the records format
+	VerdictPolicy     string                // How engine verdicts are combined (see verdictPolicies)
+	Limiter           *rate.Limiter         // Shared rate of enrichment lookups; copies of an Analyzer share it, nil is unlimited
+	ScoreBands        map[string]ScoreBands // Verdict bands per engine (see defaultScoreBands); missing engines use the defaults
+	Timezone          *time.Location        // Extra zone for Received timestamps; nil for UTC only
+	Diagnostics       bool                  // Record which parsers ran in report.Diagnostics
+	MaxHops           int                   // Received hops above this are flagged; 0 disables
+	MaxRecipients     int                   // To and Cc recipients above this are flagged; 0 disables
+	MaxDateSkew       time.Duration         // Date further than this from delivery is flagged; 0 disables
+	Deep              bool                  // Also read the MIME body and list attachments
+	StrictMIME        bool                  // With Deep, fail messages whose MIME structure or encoding is broken
+	Baseline          Baseline              // Expected values per From domain (see loadBaseline); nil disables
+	HTTPClient        HTTPClient            // All outbound HTTP for enrichment; nil uses a default client
+	Reputation        *ReputationLookup     // Sender IP reputation API; nil disables the lookup
+	Tracer            trace.Tracer          // OpenTelemetry spans for analysis and enrichment; nil disables tracing
+	Normalize         bool                  // Canonicalize domains, results and country codes (see normalizeReport)
+	Dedupe            *Deduper              // Skip messages already analyzed in this batch; nil analyzes every message
+	Locale            string                // Language of the SCL, SFV, CAT, IPV and SRV descriptions (see localeDescriptions); "" is English
+	SpamTools         []string              // X-Mailer / User-Agent substrings flagged as spam tools (see defaultSpamTools); nil flags none
+}
+
+// ReputationLookup queries an AbuseIPDB-style JSON reputation API for sender
+// IPs. Requests wait on the Analyzer's Limiter and answers are cached per IP,
+// so a batch from one sender costs a single request; concurrent misses for
+// one IP share a single request too. It is safe for concurrent use and
+// shared by copies of an Analyzer.
+type ReputationLookup struct {
+	URL string // Endpoint; the IP is added as the ipAddress query parameter
+	Key string // API key, sent in the Key header; "" sends no Key header
+
+	mu       sync.Mutex
+	cache    map[string]*ReputationResult
+	inflight map[string]*reputationCall // Requests under way, by IP
+}
+
+// reputationCall is a request under way; done is closed once result is set
+type reputationCall struct {
+	done   chan struct{}
+	result *ReputationResult
+}
+
+// NewReputationLookup validates apiURL (http or https) and returns a lookup
+func NewReputationLookup(apiURL, key string) (*ReputationLookup, error) {
+	u, err := url.Parse(apiURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, eris.Errorf("reputation API must be an http or https URL: %q", apiURL)
+	}
+	return &ReputationLookup{URL: apiURL, Key: key}, nil
+}
+
+// HTTPClient is the interface every outbound enrichment request goes
+// through. *http.Client implements it; tests and offline runs inject a stub,
+// and production can wrap it with a caching or proxying client.
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// newDefaultHTTPClient returns the client used when an Analyzer has none: an
+// http.Client bounded by DefaultHTTPTimeout overall and while waiting for
+// response headers
+func newDefaultHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = DefaultHTTPTimeout
+	return &http.Client{Timeout: DefaultHTTPTimeout, Transport: transport}
+}
+
+// NewAnalyzer returns an Analyzer with the default (balanced) configuration
+func NewAnalyzer() *Analyzer {
+	return &Analyzer{
+		Thresholds:    sclProfiles["balanced"],
+		SCLSources:    defaultSCLSources,
+		VerdictPolicy: verdictPolicies[0],
+		ScoreBands:    maps.Clone(defaultScoreBands),
+		SpamTools:     defaultSpamTools,
+		MaxHops:       DefaultMaxHops,
+		MaxRecipients: DefaultMaxRecipients,
+		MaxDateSkew:   DefaultMaxDateSkew,
+		HTTPClient:    newDefaultHTTPClient(),
+	}
+}
+
+// scoreBands returns the verdict bands configured for engine, falling back
+// to its default bands
+func (a *Analyzer) scoreBands(engine string) ScoreBands {
+	if bands, ok := a.ScoreBands[engine]; ok {
+		return bands
+	}
+	return defaultScoreBands[engine]
+}
+
+// defaultAnalyzer is the configuration used by the package-level helpers.
+// The CLI builds its own Analyzer from flags and never modifies this one.
+var defaultAnalyzer = NewAnalyzer()
+
+// HomographResult describes IDN homograph analysis of the From domain
+type HomographResult struct {
+	Domain             string   `json:"domain"`                // Decoded (Unicode) form
+	ASCIIDomain        string   `json:"ascii_domain"`          // Punycode (xn--) form
+	Skeleton           string   `json:"skeleton,omitempty"`    // Domain with confusables mapped to ASCII
+	Scripts            []string `json:"scripts,omitempty"`     // Unicode scripts present in the domain
+	Confusables        []string `json:"confusables,omitempty"` // Confusable characters found
+	HomographSuspected bool     `json:"homograph_suspected"`
+	Reason             string   `json:"reason,omitempty"`
 }
 
 // ============================================================================
@@ -301,21 +1044,16 @@ func printHelp() {
 	fmt.Println("email - Email Security Analysis Tool")
 	fmt.Println()
 	fmt.Println("USAGE:")
-	fmt.Println("  email [-v] [-json] <email-file>          Analyze email headers")
+	fmt.Println("  email [options] <email-file|directory>... Analyze email headers")
 	fmt.Println("  email dmarc [options] <report-file>      Analyze DMARC aggregate report")
 	fmt.Println("  email help                               Show this help message")
 	fmt.Println("  email version                            Show version information")
 	fmt.Println()
 	fmt.Println("EMAIL ANALYSIS OPTIONS:")
-	fmt.Println("  -v           Verbose output (include all raw headers)")
-	fmt.Println("  -json        Output results as JSON")
+	printFlags(os.Stdout, newEmailFlagSet(&emailOptions{}))
 	fmt.Println()
 	fmt.Println("DMARC REPORT OPTIONS:")
-	fmt.Println("  -v           Verbose output (show all records)")
-	fmt.Println("  -json        Output as JSON")
-	fmt.Println("  -md          Output as Markdown")
-	fmt.Println("  -no-enrich   Skip IP geolocation enrichment")
-	fmt.Println("  -geoip-db    Path to MaxMind GeoIP2 database")
+	printFlags(os.Stdout, newDMARCFlagSet(&dmarcOptions{}))
 	fmt.Println()
 	fmt.Println("EXAMPLES:")
 	fmt.Println("  email sample.msg                         Analyze an email file")
@@ -325,1208 +1063,8594 @@ func printHelp() {
 	fmt.Println("  email dmarc -md report.zip               Output DMARC analysis as Markdown")
 }
 
-// runEmailAnalysis runs the original email header analysis
-func runEmailAnalysis() {
-	// Parse command-line flags
-	verbose := flag.Bool("v", false, "Verbose output (include raw headers)")
-	jsonOutput := flag.Bool("json", false, "Output results as JSON")
-	flag.Parse()
-
-	if flag.NArg() < 1 {
-		fmt.Fprintf(os.Stderr, "Usage: %s [-v] [-json] <email-file>\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "\nSupported formats: .msg, .eml\n")
-		fmt.Fprintf(os.Stderr, "\nOptions:\n")
-		fmt.Fprintf(os.Stderr, "  -v       Verbose output (include all raw headers)\n")
-		fmt.Fprintf(os.Stderr, "  -json    Output results as JSON\n")
-		fmt.Fprintf(os.Stderr, "\nExamples:\n")
-		fmt.Fprintf(os.Stderr, "  %s sample-email.msg\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s sample-email.eml\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s -json sample-email.eml\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "\nSubcommands:\n")
-		fmt.Fprintf(os.Stderr, "  %s dmarc <report-file>   Analyze DMARC aggregate reports\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s help                  Show detailed help\n", os.Args[0])
-		os.Exit(1)
-	}
-
-	msgFile := flag.Arg(0)
+// printFlags lists every flag in fs with its usage and, unless it is the
+// zero value, its default
+func printFlags(w io.Writer, fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		usage := f.Usage
+		switch f.DefValue {
+		case "", "0", "false", "0s", "[]":
+		default:
+			usage += " (default: " + f.DefValue + ")"
+		}
+		fmt.Fprintf(w, "  %-16s %s\n", "-"+f.Name, usage)
+	})
+}
 
-	// Parse the email file (.msg or .eml)
-	report, err := parseEmailFile(msgFile, *verbose)
-	if err != nil {
-		// Log detailed error internally for debugging
-		log.Printf("Internal error: %+v", err)
-		// Show sanitized error to user
-		fmt.Fprintf(os.Stderr, "Error: Failed to parse email file. Please ensure the file is a valid .msg or .eml format.\n")
-		os.Exit(1)
-	}
+// emailOptions holds the email analysis command-line flags
+type emailOptions struct {
+	verbose           bool
+	jsonOutput        bool
+	outputPath        string
+	compressOutput    bool
+	profile           string
+	spamThreshold     int
+	sclBands          string
+	countOnly         bool
+	probe             bool
+	csvOutput         bool
+	sclSourcePriority string
+	inputFormat       string
+	recordSeparator   string
+	zipPassword       string
+	quiet             bool
+	noTruncate        bool
+	maxFiles          int
+	sampleSize        int
+	samplePercent     float64
+	sampleSeed        uint64
+	recursive         bool
+	maxDepth          int
+	followSymlinks    bool
+	maxRecipients     int
+	maxHops           int
+	maxDateSkew       time.Duration
+	minConfidence     int
+	onlySpam          bool
+	onlyClean         bool
+	exitCode          bool
+	exitAllowlisted   bool
+	explainExit       bool
+	sortSpec          string
+	groupBy           string
+	watchPath         string
+	listenPath        string
+	dumpCatalog       bool
+	lookupQPS         float64
+	timezone          string
+	locale            string
+	histogram         bool
+	summaryInterval   time.Duration
+	dedupe            bool
+	assertPath        string
+	baselinePath      string
+	reputationAPI     string
+	reputationKey     string
+	deep              bool
+	strictMIME        bool
+	timeout           time.Duration
+	cpuProfile        string
+	memProfile        string
+	compact           bool
+	normalizeOutput   bool
+	inputList         string
+	jsonArray         bool
+	pretty            bool
+	verdictPolicy     string
+	spamTools         string
+	verdictMap        string
+	redactPatterns    []string
+}
 
-	// Output results
-	if *jsonOutput {
-		outputJSON(report)
-	} else {
-		outputText(report, *verbose)
-	}
+// newEmailFlagSet returns the email analysis flags bound to o. The help text
+// and the usage message are both generated from it, so they list exactly the
+// flags that are accepted.
+func newEmailFlagSet(o *emailOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet("email", flag.ExitOnError)
+	fs.BoolVar(&o.verbose, "v", false, "Verbose output (include raw headers)")
+	fs.BoolVar(&o.jsonOutput, "json", false, "Output results as JSON")
+	fs.StringVar(&o.outputPath, "output", "", "Write the report to a file instead of stdout")
+	fs.BoolVar(&o.compressOutput, "compress", false, "Gzip the report (implied when -output ends in .gz)")
+	fs.StringVar(&o.profile, "profile", "balanced", "Threshold profile: strict, balanced, or lenient")
+	fs.IntVar(&o.spamThreshold, "spam-threshold", 5, "SCL score at or above which a message is treated as spam (overrides profile)")
+	fs.StringVar(&o.sclBands, "scl-bands", "2,5,7", "SCL scores starting the low/spam/high-confidence bands (overrides profile)")
+	fs.BoolVar(&o.countOnly, "count-only", false, "Print only SCL band counts and the error count")
+	fs.BoolVar(&o.probe, "probe", false, "Print how many messages carry each header the analyzer recognizes, without analyzing them")
+	fs.BoolVar(&o.csvOutput, "csv", false, "Output results as CSV (one row per message)")
+	fs.StringVar(&o.sclSourcePriority, "scl-source-priority", strings.Join(defaultSCLSources, ","), "SCL header names in preferred order")
+	fs.StringVar(&o.inputFormat, "input-format", "", "Force the parser: eml, emlx, msg, mbox, zip, raw-header, json-headers, graph-json or records (default: by extension)")
+	fs.StringVar(&o.recordSeparator, "record-separator", "", "Split each input on lines equal to this marker and analyze every record as a header block (implies -input-format records)")
+	fs.StringVar(&o.zipPassword, "zip-password", "", "Password for encrypted zip archives such as quarantined samples (ZipCrypto or AES)")
+	fs.BoolVar(&o.quiet, "quiet", false, "Suppress the batch progress indicator on stderr")
+	fs.BoolVar(&o.noTruncate, "no-truncate", false, "Keep SCL headers longer than the maximum length intact (uses more memory)")
+	fs.IntVar(&o.maxFiles, "max-files", DefaultMaxFiles, "Stop after this many files in directory mode (0 for no limit)")
+	fs.IntVar(&o.sampleSize, "sample", 0, "Analyze a random subset of this many input files")
+	fs.Float64Var(&o.samplePercent, "sample-percent", 0, "Analyze a random subset of this percentage (0-100] of the input files")
+	fs.Uint64Var(&o.sampleSeed, "seed", 0, "Random seed for -sample or -sample-percent, for a reproducible subset (default: time-based)")
+	fs.BoolVar(&o.recursive, "recursive", false, "Also analyze files in subdirectories of directory inputs")
+	fs.IntVar(&o.maxDepth, "max-depth", DefaultMaxDepth, "With -recursive, enter at most this many subdirectory levels")
+	fs.BoolVar(&o.followSymlinks, "follow-symlinks", false, "Read symlinked files and, with -recursive, enter symlinked directories")
+	fs.IntVar(&o.maxRecipients, "max-recipients", DefaultMaxRecipients, "Flag messages with more To and Cc recipients than this (0 to disable)")
+	fs.IntVar(&o.maxHops, "max-hops", DefaultMaxHops, "Flag messages with more Received hops than this (0 to disable)")
+	fs.DurationVar(&o.maxDateSkew, "max-date-skew", DefaultMaxDateSkew, "Flag messages whose Date is further than this from delivery (0 to disable)")
+	fs.IntVar(&o.minConfidence, "min-confidence", 0, "Omit messages whose analysis confidence (0-100) is below this from the output")
+	fs.BoolVar(&o.onlySpam, "only-spam", false, "Output only messages whose SCL is at or above the spam threshold")
+	fs.BoolVar(&o.onlyClean, "only-clean", false, "Output only messages whose SCL is below the spam threshold")
+	fs.BoolVar(&o.exitCode, "exit-code", false, "Exit 3 when a message is spam (SCL at or above the spam threshold)")
+	fs.BoolVar(&o.exitAllowlisted, "exit-allowlisted", false, "With -exit-code, exit 4 when a message skipped filtering (SCL -1)")
+	fs.BoolVar(&o.explainExit, "explain-exit", false, "Print a one-line reason for the exit status to stderr")
+	fs.StringVar(&o.sortSpec, "sort", "", "Order batch output by score, filename or date, with optional :asc/:desc")
+	fs.StringVar(&o.groupBy, "group-by", "", "Output SCL band counts per from-domain, cip-net, country or mailer instead of per-message reports")
+	fs.StringVar(&o.watchPath, "watch", "", "Watch a Maildir (or its new/ directory) and emit NDJSON for each new message")
+	fs.StringVar(&o.listenPath, "listen-unix", "", "Serve on this Unix socket: read a raw message per connection, reply with its JSON report")
+	fs.BoolVar(&o.dumpCatalog, "dump-catalog", false, "Print every code-to-description mapping as JSON and exit")
+	fs.Float64Var(&o.lookupQPS, "lookup-qps", 0, "Most enrichment lookups (e.g. reputation API requests) per second, shared by the whole run; 0 is unlimited")
+	fs.StringVar(&o.timezone, "timezone", "", "Also show Received timestamps in this IANA zone (e.g. America/New_York)")
+	fs.StringVar(&o.locale, "locale", "en", "Language of the SCL, SFV, CAT, IPV and SRV descriptions (en or de); codes and scores are unchanged")
+	fs.BoolVar(&o.histogram, "histogram", false, "Print an SCL band bar chart to stderr after the run")
+	fs.DurationVar(&o.summaryInterval, "summary-interval", 0, "In a batch, print a running summary to stderr this often (e.g. 30s)")
+	fs.BoolVar(&o.dedupe, "dedupe", false, "In a batch, skip messages whose Message-ID (or content hash, without one) was already analyzed")
+	fs.StringVar(&o.assertPath, "assert", "", "JSON file of expectations per From domain (SCL, SPF, DKIM, DMARC, CAT); exit 6 if a message fails one")
+	fs.StringVar(&o.baselinePath, "baseline", "", "JSON file of expected sender IP ranges, SPF domains and DKIM selectors per From domain")
+	fs.StringVar(&o.reputationAPI, "reputation-api", "", "URL of an AbuseIPDB-style reputation API to query for each sender IP")
+	fs.StringVar(&o.reputationKey, "reputation-key", "", "API key for -reputation-api (default: $REPUTATION_API_KEY)")
+	fs.BoolVar(&o.deep, "deep", false, "Also read message bodies and list attachments, flagging risky types")
+	fs.BoolVar(&o.strictMIME, "strict-mime", false, "With -deep, fail messages with malformed MIME (unterminated boundaries, invalid encodings)")
+	fs.DurationVar(&o.timeout, "timeout", 0, "Stop after this long (e.g. 30s, 5m), writing the results completed so far")
+	fs.StringVar(&o.cpuProfile, "cpuprofile", "", "Write a pprof CPU profile of the run to this file")
+	fs.StringVar(&o.memProfile, "memprofile", "", "Write a pprof heap profile to this file when the run ends")
+	fs.BoolVar(&o.compact, "compact", false, "With -json, write each report as minified single-line JSON")
+	fs.BoolVar(&o.normalizeOutput, "normalize-output", false, "Lowercase domains and authentication results, uppercase country codes and trim them all")
+	fs.StringVar(&o.inputList, "input-list", "", "Read input paths from this file, one per line (- for stdin); blank lines and # comments are ignored")
+	fs.BoolVar(&o.jsonArray, "json-array", false, "With -json, write all reports as one JSON array once the batch completes")
+	fs.BoolVar(&o.pretty, "pretty", false, "Group the text report into Spam Verdict, Authentication, Sender and Routing sections")
+	fs.StringVar(&o.verdictPolicy, "verdict-policy", verdictPolicies[0], "How spam engine verdicts are combined: most-severe, majority or first")
+	fs.StringVar(&o.spamTools, "spam-tools", "", "File of X-Mailer / User-Agent substrings flagged as spam tools, one per line (replaces the built-in list)")
+	fs.StringVar(&o.verdictMap, "verdict-map", "", "JSON file mapping each engine (spamassassin, mimecast) to its low_spam, spam and high_confidence score bands")
+	fs.Func("redact-pattern", "Replace matches of this regular expression in every report field with "+RedactionMask+" (repeatable)", func(pattern string) error {
+		o.redactPatterns = append(o.redactPatterns, pattern)
+		return nil
+	})
+	return fs
 }
 
-// runDMARCCommand handles the dmarc subcommand for parsing DMARC aggregate reports
-func runDMARCCommand(args []string) {
-	// Create new FlagSet for dmarc subcommand
-	dmarcFlags := flag.NewFlagSet("dmarc", flag.ExitOnError)
-	verbose := dmarcFlags.Bool("v", false, "Verbose output (show all records)")
-	jsonOutput := dmarcFlags.Bool("json", false, "Output as JSON")
-	markdownOutput := dmarcFlags.Bool("md", false, "Output as Markdown")
-	noEnrich := dmarcFlags.Bool("no-enrich", false, "Skip IP geolocation enrichment")
-	geoDBPath := dmarcFlags.String("geoip-db", "", "Path to GeoIP2 database")
+// newAnalyzer builds the Analyzer every CLI analysis uses from the parsed
+// flags, leaving defaultAnalyzer untouched. explicit holds the flags that
+// were set on the command line.
+func (o *emailOptions) newAnalyzer(explicit map[string]bool) (*Analyzer, error) {
+	a := NewAnalyzer()
+	a.IncludeRawHeaders = o.verbose
+	a.Diagnostics = o.verbose
 
-	if err := dmarcFlags.Parse(args); err != nil {
-		os.Exit(1)
+	if o.maxHops < 0 {
+		return nil, eris.New("-max-hops must not be negative")
+	}
+	a.MaxHops = o.maxHops
+	if o.maxRecipients < 0 {
+		return nil, eris.New("-max-recipients must not be negative")
 	}
+	a.MaxRecipients = o.maxRecipients
+	if o.maxDateSkew < 0 {
+		return nil, eris.New("-max-date-skew must not be negative")
+	}
+	a.MaxDateSkew = o.maxDateSkew
 
-	if dmarcFlags.NArg() < 1 {
-		fmt.Fprintf(os.Stderr, "Usage: %s dmarc [-v] [-json|-md] [-no-enrich] [-geoip-db PATH] <report-file>\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "\nSupported formats: .xml, .xml.gz, .zip\n")
-		fmt.Fprintf(os.Stderr, "\nOptions:\n")
-		fmt.Fprintf(os.Stderr, "  -v           Verbose output (show all records)\n")
-		fmt.Fprintf(os.Stderr, "  -json        Output as JSON\n")
-		fmt.Fprintf(os.Stderr, "  -md          Output as Markdown\n")
-		fmt.Fprintf(os.Stderr, "  -no-enrich   Skip IP geolocation enrichment\n")
-		fmt.Fprintf(os.Stderr, "  -geoip-db    Path to MaxMind GeoIP2 database\n")
-		fmt.Fprintf(os.Stderr, "\nExamples:\n")
-		fmt.Fprintf(os.Stderr, "  %s dmarc google-report.xml\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s dmarc -json report.xml.gz > analysis.json\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s dmarc -md report.zip > report.md\n", os.Args[0])
-		os.Exit(1)
+	thresholds, err := resolveSCLThresholds(o.profile, o.spamThreshold, o.sclBands, explicit)
+	if err != nil {
+		return nil, err
+	}
+	a.Thresholds = thresholds
+	sources, err := parseSCLSourcePriority(o.sclSourcePriority)
+	if err != nil {
+		return nil, err
+	}
+	a.SCLSources = sources
+	a.NoTruncate = o.noTruncate
+	a.Normalize = o.normalizeOutput
+	a.Deep = o.deep
+	if o.strictMIME && !o.deep {
+		return nil, eris.New("-strict-mime requires -deep")
+	}
+	a.StrictMIME = o.strictMIME
+	if o.dedupe {
+		a.Dedupe = NewDeduper()
 	}
 
-	reportFile := dmarcFlags.Arg(0)
+	if o.baselinePath != "" {
+		baseline, err := loadBaseline(o.baselinePath)
+		if err != nil {
+			log.Printf("Internal error: %+v", err)
+			return nil, eris.Errorf("Invalid baseline file: %s", sanitizeHeader(err.Error()))
+		}
+		a.Baseline = baseline
+	}
 
-	// Parse the DMARC report
-	report, err := parseDMARCReportFile(reportFile)
-	if err != nil {
-		log.Printf("Internal error: %+v", err)
-		fmt.Fprintf(os.Stderr, "Error: Failed to parse DMARC report. %s\n", sanitizeDMARCError(err))
-		os.Exit(1)
+	if o.reputationAPI != "" {
+		key := o.reputationKey
+		if key == "" {
+			key = os.Getenv("REPUTATION_API_KEY")
+		}
+		lookup, err := NewReputationLookup(o.reputationAPI, key)
+		if err != nil {
+			return nil, err
+		}
+		a.Reputation = lookup
+	} else if o.reputationKey != "" {
+		return nil, eris.New("-reputation-key requires -reputation-api")
 	}
 
-	// Enrich with IP data unless disabled
-	if !*noEnrich {
-		enrichDMARCReport(report, *geoDBPath)
+	if explicit["record-separator"] && strings.TrimSpace(o.recordSeparator) == "" {
+		return nil, eris.New("-record-separator must not be blank")
 	}
+	a.InputFormat = o.inputFormat
+	if o.recordSeparator != "" && a.InputFormat == "" {
+		a.InputFormat = "records"
+	}
+	if a.InputFormat != "" {
+		if _, err := detectInputFormat("", a.InputFormat); err != nil {
+			return nil, err
+		}
+	}
+	if (a.InputFormat == "records") != (o.recordSeparator != "") {
+		return nil, eris.New("-record-separator and -input-format records must be used together")
+	}
+	a.RecordSeparator = o.recordSeparator
+	a.ZipPassword = o.zipPassword
 
-	// Analyze the report
-	report.Analysis = analyzeDMARCReport(report)
+	if !slices.Contains(verdictPolicies, o.verdictPolicy) {
+		return nil, eris.Errorf("unknown verdict policy %q (valid: %s)", o.verdictPolicy, strings.Join(verdictPolicies, ", "))
+	}
+	a.VerdictPolicy = o.verdictPolicy
+	if _, ok := localeDescriptions[o.locale]; !ok {
+		return nil, eris.Errorf("unknown locale %q (valid: %s)", o.locale, strings.Join(slices.Sorted(maps.Keys(localeDescriptions)), ", "))
+	}
+	a.Locale = o.locale
+	if o.verdictMap != "" {
+		bands, err := loadScoreBands(o.verdictMap)
+		if err != nil {
+			log.Printf("Internal error: %+v", err)
+			return nil, eris.Errorf("Invalid verdict map: %s", sanitizeHeader(err.Error()))
+		}
+		a.ScoreBands = bands
+	}
+	if o.spamTools != "" {
+		tools, err := loadSpamTools(o.spamTools)
+		if err != nil {
+			log.Printf("Internal error: %+v", err)
+			return nil, eris.Errorf("Failed to read spam tool list %s.", sanitizeHeader(o.spamTools))
+		}
+		a.SpamTools = tools
+	}
 
-	// Output based on format
 	switch {
-	case *jsonOutput:
-		outputDMARCJSON(report)
-	case *markdownOutput:
-		outputDMARCMarkdown(report, *verbose)
-	default:
-		outputDMARCText(report, *verbose)
+	case o.lookupQPS < 0 || math.IsNaN(o.lookupQPS) || math.IsInf(o.lookupQPS, 0):
+		return nil, eris.New("-lookup-qps must be a non-negative number")
+	case o.lookupQPS > 0:
+		a.Limiter = rate.NewLimiter(rate.Limit(o.lookupQPS), 1)
 	}
-}
 
-// parseEmailFile parses a .msg or .eml file and extracts email security information
-func parseEmailFile(filename string, includeRawHeaders bool) (*EmailSecurityReport, error) {
-	// Validate file extension
-	ext := strings.ToLower(filepath.Ext(filename))
-	if ext != ".msg" && ext != ".eml" {
-		return nil, eris.New("file must have .msg or .eml extension")
+	if o.timezone != "" {
+		loc, err := time.LoadLocation(o.timezone)
+		if err != nil {
+			return nil, eris.Errorf("unknown timezone %q: %s", o.timezone, err)
+		}
+		a.Timezone = loc
 	}
+	return a, nil
+}
 
-	// Clean path and prevent traversal
-	cleanPath := filepath.Clean(filename)
+// printEmailUsage writes the short usage message shown when no input is given
+func printEmailUsage(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintf(w, "Usage: %s [options] <email-file|directory>...\n", os.Args[0])
+	fmt.Fprintf(w, "\nSupported formats: .msg, .eml, .emlx, .mbox, .mbox.gz, .mbox.bz2, .zip (a directory analyzes every such file in it)\n")
+	fmt.Fprintf(w, "\nOptions:\n")
+	printFlags(w, fs)
+	fmt.Fprintf(w, "\nExamples:\n")
+	fmt.Fprintf(w, "  %s sample-email.msg\n", os.Args[0])
+	fmt.Fprintf(w, "  %s sample-email.eml\n", os.Args[0])
+	fmt.Fprintf(w, "  %s -json sample-email.eml\n", os.Args[0])
+	fmt.Fprintf(w, "\nSubcommands:\n")
+	fmt.Fprintf(w, "  %s dmarc <report-file>   Analyze DMARC aggregate reports\n", os.Args[0])
+	fmt.Fprintf(w, "  %s help                  Show detailed help\n", os.Args[0])
+}
 
-	// Check if path contains traversal attempts
-	if strings.Contains(filename, "..") {
-		return nil, eris.New("path traversal detected")
-	}
+// runEmailAnalysis runs the original email header analysis
+func runEmailAnalysis() {
+	var o emailOptions
+	fs := newEmailFlagSet(&o)
+	fs.Usage = func() { printEmailUsage(os.Stderr, fs) }
+	_ = fs.Parse(os.Args[1:])
 
-	// Get absolute path
-	absPath, err := filepath.Abs(cleanPath)
+	redactor, err := NewRedactor(o.redactPatterns)
 	if err != nil {
-		return nil, eris.Wrap(err, "invalid file path")
+		fmt.Fprintf(os.Stderr, "Error: Invalid -redact-pattern: %s\n", sanitizeHeader(err.Error()))
+		os.Exit(1)
 	}
 
-	// Open the .msg file
-	f, err := os.Open(absPath)
-	if err != nil {
-		return nil, eris.Wrap(err, "failed to open MSG file")
+	if o.maxFiles < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -max-files must not be negative\n")
+		os.Exit(1)
+	}
+	if o.maxDepth < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -max-depth must not be negative\n")
+		os.Exit(1)
 	}
-	defer func() { _ = f.Close() }()
 
-	// Get file info for size
-	stat, err := f.Stat()
-	if err != nil {
-		return nil, eris.Wrap(err, "failed to stat MSG file")
+	if o.timeout < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -timeout must not be negative\n")
+		os.Exit(1)
 	}
 
-	// Verify it's a regular file
-	if !stat.Mode().IsRegular() {
-		return nil, eris.New("not a regular file")
+	if o.minConfidence < 0 || o.minConfidence > 100 {
+		fmt.Fprintf(os.Stderr, "Error: -min-confidence must be between 0 and 100\n")
+		os.Exit(1)
+	}
+	if o.minConfidence > 0 && o.countOnly {
+		fmt.Fprintf(os.Stderr, "Error: -min-confidence cannot be combined with -count-only, which does not compute confidence\n")
+		os.Exit(1)
 	}
 
-	// Validate file size before processing
-	if stat.Size() > MaxFileSizeBytes {
-		return nil, eris.Errorf("file size %d exceeds maximum allowed size of %d bytes (50MB)",
-			stat.Size(), MaxFileSizeBytes)
+	if o.onlySpam && o.onlyClean {
+		fmt.Fprintf(os.Stderr, "Error: -only-spam and -only-clean cannot be combined\n")
+		os.Exit(1)
 	}
-	if stat.Size() < 0 {
-		return nil, eris.New("invalid negative file size")
+	if (o.onlySpam || o.onlyClean) && o.countOnly {
+		fmt.Fprintf(os.Stderr, "Error: -only-spam and -only-clean cannot be combined with -count-only, which already tallies every band\n")
+		os.Exit(1)
 	}
 
-	var emailData []byte
+	if o.exitAllowlisted && !o.exitCode {
+		fmt.Fprintf(os.Stderr, "Error: -exit-allowlisted requires -exit-code\n")
+		os.Exit(1)
+	}
 
-	// EML files are already RFC822 format - read directly
-	// MSG files need extraction from binary format
-	if ext == ".eml" {
-		// Read EML file directly (already RFC822 format)
-		limitReader := io.LimitReader(f, MaxFileSizeBytes)
-		emailData, err = io.ReadAll(limitReader)
-		if err != nil {
-			return nil, eris.Wrap(err, "failed to read EML file")
-		}
-	} else {
-		// MSG file processing - verify format and extract
-		// Verify file magic bytes for OLE/CFBF or ZIP format
-		magic := make([]byte, 8)
-		if _, err := f.Read(magic); err != nil {
-			return nil, eris.Wrap(err, "failed to read file header")
-		}
+	// -watch streams NDJSON, which is always compact
+	if o.compact && !o.jsonOutput && o.watchPath == "" {
+		fmt.Fprintf(os.Stderr, "Error: -compact requires -json\n")
+		os.Exit(1)
+	}
 
-		// Check for CFBF signature (D0 CF 11 E0 A1 B1 1A E1)
+	if o.jsonOutput && o.csvOutput {
+		fmt.Fprintf(os.Stderr, "Error: -json and -csv cannot be combined\n")
+		os.Exit(1)
+	}
+	if o.pretty && (o.jsonOutput || o.csvOutput || o.countOnly || o.watchPath != "") {
+		fmt.Fprintf(os.Stderr, "Error: -pretty only applies to text output and cannot be combined with -json, -csv, -count-only or -watch\n")
+		os.Exit(1)
+	}
+	if o.jsonArray && (!o.jsonOutput || o.countOnly || o.groupBy != "" || o.watchPath != "" || o.listenPath != "") {
+		fmt.Fprintf(os.Stderr, "Error: -json-array requires -json and cannot be combined with -count-only, -group-by, -watch or -listen-unix\n")
+		os.Exit(1)
+	}
+	format := "text"
+	switch {
+	case o.jsonArray:
+		format = "json-array"
+	case o.jsonOutput:
+		format = "json"
+	case o.csvOutput:
+		format = "csv"
+	case o.pretty:
+		format = "pretty"
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if explicit["max-depth"] && !o.recursive {
+		fmt.Fprintf(os.Stderr, "Error: -max-depth requires -recursive\n")
+		os.Exit(1)
+	}
+	if o.sampleSize < 0 || explicit["sample-percent"] && (o.samplePercent <= 0 || o.samplePercent > 100) {
+		fmt.Fprintf(os.Stderr, "Error: -sample must be positive and -sample-percent between 0 and 100\n")
+		os.Exit(1)
+	}
+	if o.sampleSize > 0 && explicit["sample-percent"] {
+		fmt.Fprintf(os.Stderr, "Error: -sample and -sample-percent cannot be combined\n")
+		os.Exit(1)
+	}
+	sampling := o.sampleSize > 0 || explicit["sample-percent"]
+	if explicit["seed"] && !sampling {
+		fmt.Fprintf(os.Stderr, "Error: -seed requires -sample or -sample-percent\n")
+		os.Exit(1)
+	}
+	if sampling && !explicit["seed"] {
+		o.sampleSeed = uint64(time.Now().UnixNano())
+	}
+
+	// Every analysis below uses this one Analyzer, built from the flags
+	a, err := o.newAnalyzer(explicit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	if o.verbose {
+		fmt.Fprintf(os.Stderr, "Lookup rate limit: %s.\n", describeLookupLimit(a.Limiter))
+	}
+
+	if o.summaryInterval < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -summary-interval must not be negative\n")
+		os.Exit(1)
+	}
+	if o.summaryInterval > 0 && (o.countOnly || o.probe || o.watchPath != "" || o.listenPath != "") {
+		fmt.Fprintf(os.Stderr, "Error: -summary-interval cannot be combined with -count-only, -probe, -watch or -listen-unix\n")
+		os.Exit(1)
+	}
+
+	if o.dedupe && (o.countOnly || o.watchPath != "" || o.listenPath != "") {
+		fmt.Fprintf(os.Stderr, "Error: -dedupe cannot be combined with -count-only, -watch or -listen-unix\n")
+		os.Exit(1)
+	}
+
+	var assertionRules []AssertionRule
+	if o.assertPath != "" {
+		if o.countOnly || o.watchPath != "" || o.listenPath != "" {
+			fmt.Fprintf(os.Stderr, "Error: -assert cannot be combined with -count-only, -watch or -listen-unix\n")
+			os.Exit(1)
+		}
+		assertionRules, err = loadAssertions(o.assertPath)
+		if err != nil {
+			log.Printf("Internal error: %+v", err)
+			fmt.Fprintf(os.Stderr, "Error: Invalid assertion rules: %s\n", sanitizeHeader(err.Error()))
+			os.Exit(1)
+		}
+	}
+
+	var sortKey string
+	var sortDesc bool
+	if o.sortSpec != "" {
+		sortKey, sortDesc, err = parseSortSpec(o.sortSpec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if o.probe && (o.countOnly || o.csvOutput || o.pretty || o.jsonArray || o.groupBy != "" || o.sortSpec != "" || o.assertPath != "" || o.watchPath != "" || o.listenPath != "") {
+		fmt.Fprintf(os.Stderr, "Error: -probe cannot be combined with -count-only, -csv, -pretty, -json-array, -group-by, -sort, -assert, -watch or -listen-unix\n")
+		os.Exit(1)
+	}
+
+	if o.groupBy != "" {
+		if _, ok := groupByKeys[o.groupBy]; !ok {
+			fmt.Fprintf(os.Stderr, "Error: unknown -group-by %q (use from-domain, cip-net, country or mailer)\n", o.groupBy)
+			os.Exit(1)
+		}
+		if o.countOnly || o.sortSpec != "" || o.watchPath != "" || o.listenPath != "" {
+			fmt.Fprintf(os.Stderr, "Error: -group-by cannot be combined with -count-only, -sort, -watch or -listen-unix\n")
+			os.Exit(1)
+		}
+	}
+
+	// Profiles must be flushed on every exit path, so from here on the run
+	// ends through exit rather than os.Exit
+	stopProfiling, err := startProfiling(o.cpuProfile, o.memProfile)
+	if err != nil {
+		log.Printf("Internal error: %+v", err)
+		fmt.Fprintf(os.Stderr, "Error: Failed to start profiling; check the -cpuprofile and -memprofile paths.\n")
+		os.Exit(1)
+	}
+	defer stopProfiling()
+	exit := func(code int) {
+		stopProfiling()
+		os.Exit(code)
+	}
+
+	// -timeout bounds the whole run. It is checked between messages and
+	// cancels enrichment lookups in flight; a message cut short is dropped,
+	// so every result written is complete and the output stays valid.
+	ctx := context.Background()
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+	// -explain-exit makes CI failures self-documenting; stdout is untouched
+	explain := func(code int, reason string) {
+		if o.explainExit {
+			fmt.Fprintf(os.Stderr, "exit %d: %s\n", code, reason)
+		}
+	}
+
+	timedOut := false
+	exitIfTimedOut := func() {
+		if timedOut {
+			fmt.Fprintf(os.Stderr, "Error: Timed out after %s; output covers only the messages completed before the limit.\n", o.timeout)
+			explain(ExitTimeout, fmt.Sprintf("-timeout %s elapsed before every message was analyzed", o.timeout))
+			exit(ExitTimeout)
+		}
+	}
+
+	if o.compressOutput && o.outputPath == "" && isTerminal(os.Stdout) {
+		fmt.Fprintf(os.Stderr, "Error: -compress writes gzip data; redirect stdout or use -output\n")
+		exit(1)
+	}
+
+	// Watch mode runs until interrupted (or -timeout), streaming one JSON line per message
+	if o.watchPath != "" {
+		if o.outputPath != "" || o.compressOutput || o.csvOutput || o.countOnly || o.sortSpec != "" {
+			fmt.Fprintf(os.Stderr, "Error: -watch always streams NDJSON to stdout and cannot be combined with -output, -compress, -csv, -count-only or -sort\n")
+			exit(1)
+		}
+		watcher, err := newMaildirWatcher(o.watchPath)
+		if err != nil {
+			log.Printf("Internal error: %+v", err)
+			fmt.Fprintf(os.Stderr, "Error: Failed to watch %s. Please ensure it is a Maildir or directory.\n", sanitizeHeader(o.watchPath))
+			exit(1)
+		}
+		var sink ResultSink = &redactingSink{ResultSink: &ndjsonSink{w: os.Stdout}, redactor: redactor}
+		if o.onlySpam || o.onlyClean {
+			sink = &classFilterSink{ResultSink: sink, thresholds: a.Thresholds, spam: o.onlySpam}
+		}
+		sink = &confidenceFilterSink{ResultSink: sink, min: o.minConfidence}
+		if err := watchMaildir(ctx, watcher, *a, sink, WatchPollInterval); err != nil {
+			log.Printf("Internal error: %+v", err)
+			fmt.Fprintf(os.Stderr, "Error: Watch stopped.\n")
+			exit(1)
+		}
+		timedOut = ctx.Err() != nil
+		exitIfTimedOut()
+		return
+	}
+
+	// Socket mode serves until interrupted (or -timeout), one message per connection
+	if o.listenPath != "" {
+		if o.outputPath != "" || o.compressOutput || o.csvOutput || o.pretty || o.countOnly || o.sortSpec != "" || o.minConfidence > 0 || o.onlySpam || o.onlyClean || fs.NArg() > 0 || o.inputList != "" {
+			fmt.Fprintf(os.Stderr, "Error: -listen-unix replies with JSON on the socket and cannot be combined with input files, -input-list, -output, -compress, -csv, -pretty, -count-only, -sort, -min-confidence, -only-spam or -only-clean\n")
+			exit(1)
+		}
+		ln, err := listenUnixSocket(o.listenPath)
+		if err != nil {
+			log.Printf("Internal error: %+v", err)
+			fmt.Fprintf(os.Stderr, "Error: Failed to listen on %s.\n", sanitizeHeader(o.listenPath))
+			exit(1)
+		}
+		// Close the listener on Ctrl-C or SIGTERM so the socket file is removed
+		stopCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := listenUnix(ln, *a, redactor, stopCtx.Done()); err != nil {
+			log.Printf("Internal error: %+v", err)
+			fmt.Fprintf(os.Stderr, "Error: Listener stopped.\n")
+			exit(1)
+		}
+		timedOut = ctx.Err() != nil
+		exitIfTimedOut()
+		return
+	}
+
+	// The catalog needs no input; it reflects the profile flags above
+	if o.dumpCatalog {
+		err := writeOutput(o.outputPath, o.compressOutput, func(w io.Writer) error {
+			encoder := json.NewEncoder(w)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(a.Catalog()); err != nil {
+				return eris.Wrap(err, "failed to encode JSON")
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Internal error: %+v", err)
+			fmt.Fprintf(os.Stderr, "Error: Failed to write output.\n")
+			exit(1)
+		}
+		return
+	}
+
+	if fs.NArg() < 1 && o.inputList == "" {
+		fs.Usage()
+		exit(1)
+	}
+
+	inputs := fs.Args()
+	if o.inputList != "" {
+		listed, err := readInputListFile(o.inputList)
+		if err != nil {
+			log.Printf("Internal error: %+v", err)
+			fmt.Fprintf(os.Stderr, "Error: Failed to read input list %s.\n", sanitizeHeader(o.inputList))
+			exit(1)
+		}
+		if len(listed) == 0 && len(inputs) == 0 {
+			fmt.Fprintf(os.Stderr, "Error: Input list %s names no files.\n", sanitizeHeader(o.inputList))
+			exit(1)
+		}
+		inputs = append(inputs, listed...)
+	}
+
+	walk := &dirWalk{recursive: o.recursive, maxDepth: o.maxDepth, followSymlinks: o.followSymlinks}
+	files, batch, argErrors := collectInputs(inputs, a.InputFormat, walk)
+	// A list is always a batch, so a bad entry is reported without aborting
+	batch = batch || o.inputList != ""
+	if walk.tooDeep > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: Skipped %d directories nested deeper than -max-depth %d.\n", walk.tooDeep, o.maxDepth)
+	}
+	if walk.loops > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: Skipped %d directories already visited through another symlink (possible symlink loop).\n", walk.loops)
+	}
+	if walk.unreadable > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: Skipped %d subdirectories that could not be read.\n", walk.unreadable)
+	}
+	if argErrors == len(inputs) {
+		explain(1, "no input could be read")
+		exit(1)
+	}
+
+	// Sampling happens before -max-files, so a small sample of a huge archive runs
+	printSampled := func() {}
+	if sampling {
+		total := len(files)
+		files = sampleFiles(files, o.sampleSize, o.samplePercent, o.sampleSeed)
+		printSampled = func() {
+			fmt.Fprintf(os.Stderr, "Sampled %d of %d files (-seed %d).\n", len(files), total, o.sampleSeed)
+		}
+	}
+
+	// Guard against a mistargeted directory: only the first maxFiles are attempted
+	files, limited := limitFiles(files, o.maxFiles)
+	exitIfLimited := func() {
+		if limited {
+			fmt.Fprintf(os.Stderr, "Error: Stopped after %d files (-max-files limit). Narrow the input path or raise -max-files.\n", o.maxFiles)
+			explain(1, fmt.Sprintf("stopped after %d files (-max-files)", o.maxFiles))
+			exit(1)
+		}
+	}
+
+	// Batch progress goes to stderr only, so it never mixes with the report
+	var progress ProgressFunc
+	if batch && !o.quiet {
+		progress = newProgressReporter(os.Stderr, isTerminal(os.Stderr)).Update
+	}
+
+	// The histogram goes to stderr so it never mixes with the report
+	printHistogram := func(counts SCLBandCounts) {
+		if o.histogram {
+			tty := isTerminal(os.Stderr)
+			width := 80
+			if tty {
+				width = terminalWidth()
+			}
+			fmt.Fprintln(os.Stderr)
+			outputHistogram(os.Stderr, counts, width, tty)
+		}
+	}
+
+	// Count-only mode tallies SCL bands without building full reports
+	if o.countOnly {
+		counts, countErr := a.countSCLBands(ctx, files, progress)
+		timedOut = countErr != nil
+		counts.Total += argErrors
+		counts.Errors += argErrors
+		err = writeOutput(o.outputPath, o.compressOutput, func(w io.Writer) error {
+			if o.jsonOutput {
+				return outputCountsJSON(w, counts)
+			}
+			outputCountsText(w, counts)
+			return nil
+		})
+		if err != nil {
+			log.Printf("Internal error: %+v", err)
+			fmt.Fprintf(os.Stderr, "Error: Failed to write output.\n")
+			exit(1)
+		}
+		printHistogram(counts)
+		printSampled()
+		exitIfTimedOut()
+		exitIfLimited()
+		explain(0, "-count-only tallies bands without a verdict status")
+		return
+	}
+
+	// Probe mode tallies recognized headers without analyzing messages
+	if o.probe {
+		result, probeErr := a.probeHeaderFiles(ctx, files, progress)
+		timedOut = probeErr != nil
+		result.Errors += argErrors
+		err = writeOutput(o.outputPath, o.compressOutput, func(w io.Writer) error {
+			if o.jsonOutput {
+				return outputProbeJSON(w, result)
+			}
+			outputProbeText(w, result)
+			return nil
+		})
+		if err != nil {
+			log.Printf("Internal error: %+v", err)
+			fmt.Fprintf(os.Stderr, "Error: Failed to write output.\n")
+			exit(1)
+		}
+		printSampled()
+		exitIfTimedOut()
+		exitIfLimited()
+		explain(0, "-probe lists headers without a verdict status")
+		return
+	}
+
+	// -exit-code reports the verdict through the exit status
+	status := &exitCodeSink{thresholds: a.Thresholds, allowlisted: o.exitAllowlisted}
+	bands := &bandCountingSink{thresholds: a.Thresholds}
+	// -min-confidence, -only-spam and -only-clean only trim the output;
+	// -exit-code and -histogram still cover every message
+	confidence := &confidenceFilterSink{min: o.minConfidence}
+	class := &classFilterSink{thresholds: a.Thresholds, spam: o.onlySpam}
+	assertions := &assertionSink{rules: assertionRules, w: os.Stderr}
+	// -summary-interval prints running totals of the whole batch, before
+	// any output filter
+	var summary *summarySink
+	if batch && o.summaryInterval > 0 {
+		summary = newSummarySink(os.Stderr, isTerminal(os.Stderr) && progress != nil, a.Thresholds)
+		if showProgress := progress; showProgress != nil {
+			progress = func(done, total int) {
+				summary.Progress(done, total)
+				showProgress(done, total)
+			}
+		} else {
+			progress = summary.Progress
+		}
+	}
+	newStatusSink := func(w io.Writer) ResultSink {
+		output := a.newResultSink(format, w, o.verbose, o.compact)
+		if o.groupBy != "" {
+			output = newGroupingSink(w, format, o.groupBy, a.Thresholds)
+		}
+		output = &redactingSink{ResultSink: output, redactor: redactor}
+		if sortKey != "" {
+			// Sorting needs every result, so output waits for the whole batch
+			output = &sortingSink{ResultSink: output, key: sortKey, desc: sortDesc}
+		}
+		confidence.ResultSink = output
+		if o.onlySpam || o.onlyClean {
+			class.ResultSink = output
+			confidence.ResultSink = class
+		}
+		bands.ResultSink = confidence
+		if summary != nil {
+			summary.ResultSink = confidence
+			bands.ResultSink = summary
+		}
+		status.ResultSink = bands
+		if len(assertionRules) > 0 {
+			// Assertions check every message, before any output filter
+			assertions.ResultSink = bands
+			status.ResultSink = assertions
+		}
+		return status
+	}
+	exitIfAssertionsFailed := func() {
+		if len(assertionRules) == 0 {
+			return
+		}
+		if assertions.failed == 0 {
+			fmt.Fprintf(os.Stderr, "Assertions: %d messages checked, all passed.\n", assertions.checked)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Assertions: %d of %d messages checked failed.\n", assertions.failed, assertions.checked)
+		explain(ExitAssertion, fmt.Sprintf("%d messages failed -assert rules", assertions.failed))
+		exit(ExitAssertion)
+	}
+	printFiltered := func() {
+		if o.minConfidence > 0 {
+			fmt.Fprintf(os.Stderr, "Filtered %d of %d messages below -min-confidence %d.\n", confidence.filtered, confidence.filtered+confidence.written, o.minConfidence)
+		}
+		if o.onlySpam || o.onlyClean {
+			flagName := "-only-clean"
+			if o.onlySpam {
+				flagName = "-only-spam"
+			}
+			fmt.Fprintf(os.Stderr, "Filtered %d of %d messages not matching %s.\n", class.filtered, class.filtered+class.written, flagName)
+		}
+	}
+	exitWithStatus := func() {
+		if !o.exitCode {
+			explain(0, "analysis completed (-exit-code not set)")
+			return
+		}
+		explain(status.code, exitReason(status.code, status.decider, status.thresholds))
+		if status.code != 0 {
+			exit(status.code)
+		}
+	}
+
+	if !batch {
+		// Parse the email file (.msg, .eml or .emlx)
+		report, err := a.AnalyzeFileContext(ctx, files[0])
+		if err != nil && ctx.Err() != nil {
+			timedOut = true
+			exitIfTimedOut()
+		}
+		if err != nil {
+			// Log detailed error internally for debugging
+			log.Printf("Internal error: %+v", err)
+			// Show sanitized error to user
+			if isJSONInputFormat(a.InputFormat) {
+				fmt.Fprintf(os.Stderr, "Error: Invalid header JSON: %s\n", sanitizeHeader(err.Error()))
+				exit(1)
+			}
+			if msg := describeZipPasswordError(err); msg != "" {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", msg)
+				explain(1, "the input could not be decrypted")
+				exit(1)
+			}
+			if msg := describeStrictMIMEError(err); msg != "" {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", msg)
+				explain(1, "the message has malformed MIME (-strict-mime)")
+				exit(1)
+			}
+			fmt.Fprintf(os.Stderr, "Error: Failed to parse email file. Please ensure the file is a valid .msg, .eml or .emlx format.\n")
+			explain(1, "the input could not be parsed")
+			exit(1)
+		}
+
+		report.File = files[0]
+
+		// Output results
+		err = writeOutput(o.outputPath, o.compressOutput, func(w io.Writer) error {
+			sink := newStatusSink(w)
+			if err := sink.Write(report); err != nil {
+				return err
+			}
+			return sink.Close()
+		})
+		if err != nil {
+			log.Printf("Internal error: %+v", err)
+			fmt.Fprintf(os.Stderr, "Error: Failed to write output.\n")
+			exit(1)
+		}
+		printFiltered()
+		printHistogram(bands.counts)
+		printSampled()
+		exitIfAssertionsFailed()
+		exitWithStatus()
+		return
+	}
+
+	// Directory mode: analyze each file, reporting failures without aborting
+	failed := 0
+	err = writeOutput(o.outputPath, o.compressOutput, func(w io.Writer) error {
+		sink := newStatusSink(w)
+		var err error
+		stopSummary := func() {}
+		if summary != nil {
+			summary.Progress(0, len(files))
+			stopSummary = summary.Run(ctx, o.summaryInterval)
+		}
+		failed, err = a.AnalyzeFiles(ctx, files, sink, progress)
+		stopSummary()
+		if err != nil && err != ctx.Err() {
+			return err
+		}
+		// On timeout the completed results are still flushed and written
+		timedOut = err != nil
+		return sink.Close()
+	})
+	if err != nil {
+		log.Printf("Internal error: %+v", err)
+		fmt.Fprintf(os.Stderr, "Error: Failed to write output.\n")
+		exit(1)
+	}
+	printFiltered()
+	if o.dedupe {
+		fmt.Fprintf(os.Stderr, "Skipped %d duplicate messages (-dedupe).\n", a.Dedupe.Skipped())
+	}
+	if summary != nil {
+		summary.Print("Summary", failed+argErrors)
+	}
+	// Timing is only recorded with -v (see recordDuration)
+	if analyzed := bands.counts.Total; o.verbose && analyzed > 0 {
+		fmt.Fprintf(os.Stderr, "Processing time: %s total, %s average over %d messages.\n",
+			bands.processing.Round(time.Microsecond), (bands.processing / time.Duration(analyzed)).Round(time.Microsecond), analyzed)
+	}
+	bands.counts.Total += failed + argErrors
+	bands.counts.Errors = failed + argErrors
+	printHistogram(bands.counts)
+	printSampled()
+	exitIfTimedOut()
+	exitIfLimited()
+	if failed > 0 || argErrors > 0 {
+		explain(1, fmt.Sprintf("%d of %d inputs failed to parse or read", failed+argErrors, len(files)+argErrors))
+		exit(1)
+	}
+	exitIfAssertionsFailed()
+	exitWithStatus()
+}
+
+// dmarcOptions holds the dmarc subcommand flags
+type dmarcOptions struct {
+	verbose        bool
+	jsonOutput     bool
+	markdownOutput bool
+	noEnrich       bool
+	geoDBPath      string
+	outputPath     string
+}
+
+// newDMARCFlagSet returns the dmarc subcommand flags bound to o, the source
+// of both its help text and its usage message
+func newDMARCFlagSet(o *dmarcOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet("dmarc", flag.ExitOnError)
+	fs.BoolVar(&o.verbose, "v", false, "Verbose output (show all records)")
+	fs.BoolVar(&o.jsonOutput, "json", false, "Output as JSON")
+	fs.BoolVar(&o.markdownOutput, "md", false, "Output as Markdown")
+	fs.BoolVar(&o.noEnrich, "no-enrich", false, "Skip IP geolocation enrichment")
+	fs.StringVar(&o.geoDBPath, "geoip-db", "", "Path to MaxMind GeoIP2 database")
+	fs.StringVar(&o.outputPath, "output", "", "Write the report to a file instead of stdout")
+	return fs
+}
+
+// runDMARCCommand handles the dmarc subcommand for parsing DMARC aggregate reports
+func runDMARCCommand(args []string) {
+	var o dmarcOptions
+	dmarcFlags := newDMARCFlagSet(&o)
+	dmarcFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s dmarc [-v] [-json|-md] [-no-enrich] [-geoip-db PATH] [-output PATH] <report-file>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nSupported formats: .xml, .xml.gz, .zip\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		printFlags(os.Stderr, dmarcFlags)
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  %s dmarc google-report.xml\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s dmarc -json report.xml.gz > analysis.json\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s dmarc -md report.zip > report.md\n", os.Args[0])
+	}
+
+	if err := dmarcFlags.Parse(args); err != nil {
+		os.Exit(1)
+	}
+
+	if dmarcFlags.NArg() < 1 {
+		dmarcFlags.Usage()
+		os.Exit(1)
+	}
+
+	reportFile := dmarcFlags.Arg(0)
+
+	// Parse the DMARC report
+	report, err := parseDMARCReportFile(reportFile)
+	if err != nil {
+		log.Printf("Internal error: %+v", err)
+		fmt.Fprintf(os.Stderr, "Error: Failed to parse DMARC report. %s\n", sanitizeDMARCError(err))
+		os.Exit(1)
+	}
+
+	// Enrich with IP data unless disabled
+	if !o.noEnrich {
+		enrichDMARCReport(report, o.geoDBPath)
+	}
+
+	// Analyze the report
+	report.Analysis = analyzeDMARCReport(report)
+
+	// Output based on format
+	err = writeOutput(o.outputPath, false, func(w io.Writer) error {
+		switch {
+		case o.jsonOutput:
+			return outputDMARCJSON(w, report)
+		case o.markdownOutput:
+			outputDMARCMarkdown(w, report, o.verbose)
+		default:
+			outputDMARCText(w, report, o.verbose)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Internal error: %+v", err)
+		fmt.Fprintf(os.Stderr, "Error: Failed to write output.\n")
+		os.Exit(1)
+	}
+}
+
+// ============================================================================
+// Batch Processing Functions
+// ============================================================================
+
+// ResultSink receives analysis results as they are produced. Write is called
+// once per analyzed message, in input order, and never concurrently; Close is
+// called once after the last result so buffered formats can flush. Custom
+// sinks (message queues, databases) can be passed to AnalyzeFiles.
+type ResultSink interface {
+	Write(report *EmailSecurityReport) error
+	Close() error
+}
+
+// textSink writes human-readable reports
+type textSink struct {
+	w          io.Writer
+	verbose    bool
+	pretty     bool   // Sectioned layout (-pretty) instead of the compact default
+	locale     string // Language of the SFV, CAT and IPV descriptions
+	thresholds SCLThresholds
+	written    int
+}
+
+func (s *textSink) Write(report *EmailSecurityReport) error {
+	// Separate consecutive reports with a blank line
+	if s.written > 0 {
+		fmt.Fprintln(s.w)
+	}
+	if s.pretty {
+		outputPretty(s.w, report, s.verbose, s.locale, s.thresholds)
+	} else {
+		outputText(s.w, report, s.verbose, s.locale, s.thresholds)
+	}
+	s.written++
+	return nil
+}
+
+func (s *textSink) Close() error { return nil }
+
+// jsonSink writes one indented JSON document per report
+type jsonSink struct {
+	w       io.Writer
+	compact bool
+}
+
+func (s *jsonSink) Write(report *EmailSecurityReport) error {
+	return outputJSON(s.w, report, s.compact)
+}
+
+func (s *jsonSink) Close() error { return nil }
+
+// jsonArraySink buffers every report and writes them as one JSON array on
+// Close, so a batch is a single well-formed document ("[]" when empty)
+type jsonArraySink struct {
+	w       io.Writer
+	compact bool
+	reports []*EmailSecurityReport
+}
+
+func (s *jsonArraySink) Write(report *EmailSecurityReport) error {
+	s.reports = append(s.reports, report)
+	return nil
+}
+
+func (s *jsonArraySink) Close() error {
+	reports := s.reports
+	if reports == nil {
+		reports = []*EmailSecurityReport{}
+	}
+	var data []byte
+	var err error
+	if s.compact {
+		data, err = json.Marshal(reports)
+	} else {
+		data, err = json.MarshalIndent(reports, "", "  ")
+	}
+	if err != nil {
+		return eris.Wrap(err, "failed to marshal JSON array")
+	}
+	data = append(data, '\n')
+	if _, err := s.w.Write(data); err != nil {
+		return eris.Wrap(err, "failed to write JSON array")
+	}
+	return nil
+}
+
+// ndjsonSink writes one compact JSON document per line (newline-delimited
+// JSON), so each report can be consumed as soon as it is written
+type ndjsonSink struct {
+	w io.Writer
+}
+
+func (s *ndjsonSink) Write(report *EmailSecurityReport) error {
+	return outputJSON(s.w, report, true)
+}
+
+func (s *ndjsonSink) Close() error { return nil }
+
+// csvSink writes one CSV row per report, preceded by a header row
+type csvSink struct {
+	w             *csv.Writer
+	headerWritten bool
+}
+
+// csvHeader lists the CSV output columns in order
+var csvHeader = []string{
+	"file", "from", "to", "subject", "date", "message_id",
+	"spf", "dkim", "dmarc", "scl_score", "scl_description", "scl_source",
+	"homograph_suspected", "one_click_unsubscribe", "reply_domain_mismatch",
+	"message_index", "message_offset", "signal_fingerprint", "reply_to_mismatch",
+}
+
+func (s *csvSink) Write(report *EmailSecurityReport) error {
+	if !s.headerWritten {
+		if err := s.w.Write(csvHeader); err != nil {
+			return eris.Wrap(err, "failed to write CSV header")
+		}
+		s.headerWritten = true
+	}
+	if err := s.w.Write(csvRecord(report)); err != nil {
+		return eris.Wrap(err, "failed to write CSV record")
+	}
+	return nil
+}
+
+func (s *csvSink) Close() error {
+	s.w.Flush()
+	if err := s.w.Error(); err != nil {
+		return eris.Wrap(err, "failed to flush CSV output")
+	}
+	return nil
+}
+
+// sortKeys are the keys accepted by -sort, with their default direction
+var sortKeys = map[string]bool{ // key -> descending by default
+	"score":    true,
+	"filename": false,
+	"date":     false,
+}
+
+// parseSortSpec parses a -sort value such as "score", "date:asc" or
+// "filename:desc" into its key and direction
+func parseSortSpec(spec string) (string, bool, error) {
+	key, direction, hasDirection := strings.Cut(strings.ToLower(strings.TrimSpace(spec)), ":")
+	desc, ok := sortKeys[key]
+	if !ok {
+		return "", false, eris.Errorf("unknown sort key %q (valid: score, filename, date)", key)
+	}
+	if hasDirection {
+		switch direction {
+		case "asc":
+			desc = false
+		case "desc":
+			desc = true
+		default:
+			return "", false, eris.Errorf("unknown sort direction %q (valid: asc, desc)", direction)
+		}
+	}
+	return key, desc, nil
+}
+
+// sortingSink buffers every report and writes them to the wrapped sink in
+// sorted order on Close. Nothing is written until the batch is complete.
+type sortingSink struct {
+	ResultSink
+	key     string
+	desc    bool
+	reports []*EmailSecurityReport
+}
+
+func (s *sortingSink) Write(report *EmailSecurityReport) error {
+	s.reports = append(s.reports, report)
+	return nil
+}
+
+func (s *sortingSink) Close() error {
+	sortReports(s.reports, s.key, s.desc)
+	for _, report := range s.reports {
+		if err := s.ResultSink.Write(report); err != nil {
+			return err
+		}
+	}
+	return s.ResultSink.Close()
+}
+
+// sortReports orders reports by key ("score", "filename" or "date"). Reports
+// without an SCL or a parseable date go last in either direction, and ties
+// keep their input order.
+func sortReports(reports []*EmailSecurityReport, key string, desc bool) {
+	// compare returns <0, 0 or >0 in ascending order; missing reports whether
+	// either value is absent
+	var compare func(a, b *EmailSecurityReport) int
+	var missing func(r *EmailSecurityReport) bool
+	switch key {
+	case "score":
+		missing = func(r *EmailSecurityReport) bool { return r.SCL == nil }
+		compare = func(a, b *EmailSecurityReport) int { return a.SCL.Score - b.SCL.Score }
+	case "date":
+		dates := make(map[*EmailSecurityReport]time.Time, len(reports))
+		for _, r := range reports {
+			if t, err := mail.ParseDate(r.Date); err == nil {
+				dates[r] = t
+			}
+		}
+		missing = func(r *EmailSecurityReport) bool { _, ok := dates[r]; return !ok }
+		compare = func(a, b *EmailSecurityReport) int { return dates[a].Compare(dates[b]) }
+	default:
+		missing = func(r *EmailSecurityReport) bool { return false }
+		compare = func(a, b *EmailSecurityReport) int {
+			if c := strings.Compare(a.File, b.File); c != 0 {
+				return c
+			}
+			return a.MessageIndex - b.MessageIndex
+		}
+	}
+
+	sort.SliceStable(reports, func(i, j int) bool {
+		a, b := reports[i], reports[j]
+		if missing(a) || missing(b) {
+			return !missing(a) && missing(b)
+		}
+		if desc {
+			return compare(a, b) > 0
+		}
+		return compare(a, b) < 0
+	})
+}
+
+// exitCodeSink forwards reports to another sink and keeps the most
+// significant -exit-code status seen so far
+type exitCodeSink struct {
+	ResultSink
+	thresholds  SCLThresholds
+	allowlisted bool // Report SCL -1 as ExitAllowlisted
+	code        int
+	decider     *EmailSecurityReport // First report that produced code, for -explain-exit
+}
+
+func (s *exitCodeSink) Write(report *EmailSecurityReport) error {
+	if code := messageExitCode(report, s.thresholds, s.allowlisted); code != s.code && (code == ExitSpam || s.code == 0) {
+		s.code = code
+		s.decider = report
+	}
+	return s.ResultSink.Write(report)
+}
+
+// assertionSink forwards reports to another sink after checking each one
+// against the -assert rules, printing every failed condition to w
+type assertionSink struct {
+	ResultSink
+	rules   []AssertionRule
+	w       io.Writer
+	checked int // Messages matched by at least one rule
+	failed  int // Messages failing at least one condition
+}
+
+func (s *assertionSink) Write(report *EmailSecurityReport) error {
+	fromDomain := addressDomain(report.From)
+	matched, failed := false, false
+	for _, rule := range s.rules {
+		if !rule.matches(fromDomain) {
+			continue
+		}
+		matched = true
+		for _, failure := range rule.check(report) {
+			failed = true
+			fmt.Fprintf(s.w, "Assertion failed: %s: %s: %s\n", describeReportLocation(report), rule.Name, failure)
+		}
+	}
+	if matched {
+		s.checked++
+	}
+	if failed {
+		s.failed++
+	}
+	return s.ResultSink.Write(report)
+}
+
+// describeReportLocation names the message a report came from: its file,
+// the message index within an mbox or records file, and the From address
+func describeReportLocation(report *EmailSecurityReport) string {
+	location := valueOrUnknown(report.File)
+	if report.MessageIndex > 0 {
+		location += fmt.Sprintf(" (message %d)", report.MessageIndex)
+	}
+	if report.From != "" {
+		location += " from " + report.From
+	}
+	return location
+}
+
+// confidenceFilterSink forwards only reports whose AnalysisConfidence is at
+// least min, counting the ones it drops for -min-confidence
+type confidenceFilterSink struct {
+	ResultSink
+	min      int
+	written  int
+	filtered int
+}
+
+func (s *confidenceFilterSink) Write(report *EmailSecurityReport) error {
+	if report.AnalysisConfidence < s.min {
+		s.filtered++
+		return nil
+	}
+	s.written++
+	return s.ResultSink.Write(report)
+}
+
+// classFilterSink forwards only spam (spam set, -only-spam) or only clean
+// (-only-clean) reports, classified by SCL against the spam threshold as
+// -exit-code does. Messages without an SCL belong to neither subset.
+type classFilterSink struct {
+	ResultSink
+	thresholds SCLThresholds
+	spam       bool
+	written    int
+	filtered   int
+}
+
+func (s *classFilterSink) Write(report *EmailSecurityReport) error {
+	if report.SCL == nil || (report.SCL.Score >= s.thresholds.SpamThreshold) != s.spam {
+		s.filtered++
+		return nil
+	}
+	s.written++
+	return s.ResultSink.Write(report)
+}
+
+// bandCountingSink forwards reports to another sink and tallies their SCL
+// bands for -histogram
+type bandCountingSink struct {
+	ResultSink
+	thresholds SCLThresholds
+	counts     SCLBandCounts
+	processing time.Duration // Sum of ProcessingDuration (-v only)
+}
+
+func (s *bandCountingSink) Write(report *EmailSecurityReport) error {
+	s.counts.Total++
+	tallySCL(&s.counts, report.SCL, s.thresholds)
+	s.processing += report.ProcessingDuration
+	return s.ResultSink.Write(report)
+}
+
+// summarySink forwards reports to another sink and keeps a running batch
+// summary that a ticker prints while the batch is still being processed
+// (-summary-interval). Reports arrive on the analysis goroutine while the
+// summary is printed from another, so every field is guarded by mu.
+type summarySink struct {
+	ResultSink
+	w          io.Writer
+	tty        bool             // Clear a progress line being redrawn in place
+	now        func() time.Time // Clock, replaceable in tests
+	start      time.Time
+	thresholds SCLThresholds
+
+	mu     sync.Mutex
+	counts SCLBandCounts
+	done   int // Files finished
+	total  int // Files in the batch
+}
+
+// newSummarySink returns a summary sink writing to w that bands SCLs by
+// thresholds; tty must match the progress reporter's so summaries do not
+// garble its line
+func newSummarySink(w io.Writer, tty bool, thresholds SCLThresholds) *summarySink {
+	s := &summarySink{w: w, tty: tty, now: time.Now, thresholds: thresholds}
+	s.start = s.now()
+	return s
+}
+
+func (s *summarySink) Write(report *EmailSecurityReport) error {
+	s.mu.Lock()
+	s.counts.Total++
+	tallySCL(&s.counts, report.SCL, s.thresholds)
+	s.mu.Unlock()
+	return s.ResultSink.Write(report)
+}
+
+// Progress records finished files; it matches ProgressFunc
+func (s *summarySink) Progress(done, total int) {
+	s.mu.Lock()
+	s.done, s.total = done, total
+	s.mu.Unlock()
+}
+
+// Run prints the running summary every interval until ctx is done. The
+// returned stop function ends the ticker and waits for it, so the final
+// summary cannot interleave with a running one.
+func (s *summarySink) Run(ctx context.Context, interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.Print("Running summary", -1)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// Print writes one summary line headed by label. errors is the number of
+// inputs that failed, which is only known once the batch ends; pass -1 to
+// leave it out.
+func (s *summarySink) Print(label string, errors int) {
+	s.mu.Lock()
+	counts, done, total := s.counts, s.done, s.total
+	s.mu.Unlock()
+
+	elapsed := s.now().Sub(s.start).Round(time.Second)
+	line := fmt.Sprintf("%s after %s: %d/%d files, %d messages", label, elapsed, done, total, counts.Total)
+	if errors >= 0 {
+		line += fmt.Sprintf(", %d errors", errors)
+	}
+	line += fmt.Sprintf(" (not spam %d, low spam %d, spam %d, high confidence %d, skipped %d, no SCL %d)",
+		counts.NotSpam, counts.LowSpam, counts.Spam, counts.HighConfidence, counts.Skipped, counts.NoSCL)
+	if s.tty {
+		// Replace the in-place progress line; it is redrawn on the next update
+		fmt.Fprintf(s.w, "\r\033[K%s\n", line)
+		return
+	}
+	fmt.Fprintln(s.w, line)
+}
+
+// groupByKeys maps each -group-by name to the function giving a report's
+// group. Reports without a value fall into noGroup.
+var groupByKeys = map[string]func(report *EmailSecurityReport) string{
+	"from-domain": func(report *EmailSecurityReport) string { return addressDomain(report.From) },
+	"cip-net": func(report *EmailSecurityReport) string {
+		if report.SenderIP == nil {
+			return ""
+		}
+		return ipNetwork(report.SenderIP.IP)
+	},
+	"country": func(report *EmailSecurityReport) string { return report.SenderCountry },
+	"mailer":  func(report *EmailSecurityReport) string { return report.Software.mailerName() },
+}
+
+// noGroup labels reports that have no value for the -group-by key
+const noGroup = "(none)"
+
+// GroupCounts is the SCL band distribution of one -group-by group
+type GroupCounts struct {
+	Group  string        `json:"group"`
+	Counts SCLBandCounts `json:"counts"`
+}
+
+// GroupedSummary is the -group-by output: groups by descending message count,
+// ties in name order
+type GroupedSummary struct {
+	GroupBy string        `json:"group_by"`
+	Groups  []GroupCounts `json:"groups"`
+}
+
+// groupingSink tallies SCL bands per group instead of writing reports, and
+// writes the summary in the output format on Close (-group-by)
+type groupingSink struct {
+	w          io.Writer
+	format     string
+	key        string
+	thresholds SCLThresholds
+	groups     map[string]*SCLBandCounts
+}
+
+func newGroupingSink(w io.Writer, format, key string, thresholds SCLThresholds) *groupingSink {
+	return &groupingSink{w: w, format: format, key: key, thresholds: thresholds, groups: make(map[string]*SCLBandCounts)}
+}
+
+func (s *groupingSink) Write(report *EmailSecurityReport) error {
+	group := groupByKeys[s.key](report)
+	if group == "" {
+		group = noGroup
+	}
+	counts, ok := s.groups[group]
+	if !ok {
+		counts = &SCLBandCounts{}
+		s.groups[group] = counts
+	}
+	counts.Total++
+	tallySCL(counts, report.SCL, s.thresholds)
+	return nil
+}
+
+// summary returns the groups in output order
+func (s *groupingSink) summary() GroupedSummary {
+	summary := GroupedSummary{GroupBy: s.key, Groups: make([]GroupCounts, 0, len(s.groups))}
+	for group, counts := range s.groups {
+		summary.Groups = append(summary.Groups, GroupCounts{Group: group, Counts: *counts})
+	}
+	slices.SortFunc(summary.Groups, func(a, b GroupCounts) int {
+		if a.Counts.Total != b.Counts.Total {
+			return b.Counts.Total - a.Counts.Total
+		}
+		return strings.Compare(a.Group, b.Group)
+	})
+	return summary
+}
+
+func (s *groupingSink) Close() error {
+	summary := s.summary()
+	switch s.format {
+	case "json":
+		encoder := json.NewEncoder(s.w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(summary); err != nil {
+			return eris.Wrap(err, "failed to encode JSON")
+		}
+		return nil
+	case "csv":
+		w := csv.NewWriter(s.w)
+		w.Write([]string{s.key, "total", "skipped", "not_spam", "low_spam", "spam", "high_confidence", "no_scl"})
+		for _, g := range summary.Groups {
+			c := g.Counts
+			w.Write([]string{csvSafe(g.Group), strconv.Itoa(c.Total), strconv.Itoa(c.Skipped), strconv.Itoa(c.NotSpam),
+				strconv.Itoa(c.LowSpam), strconv.Itoa(c.Spam), strconv.Itoa(c.HighConfidence), strconv.Itoa(c.NoSCL)})
+		}
+		w.Flush()
+		return eris.Wrap(w.Error(), "failed to write CSV")
+	default:
+		outputGroupsText(s.w, summary)
+		return nil
+	}
+}
+
+// messageExitCode returns the -exit-code status for a single report: ExitSpam
+// at or above the spam threshold, ExitAllowlisted for SCL -1 when allowlisted
+// is set, otherwise 0
+func messageExitCode(report *EmailSecurityReport, t SCLThresholds, allowlisted bool) int {
+	switch {
+	case report.SCL == nil:
+		return 0
+	case report.SCL.Score >= t.SpamThreshold:
+		return ExitSpam
+	case allowlisted && report.Allowlisted:
+		return ExitAllowlisted
+	default:
+		return 0
+	}
+}
+
+// exitReason describes for -explain-exit why -exit-code chose code, naming
+// the SCL of the report that decided it, e.g.
+// "SCL 7 >= spam-threshold 5 (high confidence spam) in a.eml"
+func exitReason(code int, report *EmailSecurityReport, t SCLThresholds) string {
+	var reason string
+	switch {
+	case code == ExitSpam && report != nil && report.SCL != nil:
+		reason = fmt.Sprintf("SCL %d >= spam-threshold %d (%s)", report.SCL.Score, t.SpamThreshold, strings.ToLower(describeSCL(report.SCL.Score, t)))
+	case code == ExitAllowlisted && report != nil:
+		reason = "SCL -1, spam filtering was skipped (-exit-allowlisted)"
+	default:
+		return fmt.Sprintf("no message reached spam-threshold %d", t.SpamThreshold)
+	}
+	if report.File != "" {
+		reason += " in " + report.File
+		if report.MessageIndex > 0 {
+			reason += fmt.Sprintf(" (message %d)", report.MessageIndex)
+		}
+	}
+	return reason
+}
+
+// newResultSink returns the built-in sink for an output format, describing
+// reports in this Analyzer's Locale and Thresholds. compact minifies JSON
+// output; other formats ignore it.
+func (a *Analyzer) newResultSink(format string, w io.Writer, verbose, compact bool) ResultSink {
+	switch format {
+	case "json":
+		return &jsonSink{w: w, compact: compact}
+	case "json-array":
+		return &jsonArraySink{w: w, compact: compact}
+	case "csv":
+		return &csvSink{w: csv.NewWriter(w)}
+	case "pretty":
+		return &textSink{w: w, verbose: verbose, pretty: true, locale: a.Locale, thresholds: a.Thresholds}
+	default:
+		return &textSink{w: w, verbose: verbose, locale: a.Locale, thresholds: a.Thresholds}
+	}
+}
+
+// csvRecord flattens a report into a row matching csvHeader
+func csvRecord(report *EmailSecurityReport) []string {
+	spf := spfResultValues(report.SPFResults)
+	dkim := dkimResultValues(report.DKIMResults)
+	dmarc := dmarcResultValues(report.DMARCResults)
+
+	var sclScore, sclDesc, sclSource string
+	if report.SCL != nil {
+		sclScore = strconv.Itoa(report.SCL.Score)
+		sclDesc = report.SCL.Description
+		sclSource = report.SCL.HeaderSource
+	}
+
+	var messageIndex, messageOffset string
+	if report.MessageIndex > 0 {
+		messageIndex = strconv.Itoa(report.MessageIndex)
+	}
+	if report.MessageOffset != nil {
+		messageOffset = strconv.FormatInt(*report.MessageOffset, 10)
+	}
+
+	record := []string{
+		report.File, report.From, report.To, report.Subject, report.Date, report.MessageID,
+		bestAuthResult(spf), bestAuthResult(dkim), bestAuthResult(dmarc),
+		sclScore, sclDesc, sclSource,
+		strconv.FormatBool(report.Homograph != nil && report.Homograph.HomographSuspected),
+		strconv.FormatBool(report.ListUnsubscribe != nil && report.ListUnsubscribe.OneClickUnsubscribe),
+		strconv.FormatBool(report.Thread != nil && report.Thread.ReplyDomainMismatch),
+		messageIndex, messageOffset, report.SignalFingerprint,
+		strconv.FormatBool(report.ReplyToMismatch),
+	}
+	for i := range record {
+		record[i] = csvSafe(record[i])
+	}
+	return record
+}
+
+// bestAuthResult returns "pass" if any result passed, otherwise the first result
+func bestAuthResult(results []string) string {
+	for _, r := range results {
+		if strings.EqualFold(r, "pass") {
+			return "pass"
+		}
+	}
+	if len(results) > 0 {
+		return strings.ToLower(results[0])
+	}
+	return ""
+}
+
+// csvSafe neutralizes values that spreadsheet applications would interpret
+// as formulas (CSV injection), since header values are attacker-controlled
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		// Negative numbers such as SCL -1 are data, not formulas
+		if _, err := strconv.Atoi(value); err == nil {
+			return value
+		}
+		return "'" + value
+	}
+	return value
+}
+
+// ProgressFunc is called after each file of a batch with the number of files
+// attempted so far (including failures) and the batch size
+type ProgressFunc func(done, total int)
+
+// AnalyzeFiles is Analyzer.AnalyzeFiles with the default configuration;
+// includeRawHeaders (-v) also records parser diagnostics
+func AnalyzeFiles(ctx context.Context, files []string, includeRawHeaders bool, sink ResultSink, progress ProgressFunc) (int, error) {
+	a := *defaultAnalyzer
+	a.IncludeRawHeaders = includeRawHeaders
+	a.Diagnostics = includeRawHeaders
+	return a.AnalyzeFiles(ctx, files, sink, progress)
+}
+
+// AnalyzeFiles analyzes each file in order and writes every successful report
+// to sink. Files that fail to parse are logged and counted rather than
+// aborting the batch; only sink errors stop processing. The sink is not closed.
+// progress may be nil. ctx is passed to each message's enrichment lookups.
+// When ctx is done, processing stops and ctx.Err() is returned: a message
+// whose analysis it interrupted is dropped rather than written incomplete, so
+// every report already written is complete. With Dedupe set, repeats of a
+// message whose header parsed are skipped before analysis.
+func (a *Analyzer) AnalyzeFiles(ctx context.Context, files []string, sink ResultSink, progress ProgressFunc) (int, error) {
+	failed := 0
+	for i, file := range files {
+		if err := ctx.Err(); err != nil {
+			return failed, err
+		}
+
+		var sinkErr, cancelErr error
+		err := a.forEachMessage(file, func(index int, offset int64, data []byte) error {
+			if cancelErr = ctx.Err(); cancelErr != nil {
+				return cancelErr
+			}
+			start := time.Now()
+			header, err := a.readHeader(data)
+			var report *EmailSecurityReport
+			if err == nil {
+				// Only parsed messages are deduplicated; every copy that
+				// fails to parse is reported and counted
+				if a.Dedupe != nil && a.Dedupe.Seen(dedupeKey(header, data)) {
+					return nil
+				}
+				report, err = a.analyzeHeader(ctx, start, header, data)
+			}
+			if cancelErr = ctx.Err(); cancelErr != nil {
+				return cancelErr
+			}
+			if err != nil {
+				log.Printf("Internal error: %+v", err)
+				switch {
+				case isJSONInputFormat(a.InputFormat):
+					// Shape errors name the offending key, which is safe to show
+					fmt.Fprintf(os.Stderr, "Error: Invalid header JSON in %s: %s\n", sanitizeHeader(file), sanitizeHeader(err.Error()))
+				case describeStrictMIMEError(err) != "" && index > 0:
+					fmt.Fprintf(os.Stderr, "Error: Message %d in %s: %s\n", index, sanitizeHeader(file), describeStrictMIMEError(err))
+				case describeStrictMIMEError(err) != "":
+					fmt.Fprintf(os.Stderr, "Error: %s: %s\n", sanitizeHeader(file), describeStrictMIMEError(err))
+				case index > 0:
+					fmt.Fprintf(os.Stderr, "Error: Failed to parse message %d in %s.\n", index, sanitizeHeader(file))
+				default:
+					fmt.Fprintf(os.Stderr, "Error: Failed to parse email file %s.\n", sanitizeHeader(file))
+				}
+				failed++
+				return nil
+			}
+			report.File = file
+			report.MessageIndex = index
+			if index > 0 {
+				report.MessageOffset = &offset
+			}
+			sinkErr = sink.Write(report)
+			return sinkErr
+		})
+		if sinkErr != nil {
+			return failed, sinkErr
+		}
+		if cancelErr != nil {
+			return failed, cancelErr
+		}
+		if err != nil {
+			log.Printf("Internal error: %+v", err)
+			if msg := describeZipPasswordError(err); msg != "" {
+				fmt.Fprintf(os.Stderr, "Error: Failed to read %s. %s\n", sanitizeHeader(file), msg)
+			} else {
+				fmt.Fprintf(os.Stderr, "Error: Failed to parse email file %s.\n", sanitizeHeader(file))
+			}
+			failed++
+		}
+
+		if progress != nil {
+			progress(i+1, len(files))
+		}
+	}
+	return failed, nil
+}
+
+// Deduper remembers the messages of a batch for -dedupe, so copies of one
+// message filed in several folders are analyzed and counted once. It is safe
+// for concurrent use and shared by copies of an Analyzer.
+type Deduper struct {
+	mu      sync.Mutex
+	seen    map[string]bool
+	skipped int
+}
+
+// NewDeduper returns a Deduper that has seen no messages
+func NewDeduper() *Deduper {
+	return &Deduper{seen: make(map[string]bool)}
+}
+
+// Seen records key and reports whether it had already been recorded,
+// counting each repeat as skipped
+func (d *Deduper) Seen(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seen[key] {
+		d.skipped++
+		return true
+	}
+	d.seen[key] = true
+	return false
+}
+
+// Skipped returns the number of repeats Seen has reported
+func (d *Deduper) Skipped() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.skipped
+}
+
+// dedupeKey identifies a message for -dedupe by the Message-ID of its
+// already parsed header, or by a SHA-256 of the whole message data when it
+// has none.
+func dedupeKey(header mail.Header, data []byte) string {
+	if id := strings.TrimSpace(header.Get("Message-ID")); id != "" {
+		return "message-id:" + id
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// maildirWatcher finds messages newly delivered to a Maildir. Deliveries are
+// written to tmp/ and atomically renamed into new/, so only new/ is read and
+// every file seen there is complete.
+type maildirWatcher struct {
+	newDir string
+	seen   map[string]bool
+}
+
+// newMaildirWatcher watches path/new when path is a Maildir, otherwise path
+// itself. Messages already present are treated as seen, so only later
+// deliveries are reported.
+func newMaildirWatcher(path string) (*maildirWatcher, error) {
+	if strings.Contains(path, "..") {
+		return nil, eris.New("path traversal detected")
+	}
+	dir := path
+	if stat, err := os.Stat(filepath.Join(path, "new")); err == nil && stat.IsDir() {
+		dir = filepath.Join(path, "new")
+	}
+	if stat, err := os.Stat(dir); err != nil {
+		return nil, eris.Wrap(err, "failed to stat watch directory")
+	} else if !stat.IsDir() {
+		return nil, eris.Errorf("%s is not a directory", dir)
+	}
+
+	w := &maildirWatcher{newDir: dir, seen: make(map[string]bool)}
+	if _, err := w.poll(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// poll returns the files delivered since the previous poll, in name order.
+// Names no longer in new/ (moved to cur/ by a mail client) are forgotten, so
+// the seen set stays as small as the directory.
+func (w *maildirWatcher) poll() ([]string, error) {
+	entries, err := os.ReadDir(w.newDir)
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to read watch directory")
+	}
+
+	present := make(map[string]bool, len(entries))
+	var files []string
+	for _, entry := range entries {
+		// Maildir files never start with a dot; skip editor and temp files
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		present[entry.Name()] = true
+		if !w.seen[entry.Name()] {
+			w.seen[entry.Name()] = true
+			files = append(files, filepath.Join(w.newDir, entry.Name()))
+		}
+	}
+	for name := range w.seen {
+		if !present[name] {
+			delete(w.seen, name)
+		}
+	}
+	return files, nil
+}
+
+// resolve returns where a polled file now lives: still in new/, or in cur/
+// under its name plus a ":2,<flags>" suffix if a client picked it up since
+func (w *maildirWatcher) resolve(file string) string {
+	if _, err := os.Stat(file); err == nil {
+		return file
+	}
+	curDir := filepath.Join(filepath.Dir(w.newDir), "cur")
+	if matches, _ := filepath.Glob(filepath.Join(curDir, filepath.Base(file)+":*")); len(matches) > 0 {
+		return matches[0]
+	}
+	return file
+}
+
+// watchMaildir polls w every interval and writes a report for each new
+// message to sink until ctx is done; ctx is also passed to each message's
+// enrichment lookups. Maildir files have no extension, so they are read as
+// eml unless a format is forced. Reports name the path actually read, which
+// is in cur/ when a client picked the message up first. Unparseable messages
+// are reported on stderr and skipped; only sink and directory errors stop
+// the watch.
+func watchMaildir(ctx context.Context, w *maildirWatcher, a Analyzer, sink ResultSink, interval time.Duration) error {
+	if a.InputFormat == "" {
+		a.InputFormat = "eml"
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		files, err := w.poll()
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			path := w.resolve(file)
+			report, err := a.AnalyzeFileContext(ctx, path)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				log.Printf("Internal error: %+v", err)
+				fmt.Fprintf(os.Stderr, "Error: Failed to parse email file %s.\n", sanitizeHeader(path))
+				continue
+			}
+			report.File = path
+			if err := sink.Write(report); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// listenUnix serves one analysis per connection on ln until stop is closed:
+// the client writes a raw RFC822 message and shuts down its write side, and
+// the server replies with the compact JSON report (or {"error": ...}) and
+// closes the connection. Replies are redacted by redactor, which may be nil.
+// At most MaxSocketConns connections are analyzed at once; further clients
+// wait in the listen backlog.
+func listenUnix(ln net.Listener, a Analyzer, redactor *Redactor, stop <-chan struct{}) error {
+	go func() {
+		<-stop
+		ln.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	slots := make(chan struct{}, MaxSocketConns)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-stop:
+				return nil
+			default:
+				return eris.Wrap(err, "failed to accept connection")
+			}
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			serveSocketConn(conn, a, redactor)
+		}()
+	}
+}
+
+// serveSocketConn reads one message from conn, writes its report and closes
+// conn. Failures are logged and answered with a generic error so internal
+// detail stays on the server.
+func serveSocketConn(conn net.Conn, a Analyzer, redactor *Redactor) {
+	defer conn.Close()
+	deadline := time.Now().Add(SocketTimeout)
+	conn.SetDeadline(deadline)
+
+	fail := func(err error, message string) {
+		log.Printf("Internal error: %+v", err)
+		if err := json.NewEncoder(conn).Encode(map[string]string{"error": message}); err != nil {
+			log.Printf("Internal error: %+v", eris.Wrap(err, "failed to write socket reply"))
+		}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(conn, MaxFileSizeBytes+1))
+	if err != nil {
+		fail(eris.Wrap(err, "failed to read message from socket"), "failed to read message")
+		return
+	}
+	if len(data) > MaxFileSizeBytes {
+		fail(eris.Errorf("socket message exceeds maximum allowed size of %d bytes", MaxFileSizeBytes), "message too large")
+		return
+	}
+	// Enrichment lookups must finish before the connection deadline
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	report, err := a.AnalyzeMessageContext(ctx, data)
+	if err != nil {
+		fail(err, "failed to parse message")
+		return
+	}
+	redactor.Redact(report)
+	if err := outputJSON(conn, report, true); err != nil {
+		log.Printf("Internal error: %+v", err)
+	}
+}
+
+// listenUnixSocket listens on path, replacing a stale socket file left by a
+// previous run that was killed. Any other existing file is an error, so a
+// typo cannot delete real data.
+func listenUnixSocket(path string) (net.Listener, error) {
+	if stat, err := os.Lstat(path); err == nil {
+		if stat.Mode()&os.ModeSocket == 0 {
+			return nil, eris.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, eris.Errorf("%s is already in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, eris.Wrap(err, "failed to remove stale socket")
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to listen on unix socket")
+	}
+	return ln, nil
+}
+
+// progressReporter prints batch progress (files done / total and rate) to
+// stderr. On a terminal the line is redrawn in place; otherwise a line is
+// written at most once per interval so logs stay readable.
+type progressReporter struct {
+	w        io.Writer
+	tty      bool
+	interval time.Duration
+	now      func() time.Time
+	start    time.Time
+	last     time.Time
+	printed  bool
+}
+
+// newProgressReporter returns a reporter writing to w. tty selects in-place
+// redrawing.
+func newProgressReporter(w io.Writer, tty bool) *progressReporter {
+	interval := 10 * time.Second
+	if tty {
+		interval = 100 * time.Millisecond
+	}
+	p := &progressReporter{w: w, tty: tty, interval: interval, now: time.Now}
+	p.start = p.now()
+	return p
+}
+
+// isTerminal reports whether f is a character device (an interactive terminal)
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeCharDevice != 0
+}
+
+// Update records progress; it matches ProgressFunc
+func (p *progressReporter) Update(done, total int) {
+	now := p.now()
+	if done < total && p.printed && now.Sub(p.last) < p.interval {
+		return
+	}
+	p.last = now
+	p.printed = true
+
+	rate := 0.0
+	if elapsed := now.Sub(p.start).Seconds(); elapsed > 0 {
+		rate = float64(done) / elapsed
+	}
+	line := fmt.Sprintf("Progress: %d/%d files (%.1f%%), %.1f files/s",
+		done, total, float64(done)/float64(total)*100, rate)
+
+	if p.tty {
+		fmt.Fprintf(p.w, "\r\033[K%s", line)
+		if done == total {
+			fmt.Fprintln(p.w)
+		}
+		return
+	}
+	fmt.Fprintln(p.w, line)
+}
+
+// SCLBandCounts tallies analyzed messages by SCL band
+type SCLBandCounts struct {
+	Total          int `json:"total"`           // Messages seen (an mbox contributes one per message)
+	Skipped        int `json:"skipped"`         // SCL -1
+	NotSpam        int `json:"not_spam"`        // Below the low spam band
+	LowSpam        int `json:"low_spam"`        // Low spam probability band
+	Spam           int `json:"spam"`            // Spam band
+	HighConfidence int `json:"high_confidence"` // High confidence spam band
+	NoSCL          int `json:"no_scl"`          // No SCL header found
+	Errors         int `json:"errors"`          // Files that could not be parsed
+}
+
+// dirWalk controls how directory arguments are expanded and counts what was
+// skipped. The zero value reads only the top level and ignores symlinks.
+type dirWalk struct {
+	recursive      bool // Descend into subdirectories
+	maxDepth       int  // Subdirectory levels entered below the argument
+	followSymlinks bool // Read symlinked files and enter symlinked directories
+	tooDeep        int  // Directories not entered because of maxDepth
+	loops          int  // Directories not entered because they were already visited
+	unreadable     int  // Subdirectories that could not be read
+}
+
+// collectInputFiles expands an input path into the files to analyze. A
+// directory yields its .msg, .eml, .emlx, .mbox and .zip files (every
+// regular file when a format is forced) in name order, including those of
+// its subdirectories when walk is recursive.
+func collectInputFiles(path, forcedFormat string, walk *dirWalk) ([]string, bool, error) {
+	if strings.Contains(path, "..") {
+		return nil, false, eris.New("path traversal detected")
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, false, eris.Wrap(err, "failed to stat input path")
+	}
+	if !stat.IsDir() {
+		return []string{path}, false, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, true, eris.Wrap(err, "failed to read input directory")
+	}
+	visited := make(map[string]struct{})
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		visited[real] = struct{}{}
+	}
+	return walk.collect(path, entries, forcedFormat, 0, visited), true, nil
+}
+
+// collect returns the matching files among entries of dir, descending into
+// subdirectories depth-first when recursive. Every directory entered is
+// recorded in visited by its symlink-free path, so a symlink loop (or a
+// second link to the same directory) is entered only once, and no more than
+// maxDepth levels are entered below the argument.
+func (w *dirWalk) collect(dir string, entries []os.DirEntry, forcedFormat string, depth int, visited map[string]struct{}) []string {
+	var files []string
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		mode := entry.Type()
+		if mode&os.ModeSymlink != 0 {
+			if !w.followSymlinks {
+				continue
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				continue // Dangling link
+			}
+			mode = info.Mode().Type()
+		}
+
+		switch {
+		case mode.IsRegular():
+			// A forced format applies to every file, whatever its extension
+			if _, err := detectInputFormat(entry.Name(), ""); err == nil || forcedFormat != "" {
+				files = append(files, path)
+			}
+		case mode.IsDir() && w.recursive:
+			if depth >= w.maxDepth {
+				w.tooDeep++
+				continue
+			}
+			real, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				w.unreadable++
+				continue
+			}
+			if _, ok := visited[real]; ok {
+				w.loops++
+				continue
+			}
+			visited[real] = struct{}{}
+			subEntries, err := os.ReadDir(path)
+			if err != nil {
+				log.Printf("Internal error: %+v", eris.Wrap(err, "failed to read input subdirectory"))
+				w.unreadable++
+				continue
+			}
+			files = append(files, w.collect(path, subEntries, forcedFormat, depth+1, visited)...)
+		}
+	}
+
+	// os.ReadDir already returns entries sorted by filename
+	return files
+}
+
+// collectInputs collects the files to analyze from every command-line
+// argument, each a file or a directory. An unreadable argument is reported on
+// stderr and skipped without aborting the others; failed counts them. batch is
+// true for several arguments, any directory or any mbox file, since each
+// yields more than one result.
+func collectInputs(args []string, forcedFormat string, walk *dirWalk) (files []string, batch bool, failed int) {
+	batch = len(args) > 1
+	for _, arg := range args {
+		argFiles, isDir, err := collectInputFiles(arg, forcedFormat, walk)
+		if err != nil {
+			log.Printf("Internal error: %+v", err)
+			fmt.Fprintf(os.Stderr, "Error: Failed to read input %s. Please ensure the path exists.\n", sanitizeHeader(arg))
+			failed++
+			continue
+		}
+		files = append(files, argFiles...)
+
+		// An mbox holds many messages, so a single mbox file is handled as a batch
+		if isDir {
+			batch = true
+		} else if format, err := detectInputFormat(arg, forcedFormat); err == nil && (format == "mbox" || format == "records") {
+			batch = true
+		}
+	}
+	return files, batch, failed
+}
+
+// readInputListFile reads the paths named in an -input-list file, or in stdin
+// when path is "-".
+func readInputListFile(path string) ([]string, error) {
+	if path == "-" {
+		return readInputList(os.Stdin)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, eris.Wrapf(err, "failed to open input list %s", path)
+	}
+	defer f.Close()
+	return readInputList(f)
+}
+
+// readInputList returns the paths in r, one per line. Surrounding whitespace
+// is trimmed; blank lines and lines starting with '#' are skipped. Paths are
+// not checked here: an unreadable entry fails on its own in collectInputs.
+func readInputList(r io.Reader) ([]string, error) {
+	var paths []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, eris.Wrap(err, "failed to read input list")
+	}
+	return paths, nil
+}
+
+// sampleFiles returns a random subset of files: n of them, or when n is 0,
+// percent of them rounded up (so a non-empty input always keeps at least
+// one). The same seed selects the same subset, which keeps its input order.
+func sampleFiles(files []string, n int, percent float64, seed uint64) []string {
+	if n == 0 {
+		n = int(math.Ceil(float64(len(files)) * percent / 100))
+	}
+	if n >= len(files) {
+		return files
+	}
+	picked := rand.New(rand.NewPCG(seed, 0)).Perm(len(files))[:n]
+	slices.Sort(picked)
+	sample := make([]string, n)
+	for i, index := range picked {
+		sample[i] = files[index]
+	}
+	return sample
+}
+
+// limitFiles truncates files to at most max entries (0 means no limit) and
+// reports whether any were dropped. Every kept file counts as attempted,
+// whether or not it later parses.
+func limitFiles(files []string, max int) ([]string, bool) {
+	if max <= 0 || len(files) <= max {
+		return files, false
+	}
+	return files[:max], true
+}
+
+// countSCLBands is Analyzer.countSCLBands with the default configuration
+func countSCLBands(ctx context.Context, files []string, progress ProgressFunc) (SCLBandCounts, error) {
+	return defaultAnalyzer.countSCLBands(ctx, files, progress)
+}
+
+// countSCLBands tallies SCL bands across files. Only the headers are parsed and
+// only the SCL is extracted, so this is much cheaper than full analysis.
+// progress may be nil. When ctx is done, counting stops before the next message
+// and the partial counts are returned with ctx.Err().
+func (a *Analyzer) countSCLBands(ctx context.Context, files []string, progress ProgressFunc) (SCLBandCounts, error) {
+	var counts SCLBandCounts
+	for i, file := range files {
+		if err := ctx.Err(); err != nil {
+			return counts, err
+		}
+
+		var cancelErr error
+		err := a.forEachMessage(file, func(_ int, _ int64, data []byte) error {
+			if cancelErr = ctx.Err(); cancelErr != nil {
+				return cancelErr
+			}
+			counts.Total++
+			scl, err := a.readSCL(data)
+			if err != nil {
+				log.Printf("Internal error: %+v", err)
+				counts.Errors++
+				return nil
+			}
+			tallySCL(&counts, scl, a.Thresholds)
+			return nil
+		})
+		if cancelErr != nil {
+			return counts, cancelErr
+		}
+		if err != nil {
+			log.Printf("Internal error: %+v", err)
+			counts.Total++
+			counts.Errors++
+		}
+
+		if progress != nil {
+			progress(i+1, len(files))
+		}
+	}
+	return counts, nil
+}
+
+// probeHeaders lists each header a parser reads, with the parser (named as
+// in the -v diagnostics) that it feeds, for -probe. A name ending in "*"
+// matches every header with that prefix. The gateway entries must cover
+// gatewayHeaderPrefixes; add entries alongside new parsers.
+var probeHeaders = []struct{ name, parser string }{
+	{"X-Forefront-Antispam-Report", "scl"},
+	{"X-Forefront-Antispam-Report-Untrusted", "scl"},
+	{"Authentication-Results", "authentication-results"},
+	{"Authentication-Results-Original", "authentication-results-original"},
+	{"ARC-Authentication-Results", "arc"},
+	{"ARC-Seal", "arc-chain"},
+	{"ARC-Message-Signature", "arc-chain"},
+	{"Received-SPF", "spf"},
+	{"DKIM-Signature", "dkim-signature"},
+	{"X-Google-DKIM-Signature", "dkim-signature"},
+	{"Received", "received"},
+	{"X-Spam-Status", "spamassassin"},
+	{"X-Spam-Flag", "spamassassin"},
+	{"X-Spam-Score", "spamassassin"},
+	{"X-Spam-Checker-Version", "spamassassin"},
+	{"X-Spam-Report", "spamassassin"},
+	{"X-Mimecast-*", "mimecast"},
+	{"List-Unsubscribe", "list-unsubscribe"},
+	{"List-Unsubscribe-Post", "list-unsubscribe"},
+	{"Precedence", "automation"},
+	{"Auto-Submitted", "automation"},
+	{"Reply-To", "reply-to"},
+	{"In-Reply-To", "thread"},
+	{"References", "thread"},
+	{"X-Originating-Email", "webmail"},
+	{"X-Originating-IP", "webmail"},
+	{"X-Apparently-To", "webmail"},
+	{"X-PHP-Originating-Script", "webapp-origin"},
+	{"X-PHP-Script", "webapp-origin"},
+	{"X-Source", "webapp-origin"},
+	{"X-Source-Args", "webapp-origin"},
+	{"X-Source-Dir", "webapp-origin"},
+	{"X-Mailer", "sender-software"},
+	{"User-Agent", "sender-software"},
+	{"Organization", "sender-software"},
+	{"X-MS-Exchange-CrossTenant-*", "tenant"},
+	{"X-SID-PRA", "sender-id"},
+	{"X-SID-Result", "sender-id"},
+	{"X-Sender-IP", "sender-ip"},
+	{"X-SenderIP", "sender-ip"},
+	{"X-Source-IP", "sender-ip"},
+	{"X-Microsoft-Antispam*", "gateways"},
+	{"X-MS-Exchange-Organization-SCL", "gateways"},
+	{"X-Proofpoint-*", "gateways"},
+	{"X-Barracuda-*", "gateways"},
+	{"X-IronPort-*", "gateways"},
+	{"X-Brightmail-Tracker*", "gateways"},
+	{"X-FireEye*", "gateways"},
+	{"X-FE-*", "gateways"},
+	{"X-TM-AS-*", "gateways"},
+	{"X-Sophos-*", "gateways"},
+	{"X-Forcepoint-*", "gateways"},
+	{"X-Vade-*", "gateways"},
+	{"X-FEAS-*", "gateways"},
+}
+
+// ProbedHeader is one recognized header and the number of messages carrying it
+type ProbedHeader struct {
+	Header   string `json:"header"`
+	Parser   string `json:"parser"`
+	Messages int    `json:"messages"`
+}
+
+// HeaderProbe is the -probe output: every recognized header by descending
+// message count, ties (including headers never seen) in probeHeaders order
+type HeaderProbe struct {
+	Messages int            `json:"messages"` // Messages whose headers were read
+	Errors   int            `json:"errors"`   // Files and messages that could not be parsed
+	Headers  []ProbedHeader `json:"headers"`
+}
+
+// probeHeaderFiles is Analyzer.probeHeaderFiles with the default configuration
+func probeHeaderFiles(ctx context.Context, files []string, progress ProgressFunc) (HeaderProbe, error) {
+	return defaultAnalyzer.probeHeaderFiles(ctx, files, progress)
+}
+
+// probeHeaderFiles reads only the headers of every message in files and
+// counts the messages carrying each of probeHeaders. Like countSCLBands it
+// stops with ctx.Err() when ctx is done, returning the counts so far.
+func (a *Analyzer) probeHeaderFiles(ctx context.Context, files []string, progress ProgressFunc) (HeaderProbe, error) {
+	counts := make([]int, len(probeHeaders))
+	var probe HeaderProbe
+	finish := func() HeaderProbe {
+		for i, h := range probeHeaders {
+			probe.Headers = append(probe.Headers, ProbedHeader{Header: h.name, Parser: h.parser, Messages: counts[i]})
+		}
+		slices.SortStableFunc(probe.Headers, func(a, b ProbedHeader) int { return b.Messages - a.Messages })
+		return probe
+	}
+
+	for i, file := range files {
+		if err := ctx.Err(); err != nil {
+			return finish(), err
+		}
+
+		var cancelErr error
+		err := a.forEachMessage(file, func(_ int, _ int64, data []byte) error {
+			if cancelErr = ctx.Err(); cancelErr != nil {
+				return cancelErr
+			}
+			header, err := a.readHeader(data)
+			if err != nil {
+				log.Printf("Internal error: %+v", err)
+				probe.Errors++
+				return nil
+			}
+			probe.Messages++
+			tallyProbedHeaders(counts, header)
+			return nil
+		})
+		if cancelErr != nil {
+			return finish(), cancelErr
+		}
+		if err != nil {
+			log.Printf("Internal error: %+v", err)
+			probe.Errors++
+		}
+
+		if progress != nil {
+			progress(i+1, len(files))
+		}
+	}
+	return finish(), nil
+}
+
+// tallyProbedHeaders adds one to counts[i] when header carries probeHeaders[i]
+func tallyProbedHeaders(counts []int, header mail.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, strings.ToLower(name))
+	}
+	for i, h := range probeHeaders {
+		want := strings.ToLower(h.name)
+		prefix, isPrefix := strings.CutSuffix(want, "*")
+		if slices.ContainsFunc(names, func(name string) bool {
+			return name == want || isPrefix && strings.HasPrefix(name, prefix)
+		}) {
+			counts[i]++
+		}
+	}
+}
+
+// readSCL parses only the headers of a message and returns its SCL (nil if absent)
+func (a *Analyzer) readSCL(data []byte) (*SCLResult, error) {
+	header, err := a.readHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	return a.extractSCL(header, nil), nil
+}
+
+// tallySCL adds a single SCL result to the band counts, banded by t
+func tallySCL(counts *SCLBandCounts, scl *SCLResult, t SCLThresholds) {
+	switch {
+	case scl == nil:
+		counts.NoSCL++
+	case scl.Score == -1:
+		counts.Skipped++
+	case scl.Score >= t.HighConfidence:
+		counts.HighConfidence++
+	case scl.Score >= t.Spam:
+		counts.Spam++
+	case scl.Score >= t.LowSpam:
+		counts.LowSpam++
+	default:
+		counts.NotSpam++
+	}
+}
+
+// outputCountsText outputs SCL band counts as aligned text
+func outputCountsText(w io.Writer, counts SCLBandCounts) {
+	fmt.Fprintf(w, "Messages:              %d\n", counts.Total)
+	fmt.Fprintf(w, "Skipped filtering:     %d\n", counts.Skipped)
+	fmt.Fprintf(w, "Not spam:              %d\n", counts.NotSpam)
+	fmt.Fprintf(w, "Low spam probability:  %d\n", counts.LowSpam)
+	fmt.Fprintf(w, "Spam:                  %d\n", counts.Spam)
+	fmt.Fprintf(w, "High confidence spam:  %d\n", counts.HighConfidence)
+	fmt.Fprintf(w, "No SCL header:         %d\n", counts.NoSCL)
+	fmt.Fprintf(w, "Errors:                %d\n", counts.Errors)
+}
+
+// outputProbeText outputs a -probe result as an aligned table
+func outputProbeText(w io.Writer, probe HeaderProbe) {
+	fmt.Fprintf(w, "Messages: %d\n", probe.Messages)
+	fmt.Fprintf(w, "Errors:   %d\n", probe.Errors)
+	fmt.Fprintln(w)
+	headerWidth, parserWidth := len("Header"), len("Parser")
+	for _, h := range probe.Headers {
+		headerWidth = max(headerWidth, len(h.Header))
+		parserWidth = max(parserWidth, len(h.Parser))
+	}
+	fmt.Fprintf(w, "%-*s  %-*s  %8s  %6s\n", headerWidth, "Header", parserWidth, "Parser", "Messages", "Share")
+	for _, h := range probe.Headers {
+		share := 0.0
+		if probe.Messages > 0 {
+			share = float64(h.Messages) * 100 / float64(probe.Messages)
+		}
+		fmt.Fprintf(w, "%-*s  %-*s  %8d  %5.1f%%\n", headerWidth, h.Header, parserWidth, h.Parser, h.Messages, share)
+	}
+}
+
+// outputProbeJSON outputs a -probe result as JSON
+func outputProbeJSON(w io.Writer, probe HeaderProbe) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(probe); err != nil {
+		return eris.Wrap(err, "failed to encode JSON")
+	}
+	return nil
+}
+
+// outputGroupsText outputs a -group-by summary as an aligned table
+func outputGroupsText(w io.Writer, summary GroupedSummary) {
+	width := len(summary.GroupBy)
+	for _, g := range summary.Groups {
+		width = max(width, len(g.Group))
+	}
+	fmt.Fprintf(w, "%-*s  %8s  %8s  %8s  %8s  %8s  %8s  %8s\n", width, summary.GroupBy,
+		"Messages", "Skipped", "Not spam", "Low spam", "Spam", "High", "No SCL")
+	for _, g := range summary.Groups {
+		c := g.Counts
+		fmt.Fprintf(w, "%-*s  %8d  %8d  %8d  %8d  %8d  %8d  %8d\n", width, g.Group,
+			c.Total, c.Skipped, c.NotSpam, c.LowSpam, c.Spam, c.HighConfidence, c.NoSCL)
+	}
+}
+
+// outputHistogram draws the SCL band counts as a bar chart fitting width
+// columns, bars scaled to the largest band. Block characters are used on a
+// terminal; plain '#' otherwise, so logs and pipes stay ASCII.
+func outputHistogram(w io.Writer, counts SCLBandCounts, width int, tty bool) {
+	bands := []struct {
+		label string
+		count int
+	}{
+		{"Skipped filtering", counts.Skipped},
+		{"Not spam", counts.NotSpam},
+		{"Low spam probability", counts.LowSpam},
+		{"Spam", counts.Spam},
+		{"High confidence spam", counts.HighConfidence},
+		{"No SCL header", counts.NoSCL},
+	}
+
+	largest := 0
+	for _, band := range bands {
+		largest = max(largest, band.count)
+	}
+	countWidth := len(strconv.Itoa(largest))
+	// Label column, two separating spaces and the count column
+	barWidth := max(width-20-2-1-countWidth, 10)
+	mark := "#"
+	if tty {
+		mark = "█"
+	}
+
+	for _, band := range bands {
+		bar := 0
+		if largest > 0 {
+			bar = band.count * barWidth / largest
+		}
+		// Any non-empty band gets at least one mark
+		if band.count > 0 && bar == 0 {
+			bar = 1
+		}
+		fmt.Fprintf(w, "%-20s  %s%s %*d\n", band.label, strings.Repeat(mark, bar), strings.Repeat(" ", barWidth-bar), countWidth, band.count)
+	}
+}
+
+// terminalWidth returns the width reported in COLUMNS, or 80
+func terminalWidth() int {
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+		return columns
+	}
+	return 80
+}
+
+// outputCountsJSON outputs SCL band counts as JSON
+func outputCountsJSON(w io.Writer, counts SCLBandCounts) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(counts); err != nil {
+		return eris.Wrap(err, "failed to encode JSON")
+	}
+	return nil
+}
+
+// writeOutput runs write against stdout, or against path when one is given.
+// File output is atomic: the report is written to a temporary file in the
+// destination directory and renamed into place only once it is complete, so
+// a failed run never leaves a partially written report behind. A replaced
+// file keeps its mode; a new one gets 0644. The output is gzipped when
+// compress is set or path ends in .gz.
+func writeOutput(path string, compress bool, write func(w io.Writer) error) error {
+	compress = compress || strings.EqualFold(filepath.Ext(path), ".gz")
+	if path == "" {
+		return writeCompressed(os.Stdout, compress, write)
+	}
+
+	dir := filepath.Dir(filepath.Clean(path))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return eris.Wrap(err, "failed to create output directory")
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return eris.Wrap(err, "failed to create temporary output file")
+	}
+	tmpName := tmp.Name()
+	// Remove the temp file on any failure; after a successful rename this is a no-op
+	defer func() { _ = os.Remove(tmpName) }()
+
+	// CreateTemp uses 0600; give the report the mode of the file it replaces,
+	// or the usual 0644 for a new file
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		_ = tmp.Close()
+		return eris.Wrap(err, "failed to set output file mode")
+	}
+
+	if err := writeCompressed(tmp, compress, write); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return eris.Wrap(err, "failed to sync output file")
+	}
+	if err := tmp.Close(); err != nil {
+		return eris.Wrap(err, "failed to close output file")
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return eris.Wrap(err, "failed to move output file into place")
+	}
+
+	return nil
+}
+
+// writeCompressed runs write against w, through a streaming gzip writer when
+// compress is set. The gzip stream is closed even when write fails, so
+// output cut short on stdout still ends in a valid gzip trailer.
+func writeCompressed(w io.Writer, compress bool, write func(w io.Writer) error) error {
+	if !compress {
+		return write(w)
+	}
+	zw := gzip.NewWriter(w)
+	err := write(zw)
+	if closeErr := zw.Close(); err == nil && closeErr != nil {
+		err = eris.Wrap(closeErr, "failed to finish compressed output")
+	}
+	return err
+}
+
+// startProfiling starts a pprof CPU profile written to cpuPath and opens
+// memPath for a heap profile; either may be empty. Both files are created up
+// front so a bad path fails before a long run rather than after it. The
+// returned stop function ends the CPU profile and writes the heap profile;
+// only its first call has any effect, so it can be both deferred and called
+// before os.Exit.
+func startProfiling(cpuPath, memPath string) (func(), error) {
+	var cpuFile, memFile *os.File
+	closeAll := func() {
+		for _, f := range []*os.File{cpuFile, memFile} {
+			if f != nil {
+				_ = f.Close()
+			}
+		}
+	}
+
+	var err error
+	if cpuPath != "" {
+		if cpuFile, err = os.Create(filepath.Clean(cpuPath)); err != nil {
+			return nil, eris.Wrap(err, "failed to create CPU profile")
+		}
+	}
+	if memPath != "" {
+		if memFile, err = os.Create(filepath.Clean(memPath)); err != nil {
+			closeAll()
+			return nil, eris.Wrap(err, "failed to create heap profile")
+		}
+	}
+	if cpuFile != nil {
+		if err := pprof.StartCPUProfile(cpuFile); err != nil {
+			closeAll()
+			return nil, eris.Wrap(err, "failed to start CPU profile")
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if cpuFile != nil {
+				pprof.StopCPUProfile()
+			}
+			if memFile != nil {
+				// Collect garbage first so the profile shows live memory
+				runtime.GC()
+				if err := pprof.WriteHeapProfile(memFile); err != nil {
+					log.Printf("Internal error: %+v", eris.Wrap(err, "failed to write heap profile"))
+					fmt.Fprintf(os.Stderr, "Warning: Failed to write the -memprofile heap profile.\n")
+				}
+			}
+			closeAll()
+		})
+	}, nil
+}
+
+// normalizeRawHeader prepares a bare header dump for parsing: leading blank
+// lines are dropped and an empty line is appended to end the header block
+func normalizeRawHeader(data []byte) []byte {
+	data = bytes.TrimLeft(data, "\r\n")
+	normalized := make([]byte, 0, len(data)+4)
+	normalized = append(normalized, data...)
+	return append(normalized, "\r\n\r\n"...)
+}
+
+// forEachMboxMessage splits an mbox stream on its "From " separator lines
+// and calls fn with each message (1-based index) and the byte offset of its
+// separator line. Body lines quoted as ">From " are unquoted. The stream is
+// read line by line, so only one message is held in memory at a time.
+func forEachMboxMessage(r io.Reader, fn func(index int, offset int64, data []byte) error) error {
+	br := bufio.NewReader(r)
+	var msg []byte
+	index := 0
+	var pos, offset int64
+	started := false
+	prevBlank := true
+
+	emit := func() error {
+		if !started {
+			return nil
+		}
+		index++
+		return fn(index, offset, msg)
+	}
+
+	for {
+		line, err := br.ReadBytes('\n')
+		lineStart := pos
+		pos += int64(len(line))
+		if len(line) > 0 {
+			blank := len(bytes.TrimSpace(line)) == 0
+			switch {
+			case prevBlank && bytes.HasPrefix(line, []byte("From ")):
+				if err := emit(); err != nil {
+					return err
+				}
+				msg = nil
+				offset = lineStart
+				started = true
+			case started:
+				if unquoted := bytes.TrimLeft(line, ">"); len(unquoted) < len(line) && bytes.HasPrefix(unquoted, []byte("From ")) {
+					line = line[1:]
+				}
+				msg = append(msg, line...)
+				if len(msg) > MaxFileSizeBytes {
+					return eris.Errorf("mbox message %d exceeds maximum allowed size of %d bytes", index+1, MaxFileSizeBytes)
+				}
+			case !blank:
+				return eris.New("malformed mbox: content before the first From line")
+			}
+			prevBlank = blank
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return eris.Wrap(err, "failed to read mbox")
+		}
+	}
+
+	if !started {
+		return eris.New("malformed mbox: no messages found")
+	}
+	return emit()
+}
+
+// forEachRecord splits a stream of header blocks on lines equal to separator
+// (ignoring the line ending and surrounding whitespace) and calls fn with
+// each record, prepared as by normalizeRawHeader, its 1-based index and the
+// byte offset of its first line. Records holding only whitespace, such as
+// the one before a leading separator, are skipped and not numbered.
+func forEachRecord(r io.Reader, separator string, fn func(index int, offset int64, data []byte) error) error {
+	br := bufio.NewReader(r)
+	separator = strings.TrimSpace(separator)
+	var record []byte
+	index := 0
+	var pos, offset int64
+
+	emit := func() error {
+		if len(bytes.TrimSpace(record)) == 0 {
+			return nil
+		}
+		index++
+		return fn(index, offset, normalizeRawHeader(record))
+	}
+
+	for {
+		line, err := br.ReadBytes('\n')
+		lineStart := pos
+		pos += int64(len(line))
+		if len(line) > 0 {
+			if string(bytes.TrimSpace(line)) == separator {
+				if err := emit(); err != nil {
+					return err
+				}
+				record = nil
+			} else {
+				if len(bytes.TrimSpace(record)) == 0 {
+					offset = lineStart
+				}
+				record = append(record, line...)
+				if len(record) > MaxFileSizeBytes {
+					return eris.Errorf("record %d exceeds maximum allowed size of %d bytes", index+1, MaxFileSizeBytes)
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return eris.Wrap(err, "failed to read records")
+		}
+	}
+
+	if err := emit(); err != nil {
+		return err
+	}
+	if index == 0 {
+		return eris.New("no records found")
+	}
+	return nil
+}
+
+// forEachMessage calls fn with the RFC822 content of each message in
+// filename: once (index 0, offset 0) for single-message formats, once per
+// message (1-based index, separator offset) for mbox, and once per record
+// (1-based index, record offset) for records. For a compressed mbox or
+// records file the offset is into the decompressed stream.
+func (a *Analyzer) forEachMessage(filename string, fn func(index int, offset int64, data []byte) error) error {
+	format, err := detectInputFormat(filename, a.InputFormat)
+	if err != nil {
+		return err
+	}
+
+	if format != "mbox" && format != "records" {
+		data, err := readEmailFileAs(filename, format, a.ZipPassword)
+		if err != nil {
+			return err
+		}
+		return fn(0, 0, data)
+	}
+
+	f, _, err := openEmailFile(filename)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	r, err := decompressMbox(f)
+	if err != nil {
+		return err
+	}
+	if format == "records" {
+		return forEachRecord(r, a.RecordSeparator, fn)
+	}
+	return forEachMboxMessage(r, fn)
+}
+
+// decompressMbox returns the mbox content of r, transparently decompressing
+// gzip or bzip2 detected by magic bytes. Decompression streams; the
+// decompressed size is capped at MaxDecompressedMbox.
+func decompressMbox(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(3)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, eris.Wrap(err, "failed to create gzip reader")
+		}
+		return &cappedReader{r: gz, remaining: MaxDecompressedMbox}, nil
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return &cappedReader{r: bzip2.NewReader(br), remaining: MaxDecompressedMbox}, nil
+	default:
+		return br, nil
+	}
+}
+
+// cappedReader fails once more than remaining bytes are read. Unlike
+// io.LimitReader it never truncates silently, so a decompression bomb
+// cannot pass off its first part as a complete mailbox.
+type cappedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	// Read one byte past the cap so reaching it exactly is not an error
+	if int64(len(p)) > c.remaining+1 {
+		p = p[:c.remaining+1]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if c.remaining < 0 {
+		return 0, eris.Errorf("decompressed mbox exceeds maximum allowed size of %d bytes", MaxDecompressedMbox)
+	}
+	return n, err
+}
+
+// extractEmailFromEmlx strips Apple Mail .emlx framing: a first line holding
+// the message length in bytes, the message itself, then an XML property list
+func extractEmailFromEmlx(data []byte) ([]byte, error) {
+	newline := bytes.IndexByte(data, '\n')
+	if newline == -1 {
+		return nil, eris.New("malformed emlx: missing length line")
+	}
+
+	length, err := strconv.Atoi(strings.TrimSpace(string(data[:newline])))
+	if err != nil {
+		return nil, eris.Wrap(err, "malformed emlx: invalid length line")
+	}
+
+	body := data[newline+1:]
+	if length <= 0 || length > len(body) {
+		return nil, eris.Errorf("malformed emlx: declared length %d does not fit %d bytes of content", length, len(body))
+	}
+
+	// Whatever follows the message must be the plist (or nothing)
+	trailer := bytes.TrimSpace(body[length:])
+	if len(trailer) > 0 && !bytes.HasPrefix(trailer, []byte("<?xml")) && !bytes.HasPrefix(trailer, []byte("<plist")) {
+		return nil, eris.New("malformed emlx: content after the message is not a property list")
+	}
+
+	return body[:length], nil
+}
+
+// AnalyzeFile parses a .msg, .eml or .emlx file and analyzes its headers
+func (a *Analyzer) AnalyzeFile(filename string) (*EmailSecurityReport, error) {
+	return a.AnalyzeFileContext(context.Background(), filename)
+}
+
+// AnalyzeFileContext is AnalyzeFile with a context, handled as by
+// AnalyzeMessageContext
+func (a *Analyzer) AnalyzeFileContext(ctx context.Context, filename string) (*EmailSecurityReport, error) {
+	format, err := detectInputFormat(filename, a.InputFormat)
+	if err != nil {
+		return nil, err
+	}
+	emailData, err := readEmailFileAs(filename, format, a.ZipPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the email
+	return a.analyzeData(ctx, emailData)
+}
+
+// inputFormats lists the parsers selectable with -input-format
+var inputFormats = []string{"eml", "emlx", "msg", "mbox", "zip", "raw-header", "json-headers", "graph-json", "records"}
+
+// isJSONInputFormat reports whether format reads headers from JSON
+// (json-headers, graph-json) rather than an RFC822 message. Such input has no
+// body, and its shape errors are safe to show.
+func isJSONInputFormat(format string) bool {
+	return format == "json-headers" || format == "graph-json"
+}
+
+// inputFormatsByExt maps file extensions to the parser used when no format
+// is forced
+var inputFormatsByExt = map[string]string{
+	".eml":  "eml",
+	".emlx": "emlx",
+	".msg":  "msg",
+	".mbox": "mbox",
+	".zip":  "zip",
+}
+
+// compressedMboxSuffixes name compressed mailboxes. The compression itself
+// is detected from the content, so any mbox may be compressed.
+var compressedMboxSuffixes = []string{".mbox.gz", ".mbox.bz2"}
+
+// detectInputFormat returns forced when set, otherwise the format implied by
+// the file extension
+func detectInputFormat(filename, forced string) (string, error) {
+	if forced != "" {
+		for _, f := range inputFormats {
+			if f == forced {
+				return forced, nil
+			}
+		}
+		return "", eris.Errorf("unknown input format %q (valid: %s)", forced, strings.Join(inputFormats, ", "))
+	}
+
+	lower := strings.ToLower(filename)
+	for _, suffix := range compressedMboxSuffixes {
+		if strings.HasSuffix(lower, suffix) {
+			return "mbox", nil
+		}
+	}
+	format, ok := inputFormatsByExt[filepath.Ext(lower)]
+	if !ok {
+		return "", eris.New("file must have .msg, .eml, .emlx, .mbox, .mbox.gz, .mbox.bz2 or .zip extension")
+	}
+	return format, nil
+}
+
+// readEmailFile validates a .msg, .eml or .emlx file and returns its RFC822 content
+func readEmailFile(filename string) ([]byte, error) {
+	format, err := detectInputFormat(filename, "")
+	if err != nil {
+		return nil, err
+	}
+	return readEmailFileAs(filename, format, "")
+}
+
+// openEmailFile validates the path and opens it, refusing anything that is
+// not a regular file
+func openEmailFile(filename string) (*os.File, os.FileInfo, error) {
+	// Clean path and prevent traversal
+	cleanPath := filepath.Clean(filename)
+
+	// Check if path contains traversal attempts
+	if strings.Contains(filename, "..") {
+		return nil, nil, eris.New("path traversal detected")
+	}
+
+	// Get absolute path
+	absPath, err := filepath.Abs(cleanPath)
+	if err != nil {
+		return nil, nil, eris.Wrap(err, "invalid file path")
+	}
+
+	// Open the .msg file
+	f, err := os.Open(absPath)
+	if err != nil {
+		return nil, nil, eris.Wrap(err, "failed to open MSG file")
+	}
+
+	// Get file info for size
+	stat, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, eris.Wrap(err, "failed to stat MSG file")
+	}
+
+	// Verify it's a regular file
+	if !stat.Mode().IsRegular() {
+		_ = f.Close()
+		return nil, nil, eris.New("not a regular file")
+	}
+
+	return f, stat, nil
+}
+
+// readEmailFileAs reads a single-message file with the given parser and
+// returns its RFC822 content. The extension is not checked, so a forced
+// format can read any file. zipPassword decrypts encrypted zip entries.
+func readEmailFileAs(filename, format, zipPassword string) ([]byte, error) {
+	if format == "mbox" || format == "records" {
+		return nil, eris.Errorf("%s input holds multiple messages; analyze it as a batch", format)
+	}
+
+	f, stat, err := openEmailFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	// Validate file size before processing
+	if stat.Size() > MaxFileSizeBytes {
+		return nil, eris.Errorf("file size %d exceeds maximum allowed size of %d bytes (50MB)",
+			stat.Size(), MaxFileSizeBytes)
+	}
+	if stat.Size() < 0 {
+		return nil, eris.New("invalid negative file size")
+	}
+
+	var emailData []byte
+
+	// EML files are already RFC822 format - read directly
+	// MSG files need extraction from binary format
+	if isJSONInputFormat(format) {
+		// Decoded later by readHeader; no RFC822 reserialization
+		limitReader := io.LimitReader(f, MaxFileSizeBytes)
+		emailData, err = io.ReadAll(limitReader)
+		if err != nil {
+			return nil, eris.Wrap(err, "failed to read JSON header file")
+		}
+	} else if format == "raw-header" {
+		// A bare header block: terminate it so it parses as a message
+		limitReader := io.LimitReader(f, MaxFileSizeBytes)
+		raw, err := io.ReadAll(limitReader)
+		if err != nil {
+			return nil, eris.Wrap(err, "failed to read header file")
+		}
+		emailData = normalizeRawHeader(raw)
+	} else if format == "eml" {
+		// Read EML file directly (already RFC822 format)
+		limitReader := io.LimitReader(f, MaxFileSizeBytes)
+		emailData, err = io.ReadAll(limitReader)
+		if err != nil {
+			return nil, eris.Wrap(err, "failed to read EML file")
+		}
+	} else if format == "emlx" {
+		// EMLX files wrap the RFC822 message in Apple Mail framing
+		limitReader := io.LimitReader(f, MaxFileSizeBytes)
+		raw, err := io.ReadAll(limitReader)
+		if err != nil {
+			return nil, eris.Wrap(err, "failed to read EMLX file")
+		}
+		emailData, err = extractEmailFromEmlx(raw)
+		if err != nil {
+			return nil, eris.Wrap(err, "failed to extract email from EMLX file")
+		}
+	} else if format == "zip" {
+		// An archive holding the message, e.g. a quarantined sample
+		zr, err := zip.NewReader(f, stat.Size())
+		if err != nil {
+			return nil, eris.Wrap(err, "failed to open ZIP archive")
+		}
+		emailData, err = extractEmailFromZip(zr, zipPassword)
+		if err != nil {
+			return nil, err
+		}
+		if emailData == nil {
+			return nil, eris.New("no email message found in ZIP archive")
+		}
+	} else {
+		// MSG file processing - verify format and extract
+		// Verify file magic bytes for OLE/CFBF or ZIP format
+		magic := make([]byte, 8)
+		if _, err := f.Read(magic); err != nil {
+			return nil, eris.Wrap(err, "failed to read file header")
+		}
+
+		// Check for CFBF signature (D0 CF 11 E0 A1 B1 1A E1)
 		// or ZIP signature (50 4B 03 04 or 50 4B 05 06)
 		isCFBF := len(magic) >= 8 && bytes.Equal(magic, []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1})
 		isZIP := len(magic) >= 2 && magic[0] == 0x50 && magic[1] == 0x4B
 
-		if !isCFBF && !isZIP {
-			return nil, eris.New("file is not a valid .msg format (invalid file signature)")
+		if !isCFBF && !isZIP {
+			return nil, eris.New("file is not a valid .msg format (invalid file signature)")
+		}
+
+		// Seek back to start
+		if _, err := f.Seek(0, 0); err != nil {
+			return nil, eris.Wrap(err, "failed to seek file")
+		}
+
+		// Try to extract email content from MSG file
+		// MSG files are OLE/CFBF format, but we'll try a simpler approach first
+		// by looking for embedded RFC822 message
+		emailData, err = extractEmailFromMsg(f, stat.Size(), zipPassword)
+		if err != nil {
+			return nil, eris.Wrap(err, "failed to extract email from MSG file")
+		}
+	}
+
+	return emailData, nil
+}
+
+// extractEmailFromMsg attempts to extract RFC822 email data from .msg file
+// .msg files can contain the email in various formats, we'll try common approaches
+func extractEmailFromMsg(r io.ReaderAt, size int64, zipPassword string) ([]byte, error) {
+	// Strategy 1: Try to open as a ZIP file (some .msg files are ZIP-based)
+	if zr, err := zip.NewReader(r, size); err == nil {
+		data, err := extractEmailFromZip(zr, zipPassword)
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			return data, nil
+		}
+	}
+
+	// Strategy 2: Read the entire file and search for embedded RFC822 headers
+	// This is a fallback that works for some MSG formats
+	data := make([]byte, size)
+	n, err := r.ReadAt(data, 0)
+	if err != nil && err != io.EOF {
+		return nil, eris.Wrap(err, "failed to read MSG file")
+	}
+	data = data[:n]
+
+	// Look for RFC822 email headers in the binary data
+	// MSG files often contain the internet headers as a property
+	emailContent := extractRFC822FromBinary(data)
+	if emailContent != nil {
+		return emailContent, nil
+	}
+
+	// Strategy 3: Try to find MIME headers directly
+	// Some MSG files have embedded EML content
+	if idx := bytes.Index(data, []byte("Return-Path:")); idx != -1 {
+		return data[idx:], nil
+	}
+	if idx := bytes.Index(data, []byte("Received:")); idx != -1 {
+		return data[idx:], nil
+	}
+	if idx := bytes.Index(data, []byte("From:")); idx != -1 && idx < 1000 {
+		return data[idx:], nil
+	}
+
+	return nil, eris.New("could not find RFC822 email headers in MSG file")
+}
+
+// extractEmailFromZip returns the first entry of zr that holds a message,
+// or nil if none does. Encrypted entries (ZipCrypto or AES) are decrypted
+// with password; a missing or wrong password is an error rather than a
+// skipped entry, so an encrypted sample never yields garbage.
+func extractEmailFromZip(zr *zip.Reader, password string) ([]byte, error) {
+	// Check number of files in ZIP to prevent zip bombs
+	if len(zr.File) > MaxZipFiles {
+		return nil, eris.Errorf("zip contains too many files: %d (max %d)", len(zr.File), MaxZipFiles)
+	}
+
+	// Look for email content in the ZIP
+	for _, f := range zr.File {
+		// Check compression ratio to detect zip bombs
+		if f.UncompressedSize64 > 0 && f.CompressedSize64 > 0 {
+			ratio := f.UncompressedSize64 / f.CompressedSize64
+			if ratio > MaxCompressionRatio {
+				return nil, eris.Errorf("suspicious compression ratio detected: %d:1 (max %d:1)",
+					ratio, MaxCompressionRatio)
+			}
+		}
+
+		// Check uncompressed size
+		if f.UncompressedSize64 > MaxUncompressedSize {
+			return nil, eris.Errorf("uncompressed file too large: %d bytes (max %d)",
+				f.UncompressedSize64, MaxUncompressedSize)
+		}
+
+		// Common locations for email content in ZIP-based MSG
+		if !strings.Contains(strings.ToLower(f.Name), "message") &&
+			!strings.HasSuffix(strings.ToLower(f.Name), ".eml") {
+			continue
+		}
+
+		if f.IsEncrypted() {
+			if password == "" {
+				return nil, eris.Errorf("zip entry %s is encrypted; pass -zip-password", sanitizeHeader(f.Name))
+			}
+			f.SetPassword(password)
+		}
+
+		rc, err := f.Open()
+		if err == nil {
+			// Use anonymous function for proper defer scoping
+			var data []byte
+			data, err = func() ([]byte, error) {
+				defer func() { _ = rc.Close() }()
+				// Limit read size to prevent excessive memory use
+				limitReader := io.LimitReader(rc, MaxUncompressedSize)
+				return io.ReadAll(limitReader)
+			}()
+			// Check if it looks like an email
+			if err == nil && bytes.Contains(data, []byte("From:")) && bytes.Contains(data, []byte("Subject:")) {
+				return data, nil
+			}
+		}
+		// A wrong password surfaces as a verification, authentication,
+		// decompression or checksum error depending on the scheme
+		if err != nil && f.IsEncrypted() {
+			return nil, eris.Wrapf(err, "wrong zip password for entry %s", sanitizeHeader(f.Name))
+		}
+	}
+
+	return nil, nil
+}
+
+// describeZipPasswordError returns a user-facing explanation when err is a
+// missing or wrong -zip-password, or "" for any other error
+func describeZipPasswordError(err error) string {
+	errStr := err.Error()
+	switch {
+	case strings.Contains(errStr, "wrong zip password"):
+		return "Wrong -zip-password for the encrypted archive."
+	case strings.Contains(errStr, "is encrypted; pass -zip-password"):
+		return "The archive is encrypted; pass its password with -zip-password."
+	default:
+		return ""
+	}
+}
+
+// describeStrictMIMEError returns a user-facing explanation when err is a
+// -strict-mime rejection, or "" for any other error. The cause names the
+// broken part, which is safe to show.
+func describeStrictMIMEError(err error) string {
+	errStr := err.Error()
+	if !strings.HasPrefix(errStr, "malformed MIME: ") {
+		return ""
+	}
+	return "Malformed MIME (-strict-mime): " + sanitizeHeader(strings.TrimPrefix(errStr, "malformed MIME: ")) + "."
+}
+
+// extractRFC822FromBinary searches for RFC822 email content in binary MSG data
+func extractRFC822FromBinary(data []byte) []byte {
+	// .msg files store the Internet Headers in a specific property
+	// We'll search for the start of email headers and extract them
+
+	// Strategy 1: Look for "Received:" which is typically the first header in transport messages
+	receivedIdx := bytes.Index(data, []byte("Received:"))
+	if receivedIdx != -1 && receivedIdx < 200000 {
+		// Found it! Now let's extract from here to the end of headers
+		// Headers end with a blank line (double newline)
+		start := receivedIdx
+
+		// Try to find where headers end
+		// Look for double newline patterns
+		end := len(data)
+		searchStart := start
+		iterations := 0
+		// Use MaxHeaderSearchBytes to prevent excessive searching
+		for searchStart < len(data)-4 && (searchStart-start) < MaxHeaderSearchBytes {
+			// Add iteration counter to prevent infinite loops
+			if iterations >= MaxHeaderSearchBytes {
+				break
+			}
+			iterations++
+
+			// Check for various double-newline patterns
+			if searchStart+3 < len(data) &&
+				data[searchStart] == '\r' && data[searchStart+1] == '\n' &&
+				data[searchStart+2] == '\r' && data[searchStart+3] == '\n' {
+				end = searchStart + 4
+				break
+			}
+			if searchStart+1 < len(data) &&
+				data[searchStart] == '\n' && data[searchStart+1] == '\n' {
+				end = searchStart + 2
+				break
+			}
+			searchStart++
+		}
+
+		headerData := data[start:min(end, len(data))]
+
+		// Clean up the extracted headers - remove null bytes and invalid characters
+		cleanedHeaders := bytes.ReplaceAll(headerData, []byte{0}, []byte{})
+
+		// Verify we have valid headers
+		if bytes.Contains(cleanedHeaders, []byte("From:")) ||
+			bytes.Contains(cleanedHeaders, []byte("Subject:")) {
+			return cleanedHeaders
+		}
+	}
+
+	// Strategy 2: Look for "Return-Path:" which can be at the start
+	returnPathIdx := bytes.Index(data, []byte("Return-Path:"))
+	if returnPathIdx != -1 && returnPathIdx < 200000 {
+		start := returnPathIdx
+		end := len(data)
+		searchStart := start
+		iterations := 0
+
+		for searchStart < len(data)-4 && (searchStart-start) < MaxHeaderSearchBytes {
+			if iterations >= MaxHeaderSearchBytes {
+				break
+			}
+			iterations++
+
+			if searchStart+3 < len(data) &&
+				data[searchStart] == '\r' && data[searchStart+1] == '\n' &&
+				data[searchStart+2] == '\r' && data[searchStart+3] == '\n' {
+				end = searchStart + 4
+				break
+			}
+			if searchStart+1 < len(data) &&
+				data[searchStart] == '\n' && data[searchStart+1] == '\n' {
+				end = searchStart + 2
+				break
+			}
+			searchStart++
+		}
+
+		headerData := data[start:min(end, len(data))]
+		cleanedHeaders := bytes.ReplaceAll(headerData, []byte{0}, []byte{})
+
+		if bytes.Contains(cleanedHeaders, []byte("From:")) ||
+			bytes.Contains(cleanedHeaders, []byte("Subject:")) {
+			return cleanedHeaders
+		}
+	}
+
+	// Strategy 3: Look for "Authentication-Results:" which contains security info
+	authResultsIdx := bytes.Index(data, []byte("Authentication-Results:"))
+	if authResultsIdx != -1 && authResultsIdx < 200000 {
+		// Found auth results, try to extract surrounding headers
+		// Walk backwards to find the start of headers
+		start := authResultsIdx
+		for start > 0 && start > authResultsIdx-10000 {
+			// Look for "Received:" which is typically first
+			if start >= 9 && bytes.Equal(data[start-9:start], []byte("Received:")) {
+				start = start - 9
+				break
+			}
+			if start >= 12 && bytes.Equal(data[start-12:start], []byte("Return-Path:")) {
+				start = start - 12
+				break
+			}
+			start--
+		}
+
+		// Find end of headers
+		end := len(data)
+		searchStart := authResultsIdx
+		iterations := 0
+
+		for searchStart < len(data)-4 && (searchStart-start) < MaxHeaderSearchBytes {
+			if iterations >= MaxHeaderSearchBytes {
+				break
+			}
+			iterations++
+
+			if searchStart+3 < len(data) &&
+				data[searchStart] == '\r' && data[searchStart+1] == '\n' &&
+				data[searchStart+2] == '\r' && data[searchStart+3] == '\n' {
+				end = searchStart + 4
+				break
+			}
+			if searchStart+1 < len(data) &&
+				data[searchStart] == '\n' && data[searchStart+1] == '\n' {
+				end = searchStart + 2
+				break
+			}
+			searchStart++
+		}
+
+		headerData := data[start:min(end, len(data))]
+		cleanedHeaders := bytes.ReplaceAll(headerData, []byte{0}, []byte{})
+
+		if bytes.Contains(cleanedHeaders, []byte("From:")) ||
+			bytes.Contains(cleanedHeaders, []byte("Authentication-Results:")) {
+			return cleanedHeaders
+		}
+	}
+
+	return nil
+}
+
+// stripControlChars removes CR/LF (preventing header injection) and every
+// other control character except tab, and replaces invalid UTF-8 (e.g. raw
+// Latin-1 bytes) with U+FFFD so the result is always safe to JSON-encode.
+// Length is not limited.
+func stripControlChars(value string) string {
+	value = strings.ToValidUTF8(value, "\uFFFD")
+
+	// Remove all CR/LF characters to prevent header injection
+	value = strings.ReplaceAll(value, "\r", "")
+	value = strings.ReplaceAll(value, "\n", "")
+
+	// Remove control characters except tab
+	return strings.Map(func(r rune) rune {
+		if r < 32 && r != '\t' {
+			return -1
+		}
+		return r
+	}, value)
+}
+
+// sanitizeHeader removes control characters and prevents header injection
+func sanitizeHeader(value string) string {
+	value = stripControlChars(value)
+
+	// Limit length to prevent buffer issues, without splitting a character
+	value = truncate(value, MaxHeaderLength)
+
+	return strings.TrimSpace(value)
+}
+
+// parseEmail parses RFC822 email data and extracts security headers
+func parseEmail(data []byte, includeRawHeaders bool) (*EmailSecurityReport, error) {
+	a := *defaultAnalyzer
+	a.IncludeRawHeaders = includeRawHeaders
+	return a.AnalyzeMessage(data)
+}
+
+// AnalyzeMessage parses RFC822 email data and analyzes its headers (and its
+// attachments when Deep is set)
+func (a *Analyzer) AnalyzeMessage(data []byte) (*EmailSecurityReport, error) {
+	return a.AnalyzeMessageContext(context.Background(), data)
+}
+
+// AnalyzeMessageContext is AnalyzeMessage with a context for AnalyzeContext.
+// Once ctx is done the report may be incomplete, so ctx.Err() is returned
+// instead.
+func (a *Analyzer) AnalyzeMessageContext(ctx context.Context, data []byte) (*EmailSecurityReport, error) {
+	start := time.Now()
+	header, err := parseRFC822Header(data)
+	if err != nil {
+		return nil, err
+	}
+	report := a.AnalyzeContext(ctx, header)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := a.analyzeBody(data, report); err != nil {
+		return nil, err
+	}
+	a.recordDuration(report, start)
+	return report, nil
+}
+
+// AnalyzeReader parses an RFC822 message from any stream (a network
+// connection, a decompressor) and analyzes its headers. Only the header block
+// is consumed, plus whatever read-ahead buffering pulls in, unless Deep is
+// set, in which case the body is read for attachments. At most
+// MaxFileSizeBytes are read.
+func (a *Analyzer) AnalyzeReader(r io.Reader) (*EmailSecurityReport, error) {
+	start := time.Now()
+	msg, err := mail.ReadMessage(io.LimitReader(r, MaxFileSizeBytes))
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to parse email message")
+	}
+	report := a.Analyze(msg.Header)
+	if a.Deep {
+		if err := a.addAttachments(report, msg, nil); err != nil {
+			return nil, err
+		}
+	}
+	a.recordDuration(report, start)
+	return report, nil
+}
+
+// AnalyzeParts analyzes a message whose headers and body are already
+// separated, without rebuilding an RFC822 message. body is read only when
+// Deep is set, to list attachments, and may be nil otherwise. With
+// StrictMIME, a malformed body is an error; otherwise the error is always
+// nil.
+func (a *Analyzer) AnalyzeParts(header mail.Header, body io.Reader) (*EmailSecurityReport, error) {
+	start := time.Now()
+	report := a.Analyze(header)
+	if a.Deep {
+		if body == nil {
+			body = strings.NewReader("")
+		}
+		msg := &mail.Message{Header: header, Body: io.LimitReader(body, MaxFileSizeBytes)}
+		if err := a.addAttachments(report, msg, nil); err != nil {
+			return nil, err
+		}
+	}
+	a.recordDuration(report, start)
+	return report, nil
+}
+
+// analyzeBody lists the attachments of RFC822 data when Deep is set. The
+// error is non-nil only with StrictMIME (see addAttachments).
+func (a *Analyzer) analyzeBody(data []byte, report *EmailSecurityReport) error {
+	if !a.Deep {
+		return nil
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	return a.addAttachments(report, msg, err)
+}
+
+// addAttachments records the attachments of msg, or readErr if the message
+// could not be read. By default a body that cannot be parsed is logged and
+// leaves the header analysis intact; with StrictMIME it is returned as a
+// "malformed MIME" error and the message fails.
+func (a *Analyzer) addAttachments(report *EmailSecurityReport, msg *mail.Message, readErr error) error {
+	err := readErr
+	if err == nil {
+		report.Attachments, err = parseAttachments(msg.Header, msg.Body, a.StrictMIME)
+	}
+	if err != nil && a.StrictMIME {
+		return eris.Wrap(err, "malformed MIME")
+	}
+	if err != nil {
+		log.Printf("Warning: could not read MIME body: %v", err)
+	}
+	if a.Diagnostics {
+		run := ParserRun{Parser: "attachments", Matched: len(report.Attachments) > 0}
+		if err != nil {
+			run.Error = sanitizeHeader(err.Error())
+		}
+		report.Diagnostics = append(report.Diagnostics, run)
+	}
+	return nil
+}
+
+// AnalyzeHeaderJSON analyzes headers already extracted into a JSON object
+// (see parseHeaderJSON), without rebuilding an RFC822 message
+func (a *Analyzer) AnalyzeHeaderJSON(data []byte) (*EmailSecurityReport, error) {
+	start := time.Now()
+	header, err := parseHeaderJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	report := a.Analyze(header)
+	a.recordDuration(report, start)
+	return report, nil
+}
+
+// AnalyzeGraphMessage analyzes a message exported from Microsoft Graph (see
+// parseGraphMessage), without rebuilding an RFC822 message
+func (a *Analyzer) AnalyzeGraphMessage(data []byte) (*EmailSecurityReport, error) {
+	start := time.Now()
+	header, err := parseGraphMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	report := a.Analyze(header)
+	a.recordDuration(report, start)
+	return report, nil
+}
+
+// analyzeData analyzes one message read from a file in the analyzer's input
+// format. ctx is passed to AnalyzeContext for its enrichment lookups; once
+// ctx is done the report may be incomplete, so ctx.Err() is returned instead.
+func (a *Analyzer) analyzeData(ctx context.Context, data []byte) (*EmailSecurityReport, error) {
+	start := time.Now()
+	header, err := a.readHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	return a.analyzeHeader(ctx, start, header, data)
+}
+
+// analyzeHeader is analyzeData for a message whose header was already read
+// from data; start is when reading began, for the processing duration
+func (a *Analyzer) analyzeHeader(ctx context.Context, start time.Time, header mail.Header, data []byte) (*EmailSecurityReport, error) {
+	report := a.AnalyzeContext(ctx, header)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !isJSONInputFormat(a.InputFormat) {
+		if err := a.analyzeBody(data, report); err != nil {
+			return nil, err
+		}
+	}
+	a.recordDuration(report, start)
+	return report, nil
+}
+
+// waitLookup blocks until the shared Limiter allows one more enrichment
+// lookup. Lookups queue up rather than being dropped; it returns early with
+// ctx's error when ctx ends first.
+func (a *Analyzer) waitLookup(ctx context.Context) error {
+	if a.Limiter == nil {
+		return ctx.Err()
+	}
+	return a.Limiter.Wait(ctx)
+}
+
+// describeLookupLimit renders limiter's effective rate for -v
+func describeLookupLimit(limiter *rate.Limiter) string {
+	if limiter == nil || limiter.Limit() == rate.Inf {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%g queries/second", float64(limiter.Limit()))
+}
+
+// recordDuration sets the report's ProcessingDuration to the time since
+// start when Diagnostics is set. Entry points that parse or read the body
+// call it again after AnalyzeContext so the duration covers that work too.
+func (a *Analyzer) recordDuration(report *EmailSecurityReport, start time.Time) {
+	if a.Diagnostics {
+		report.ProcessingDuration = time.Since(start)
+	}
+}
+
+// readHeader parses the headers of one message read from a file: a JSON
+// header object for the json-headers format, a Graph message for graph-json,
+// RFC822 otherwise
+func (a *Analyzer) readHeader(data []byte) (mail.Header, error) {
+	switch a.InputFormat {
+	case "json-headers":
+		return parseHeaderJSON(data)
+	case "graph-json":
+		return parseGraphMessage(data)
+	}
+	return parseRFC822Header(data)
+}
+
+// canonicalHeader returns header with every name in canonical MIME form
+// ("x-forefront-antispam-report" becomes "X-Forefront-Antispam-Report"), so
+// Get and direct lookups find headers built by hand with any casing. Values
+// of names that differ only in case are merged in sorted-name order. A header
+// that is already canonical is returned unchanged.
+func canonicalHeader(header mail.Header) mail.Header {
+	canonical := true
+	for name := range header {
+		if textproto.CanonicalMIMEHeaderKey(name) != name {
+			canonical = false
+			break
+		}
+	}
+	if canonical {
+		return header
+	}
+
+	normalized := make(mail.Header, len(header))
+	for _, name := range sortedKeys(header) {
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		normalized[key] = append(normalized[key], header[name]...)
+	}
+	return normalized
+}
+
+// parseRFC822Header parses the header block of RFC822 data, retrying once
+// on cleaned-up data
+func parseRFC822Header(data []byte) (mail.Header, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		// Try to clean up the data and parse again
+		cleanData := cleanEmailData(data)
+		msg, err = mail.ReadMessage(bytes.NewReader(cleanData))
+		if err != nil {
+			return nil, eris.Wrap(err, "failed to parse email message")
+		}
+	}
+	return msg.Header, nil
+}
+
+// ParseHeaderBlock parses a raw header block ("Name: value" lines) into a
+// mail.Header with canonical names, for callers and tests that start from
+// header text. Folded continuation lines are unfolded and repeated headers
+// keep every value in order. The trailing blank line is optional; anything
+// after a blank line is ignored.
+func ParseHeaderBlock(raw string) (mail.Header, error) {
+	raw = strings.TrimLeft(raw, "\r\n")
+	if raw == "" {
+		return nil, eris.New("header block is empty")
+	}
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(raw + "\r\n\r\n")))
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to parse header block")
+	}
+	return mail.Header(header), nil
+}
+
+// parseHeaderJSON converts a JSON object of header names to value arrays,
+// e.g. {"X-Forefront-Antispam-Report": ["CIP:...;SCL:1;"]}, into a
+// mail.Header. Names are canonicalized, so keys differing only in case are
+// merged in document order. Anything but an object of string arrays is
+// rejected.
+func parseHeaderJSON(data []byte) (mail.Header, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, eris.Wrap(err, "header JSON must be an object mapping header names to arrays of strings")
+	}
+	if len(raw) == 0 {
+		return nil, eris.New("header JSON contains no headers")
+	}
+
+	// Validate in sorted order so the reported error is deterministic
+	header := make(mail.Header, len(raw))
+	for _, name := range sortedKeys(raw) {
+		value := raw[name]
+		if strings.TrimSpace(name) == "" || strings.ContainsAny(name, ": \t\r\n") {
+			return nil, eris.Errorf("invalid header name %q", name)
+		}
+		var values []string
+		if err := json.Unmarshal(value, &values); err != nil {
+			return nil, eris.Errorf("header %q must be an array of strings", name)
+		}
+		header[name] = values
+	}
+	return canonicalHeader(header), nil
+}
+
+// graphMessageHeader is one entry of a Microsoft Graph message's
+// internetMessageHeaders array
+type graphMessageHeader struct {
+	Name  *string `json:"name"`
+	Value *string `json:"value"`
+}
+
+// parseGraphMessage builds a mail.Header from a message as Microsoft Graph
+// returns it, e.g. {"internetMessageHeaders": [{"name": "From", "value":
+// "a@example.com"}], ...}. Only internetMessageHeaders is read; the other
+// message properties are ignored. Keys match case-insensitively, so
+// PowerShell's PascalCase export works too. Header names are canonicalized
+// and repeated names keep every value in array order. A message without the
+// array (it is only returned when $select-ed) has no headers and yields an
+// empty header; any other shape is rejected with an error naming the
+// offending entry.
+func parseGraphMessage(data []byte) (mail.Header, error) {
+	var message struct {
+		InternetMessageHeaders json.RawMessage `json:"internetMessageHeaders"`
+	}
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil, eris.Wrap(err, "Graph message JSON must be an object")
+	}
+	header := make(mail.Header)
+	if len(message.InternetMessageHeaders) == 0 || string(message.InternetMessageHeaders) == "null" {
+		return header, nil
+	}
+
+	var entries []json.RawMessage
+	if err := json.Unmarshal(message.InternetMessageHeaders, &entries); err != nil {
+		return nil, eris.New("internetMessageHeaders must be an array of {name, value} objects")
+	}
+	for i, raw := range entries {
+		var entry graphMessageHeader
+		if err := json.Unmarshal(raw, &entry); err != nil || entry.Name == nil || entry.Value == nil {
+			return nil, eris.Errorf("internetMessageHeaders[%d] must be an object with string name and value", i)
+		}
+		name := *entry.Name
+		if strings.TrimSpace(name) == "" || strings.ContainsAny(name, ": \t\r\n") {
+			return nil, eris.Errorf("internetMessageHeaders[%d] has an invalid header name %q", i, name)
+		}
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		header[key] = append(header[key], *entry.Value)
+	}
+	return header, nil
+}
+
+// Analyze extracts security information from parsed message headers. Header
+// names need not be canonical (see canonicalHeader).
+func (a *Analyzer) Analyze(header mail.Header) *EmailSecurityReport {
+	return a.AnalyzeContext(context.Background(), header)
+}
+
+// AnalyzeContext is Analyze with a context. Canceling ctx cancels the
+// enrichment lookups still waiting or in flight (see ReputationLookup); when
+// Tracer is set, ctx also parents the analysis span. The CLI passes its run
+// context, bounded by -timeout, through AnalyzeFiles, AnalyzeFileContext and
+// AnalyzeMessageContext.
+func (a *Analyzer) AnalyzeContext(ctx context.Context, header mail.Header) *EmailSecurityReport {
+	start := time.Now()
+	ctx, span := a.startSpan(ctx, "email.Analyze")
+	defer span.End()
+
+	header = canonicalHeader(header)
+	var diag *parserLog
+	if a.Diagnostics {
+		diag = &parserLog{}
+	}
+	report := &EmailSecurityReport{
+		From:      sanitizeHeader(header.Get("From")),
+		To:        sanitizeHeader(header.Get("To")),
+		Subject:   sanitizeHeader(header.Get("Subject")),
+		Date:      sanitizeHeader(header.Get("Date")),
+		MessageID: sanitizeHeader(header.Get("Message-ID")),
+	}
+
+	if a.IncludeRawHeaders {
+		report.RawHeaders = make(map[string][]string)
+		for k, v := range header {
+			report.RawHeaders[k] = v
+		}
+	}
+
+	// Extract SPF results
+	report.SPFResults = extractSPFResults(header, diag)
+	report.ReceivedSPF = header.Get("Received-SPF")
+	report.SPFDisagreement = spfResultsDisagree(report.SPFResults)
+	report.SPFConsensus = spfConsensus(report.SPFResults, header)
+	fromDomain := addressDomain(report.From)
+	aligned, passed := spfAlignment(report.SPFResults, fromDomain)
+	report.SPFAligned = aligned
+	report.SPFUnalignedPass = passed && !aligned
+	report.ReturnPathDomain = sanitizeHeader(addressDomain(header.Get("Return-Path")))
+	report.ReturnPathMismatch = report.ReturnPathDomain != "" && fromDomain != "" &&
+		!sameOrganization(report.ReturnPathDomain, fromDomain)
+	report.FromDomain = sanitizeHeader(fromDomain)
+	report.ReplyToDomains = replyToDomains(header["Reply-To"], diag)
+	for _, domain := range report.ReplyToDomains {
+		if fromDomain != "" && !sameOrganization(domain, fromDomain) {
+			report.ReplyToMismatch = true
+		}
+	}
+
+	// Extract DKIM results
+	report.DKIMResults = extractDKIMResults(header, diag)
+	report.DKIMSignatures = parseDKIMSignatures(header)
+	diag.record("dkim-signature", len(report.DKIMSignatures) > 0, "")
+
+	report.DKIMAligned, _ = dkimAlignment(report.DKIMResults, fromDomain)
+
+	// Extract DMARC results
+	report.DMARCResults = extractDMARCResults(header)
+	diag.record("dmarc", len(report.DMARCResults) > 0, "")
+	fillDMARCAlignment(report)
+
+	// Parse Authentication-Results headers
+	report.AuthResults = parseAuthenticationResults(header, diag)
+
+	// Extract ARC results
+	report.ARCResults = extractARCResults(header)
+	diag.record("arc", len(report.ARCResults) > 0, "")
+	report.ARCChain = parseARCChain(header)
+	diag.record("arc-chain", report.ARCChain != nil, "")
+
+	// Parse verdicts preserved by a forwarder and compare them with ours
+	report.OriginalAuth = parseOriginalAuthResults(header, report)
+	diag.record("authentication-results-original", report.OriginalAuth != nil, "")
+
+	// Extract SCL (Spam Confidence Level) results
+	report.SCL = a.extractSCL(header, diag)
+
+	// SCL -1 means filtering was skipped (safe sender, allow list or rule)
+	report.Allowlisted = report.SCL != nil && report.SCL.Score == -1
+	report.SCLCategoryConflict = sclCategoryConflict(report.SCL, a.Thresholds)
+	report.SignalFingerprint = signalFingerprint(header)
+
+	// Check the From domain for IDN homographs
+	report.Homograph = checkHomograph(addressDomain(report.From))
+	diag.record("homograph", report.Homograph != nil, "")
+
+	// Parse List-Unsubscribe headers (bulk mail indicator)
+	report.ListUnsubscribe = parseListUnsubscribe(header)
+	diag.record("list-unsubscribe", report.ListUnsubscribe != nil, "")
+	report.Automation = parseAutomation(header)
+	diag.record("automation", report.Automation != nil, "")
+
+	// Parse SpamAssassin verdict and engine provenance
+	report.SpamAssassin = parseSpamAssassin(header)
+	diag.record("spamassassin", report.SpamAssassin != nil, "")
+
+	// Parse Mimecast gateway verdict
+	report.Mimecast = parseMimecast(header, a.scoreBands("mimecast"))
+	diag.record("mimecast", report.Mimecast != nil, "")
+
+	// Combine the spam engine verdicts under the configured policy
+	if verdicts := a.collectVerdicts(report); len(verdicts) > 0 {
+		consolidated := consolidateVerdicts(verdicts, a.VerdictPolicy)
+		report.Verdict = &consolidated
+	}
+	diag.record("verdict", report.Verdict != nil, "")
+
+	// Identify security gateways from the headers they stamp
+	report.Gateways = detectGateways(header)
+	diag.record("gateways", len(report.Gateways) > 0, "")
+
+	// Parse reply-chain headers for thread-hijacking detection
+	report.Thread = parseThreadInfo(header, addressDomain(report.From))
+	diag.record("thread", report.Thread != nil, "")
+
+	// Parse webmail origin headers (weak provenance signals)
+	report.Webmail = parseWebmailProvenance(header, report.From, diag)
+	report.WebappOrigin = parseWebappOrigin(header)
+	diag.record("webapp-origin", report.WebappOrigin != nil, "")
+	report.Software = parseSenderSoftware(header, a.SpamTools)
+	diag.record("sender-software", report.Software != nil, "")
+
+	// Parse Microsoft 365 tenant attribution
+	report.Tenant = parseTenantProvenance(header)
+	diag.record("tenant", report.Tenant != nil, "")
+
+	// Parse legacy Sender-ID headers (archived Exchange and Hotmail mail)
+	report.SenderID = parseSenderID(header, diag)
+	if report.Recipients = countRecipients(header, diag); report.Recipients != nil {
+		report.Recipients.Excessive = a.MaxRecipients > 0 && report.Recipients.Total > a.MaxRecipients
+	}
+
+	// Find the sending client IP across Forefront and gateway headers
+	report.SenderIP = parseSenderIP(header, diag)
+	report.SenderCountry = parseSenderCountry(header)
+	report.CountryName = countryName(report.SenderCountry)
+	if a.Reputation != nil && report.SenderIP != nil {
+		report.Reputation = a.lookupReputation(ctx, report.SenderIP.IP)
+	}
+
+	// Compare with the values expected for this sender
+	report.Baseline = a.Baseline.check(report, fromDomain)
+
+	// Parse the Received chain with normalized timestamps
+	report.ReceivedChain, report.TransitSeconds = parseReceivedChain(header, a.Timezone, diag)
+
+	// Long relay chains suggest open-relay abuse or forwarding loops. Every
+	// Received header counts, including those beyond the parsed chain.
+	report.HopCount = len(header["Received"])
+	report.ExcessiveHops = a.MaxHops > 0 && report.HopCount > a.MaxHops
+	report.RoutingExplanation = detectSuspiciousRouting(report.ReceivedChain)
+
+	// A Date far from delivery suggests a forged or misconfigured sender clock
+	if skew, ok := dateSkew(report.Date, report.ReceivedChain, diag); ok {
+		seconds := int64(skew.Seconds())
+		report.DateSkewSeconds = &seconds
+		report.DateAnomaly = a.MaxDateSkew > 0 && (skew > a.MaxDateSkew || skew < -a.MaxDateSkew)
+	}
+	report.SuspiciousRouting = report.RoutingExplanation != ""
+
+	report.AnalysisConfidence = computeAnalysisConfidence(report)
+
+	if diag != nil {
+		report.Diagnostics = diag.runs
+	}
+	a.recordDuration(report, start)
+
+	// Last, so every check above sees the values as the headers gave them
+	if a.Normalize {
+		normalizeReport(report)
+	}
+
+	if span.IsRecording() {
+		if report.SCL != nil {
+			span.SetAttributes(attribute.Int("email.scl", report.SCL.Score))
+		}
+		if report.Verdict != nil {
+			span.SetAttributes(attribute.String("email.verdict", report.Verdict.Verdict))
+		}
+		span.SetAttributes(attribute.Int("email.analysis_confidence", report.AnalysisConfidence))
+	}
+
+	return report
+}
+
+// startSpan starts a span when a Tracer is configured. Without one it
+// returns ctx unchanged and a no-op span, so tracing costs nothing by
+// default.
+func (a *Analyzer) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if a.Tracer == nil {
+		return ctx, noop.Span{}
+	}
+	return a.Tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// parserLog collects the ParserRun diagnostics of one analysis as the
+// parsers run, so the runs are in analysis order. A parser that can tell
+// unusable input from absent input records its own run; AnalyzeContext
+// records the rest. A nil *parserLog records nothing, so diagnostics cost
+// nothing when Diagnostics is off.
+type parserLog struct {
+	runs []ParserRun
+}
+
+// record adds a run of parser. err describes input that was present but
+// could not be used, which usually explains a surprising verdict.
+func (l *parserLog) record(parser string, matched bool, err string) {
+	if l != nil {
+		l.runs = append(l.runs, ParserRun{Parser: parser, Matched: matched, Error: err})
+	}
+}
+
+// recordUnused adds a run of parser whose failure is input that was present
+// but yielded nothing; err is kept only in that case
+func (l *parserLog) recordUnused(parser string, matched, inputPresent bool, err string) {
+	if matched || !inputPresent {
+		err = ""
+	}
+	l.record(parser, matched, err)
+}
+
+// confidenceWeights is the contribution of each independent signal to
+// AnalysisConfidence. The weights sum to 100. DMARC weighs most because it
+// already combines SPF and DKIM with alignment; compauth and ARC are
+// supporting evidence.
+var confidenceWeights = map[string]int{
+	"dmarc":    25,
+	"spf":      20,
+	"dkim":     20,
+	"scl":      15,
+	"compauth": 10,
+	"arc":      10,
+}
+
+// computeAnalysisConfidence scores how trustworthy the analysis is by summing
+// the weights of the signals that produced a result
+func computeAnalysisConfidence(report *EmailSecurityReport) int {
+	present := make(map[string]bool)
+	for _, spf := range report.SPFResults {
+		if spf.Result != "" {
+			present["spf"] = true
+		}
+	}
+	for _, dkim := range report.DKIMResults {
+		// Signatures without a verification result are not a verdict
+		if dkim.Result != "" {
+			present["dkim"] = true
+		}
+	}
+	for _, dmarc := range report.DMARCResults {
+		if dmarc.Result != "" {
+			present["dmarc"] = true
+		}
+	}
+	for _, arc := range report.ARCResults {
+		if arc.Result != "" {
+			present["arc"] = true
+		}
+	}
+	for _, ar := range report.AuthResults {
+		for _, method := range ar.Methods {
+			if method.Method == "compauth" && method.Result != "" {
+				present["compauth"] = true
+			}
+		}
+	}
+	if report.SCL != nil {
+		present["scl"] = true
+	}
+
+	confidence := 0
+	for signal := range present {
+		confidence += confidenceWeights[signal]
+	}
+	return confidence
+}
+
+// cleanEmailData attempts to clean up malformed email data
+func cleanEmailData(data []byte) []byte {
+	// Remove null bytes
+	data = bytes.ReplaceAll(data, []byte{0}, []byte{})
+
+	// Ensure headers end with double newline
+	if !bytes.Contains(data[:min(len(data), 5000)], []byte("\n\n")) &&
+		!bytes.Contains(data[:min(len(data), 5000)], []byte("\r\n\r\n")) {
+		// Try to find where headers might end
+		lines := bytes.Split(data, []byte("\n"))
+		for i, line := range lines {
+			if len(bytes.TrimSpace(line)) == 0 ||
+				(!bytes.Contains(line, []byte(":")) && i > 5) {
+				// Insert double newline here
+				before := bytes.Join(lines[:i], []byte("\n"))
+				after := bytes.Join(lines[i:], []byte("\n"))
+				return append(append(before, []byte("\n\n")...), after...)
+			}
+		}
+	}
+
+	return data
+}
+
+// extractSPFResults extracts SPF authentication results from headers and
+// records the run in diag, which may be nil
+func extractSPFResults(header mail.Header, diag *parserLog) []SPFResult {
+	var results []SPFResult
+
+	// Check Received-SPF header
+	if result := parseReceivedSPF(header); result != nil {
+		results = append(results, *result)
+	}
+
+	// Also check Authentication-Results for SPF
+	authResults := header["Authentication-Results"]
+	for _, ar := range authResults {
+		// Validate header length
+		if len(ar) > MaxHeaderLength {
+			log.Printf("Warning: Authentication-Results header exceeds maximum length, truncating")
+			ar = ar[:MaxHeaderLength]
+		}
+		for _, result := range parseAuthResultsForSPF(ar) {
+			result.Source = "authentication-results"
+			results = append(results, result)
+		}
+	}
+
+	results = dedupeResults(results, func(r SPFResult) string {
+		return strings.ToLower(r.Source + "|" + r.Domain + "|" + r.Result)
+	})
+	diag.recordUnused("spf", len(results) > 0, header.Get("Received-SPF") != "", "Received-SPF present but no SPF result parsed")
+	return results
+}
+
+var receivedSPFDomainRegex = regexp.MustCompile(`domain of (?:transitioning )?([^\s;)]+)`)
+
+// parseReceivedSPF parses the Received-SPF header stamped by the receiving
+// server (e.g. Gmail), independently of Authentication-Results. When the
+// header has no domain= key the domain is taken from the "domain of
+// [transitioning] <address>" comment. Returns nil when the header is absent.
+func parseReceivedSPF(header mail.Header) *SPFResult {
+	receivedSPF := header.Get("Received-SPF")
+	if receivedSPF == "" {
+		return nil
+	}
+
+	// Validate header length
+	if len(receivedSPF) > MaxHeaderLength {
+		log.Printf("Warning: Received-SPF header exceeds maximum length, truncating")
+		receivedSPF = receivedSPF[:MaxHeaderLength]
+	}
+
+	result := parseSPFHeader(receivedSPF)
+	result.Source = "received-spf"
+
+	if result.Domain == "" {
+		// Pattern is safe from ReDoS: literal prefix + negated character class
+		if match := receivedSPFDomainRegex.FindStringSubmatch(receivedSPF); len(match) > 1 {
+			result.Domain = addressDomain(match[1])
+			if result.Domain == "" {
+				result.Domain = match[1]
+			}
+		}
+	}
+	result.Domain = sanitizeHeader(result.Domain)
+
+	return result
+}
+
+// spfResultsDisagree reports whether the Received-SPF result differs from
+// the first Authentication-Results SPF result. Both must be present.
+func spfResultsDisagree(results []SPFResult) bool {
+	var received, authResult *SPFResult
+	for i := range results {
+		switch results[i].Source {
+		case "received-spf":
+			if received == nil {
+				received = &results[i]
+			}
+		case "authentication-results":
+			if authResult == nil {
+				authResult = &results[i]
+			}
+		}
+	}
+	if received == nil || authResult == nil {
+		return false
+	}
+	return received.Result != authResult.Result
+}
+
+// spfSourcePrecedence ranks SPF sources for spfConsensus, most authoritative
+// first: Authentication-Results is the receiving server's final verdict and
+// what DMARC evaluates, Received-SPF may come from the same or an earlier
+// hop, and ARC-Authentication-Results records what intermediaries saw
+// before forwarding
+var spfSourcePrecedence = []string{"authentication-results", "received-spf", "arc-authentication-results"}
+
+// spfConsensus gathers every SPF assertion: results (from
+// extractSPFResults) plus the spf= results sealed into each
+// ARC-Authentication-Results, newest instance first. The dominant result is
+// the one asserted most often; a tie goes to the result of the
+// highest-precedence source (see spfSourcePrecedence), and within a source
+// to the header nearest the top. Returns nil when no header asserts SPF.
+func spfConsensus(results []SPFResult, header mail.Header) *SPFConsensus {
+	var assertions []SPFAssertion
+	for _, r := range results {
+		assertions = append(assertions, SPFAssertion{Source: r.Source, Result: strings.ToLower(r.Result), Domain: r.Domain})
+	}
+
+	var arc []SPFAssertion
+	instances := make(map[string]int)
+	for _, ar := range header["Arc-Authentication-Results"] {
+		if len(ar) > MaxHeaderLength {
+			ar = ar[:MaxHeaderLength]
+		}
+		source := "arc-authentication-results"
+		if sealed := parseARCHeader(ar); sealed.Instance > 0 {
+			source = fmt.Sprintf("%s (i=%d)", source, sealed.Instance)
+			instances[source] = sealed.Instance
+		}
+		for _, r := range parseAuthResultsForSPF(ar) {
+			arc = append(arc, SPFAssertion{Source: source, Result: strings.ToLower(r.Result), Domain: sanitizeHeader(r.Domain)})
+		}
+	}
+	slices.SortStableFunc(arc, func(a, b SPFAssertion) int {
+		return instances[b.Source] - instances[a.Source]
+	})
+	assertions = append(assertions, arc...)
+	if len(assertions) == 0 {
+		return nil
+	}
+
+	rank := func(source string) int {
+		for i, prefix := range spfSourcePrecedence {
+			if strings.HasPrefix(source, prefix) {
+				return i
+			}
+		}
+		return len(spfSourcePrecedence)
+	}
+	slices.SortStableFunc(assertions, func(a, b SPFAssertion) int {
+		return rank(a.Source) - rank(b.Source)
+	})
+
+	// Assertions are now in precedence order, so the first to reach the
+	// highest count wins ties
+	counts := make(map[string]int)
+	for _, a := range assertions {
+		counts[a.Result]++
+	}
+	consensus := &SPFConsensus{Assertions: len(assertions)}
+	for _, a := range assertions {
+		if counts[a.Result] > consensus.Agreeing {
+			consensus.Result = a.Result
+			consensus.Source = a.Source
+			consensus.Agreeing = counts[a.Result]
+		}
+	}
+	for _, a := range assertions {
+		if a.Result != consensus.Result {
+			consensus.Dissenting = append(consensus.Dissenting, a)
+		}
+	}
+	return consensus
+}
+
+// spfAlignment reports whether any passing SPF result's domain is aligned
+// with fromDomain (see sameOrganization) and whether any SPF result passed
+func spfAlignment(results []SPFResult, fromDomain string) (aligned, passed bool) {
+	for _, result := range results {
+		if !strings.EqualFold(result.Result, "pass") {
+			continue
+		}
+		passed = true
+		// smtp.mailfrom may hold the whole envelope sender
+		domain := result.Domain
+		if strings.Contains(domain, "@") {
+			domain = addressDomain(domain)
+		}
+		if sameOrganization(domain, fromDomain) {
+			aligned = true
+		}
+	}
+	return aligned, passed
+}
+
+// dkimAlignment reports whether any passing DKIM result's signing domain is
+// aligned with fromDomain (see sameOrganization) and whether any DKIM result
+// passed
+func dkimAlignment(results []DKIMResult, fromDomain string) (aligned, passed bool) {
+	for _, result := range results {
+		if !strings.EqualFold(result.Result, "pass") {
+			continue
+		}
+		passed = true
+		if sameOrganization(result.Domain, fromDomain) {
+			aligned = true
+		}
+	}
+	return aligned, passed
+}
+
+// fillDMARCAlignment sets the SPF and DKIM alignment of each DMARC result
+// that names its header.from domain, using relaxed (organizational domain)
+// alignment. Receivers rarely stamp alignment themselves; a value already
+// present is kept.
+func fillDMARCAlignment(report *EmailSecurityReport) {
+	for i := range report.DMARCResults {
+		dmarc := &report.DMARCResults[i]
+		if dmarc.Domain == "" {
+			continue
+		}
+		if dmarc.SPFAlignment == "" {
+			aligned, _ := spfAlignment(report.SPFResults, dmarc.Domain)
+			dmarc.SPFAlignment = passOrFail(aligned)
+		}
+		if dmarc.DKIMAlignment == "" {
+			aligned, _ := dkimAlignment(report.DKIMResults, dmarc.Domain)
+			dmarc.DKIMAlignment = passOrFail(aligned)
+		}
+	}
+}
+
+// passOrFail maps a check outcome to an authentication result keyword
+func passOrFail(ok bool) string {
+	if ok {
+		return "pass"
+	}
+	return "fail"
+}
+
+var (
+	spfDomainRegex   = regexp.MustCompile(`domain=([^\s;]+)`)
+	spfClientIPRegex = regexp.MustCompile(`client-ip=([^\s;]+)`)
+)
+
+// parseSPFHeader parses a Received-SPF header
+func parseSPFHeader(header string) *SPFResult {
+	result := &SPFResult{}
+
+	// Extract result (first word)
+	parts := strings.Fields(header)
+	if len(parts) > 0 {
+		result.Result = strings.ToLower(strings.TrimSuffix(parts[0], ";"))
+	}
+
+	// Extract domain
+	if match := spfDomainRegex.FindStringSubmatch(header); len(match) > 1 {
+		result.Domain = match[1]
+	}
+
+	// Extract client IP
+	if match := spfClientIPRegex.FindStringSubmatch(header); len(match) > 1 {
+		result.ClientIP = match[1]
+	}
+
+	// Extract explanation
+	result.Explanation = strings.TrimSpace(header)
+
+	return result
+}
+
+// splitAuthResultClauses splits an Authentication-Results value into its
+// ';'-separated clauses (the authserv-id first, then one per method result).
+// Folding whitespace is collapsed, and ';' inside a parenthesized comment or
+// a quoted reason does not end a clause.
+func splitAuthResultClauses(authResult string) []string {
+	var clauses []string
+	var current strings.Builder
+	depth := 0
+	var quoted, escaped bool
+	flush := func() {
+		if clause := strings.Join(strings.Fields(current.String()), " "); clause != "" {
+			clauses = append(clauses, clause)
+		}
+		current.Reset()
+	}
+
+	for _, r := range authResult {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case quoted:
+		case r == '(':
+			depth++
+		case r == ')' && depth > 0:
+			depth--
+		case r == ';' && depth == 0:
+			flush()
+			continue
+		}
+		current.WriteRune(r)
+	}
+	flush()
+
+	return clauses
+}
+
+// authReasonRegex matches a reason= property (RFC 8601 section 2.7), either a
+// quoted string (reason="ip allowlisted") or a token (compauth's reason=100)
+var authReasonRegex = regexp.MustCompile(`(?i)(?:^|\s)reason=(?:"((?:[^"\\]|\\.)*)"|([^\s;"]+))`)
+
+// authResultReason returns the unquoted reason= text of one method clause,
+// or "" when it has none
+func authResultReason(clause string) string {
+	match := authReasonRegex.FindStringSubmatch(clause)
+	if match == nil {
+		return ""
+	}
+	if match[2] != "" {
+		return sanitizeHeader(match[2])
+	}
+	var reason strings.Builder
+	escaped := false
+	for _, r := range match[1] {
+		if r == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		reason.WriteRune(r)
+	}
+	return sanitizeHeader(strings.TrimSpace(reason.String()))
+}
+
+// dedupeResults drops results whose key has already been seen, keeping the
+// first occurrence. Boundary MTAs that re-stamp Authentication-Results would
+// otherwise report the same result several times.
+func dedupeResults[T any](results []T, key func(T) string) []T {
+	if len(results) < 2 {
+		return results
+	}
+	seen := make(map[string]bool)
+	deduped := results[:0]
+	for _, r := range results {
+		k := key(r)
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		deduped = append(deduped, r)
+	}
+	return deduped
+}
+
+var (
+	authSPFRegex      = regexp.MustCompile(`spf=([a-z]+)(?:\s+\(([^)]+)\))?`)
+	smtpMailfromRegex = regexp.MustCompile(`smtp\.mailfrom=([^\s;]+)`)
+)
+
+// parseAuthResultsForSPF extracts SPF results from Authentication-Results header
+func parseAuthResultsForSPF(authResult string) []SPFResult {
+	var results []SPFResult
+
+	// Look for spf=result pattern with limited matches to prevent ReDoS
+
+	// Properties are read from the method's own clause so that several
+	// methods in one header do not borrow each other's domains
+	for _, clause := range splitAuthResultClauses(authResult) {
+		matches := authSPFRegex.FindAllStringSubmatch(clause, MaxRegexMatches)
+		for _, match := range matches {
+			result := SPFResult{
+				Result: match[1],
+				Reason: authResultReason(clause),
+			}
+			if len(match) > 2 {
+				result.Explanation = match[2]
+			}
+
+			// Extract domain from the context
+			if domainMatch := smtpMailfromRegex.FindStringSubmatch(clause); len(domainMatch) > 1 {
+				result.Domain = domainMatch[1]
+			}
+
+			results = append(results, result)
+		}
+	}
+
+	return results
+}
+
+// extractDKIMResults extracts DKIM signature information and validation
+// results and records the run in diag, which may be nil
+func extractDKIMResults(header mail.Header, diag *parserLog) []DKIMResult {
+	var results []DKIMResult
+
+	// Parse DKIM-Signature and X-Google-DKIM-Signature headers
+	for _, h := range dkimSignatureHeaders {
+		for _, sig := range header[h.name] {
+			result := parseDKIMSignature(sig)
+			if result != nil {
+				result.Source = h.source
+				results = append(results, *result)
+			}
+		}
+	}
+
+	// Also check Authentication-Results for DKIM validation
+	authResults := header["Authentication-Results"]
+	for _, ar := range authResults {
+		dkimResults := parseAuthResultsForDKIM(ar)
+
+		// Merge with signature info if available. Receivers only verify
+		// DKIM-Signature, so Google's own signature never takes a result.
+		for i := range dkimResults {
+			// Try to find matching signature
+			for j := range results {
+				if results[j].Domain == dkimResults[i].Domain && results[j].Source != dkimSourceGoogle {
+					// Update result status
+					if dkimResults[i].Result != "" {
+						results[j].Result = dkimResults[i].Result
+						results[j].Reason = dkimResults[i].Reason
+					}
+					break
+				}
+			}
+			// If no match, add as new result
+			if dkimResults[i].Result != "" {
+				found := false
+				for j := range results {
+					if results[j].Domain == dkimResults[i].Domain && results[j].Source != dkimSourceGoogle {
+						found = true
+						break
+					}
+				}
+				if !found {
+					results = append(results, dkimResults[i])
+				}
+			}
+		}
+	}
+
+	results = dedupeResults(results, func(r DKIMResult) string {
+		return strings.ToLower(r.Domain + "|" + r.Selector + "|" + r.Result + "|" + r.Signature)
+	})
+	diag.recordUnused("dkim", len(results) > 0, len(header["Dkim-Signature"]) > 0, "DKIM-Signature present but no DKIM result parsed")
+	return results
+}
+
+// parseDKIMSignatures parses the tag=value structure of every DKIM-Signature
+// and X-Google-DKIM-Signature header and flags signatures whose x=
+// expiration has passed
+func parseDKIMSignatures(header mail.Header) []DKIMSignature {
+	var signatures []DKIMSignature
+	now := time.Now()
+	for _, h := range dkimSignatureHeaders {
+		for _, sig := range header[h.name] {
+			// Validate header length
+			if len(sig) > MaxHeaderLength {
+				log.Printf("Warning: %s header exceeds maximum length, truncating", h.name)
+				sig = sig[:MaxHeaderLength]
+			}
+			signature := parseDKIMSignatureTags(sig, now)
+			signature.Source = h.source
+			signatures = append(signatures, signature)
+		}
+	}
+	return signatures
+}
+
+// parseDKIMSignatureTags parses a single DKIM-Signature tag list. Expired is
+// evaluated against now.
+func parseDKIMSignatureTags(sig string, now time.Time) DKIMSignature {
+	var result DKIMSignature
+	for _, tag := range strings.Split(sig, ";") {
+		name, value, ok := strings.Cut(tag, "=")
+		if !ok {
+			continue
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		// Folding whitespace is allowed anywhere inside a tag value
+		value = strings.Join(strings.Fields(value), "")
+
+		switch name {
+		case "d":
+			result.Domain = sanitizeHeader(strings.ToLower(value))
+		case "s":
+			result.Selector = sanitizeHeader(value)
+		case "a":
+			result.Algorithm = sanitizeHeader(strings.ToLower(value))
+		case "h":
+			for _, h := range strings.Split(value, ":") {
+				if h != "" {
+					result.SignedHeaders = append(result.SignedHeaders, sanitizeHeader(strings.ToLower(h)))
+				}
+			}
+		case "bh":
+			result.BodyHash = sanitizeHeader(value)
+		case "t":
+			if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+				result.Timestamp = ts
+			}
+		case "x":
+			if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+				result.Expiration = ts
+			}
+		}
+	}
+
+	if result.Expiration > 0 && result.Expiration < now.Unix() {
+		result.Expired = true
+	}
+	return result
+}
+
+var (
+	dkimDomainTagRegex    = regexp.MustCompile(`d=([^\s;]+)`)
+	dkimSelectorTagRegex  = regexp.MustCompile(`s=([^\s;]+)`)
+	dkimAlgorithmTagRegex = regexp.MustCompile(`a=([^\s;]+)`)
+)
+
+// parseDKIMSignature parses a DKIM-Signature header
+func parseDKIMSignature(sig string) *DKIMResult {
+	result := &DKIMResult{
+		Signature: sig,
+	}
+
+	// Parse d= (domain)
+	if match := dkimDomainTagRegex.FindStringSubmatch(sig); len(match) > 1 {
+		result.Domain = match[1]
+		result.HeaderD = match[1]
+	}
+
+	// Parse s= (selector)
+	if match := dkimSelectorTagRegex.FindStringSubmatch(sig); len(match) > 1 {
+		result.Selector = match[1]
+		result.HeaderS = match[1]
+	}
+
+	// Parse a= (algorithm)
+	if match := dkimAlgorithmTagRegex.FindStringSubmatch(sig); len(match) > 1 {
+		result.HeaderA = match[1]
+	}
+
+	return result
+}
+
+var (
+	authDKIMRegex = regexp.MustCompile(`dkim=([a-z]+)(?:\s+\(([^)]+)\))?`)
+	headerDRegex  = regexp.MustCompile(`header\.d=([^\s;]+)`)
+	headerSRegex  = regexp.MustCompile(`header\.s=([^\s;]+)`)
+)
+
+// parseAuthResultsForDKIM extracts DKIM results from Authentication-Results header
+func parseAuthResultsForDKIM(authResult string) []DKIMResult {
+	var results []DKIMResult
+
+	// Look for dkim=result pattern with limited matches to prevent ReDoS
+
+	for _, clause := range splitAuthResultClauses(authResult) {
+		matches := authDKIMRegex.FindAllStringSubmatch(clause, MaxRegexMatches)
+		for _, match := range matches {
+			result := DKIMResult{
+				Result: match[1],
+				Reason: authResultReason(clause),
+				Source: dkimSourceAuthResults,
+			}
+
+			// Extract domain from header.d
+			if domainMatch := headerDRegex.FindStringSubmatch(clause); len(domainMatch) > 1 {
+				result.Domain = domainMatch[1]
+			}
+
+			// Extract selector from header.s
+			if selectorMatch := headerSRegex.FindStringSubmatch(clause); len(selectorMatch) > 1 {
+				result.Selector = selectorMatch[1]
+			}
+
+			results = append(results, result)
+		}
+	}
+
+	return results
+}
+
+// extractDMARCResults extracts DMARC evaluation results from headers
+func extractDMARCResults(header mail.Header) []DMARCResult {
+	var results []DMARCResult
+
+	// Check Authentication-Results for DMARC
+	authResults := header["Authentication-Results"]
+	for _, ar := range authResults {
+		dmarcResults := parseAuthResultsForDMARC(ar)
+		results = append(results, dmarcResults...)
+	}
+
+	return dedupeResults(results, func(r DMARCResult) string {
+		return strings.ToLower(r.Domain + "|" + r.Result)
+	})
+}
+
+var (
+	authDMARCRegex           = regexp.MustCompile(`dmarc=([a-z]+)(?:\s+\(([^)]+)\))?`)
+	dmarcPolicyPropertyRegex = regexp.MustCompile(`policy\.([a-z-]+)=([^\s;]+)`)
+	dmarcPolicyTagRegex      = regexp.MustCompile(`p=([^\s;]+)`)
+	dmarcActionRegex         = regexp.MustCompile(`action=([^\s;]+)`)
+	headerFromRegex          = regexp.MustCompile(`header\.from=([^\s;]+)`)
+)
+
+// parseAuthResultsForDMARC extracts DMARC results from Authentication-Results header
+func parseAuthResultsForDMARC(authResult string) []DMARCResult {
+	var results []DMARCResult
+
+	// Look for dmarc=result pattern with limited matches to prevent ReDoS
+
+	for _, clause := range splitAuthResultClauses(authResult) {
+		matches := authDMARCRegex.FindAllStringSubmatch(clause, MaxRegexMatches)
+
+		for _, match := range matches {
+			result := DMARCResult{
+				Result: match[1],
+				Reason: authResultReason(clause),
+			}
+
+			// Extract policy
+			if policyMatch := dmarcPolicyPropertyRegex.FindStringSubmatch(clause); len(policyMatch) > 2 {
+				if policyMatch[1] == "dmarc" || policyMatch[1] == "policy" {
+					result.Policy = policyMatch[2]
+				}
+			}
+
+			// Alternative policy extraction
+			if result.Policy == "" {
+				if policyMatch := dmarcPolicyTagRegex.FindStringSubmatch(clause); len(policyMatch) > 1 {
+					result.Policy = policyMatch[1]
+				}
+			}
+
+			// Extract disposition
+			if dispMatch := dmarcActionRegex.FindStringSubmatch(clause); len(dispMatch) > 1 {
+				result.Disposition = dispMatch[1]
+			}
+
+			// Extract domain
+			if domainMatch := headerFromRegex.FindStringSubmatch(clause); len(domainMatch) > 1 {
+				result.Domain = domainMatch[1]
+			}
+
+			results = append(results, result)
+		}
+	}
+
+	return results
+}
+
+// parseOriginalAuthResults parses Authentication-Results-Original through
+// the SPF, DKIM and DMARC extractors and notes where the best result per
+// method differs from the current report. Returns nil when the header is
+// absent.
+func parseOriginalAuthResults(header mail.Header, current *EmailSecurityReport) *OriginalAuthResults {
+	values := header["Authentication-Results-Original"]
+	if len(values) == 0 {
+		return nil
+	}
+
+	// Present the preserved values to the extractors as Authentication-Results
+	original := make(mail.Header)
+	for _, value := range values {
+		// Validate header length
+		if len(value) > MaxHeaderLength {
+			log.Printf("Warning: Authentication-Results-Original header exceeds maximum length, truncating")
+			value = value[:MaxHeaderLength]
+		}
+		original["Authentication-Results"] = append(original["Authentication-Results"], value)
+	}
+
+	result := &OriginalAuthResults{
+		SPFResults:   extractSPFResults(original, nil),
+		DKIMResults:  extractDKIMResults(original, nil),
+		DMARCResults: extractDMARCResults(original),
+	}
+	for i := range result.SPFResults {
+		result.SPFResults[i].Source = "authentication-results-original"
+	}
+
+	compare := func(method string, before, now []string) {
+		was, is := bestAuthResult(before), bestAuthResult(now)
+		if was == "" || strings.EqualFold(was, is) {
+			return
+		}
+		result.Differences = append(result.Differences,
+			fmt.Sprintf("%s: %s originally, %s now", method, was, valueOrNone(is)))
+	}
+	compare("spf", spfResultValues(result.SPFResults), spfResultValues(current.SPFResults))
+	compare("dkim", dkimResultValues(result.DKIMResults), dkimResultValues(current.DKIMResults))
+	compare("dmarc", dmarcResultValues(result.DMARCResults), dmarcResultValues(current.DMARCResults))
+
+	return result
+}
+
+// spfResultValues returns the result of each SPF check
+func spfResultValues(results []SPFResult) []string {
+	values := make([]string, len(results))
+	for i, r := range results {
+		values[i] = r.Result
+	}
+	return values
+}
+
+// dkimResultValues returns the result of each DKIM check
+func dkimResultValues(results []DKIMResult) []string {
+	values := make([]string, len(results))
+	for i, r := range results {
+		values[i] = r.Result
+	}
+	return values
+}
+
+// dmarcResultValues returns the result of each DMARC check
+func dmarcResultValues(results []DMARCResult) []string {
+	values := make([]string, len(results))
+	for i, r := range results {
+		values[i] = r.Result
+	}
+	return values
+}
+
+// parseAuthenticationResults parses Authentication-Results headers
+// comprehensively and records the run in diag, which may be nil
+func parseAuthenticationResults(header mail.Header, diag *parserLog) []AuthResult {
+	var results []AuthResult
+
+	authHeaders := header["Authentication-Results"]
+	for _, ah := range authHeaders {
+		result := parseAuthResultHeader(ah)
+		if result != nil {
+			results = append(results, *result)
+		}
+	}
+
+	// Identical re-stamped headers collapse to one entry
+	results = dedupeResults(results, func(r AuthResult) string {
+		return fmt.Sprintf("%s|%v", strings.ToLower(r.AuthServID), r.Methods)
+	})
+	diag.recordUnused("authentication-results", len(results) > 0, len(authHeaders) > 0, "Authentication-Results present but not parseable")
+	return results
+}
+
+// authMethods are the Authentication-Results methods parseAuthResultHeader
+// reports, in order
+var authMethods = []string{"spf", "dkim", "dmarc", "arc", "compauth"}
+
+// authMethodRegexes matches "<method>=<result> <properties>" for each of
+// authMethods within one clause. The method must start a word, so "arc"
+// does not match inside "dmarc".
+var authMethodRegexes = func() map[string]*regexp.Regexp {
+	regexes := make(map[string]*regexp.Regexp, len(authMethods))
+	for _, method := range authMethods {
+		regexes[method] = regexp.MustCompile(`(?:^|\s)` + method + `=([a-z]+)(?:\s+(.+))?`)
+	}
+	return regexes
+}()
+
+// parseAuthResultHeader parses a single Authentication-Results header
+func parseAuthResultHeader(header string) *AuthResult {
+	result := &AuthResult{
+		Methods: []AuthMethod{},
+	}
+
+	// Extract authserv-id (first component before semicolon)
+	parts := strings.SplitN(header, ";", 2)
+	if len(parts) > 0 {
+		result.AuthServID = strings.TrimSpace(parts[0])
+	}
+
+	if len(parts) < 2 {
+		return result
+	}
+
+	// Parse method results
+	methodsStr := parts[1]
+
+	// Split by method types
+	clauses := splitAuthResultClauses(methodsStr)
+	for _, method := range authMethods {
+		for _, clause := range clauses {
+			// Find all occurrences of this method with limited matches to prevent ReDoS
+			matches := authMethodRegexes[method].FindAllStringSubmatch(clause, MaxRegexMatches)
+
+			for _, match := range matches {
+				authMethod := AuthMethod{
+					Method:     method,
+					Result:     match[1],
+					Reason:     authResultReason(clause),
+					Properties: make(map[string]string),
+				}
+
+				// Parse properties. A quoted reason may contain spaces, so it is
+				// taken out first and stored whole.
+				if len(match) > 2 && match[2] != "" {
+					props := strings.Fields(authReasonRegex.ReplaceAllString(match[2], ""))
+					for _, prop := range props {
+						if strings.Contains(prop, "=") {
+							kv := strings.SplitN(prop, "=", 2)
+							authMethod.Properties[kv[0]] = kv[1]
+						}
+					}
+				}
+				if authMethod.Reason != "" {
+					authMethod.Properties["reason"] = authMethod.Reason
+				}
+
+				result.Methods = append(result.Methods, authMethod)
+			}
+		}
+	}
+
+	return result
+}
+
+// extractARCResults extracts ARC (Authenticated Received Chain) results
+func extractARCResults(header mail.Header) []ARCResult {
+	var results []ARCResult
+
+	// Check for ARC-Authentication-Results headers
+	arcAuthResults := header["Arc-Authentication-Results"]
+	for _, ar := range arcAuthResults {
+		result := parseARCHeader(ar)
+		if result != nil {
+			results = append(results, *result)
+		}
+	}
+
+	// Check Authentication-Results for ARC chain validation
+	authResults := header["Authentication-Results"]
+	for _, ar := range authResults {
+		arcChainResult := parseAuthResultsForARC(ar)
+		if arcChainResult != nil {
+			results = append(results, *arcChainResult)
+		}
+	}
+
+	return dedupeResults(results, func(r ARCResult) string {
+		return fmt.Sprintf("%d|%s|%s", r.Instance, r.Result, r.Chain)
+	})
+}
+
+var arcInstanceRegex = regexp.MustCompile(`i=(\d+)`)
+
+// parseARCHeader parses an ARC-Authentication-Results header
+func parseARCHeader(header string) *ARCResult {
+	result := &ARCResult{}
+
+	// Extract i= (instance)
+	if match := arcInstanceRegex.FindStringSubmatch(header); len(match) > 1 {
+		if instance, err := strconv.Atoi(match[1]); err == nil {
+			result.Instance = instance
+		}
+	}
+
+	return result
+}
+
+// parseARCChain groups ARC-Seal, ARC-Message-Signature and
+// ARC-Authentication-Results by instance and checks the chain's structure
+// (RFC 8617 section 5.2). The chain fails when an instance is missing,
+// duplicated, out of range or incomplete, when instance 1 does not seal with
+// cv=none or a later instance with cv=pass, or when any seal reports
+// cv=fail. Returns nil when none of the headers is present.
+func parseARCChain(header mail.Header) *ARCChain {
+	seals := header["Arc-Seal"]
+	signatures := header["Arc-Message-Signature"]
+	results := header["Arc-Authentication-Results"]
+	if len(seals) == 0 && len(signatures) == 0 && len(results) == 0 {
+		return nil
+	}
+
+	chain := &ARCChain{}
+	sets := make(map[int]*ARCSet)
+	problem := func(format string, args ...any) {
+		chain.Problems = append(chain.Problems, fmt.Sprintf(format, args...))
+	}
+	// add records one header of a set and returns the set with the header's
+	// tags, or a nil set for a header whose instance is invalid or already
+	// taken by the same kind of header
+	add := func(name, value string, has func(set *ARCSet) *bool) (*ARCSet, map[string]string) {
+		if len(value) > MaxHeaderLength {
+			log.Printf("Warning: %s header exceeds maximum length, truncating", name)
+			value = value[:MaxHeaderLength]
+		}
+		tags := parseARCTags(value)
+		instance, err := strconv.Atoi(tags["i"])
+		if err != nil || instance < 1 || instance > MaxARCInstances {
+			problem("%s without a valid instance (i= 1 to %d)", name, MaxARCInstances)
+			return nil, nil
+		}
+		set := sets[instance]
+		if set == nil {
+			set = &ARCSet{Instance: instance}
+			sets[instance] = set
+		}
+		if *has(set) {
+			problem("instance %d has more than one %s", instance, name)
+			return nil, nil
+		}
+		*has(set) = true
+		return set, tags
+	}
+
+	for _, value := range seals {
+		if set, tags := add("ARC-Seal", value, func(set *ARCSet) *bool { return &set.HasSeal }); set != nil {
+			set.ChainValidation = sanitizeHeader(strings.ToLower(tags["cv"]))
+			set.SealDomain = sanitizeHeader(strings.ToLower(tags["d"]))
+		}
+	}
+	for _, value := range signatures {
+		if set, tags := add("ARC-Message-Signature", value, func(set *ARCSet) *bool { return &set.HasSignature }); set != nil {
+			set.SignatureDomain = sanitizeHeader(strings.ToLower(tags["d"]))
+		}
+	}
+	for _, value := range results {
+		add("ARC-Authentication-Results", value, func(set *ARCSet) *bool { return &set.HasResults })
+	}
+
+	highest := 0
+	for instance, set := range sets {
+		highest = max(highest, instance)
+		chain.Sets = append(chain.Sets, *set)
+	}
+	slices.SortFunc(chain.Sets, func(a, b ARCSet) int { return a.Instance - b.Instance })
+	for instance := 1; instance < highest; instance++ {
+		if sets[instance] == nil {
+			chain.Gaps = append(chain.Gaps, instance)
+			problem("instance %d is missing", instance)
+		}
+	}
+
+	sealed := false
+	for _, set := range chain.Sets {
+		sealed = sealed || set.HasSeal || set.HasSignature
+		switch {
+		case !set.HasSeal:
+			problem("instance %d has no ARC-Seal", set.Instance)
+		case set.ChainValidation == "fail":
+			problem("instance %d sealed with cv=fail (the chain was already broken)", set.Instance)
+		case set.Instance == 1 && set.ChainValidation != "none":
+			problem("instance 1 sealed with cv=%s, want none", valueOrMissing(set.ChainValidation))
+		case set.Instance > 1 && set.ChainValidation != "pass":
+			problem("instance %d sealed with cv=%s, want pass", set.Instance, valueOrMissing(set.ChainValidation))
+		}
+		if !set.HasSignature {
+			problem("instance %d has no ARC-Message-Signature", set.Instance)
+		}
+		if !set.HasResults {
+			problem("instance %d has no ARC-Authentication-Results", set.Instance)
+		}
+	}
+
+	switch {
+	case !sealed:
+		// Results alone were recorded; there is no chain to validate
+		chain.Status = "none"
+		chain.Problems = nil
+	case len(chain.Problems) > 0:
+		chain.Status = "fail"
+	default:
+		chain.Status = "pass"
+	}
+	return chain
+}
+
+// parseARCTags parses the tag=value list of an ARC-Seal or
+// ARC-Message-Signature into a map keyed by lowercase tag name. Folding
+// whitespace inside values is removed.
+func parseARCTags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		name, value, ok := strings.Cut(tag, "=")
+		if !ok {
+			continue
+		}
+		tags[strings.ToLower(strings.TrimSpace(name))] = strings.Join(strings.Fields(value), "")
+	}
+	return tags
+}
+
+var authARCRegex = regexp.MustCompile(`arc=([a-z]+)`)
+
+// parseAuthResultsForARC extracts ARC chain validation from Authentication-Results
+func parseAuthResultsForARC(authResult string) *ARCResult {
+	// Look for arc=result pattern
+	matches := authARCRegex.FindStringSubmatch(authResult)
+
+	if len(matches) > 1 {
+		result := &ARCResult{
+			Result: matches[1],
+			Chain:  matches[1],
+		}
+		return result
+	}
+
+	return nil
+}
+
+// extractSCLResults extracts Microsoft Spam Confidence Level from X-Forefront-Antispam-Report headers
+//
+// SECURITY NOTE: X-Forefront-Antispam-Report headers can be spoofed by attackers.
+// This header should ONLY be trusted when the email is received from authenticated
+// Microsoft Exchange Online servers. Always verify the Received headers and
+// authentication results (SPF/DKIM/DMARC) to ensure the email actually originated
+// from Microsoft infrastructure before trusting the SCL score for security decisions.
+func extractSCLResults(header mail.Header) *SCLResult {
+	return defaultAnalyzer.extractSCL(header, nil)
+}
+
+// extractSCL returns the SCL from the first of the analyzer's SCL sources (in
+// order) that carries one. With NoTruncate set, the full header value is
+// parsed and kept in RawHeader. The run is recorded in diag, which may be
+// nil.
+func (a *Analyzer) extractSCL(header mail.Header, diag *parserLog) *SCLResult {
+	header = canonicalHeader(header)
+	present := false
+	for _, source := range a.SCLSources {
+		value := decodeHeaderValue(header.Get(source))
+		if value == "" {
+			continue
+		}
+		present = true
+
+		// Validate header length
+		if len(value) > MaxHeaderLength && !a.NoTruncate {
+			log.Printf("Warning: %s header exceeds maximum length, truncating", source)
+			value = value[:MaxHeaderLength]
+		}
+
+		if result := parseSCLHeader(value, source); result != nil {
+			result.Description = localizedSCL(a.Locale, result.Score, a.Thresholds)
+			for i := range result.Services {
+				result.Services[i].Description = describeService(a.Locale, result.Services[i].Code)
+			}
+			if a.NoTruncate {
+				result.RawHeader = strings.TrimSpace(stripControlChars(value))
+			}
+			diag.record("scl", true, "")
+			return result
+		}
+	}
+
+	diag.recordUnused("scl", false, present, "SCL header present but no valid SCL value (missing or out of range)")
+	return nil
+}
+
+// decodeHeaderValue undoes the encodings some relays apply to antispam
+// headers before tokens are extracted: RFC 2047 encoded-words ("=?utf-8?Q?...?=")
+// and bare quoted-printable ("SCL=3A5=3B"). Bare quoted-printable is only
+// decoded when the value contains an escaped ':' or ';', the separators every
+// Forefront token uses, so ordinary ASCII values pass through untouched. A
+// value is decoded at most once; on any decoding error it is returned as is.
+func decodeHeaderValue(value string) string {
+	if strings.Contains(value, "=?") {
+		if decoded, err := new(mime.WordDecoder).DecodeHeader(value); err == nil {
+			return decoded
+		}
+		return value
+	}
+	upper := strings.ToUpper(value)
+	if !strings.Contains(upper, "=3A") && !strings.Contains(upper, "=3B") {
+		return value
+	}
+	decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(value)))
+	if err != nil {
+		return value
+	}
+	return string(decoded)
+}
+
+// parseSCLSourcePriority parses a comma-separated list of SCL header names in
+// preferred order. Names are matched case-insensitively against the known
+// sources; unknown or repeated names are an error.
+func parseSCLSourcePriority(value string) ([]string, error) {
+	var sources []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		canonical := ""
+		for _, known := range defaultSCLSources {
+			if strings.EqualFold(name, known) {
+				canonical = known
+				break
+			}
+		}
+		if canonical == "" {
+			return nil, eris.Errorf("unknown SCL source %q (valid: %s)", name, strings.Join(defaultSCLSources, ", "))
+		}
+		if seen[canonical] {
+			return nil, eris.Errorf("SCL source %q listed more than once", canonical)
+		}
+		seen[canonical] = true
+		sources = append(sources, canonical)
+	}
+
+	if len(sources) == 0 {
+		return nil, eris.New("scl-source-priority must name at least one header")
+	}
+	return sources, nil
+}
+
+var sclTokenRegex = regexp.MustCompile(`SCL:(-?\d+)`)
+
+// parseSCLHeader parses SCL value from X-Forefront-Antispam-Report header
+func parseSCLHeader(header string, headerSource string) *SCLResult {
+	// Use regex to extract SCL:value pattern
+	// Pattern is safe from ReDoS: simple literal + digit capture group with no backtracking
+	matches := sclTokenRegex.FindStringSubmatch(header)
+
+	if len(matches) > 1 {
+		// Use strconv.Atoi for robust integer parsing with proper error handling
+		score, err := strconv.Atoi(matches[1])
+		if err != nil {
+			log.Printf("Warning: Failed to parse SCL score from value '%s': %v", matches[1], err)
+			return nil
+		}
+
+		// Validate score range - reject out-of-range values
+		// Microsoft SCL valid range is -1 to 9
+		if score < -1 || score > 9 {
+			log.Printf("Warning: SCL score %d out of valid range [-1, 9], rejecting value", score)
+			return nil
+		}
+
+		result := &SCLResult{
+			Score:        score,
+			Description:  getSCLDescription(score),
+			HeaderSource: sanitizeHeader(headerSource),
+			RawHeader:    sanitizeHeader(header),
+			Services:     parseSRVToken(header),
+		}
+		tokens := parseForefrontTokens(header)
+		result.SFV = strings.ToUpper(tokens["SFV"])
+		result.CAT = strings.ToUpper(tokens["CAT"])
+		result.IPV = strings.ToUpper(tokens["IPV"])
+		result.OverriddenByRule = sfvRuleOverrides[result.SFV]
+
+		return result
+	}
+
+	return nil
+}
+
+// sfvDescriptions maps SFV (spam filter verdict) codes to descriptions
+var sfvDescriptions = map[string]string{
+	"BLK":  "Skipped filtering; sender is on a user's blocked senders list",
+	"NSPM": "Not spam",
+	"SFE":  "Skipped filtering; sender is on a user's safe senders list",
+	"SKA":  "Skipped filtering; sender is on an allowed senders or domains list",
+	"SKB":  "Marked as spam; sender is on a blocked senders or domains list",
+	"SKI":  "Skipped filtering; intra-organization message",
+	"SKN":  "Marked as non-spam before filtering (e.g. by a mail flow rule)",
+	"SKQ":  "Released from quarantine",
+	"SKS":  "Marked as spam before filtering (e.g. by a mail flow rule)",
+	"SPM":  "Spam",
+}
+
+// catDescriptions maps CAT (protection policy category) codes to descriptions
+var catDescriptions = map[string]string{
+	"AMP":    "Anti-malware",
+	"BULK":   "Bulk",
+	"DIMP":   "Domain impersonation",
+	"FTBP":   "Anti-malware common attachments filter",
+	"GIMP":   "Mailbox intelligence impersonation",
+	"HPHSH":  "High confidence phishing",
+	"HPHISH": "High confidence phishing",
+	"HSPM":   "High confidence spam",
+	"MALW":   "Malware",
+	"NONE":   "No protection policy applied",
+	"OSPM":   "Outbound spam",
+	"PHSH":   "Phishing",
+	"SAP":    "Safe Attachments",
+	"SPM":    "Spam",
+	"SPOOF":  "Spoofing",
+	"UIMP":   "User impersonation",
+}
+
+// maliciousCategories are the CAT codes that contradict a clean SCL
+var maliciousCategories = map[string]bool{
+	"PHSH":   true,
+	"HPHSH":  true,
+	"HPHISH": true,
+	"MALW":   true,
+	"HSPM":   true,
+}
+
+// sclCategoryConflict reports whether a score below the spam band (including
+// SCL -1, where filtering was skipped) coexists with a malicious CAT, i.e.
+// the message would slip through on score alone
+func sclCategoryConflict(scl *SCLResult, t SCLThresholds) bool {
+	return scl != nil && scl.Score < t.Spam && maliciousCategories[scl.CAT]
+}
+
+// ipvDescriptions maps IPV (connecting IP reputation) codes to descriptions
+var ipvDescriptions = map[string]string{
+	"CAL": "Skipped filtering; source IP is on the IP Allow List",
+	"NLI": "Source IP is not on any IP reputation list",
+}
+
+// sfvRuleOverrides are the SFV codes where a mail flow rule or an anti-spam
+// policy allow/block list set the verdict instead of content filtering
+var sfvRuleOverrides = map[string]bool{
+	"SKA": true,
+	"SKB": true,
+	"SKN": true,
+	"SKS": true,
+}
+
+// sclDescriptions maps SCL bands (see sclBand) to descriptions
+var sclDescriptions = map[string]string{
+	"skipped":         "Skipped spam filtering (safe sender or SCL override)",
+	"not_spam":        "Not spam",
+	"low_spam":        "Low spam probability",
+	"spam":            "Spam",
+	"high_confidence": "High confidence spam",
+	"unknown":         "Unknown spam confidence level",
+}
+
+// unknownDescriptions is the text for codes missing from the other tables:
+// "code" for SFV, CAT and IPV tokens, "service" for SRV values
+var unknownDescriptions = map[string]string{
+	"code":    "Unknown code",
+	"service": "Unknown service classification",
+}
+
+// Descriptions holds one locale's description tables by kind: scl (keyed
+// by band), sfv, cat, ipv and srv (keyed by code) and unknown
+type Descriptions map[string]map[string]string
+
+// localeDescriptions maps each -locale name to its tables. A locale other
+// than English needs only the entries it translates; the rest fall back to
+// English. To add a locale, add its translation map here.
+var localeDescriptions = map[string]Descriptions{
+	"en": {
+		"scl":     sclDescriptions,
+		"sfv":     sfvDescriptions,
+		"cat":     catDescriptions,
+		"ipv":     ipvDescriptions,
+		"srv":     srvDescriptions,
+		"unknown": unknownDescriptions,
+	},
+	"de": {
+		"scl": {
+			"skipped":         "Spamfilterung übersprungen (sicherer Absender oder SCL-Überschreibung)",
+			"not_spam":        "Kein Spam",
+			"low_spam":        "Geringe Spamwahrscheinlichkeit",
+			"spam":            "Spam",
+			"high_confidence": "Spam mit hoher Konfidenz",
+			"unknown":         "Unbekannte Spam-Konfidenzstufe",
+		},
+		"sfv": {
+			"BLK":  "Filterung übersprungen; Absender steht auf der Liste blockierter Absender eines Benutzers",
+			"NSPM": "Kein Spam",
+			"SFE":  "Filterung übersprungen; Absender steht auf der Liste sicherer Absender eines Benutzers",
+			"SKA":  "Filterung übersprungen; Absender steht auf einer Liste zugelassener Absender oder Domänen",
+			"SKB":  "Als Spam markiert; Absender steht auf einer Liste blockierter Absender oder Domänen",
+			"SKI":  "Filterung übersprungen; organisationsinterne Nachricht",
+			"SKN":  "Vor der Filterung als Nicht-Spam markiert (z. B. durch eine Nachrichtenflussregel)",
+			"SKQ":  "Aus der Quarantäne freigegeben",
+			"SKS":  "Vor der Filterung als Spam markiert (z. B. durch eine Nachrichtenflussregel)",
+			"SPM":  "Spam",
+		},
+		"cat": {
+			"AMP":    "Antischadsoftware",
+			"BULK":   "Massen-E-Mail",
+			"DIMP":   "Domänenidentitätswechsel",
+			"FTBP":   "Filter für allgemeine Anlagen (Antischadsoftware)",
+			"GIMP":   "Identitätswechsel laut Postfachintelligenz",
+			"HPHSH":  "Phishing mit hoher Konfidenz",
+			"HPHISH": "Phishing mit hoher Konfidenz",
+			"HSPM":   "Spam mit hoher Konfidenz",
+			"MALW":   "Schadsoftware",
+			"NONE":   "Keine Schutzrichtlinie angewendet",
+			"OSPM":   "Ausgehender Spam",
+			"PHSH":   "Phishing",
+			"SAP":    "Sichere Anlagen",
+			"SPM":    "Spam",
+			"SPOOF":  "Spoofing",
+			"UIMP":   "Benutzeridentitätswechsel",
+		},
+		"ipv": {
+			"CAL": "Filterung übersprungen; Quell-IP steht auf der Liste zugelassener IP-Adressen",
+			"NLI": "Quell-IP steht auf keiner IP-Reputationsliste",
+		},
+		"srv": {
+			"BULK": "Anhand des Schwellenwerts der Massenbeschwerdestufe (BCL) als Massen-E-Mail erkannt",
+		},
+		"unknown": {
+			"code":    "Unbekannter Code",
+			"service": "Unbekannte Dienstklassifizierung",
+		},
+	},
+}
+
+// localize returns locale's text for key in the kind table, falling back to
+// English; ok is false when neither has it
+func localize(locale, kind, key string) (text string, ok bool) {
+	if text, ok = localeDescriptions[locale][kind][key]; ok {
+		return text, true
+	}
+	text, ok = localeDescriptions["en"][kind][key]
+	return text, ok
+}
+
+// localizedTable returns a copy of the English kind table with locale's
+// translations applied
+func localizedTable(locale, kind string) map[string]string {
+	table := maps.Clone(localeDescriptions["en"][kind])
+	for key := range table {
+		table[key], _ = localize(locale, kind, key)
+	}
+	return table
+}
+
+// describeToken looks up a Forefront token code in the kind (sfv, cat or
+// ipv) description table of locale
+func describeToken(locale, kind, code string) string {
+	if desc, ok := localize(locale, kind, code); ok {
+		return desc
+	}
+	desc, _ := localize(locale, "unknown", "code")
+	return desc
+}
+
+// describeService returns the description of an SRV value in locale
+func describeService(locale, code string) string {
+	if desc, ok := localize(locale, "srv", code); ok {
+		return desc
+	}
+	desc, _ := localize(locale, "unknown", "service")
+	return desc
+}
+
+// Catalog lists every code-to-description mapping the parsers use, for
+// building interfaces that display the same text. SCL keys are the scores
+// -1 to 9, described under the configured thresholds.
+type Catalog struct {
+	SCL map[string]string `json:"scl"`
+	SFV map[string]string `json:"sfv"`
+	CAT map[string]string `json:"cat"`
+	IPV map[string]string `json:"ipv"`
+	SRV map[string]string `json:"srv"`
+}
+
+// Catalog returns the built-in description maps for this Analyzer's
+// configuration and Locale. The maps are copies, so callers may modify them.
+func (a *Analyzer) Catalog() Catalog {
+	scl := make(map[string]string)
+	for score := -1; score <= 9; score++ {
+		scl[strconv.Itoa(score)] = localizedSCL(a.Locale, score, a.Thresholds)
+	}
+	return Catalog{
+		SCL: scl,
+		SFV: localizedTable(a.Locale, "sfv"),
+		CAT: localizedTable(a.Locale, "cat"),
+		IPV: localizedTable(a.Locale, "ipv"),
+		SRV: localizedTable(a.Locale, "srv"),
+	}
+}
+
+// srvDescriptions maps known SRV token values to descriptions
+var srvDescriptions = map[string]string{
+	"BULK": "Identified as bulk email by the bulk complaint level (BCL) threshold",
+}
+
+// parseForefrontTokens splits a Forefront antispam header ("KEY:VALUE;...")
+// into a map of every token, including ones without a dedicated parser. Keys
+// are case-sensitive as Microsoft writes them; values are trimmed and may be
+// empty ("SRV:;"). When a key repeats, the first occurrence wins, as for SCL.
+// Segments without a colon are ignored.
+func parseForefrontTokens(header string) map[string]string {
+	// Validate header length
+	if len(header) > MaxHeaderLength {
+		log.Printf("Warning: Forefront header exceeds maximum length, truncating")
+		header = header[:MaxHeaderLength]
+	}
+
+	tokens := make(map[string]string)
+	for _, segment := range strings.Split(header, ";") {
+		key, value, ok := strings.Cut(segment, ":")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			continue
+		}
+		if _, seen := tokens[key]; seen {
+			continue
+		}
+		tokens[key] = sanitizeHeader(strings.TrimSpace(value))
+	}
+	return tokens
+}
+
+// parseSRVToken extracts the SRV token values from a Forefront header.
+// The common empty form "SRV:;" yields nil.
+func parseSRVToken(header string) []ForefrontService {
+	srv, ok := parseForefrontTokens(header)["SRV"]
+	if !ok {
+		return nil
+	}
+
+	var services []ForefrontService
+	for _, code := range strings.Split(srv, ",") {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if code == "" {
+			continue
+		}
+		services = append(services, ForefrontService{
+			Code:        sanitizeHeader(code),
+			Description: describeService("en", code),
+		})
+	}
+
+	return services
+}
+
+// getSCLDescription returns a human-readable description for an SCL score
+func getSCLDescription(score int) string {
+	return describeSCL(score, defaultAnalyzer.Thresholds)
+}
+
+// describeSCL returns the English description for an SCL score under the
+// given bands
+func describeSCL(score int, t SCLThresholds) string {
+	return localizedSCL("en", score, t)
+}
+
+// localizedSCL returns the description for an SCL score under the given
+// bands in locale
+func localizedSCL(locale string, score int, t SCLThresholds) string {
+	desc, _ := localize(locale, "scl", sclBand(score, t))
+	return desc
+}
+
+// sclBand names the band of an SCL score under t, keying sclDescriptions
+func sclBand(score int, t SCLThresholds) string {
+	switch {
+	case score == -1:
+		return "skipped"
+	case score < -1 || score > 9:
+		return "unknown"
+	case score >= t.HighConfidence:
+		return "high_confidence"
+	case score >= t.Spam:
+		return "spam"
+	case score >= t.LowSpam:
+		return "low_spam"
+	default:
+		return "not_spam"
+	}
+}
+
+// resolveSCLThresholds starts from the named profile and applies any
+// individually supplied overrides. explicit holds the names of flags the user
+// actually set, so unset flags never clobber profile values.
+func resolveSCLThresholds(profile string, spamThreshold int, bands string, explicit map[string]bool) (SCLThresholds, error) {
+	t, ok := sclProfiles[strings.ToLower(profile)]
+	if !ok {
+		return SCLThresholds{}, eris.Errorf("unknown profile %q (valid: strict, balanced, lenient)", profile)
+	}
+
+	if explicit["scl-bands"] {
+		parts := strings.Split(bands, ",")
+		if len(parts) != 3 {
+			return SCLThresholds{}, eris.Errorf("scl-bands must be three comma-separated scores, got %q", bands)
+		}
+		values := make([]int, 3)
+		for i, p := range parts {
+			v, err := strconv.Atoi(strings.TrimSpace(p))
+			if err != nil {
+				return SCLThresholds{}, eris.Wrapf(err, "invalid scl-bands value %q", p)
+			}
+			values[i] = v
+		}
+		t.LowSpam, t.Spam, t.HighConfidence = values[0], values[1], values[2]
+	}
+
+	if explicit["spam-threshold"] {
+		t.SpamThreshold = spamThreshold
+	}
+
+	// Bands must be ascending and within the valid SCL range
+	if t.LowSpam < 1 || t.LowSpam > t.Spam || t.Spam > t.HighConfidence || t.HighConfidence > 9 {
+		return SCLThresholds{}, eris.Errorf("scl-bands must satisfy 1 <= low <= spam <= high <= 9, got %d,%d,%d",
+			t.LowSpam, t.Spam, t.HighConfidence)
+	}
+	if t.SpamThreshold < 0 || t.SpamThreshold > 9 {
+		return SCLThresholds{}, eris.Errorf("spam-threshold must be between 0 and 9, got %d", t.SpamThreshold)
+	}
+
+	return t, nil
+}
+
+// gatewayHeaderPrefixes maps lowercase header name prefixes to the mail
+// security vendor that stamps them. Add entries as new gateways are observed.
+var gatewayHeaderPrefixes = []struct {
+	prefix string
+	vendor string
+}{
+	{"x-forefront-antispam-report", "Microsoft"},
+	{"x-microsoft-antispam", "Microsoft"},
+	{"x-ms-exchange-organization-scl", "Microsoft"},
+	{"x-proofpoint-", "Proofpoint"},
+	{"x-barracuda-", "Barracuda"},
+	{"x-mimecast-", "Mimecast"},
+	{"x-ironport-", "Cisco"},
+	{"x-brightmail-tracker", "Symantec"},
+	{"x-fireeye", "Trellix"},
+	{"x-tm-as-", "Trend Micro"},
+	{"x-sophos-", "Sophos"},
+	{"x-forcepoint-", "Forcepoint"},
+	{"x-vade-", "Vade"},
+	{"x-fe-", "Trellix"},
+	{"x-feas-", "Fortinet"},
+}
+
+// detectGateways reports which mail security gateways touched the message,
+// judged purely by which of their headers are present. The result is sorted
+// and free of duplicates.
+func detectGateways(header mail.Header) []string {
+	found := make(map[string]bool)
+	for name := range header {
+		lower := strings.ToLower(name)
+		for _, g := range gatewayHeaderPrefixes {
+			if strings.HasPrefix(lower, g.prefix) {
+				found[g.vendor] = true
+			}
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	return sortedKeys(found)
+}
+
+// Patterns are safe from ReDoS: literal key + bounded numeric class
+var (
+	spamStatusScoreRegex    = regexp.MustCompile(`score=(-?[0-9]+(?:\.[0-9]+)?)`)
+	spamStatusRequiredRegex = regexp.MustCompile(`required=(-?[0-9]+(?:\.[0-9]+)?)`)
+	spamStatusTestsRegex    = regexp.MustCompile(`tests=([^ ]*)`)
+)
+
+// parseSpamAssassin parses the X-Spam-Status, X-Spam-Flag, X-Spam-Score and
+// X-Spam-Checker-Version headers. Returns nil when none are present.
+func parseSpamAssassin(header mail.Header) *SpamAssassinResult {
+	status := header.Get("X-Spam-Status")
+	spamFlag := header.Get("X-Spam-Flag")
+	score := header.Get("X-Spam-Score")
+	checker := header.Get("X-Spam-Checker-Version")
+	spamReport := header.Get("X-Spam-Report")
+	if status == "" && spamFlag == "" && score == "" && checker == "" && spamReport == "" {
+		return nil
+	}
+
+	// Validate header length
+	if len(status) > MaxHeaderLength {
+		log.Printf("Warning: X-Spam-Status header exceeds maximum length, truncating")
+		status = status[:MaxHeaderLength]
+	}
+
+	result := &SpamAssassinResult{}
+	status = strings.Join(strings.Fields(status), " ")
+	if strings.HasPrefix(strings.ToLower(status), "yes") || strings.EqualFold(strings.TrimSpace(spamFlag), "yes") {
+		result.IsSpam = true
+	}
+
+	if match := spamStatusScoreRegex.FindStringSubmatch(status); len(match) > 1 {
+		result.Score, _ = strconv.ParseFloat(match[1], 64)
+	} else if v, err := strconv.ParseFloat(strings.TrimSpace(score), 64); err == nil {
+		result.Score = v
+	}
+	if match := spamStatusRequiredRegex.FindStringSubmatch(status); len(match) > 1 {
+		result.Required, _ = strconv.ParseFloat(match[1], 64)
+	}
+	// The tests list is folded after commas, so rejoin it before matching
+	if match := spamStatusTestsRegex.FindStringSubmatch(strings.ReplaceAll(status, ", ", ",")); len(match) > 1 {
+		for _, test := range strings.Split(match[1], ",") {
+			if test = strings.TrimSpace(test); test != "" && test != "none" {
+				result.Tests = append(result.Tests, sanitizeHeader(test))
+			}
+		}
+	}
+
+	result.Engine, result.EngineVersion = parseSpamCheckerVersion(checker)
+	result.Rules = parseSpamReport(spamReport)
+
+	return result
+}
+
+// sclVerdict maps an SCL score to the shared verdict categories. SCL -1
+// (filtering skipped) counts as not spam.
+func sclVerdict(score int, t SCLThresholds) string {
+	switch {
+	case score >= t.HighConfidence:
+		return VerdictHighConfidence
+	case score >= t.Spam:
+		return VerdictSpam
+	case score >= t.LowSpam:
+		return VerdictLowSpam
+	default:
+		return VerdictNotSpam
+	}
+}
+
+// collectVerdicts gathers the verdict of every spam engine in the report, in
+// a fixed source order: SCL, SpamAssassin, Mimecast. SpamAssassin's score is
+// mapped through its score bands; a message it flagged as spam is at least
+// spam whatever the score.
+func (a *Analyzer) collectVerdicts(report *EmailSecurityReport) []SpamVerdict {
+	var verdicts []SpamVerdict
+	if report.SCL != nil {
+		verdicts = append(verdicts, SpamVerdict{Source: "scl", Verdict: sclVerdict(report.SCL.Score, a.Thresholds)})
+	}
+	if report.SpamAssassin != nil {
+		verdict := a.scoreBands("spamassassin").verdict(report.SpamAssassin.Score)
+		if report.SpamAssassin.IsSpam && verdictSeverity[verdict] < verdictSeverity[VerdictSpam] {
+			verdict = VerdictSpam
+		}
+		verdicts = append(verdicts, SpamVerdict{Source: "spamassassin", Verdict: verdict})
+	}
+	if report.Mimecast != nil {
+		verdicts = append(verdicts, SpamVerdict{Source: "mimecast", Verdict: report.Mimecast.Verdict})
+	}
+	return verdicts
+}
+
+// consolidateVerdicts combines engine verdicts into one under a policy:
+//
+//   - most-severe: the most severe verdict wins
+//   - majority: the most common verdict wins; ties go to the more severe
+//   - first: the first verdict wins (see collectVerdicts for the order)
+//
+// An unknown policy falls back to most-severe. Contributors lists the
+// verdicts that decided the result.
+func consolidateVerdicts(verdicts []SpamVerdict, policy string) ConsolidatedVerdict {
+	if !slices.Contains(verdictPolicies, policy) {
+		policy = verdictPolicies[0]
+	}
+	result := ConsolidatedVerdict{Policy: policy, Inputs: verdicts}
+	if len(verdicts) == 0 {
+		return result
+	}
+
+	counts := make(map[string]int)
+	for _, v := range verdicts {
+		counts[v.Verdict]++
+	}
+	result.Disagreement = len(counts) > 1
+
+	switch policy {
+	case "first":
+		result.Verdict = verdicts[0].Verdict
+		result.Contributors = verdicts[:1]
+		return result
+	case "majority":
+		for verdict, n := range counts {
+			best := counts[result.Verdict]
+			if n > best || (n == best && verdictSeverity[verdict] > verdictSeverity[result.Verdict]) {
+				result.Verdict = verdict
+			}
+		}
+	default:
+		result.Verdict = verdicts[0].Verdict
+		for _, v := range verdicts[1:] {
+			if verdictSeverity[v.Verdict] > verdictSeverity[result.Verdict] {
+				result.Verdict = v.Verdict
+			}
 		}
+	}
 
-		// Seek back to start
-		if _, err := f.Seek(0, 0); err != nil {
-			return nil, eris.Wrap(err, "failed to seek file")
+	for _, v := range verdicts {
+		if v.Verdict == result.Verdict {
+			result.Contributors = append(result.Contributors, v)
 		}
+	}
+	return result
+}
 
-		// Try to extract email content from MSG file
-		// MSG files are OLE/CFBF format, but we'll try a simpler approach first
-		// by looking for embedded RFC822 message
-		emailData, err = extractEmailFromMsg(f, stat.Size())
-		if err != nil {
-			return nil, eris.Wrap(err, "failed to extract email from MSG file")
+// parseMimecast parses the X-Mimecast-Spam-Score and X-Mimecast-Spam-Signature
+// headers into the shared verdict categories. The more severe of the score
+// band and the signature wins. Returns nil when no X-Mimecast-* header is
+// present.
+func parseMimecast(header mail.Header, bands ScoreBands) *MimecastResult {
+	present := false
+	for name := range header {
+		if strings.HasPrefix(strings.ToLower(name), "x-mimecast-") {
+			present = true
+			break
 		}
 	}
+	if !present {
+		return nil
+	}
 
-	// Parse the email
-	return parseEmail(emailData, includeRawHeaders)
+	result := &MimecastResult{
+		Signature: strings.ToLower(sanitizeHeader(header.Get("X-Mimecast-Spam-Signature"))),
+	}
+	if score, err := strconv.Atoi(strings.TrimSpace(header.Get("X-Mimecast-Spam-Score"))); err == nil {
+		result.Score = score
+	}
+
+	result.Verdict = bands.verdict(float64(result.Score))
+
+	signatureVerdict := VerdictNotSpam
+	switch result.Signature {
+	case "spam":
+		signatureVerdict = VerdictSpam
+	case "bulk":
+		signatureVerdict = VerdictLowSpam
+	}
+	if verdictSeverity[signatureVerdict] > verdictSeverity[result.Verdict] {
+		result.Verdict = signatureVerdict
+	}
+
+	return result
 }
 
-// extractEmailFromMsg attempts to extract RFC822 email data from .msg file
-// .msg files can contain the email in various formats, we'll try common approaches
-func extractEmailFromMsg(r io.ReaderAt, size int64) ([]byte, error) {
-	// Strategy 1: Try to open as a ZIP file (some .msg files are ZIP-based)
-	zr, err := zip.NewReader(r, size)
-	if err == nil {
-		// Check number of files in ZIP to prevent zip bombs
-		if len(zr.File) > MaxZipFiles {
-			return nil, eris.Errorf("zip contains too many files: %d (max %d)", len(zr.File), MaxZipFiles)
-		}
-
-		// Look for email content in the ZIP
-		for _, f := range zr.File {
-			// Check compression ratio to detect zip bombs
-			if f.UncompressedSize64 > 0 && f.CompressedSize64 > 0 {
-				ratio := f.UncompressedSize64 / f.CompressedSize64
-				if ratio > MaxCompressionRatio {
-					return nil, eris.Errorf("suspicious compression ratio detected: %d:1 (max %d:1)",
-						ratio, MaxCompressionRatio)
+// spamReportRuleRegex finds the start of each rule in an unfolded
+// X-Spam-Report: a points value followed by an upper-case rule name.
+// Pattern is safe from ReDoS: RE2 matching with bounded numeric classes
+var spamReportRuleRegex = regexp.MustCompile(`(?:^|\s)(-?[0-9]{1,4}\.[0-9]{1,3})\s+([A-Z][A-Z0-9_]+)\b`)
+
+// parseSpamReport extracts the per-rule point breakdown from X-Spam-Report.
+// Both the "*  1.5 RULE Description" list and the aligned "pts rule name
+// description" table are supported; the header is unfolded first, so a
+// description continued on the next line (e.g. "[URIs: example.com]") stays
+// with its rule. Separator lines and "*" markers are dropped.
+func parseSpamReport(value string) []SpamAssassinRule {
+	if len(value) > MaxHeaderLength {
+		log.Printf("Warning: X-Spam-Report header exceeds maximum length, truncating")
+		value = value[:MaxHeaderLength]
+	}
+	value = strings.Join(strings.Fields(sanitizeHeader(value)), " ")
+
+	matches := spamReportRuleRegex.FindAllStringSubmatchIndex(value, MaxRegexMatches)
+	rules := make([]SpamAssassinRule, 0, len(matches))
+	for i, m := range matches {
+		end := len(value)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+		var description []string
+		for _, word := range strings.Fields(value[m[1]:end]) {
+			if strings.Trim(word, "-*") != "" {
+				description = append(description, word)
+			}
+		}
+		score, _ := strconv.ParseFloat(value[m[2]:m[3]], 64)
+		rules = append(rules, SpamAssassinRule{
+			Name:        value[m[4]:m[5]],
+			Score:       score,
+			Description: strings.Join(description, " "),
+		})
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	return rules
+}
+
+// parseSpamCheckerVersion splits X-Spam-Checker-Version (e.g. "SpamAssassin
+// 3.4.6 (2021-04-09) on mail.example.com") into engine name and version.
+// Both are empty when the header is absent.
+func parseSpamCheckerVersion(value string) (string, string) {
+	fields := strings.Fields(sanitizeHeader(value))
+	if len(fields) == 0 {
+		return "", ""
+	}
+	engine := fields[0]
+	version := ""
+	if len(fields) > 1 && strings.IndexFunc(fields[1], unicode.IsDigit) == 0 {
+		version = fields[1]
+	}
+	return engine, version
+}
+
+// obsoleteZones maps the RFC 5322 obsolete zone names (section 4.3) to UTC
+// offsets. time.Parse accepts any abbreviation but treats unknown ones as
+// UTC, so named zones are rewritten as numeric offsets before parsing.
+var obsoleteZones = map[string]string{
+	"UT":  "+0000",
+	"GMT": "+0000",
+	"Z":   "+0000",
+	"EST": "-0500",
+	"EDT": "-0400",
+	"CST": "-0600",
+	"CDT": "-0500",
+	"MST": "-0700",
+	"MDT": "-0600",
+	"PST": "-0800",
+	"PDT": "-0700",
+}
+
+var dateCommentRegex = regexp.MustCompile(`\([^()]*\)`)
+
+// parseReceivedDate parses the date of a Received header. Comments such as
+// "(PST)" are dropped and named zones are converted to numeric offsets.
+func parseReceivedDate(value string) (time.Time, error) {
+	// Pattern is safe from ReDoS: negated character class, no nesting
+	value = dateCommentRegex.ReplaceAllString(value, " ")
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return time.Time{}, eris.New("empty date")
+	}
+	if offset, ok := obsoleteZones[strings.ToUpper(fields[len(fields)-1])]; ok {
+		fields[len(fields)-1] = offset
+	}
+	t, err := mail.ParseDate(strings.Join(fields, " "))
+	if err != nil {
+		return time.Time{}, eris.Wrapf(err, "unparseable date %q", value)
+	}
+	return t, nil
+}
+
+// dateSkew returns how far date (a Date header) is ahead of delivery, the
+// newest Received hop with a parseable timestamp; negative means the Date is
+// older. ok is false when the Date or every Received date is missing or
+// unparseable. Parsing the Date is recorded in diag, which may be nil.
+func dateSkew(date string, hops []ReceivedHop, diag *parserLog) (time.Duration, bool) {
+	sent, err := parseReceivedDate(date)
+	diag.recordUnused("date", err == nil, date != "", "Date header present but not a recognizable date")
+	if err != nil {
+		return 0, false
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !hops[i].parsed.IsZero() {
+			return sent.Sub(hops[i].parsed), true
+		}
+	}
+	return 0, false
+}
+
+// Patterns are safe from ReDoS: keyword + single non-space run
+var (
+	receivedFromRegex = regexp.MustCompile(`(?i)(?:^|\s)from\s+(\S+)`)
+	receivedByRegex   = regexp.MustCompile(`(?i)(?:^|\s)by\s+(\S+)`)
+	receivedWithRegex = regexp.MustCompile(`(?i)(?:^|\s)with\s+(\S+)`)
+)
+
+// parseReceivedChain parses the Received headers oldest first. Each hop keeps
+// its original timestamp alongside the UTC form (and loc's form when loc is
+// set), and records the delay since the previous hop with a parseable date.
+// Clock skew between relays can make a delay negative; it is reported as is.
+// The second result is the transit time from the earliest to the latest
+// parseable hop. Unparseable dates are recorded in diag, which may be nil.
+func parseReceivedChain(header mail.Header, loc *time.Location, diag *parserLog) ([]ReceivedHop, int64) {
+	values := header["Received"]
+	if len(values) == 0 {
+		diag.record("received", false, "")
+		return nil, 0
+	}
+	if len(values) > MaxRegexMatches {
+		log.Printf("Warning: more than %d Received headers, ignoring the oldest", MaxRegexMatches)
+		values = values[:MaxRegexMatches]
+	}
+
+	hops := make([]ReceivedHop, 0, len(values))
+	unparsed := 0
+	// Relays prepend Received headers, so walk them from the bottom
+	for i := len(values) - 1; i >= 0; i-- {
+		value := values[i]
+		if len(value) > MaxHeaderLength {
+			log.Printf("Warning: Received header exceeds maximum length, truncating")
+			value = value[:MaxHeaderLength]
+		}
+
+		var hop ReceivedHop
+		clauses, date, hasDate := value, "", false
+		if idx := strings.LastIndex(value, ";"); idx >= 0 {
+			clauses, date, hasDate = value[:idx], value[idx+1:], true
+		}
+		if match := receivedFromRegex.FindStringSubmatch(clauses); len(match) > 1 {
+			hop.From = sanitizeHeader(match[1])
+		}
+		// The from clause runs up to "by"; its comment holds the peer address
+		fromClause := clauses
+		if loc := receivedByRegex.FindStringSubmatchIndex(clauses); loc != nil {
+			hop.By = sanitizeHeader(clauses[loc[2]:loc[3]])
+			fromClause = clauses[:loc[0]]
+		}
+		hop.FromIP = parseHopIP(fromClause)
+		hop.FromIPScope = ipScope(hop.FromIP)
+		if match := receivedWithRegex.FindStringSubmatch(clauses); len(match) > 1 {
+			hop.With = sanitizeHeader(match[1])
+		}
+		if hasDate {
+			hop.Timestamp = sanitizeHeader(strings.Join(strings.Fields(date), " "))
+			if t, err := parseReceivedDate(date); err == nil {
+				hop.parsed = t
+				hop.TimestampUTC = t.UTC().Format(time.RFC3339)
+				if loc != nil {
+					hop.TimestampLocal = t.In(loc).Format(time.RFC3339)
+				}
+			}
+		}
+		if hop.TimestampUTC == "" {
+			unparsed++
+		}
+		hops = append(hops, hop)
+	}
+	receivedErr := ""
+	if unparsed > 0 {
+		receivedErr = fmt.Sprintf("%d of %d Received dates could not be parsed", unparsed, len(hops))
+	}
+	diag.record("received", true, receivedErr)
+
+	var first, prev time.Time
+	for i := range hops {
+		if hops[i].parsed.IsZero() {
+			continue
+		}
+		if prev.IsZero() {
+			first = hops[i].parsed
+		} else {
+			hops[i].DelaySeconds = int64(hops[i].parsed.Sub(prev).Seconds())
+		}
+		prev = hops[i].parsed
+	}
+
+	var transit int64
+	if !first.IsZero() {
+		transit = int64(prev.Sub(first).Seconds())
+	}
+	return hops, transit
+}
+
+// hopIPRegex matches an address literal in a Received from clause, as
+// "[192.0.2.1]", "[IPv6:2001:db8::1]" or "(2001:db8::1)".
+// Pattern is safe from ReDoS: single bounded character class
+var hopIPRegex = regexp.MustCompile(`[\[(](?:IPv6:)?([0-9A-Fa-f:.]{2,45})[\])]`)
+
+// hopCommentRegex matches a parenthesized comment in a Received from clause,
+// where the receiving server records the TCP peer it actually saw.
+// Pattern is safe from ReDoS: single negated character class
+var hopCommentRegex = regexp.MustCompile(`\([^()]*\)`)
+
+// parseHopIP returns the source address of a Received from clause, or ""
+// when it names none. The TCP-info comment, as in "(host [192.0.2.1])", is
+// preferred: a bracketed literal before it is only the sender's HELO
+// argument, which the sender chooses freely. The HELO literal is used when
+// no comment carries an address.
+func parseHopIP(clause string) string {
+	for _, comment := range hopCommentRegex.FindAllString(clause, MaxRegexMatches) {
+		if ip := firstHopIP(comment); ip != "" {
+			return ip
+		}
+	}
+	return firstHopIP(hopCommentRegex.ReplaceAllString(clause, " "))
+}
+
+// firstHopIP returns the first valid address literal in s, or ""
+func firstHopIP(s string) string {
+	for _, match := range hopIPRegex.FindAllStringSubmatch(s, MaxRegexMatches) {
+		if ip := parseIPValue(match[1]); ip != "" {
+			return ip
+		}
+	}
+	return ""
+}
+
+// IP scopes of Received hop sources
+const (
+	ScopePublic      = "public"
+	ScopePrivate     = "private" // RFC 1918, RFC 6598 shared and IPv6 ULA space
+	ScopeLoopback    = "loopback"
+	ScopeLinkLocal   = "link-local"
+	ScopeNonRoutable = "non-routable" // Unspecified, multicast, broadcast or reserved: never a TCP peer
+)
+
+// sharedAddressSpace is RFC 6598 carrier-grade NAT space (100.64.0.0/10),
+// which net.IP.IsPrivate does not include
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// ipScope classifies ip (as returned by parseIPValue) for routing checks.
+// Returns "" for an unparseable address.
+func ipScope(ip string) string {
+	parsed := net.ParseIP(ip)
+	switch {
+	case parsed == nil:
+		return ""
+	case parsed.IsLoopback():
+		return ScopeLoopback
+	case parsed.IsLinkLocalUnicast():
+		return ScopeLinkLocal
+	case parsed.IsPrivate() || sharedAddressSpace.Contains(parsed):
+		return ScopePrivate
+	case parsed.IsUnspecified() || parsed.IsMulticast() || parsed.Equal(net.IPv4bcast),
+		parsed.To4() != nil && parsed.To4()[0] >= 240:
+		return ScopeNonRoutable
+	default:
+		return ScopePublic
+	}
+}
+
+// detectSuspiciousRouting looks for sequences in a Received chain (oldest
+// first) that no real delivery produces, returning an explanation or "".
+// Only clear impossibilities are flagged, because legitimate mail routinely
+// goes private -> public -> private (sender LAN, Internet, recipient LAN):
+//   - a hop received from a non-routable address, which cannot open a TCP
+//     connection
+//   - the same private address handing the message to the same by host on
+//     both sides of a public hop: a private address is only reachable inside
+//     one network, so the message cannot have left that network over the
+//     Internet and been handed over between the same internal hosts again.
+//     The address alone is not enough, since two organisations may both
+//     number a relay 10.0.0.1.
+func detectSuspiciousRouting(hops []ReceivedHop) string {
+	lastPublic := 0
+	firstPrivate := make(map[string]int) // By FromIP and lowercase By host
+	for i, hop := range hops {
+		n := i + 1
+		switch hop.FromIPScope {
+		case ScopeNonRoutable:
+			return fmt.Sprintf("hop %d was received from %s, which is non-routable and cannot be a sending host", n, hop.FromIP)
+		case ScopePublic:
+			lastPublic = n
+		case ScopePrivate:
+			if hop.By == "" {
+				continue
+			}
+			key := hop.FromIP + " " + strings.ToLower(hop.By)
+			first, seen := firstPrivate[key]
+			if !seen {
+				firstPrivate[key] = n
+			} else if lastPublic > first {
+				return fmt.Sprintf("private address %s sent hop %d and again hop %d to %s, after hop %d came from the public Internet", hop.FromIP, first, n, hop.By, lastPublic)
+			}
+		}
+	}
+	return ""
+}
+
+var listUnsubscribeEntryRegex = regexp.MustCompile(`<([^<>]+)>`)
+
+// parseListUnsubscribe parses List-Unsubscribe and List-Unsubscribe-Post headers.
+// Legitimate bulk senders include these headers, so their presence helps separate
+// commercial mail from targeted threats. Returns nil when List-Unsubscribe is absent.
+func parseListUnsubscribe(header mail.Header) *ListUnsubscribeResult {
+	listUnsub := header.Get("List-Unsubscribe")
+	if listUnsub == "" {
+		return nil
+	}
+
+	// Validate header length
+	if len(listUnsub) > MaxHeaderLength {
+		log.Printf("Warning: List-Unsubscribe header exceeds maximum length, truncating")
+		listUnsub = listUnsub[:MaxHeaderLength]
+	}
+
+	result := &ListUnsubscribeResult{
+		RawHeader: sanitizeHeader(listUnsub),
+	}
+
+	// Entries are angle-bracketed URIs separated by commas: <mailto:...>, <https://...>
+	for _, match := range listUnsubscribeEntryRegex.FindAllStringSubmatch(listUnsub, MaxRegexMatches) {
+		uri := sanitizeHeader(match[1])
+		lower := strings.ToLower(uri)
+		switch {
+		case strings.HasPrefix(lower, "mailto:"):
+			result.Mailtos = append(result.Mailtos, uri)
+		case strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "http://"):
+			result.URLs = append(result.URLs, uri)
+		}
+	}
+
+	if post := header.Get("List-Unsubscribe-Post"); post != "" {
+		result.PostPresent = true
+		result.OneClickUnsubscribe = strings.EqualFold(strings.TrimSpace(post), "List-Unsubscribe=One-Click")
+	}
+
+	return result
+}
+
+// parseAutomation parses Precedence and Auto-Submitted. Only the keyword is
+// kept: Auto-Submitted parameters ("auto-generated; owner-email=...") and
+// comments are dropped. Returns nil when neither header is present, so human
+// mail is unaffected.
+func parseAutomation(header mail.Header) *AutomationInfo {
+	keyword := func(name string) string {
+		value, _, _ := strings.Cut(header.Get(name), ";")
+		value, _, _ = strings.Cut(value, "(")
+		return sanitizeHeader(strings.ToLower(strings.TrimSpace(value)))
+	}
+	info := &AutomationInfo{Precedence: keyword("Precedence"), AutoSubmitted: keyword("Auto-Submitted")}
+	if info.Precedence == "" && info.AutoSubmitted == "" {
+		return nil
+	}
+	info.Bulk = info.Precedence == "bulk" || info.Precedence == "list" || info.Precedence == "junk"
+	info.Automated = info.AutoSubmitted != "" && info.AutoSubmitted != "no"
+	return info
+}
+
+// parseThreadInfo parses In-Reply-To and References into Message-ID lists and
+// checks whether the sender plausibly belongs to the thread. Returns nil when
+// neither header is present.
+//
+// A reply whose From domain matches none of the domains in an established
+// thread (two or more referenced messages) is flagged, since a genuine
+// participant's earlier messages normally appear in References. First replies
+// are not flagged because the replier has not posted to the thread yet.
+func parseThreadInfo(header mail.Header, fromDomain string) *ThreadInfo {
+	inReplyTo := header.Get("In-Reply-To")
+	references := header.Get("References")
+	if inReplyTo == "" && references == "" {
+		return nil
+	}
+
+	info := &ThreadInfo{
+		InReplyTo:  extractMessageIDs(inReplyTo),
+		References: extractMessageIDs(references),
+	}
+	info.IsReply = len(info.InReplyTo) > 0
+
+	seen := make(map[string]bool)
+	referenced := make(map[string]bool)
+	for _, id := range append(append([]string{}, info.References...), info.InReplyTo...) {
+		referenced[id] = true
+		at := strings.LastIndex(id, "@")
+		if at == -1 {
+			continue
+		}
+		domain := strings.ToLower(id[at+1:])
+		if !seen[domain] {
+			seen[domain] = true
+			info.ThreadDomains = append(info.ThreadDomains, domain)
+		}
+	}
+
+	if info.IsReply && fromDomain != "" && len(referenced) >= 2 && len(info.ThreadDomains) > 0 {
+		info.ReplyDomainMismatch = true
+		for _, domain := range info.ThreadDomains {
+			if sameOrganization(fromDomain, domain) {
+				info.ReplyDomainMismatch = false
+				break
+			}
+		}
+	}
+
+	return info
+}
+
+var messageIDRegex = regexp.MustCompile(`<([^<>\s]+)>`)
+
+// extractMessageIDs returns the angle-bracketed Message-IDs in a header value
+func extractMessageIDs(value string) []string {
+	if len(value) > MaxHeaderLength {
+		log.Printf("Warning: Message-ID list exceeds maximum length, truncating")
+		value = value[:MaxHeaderLength]
+	}
+
+	var ids []string
+	for _, match := range messageIDRegex.FindAllStringSubmatch(value, MaxRegexMatches) {
+		ids = append(ids, sanitizeHeader(match[1]))
+	}
+	return ids
+}
+
+// parseIPValue returns the normalized IP in a header value, which may be
+// bracketed ("[192.0.2.1]"), or "" if it is not a valid IP
+func parseIPValue(value string) string {
+	if ip := net.ParseIP(strings.Trim(strings.TrimSpace(value), "[]")); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// guidRegex matches a GUID such as a Microsoft 365 tenant ID.
+// Pattern is safe from ReDoS: fixed-length hex groups
+var guidRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// parseTenantProvenance parses the X-MS-Exchange-CrossTenant-* headers. A
+// tenant ID that is not a GUID is dropped. The topmost (most recent) value
+// of each header is used. Returns nil for mail that never passed through
+// Exchange Online.
+func parseTenantProvenance(header mail.Header) *TenantProvenance {
+	get := func(name string) string {
+		return sanitizeHeader(header.Get("X-MS-Exchange-CrossTenant-" + name))
+	}
+	result := &TenantProvenance{
+		UserPrincipalName:   get("UserPrincipalName"),
+		AuthAs:              get("AuthAs"),
+		AuthSource:          get("AuthSource"),
+		FromEntityHeader:    get("FromEntityHeader"),
+		NetworkMessageID:    get("Network-Message-Id"),
+		OriginalArrivalTime: get("OriginalArrivalTime"),
+	}
+	if id := get("Id"); guidRegex.MatchString(id) {
+		result.TenantID = strings.ToLower(id)
+	}
+	if *result == (TenantProvenance{}) {
+		return nil
+	}
+	return result
+}
+
+// senderIDResults are the results Sender-ID defines (RFC 4406 section 6)
+var senderIDResults = []string{"pass", "fail", "softfail", "neutral", "none", "temperror", "permerror"}
+
+// parseSenderID parses X-SID-PRA and X-SID-Result. The PRA is reduced to its
+// address when it parses as one; a result outside senderIDResults is
+// dropped. Returns nil when neither yields a value, so modern mail is
+// unaffected. The run is recorded in diag, which may be nil.
+func parseSenderID(header mail.Header, diag *parserLog) *SenderIDResult {
+	result := &SenderIDResult{PRA: sanitizeHeader(strings.TrimSpace(header.Get("X-SID-PRA")))}
+	if addr, err := mail.ParseAddress(result.PRA); err == nil {
+		result.PRA = sanitizeHeader(addr.Address)
+	}
+	// Some servers append a comment, e.g. "Pass (sender authenticated)"
+	if fields := strings.Fields(header.Get("X-SID-Result")); len(fields) > 0 {
+		if value := strings.ToLower(strings.TrimRight(fields[0], ";")); slices.Contains(senderIDResults, value) {
+			result.Result = value
+		}
+	}
+	if *result == (SenderIDResult{}) {
+		present := header.Get("X-SID-PRA") != "" || header.Get("X-SID-Result") != ""
+		diag.recordUnused("sender-id", false, present, "Sender-ID headers present but empty or with an unknown result")
+		return nil
+	}
+	diag.record("sender-id", true, "")
+	return result
+}
+
+// countRecipients counts the addresses in every To and Cc header. Each list
+// is parsed with mail.ParseAddressList; if that fails, the list is split on
+// top-level commas and each entry parsed alone, so one bad address does not
+// hide the rest. Returns nil when the message has neither header. The run is
+// recorded in diag, which may be nil.
+func countRecipients(header mail.Header, diag *parserLog) *RecipientCount {
+	to, toErrs := countAddresses(header["To"])
+	cc, ccErrs := countAddresses(header["Cc"])
+	if len(header["To"]) == 0 && len(header["Cc"]) == 0 {
+		diag.record("recipients", false, "")
+		return nil
+	}
+	result := &RecipientCount{To: to, Cc: cc, Total: to + cc, ParseErrors: append(toErrs, ccErrs...)}
+	recipientsErr := ""
+	if len(result.ParseErrors) > 0 {
+		recipientsErr = fmt.Sprintf("%d To/Cc addresses could not be parsed", len(result.ParseErrors))
+	}
+	diag.record("recipients", true, recipientsErr)
+	return result
+}
+
+// countAddresses counts the addresses in the given header values, returning
+// the (sanitized) entries that could not be parsed
+func countAddresses(values []string) (int, []string) {
+	count := 0
+	var failed []string
+	for _, value := range values {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		if addrs, err := mail.ParseAddressList(value); err == nil {
+			count += len(addrs)
+			continue
+		}
+		for _, entry := range splitAddressList(value) {
+			if _, err := mail.ParseAddress(entry); err == nil {
+				count++
+			} else {
+				failed = append(failed, sanitizeHeader(entry))
+			}
+		}
+	}
+	return count, failed
+}
+
+// replyToDomains returns the distinct lowercased domains of the addresses in
+// the given Reply-To values. A message may carry several Reply-To headers,
+// each a list; entries net/mail rejects fall back to addressDomain. The run
+// is recorded in diag, which may be nil.
+func replyToDomains(values []string, diag *parserLog) []string {
+	var domains []string
+	seen := make(map[string]bool)
+	add := func(domain string) {
+		domain = sanitizeHeader(domain)
+		if domain != "" && !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	for _, value := range values {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		if addrs, err := mail.ParseAddressList(value); err == nil {
+			for _, addr := range addrs {
+				add(addressDomain(addr.Address))
+			}
+			continue
+		}
+		for _, entry := range splitAddressList(value) {
+			add(addressDomain(entry))
+		}
+	}
+	diag.recordUnused("reply-to", len(domains) > 0, len(values) > 0, "Reply-To present but no address domain parsed")
+	return domains
+}
+
+// splitAddressList splits an address list on the commas that separate
+// entries, ignoring commas in quoted strings, comments and angle brackets.
+// Empty entries are dropped.
+func splitAddressList(value string) []string {
+	var entries []string
+	var quoted, escaped bool
+	depth, start := 0, 0
+	for i, r := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case quoted:
+		case r == '(' || r == '<':
+			depth++
+		case (r == ')' || r == '>') && depth > 0:
+			depth--
+		case r == ',' && depth == 0:
+			entries = append(entries, value[start:i])
+			start = i + 1
+		}
+	}
+	entries = append(entries, value[start:])
+	kept := entries[:0]
+	for _, entry := range entries {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// parseSenderIP returns the sending client IP, preferring the CIP token of
+// X-Forefront-Antispam-Report and falling back to the gateway variants in
+// senderIPHeaders. Invalid values are skipped. Returns nil when no header
+// yields a valid IP. The run is recorded in diag, which may be nil.
+func parseSenderIP(header mail.Header, diag *parserLog) *SenderIP {
+	if ip := parseIPValue(parseForefrontTokens(decodeHeaderValue(header.Get("X-Forefront-Antispam-Report")))["CIP"]); ip != "" {
+		diag.record("sender-ip", true, "")
+		return &SenderIP{IP: ip, Source: "X-Forefront-Antispam-Report (CIP)"}
+	}
+	present := false
+	for _, name := range senderIPHeaders {
+		value := header.Get(name)
+		if ip := parseIPValue(value); ip != "" {
+			diag.record("sender-ip", true, "")
+			return &SenderIP{IP: ip, Source: name}
+		}
+		present = present || value != ""
+	}
+	diag.recordUnused("sender-ip", false, present, "sender IP header present but not a valid IP")
+	return nil
+}
+
+// sfsRuleRegex matches one parenthesized SFS rule ID, e.g. "(13230040)".
+// Pattern is safe from ReDoS: a single bounded digit run
+var sfsRuleRegex = regexp.MustCompile(`\((\d{1,20})\)`)
+
+// signalFingerprint hashes the campaign-level spam signals of the
+// X-Forefront-Antispam-Report header so messages from one campaign share a
+// value. The hashed text is "cat=<CAT>;sfv=<SFV>;sfs=<ids>;net=<prefix>",
+// where CAT and SFV are upper-cased, ids are the SFS rule IDs de-duplicated,
+// sorted numerically and joined with commas, and prefix is the CIP's /24
+// (IPv4) or /48 (IPv6) network; absent tokens are left empty. The result is
+// the first 16 hex digits of the SHA-256 of that text, or "" when none of
+// the four tokens is present.
+func signalFingerprint(header mail.Header) string {
+	tokens := parseForefrontTokens(decodeHeaderValue(header.Get("X-Forefront-Antispam-Report")))
+
+	var ids []int
+	for _, m := range sfsRuleRegex.FindAllStringSubmatch(tokens["SFS"], MaxRegexMatches) {
+		if id, err := strconv.Atoi(m[1]); err == nil && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	rules := make([]string, len(ids))
+	for i, id := range ids {
+		rules[i] = strconv.Itoa(id)
+	}
+
+	network := ipNetwork(parseIPValue(tokens["CIP"]))
+	cat := strings.ToUpper(tokens["CAT"])
+	sfv := strings.ToUpper(tokens["SFV"])
+	if cat == "" && sfv == "" && len(rules) == 0 && network == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte("cat=" + cat + ";sfv=" + sfv + ";sfs=" + strings.Join(rules, ",") + ";net=" + network))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ipNetwork returns the /24 (IPv4) or /48 (IPv6) network containing ip in
+// CIDR form, e.g. "203.0.113.0/24", or "" when ip is not an address. Senders
+// in one campaign or provider usually share it.
+func ipNetwork(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		mask := net.CIDRMask(24, 32)
+		return (&net.IPNet{IP: v4.Mask(mask), Mask: mask}).String()
+	}
+	mask := net.CIDRMask(48, 128)
+	return (&net.IPNet{IP: parsed.Mask(mask), Mask: mask}).String()
+}
+
+// parseSenderCountry returns the sender's country as Exchange Online
+// determined it (the CTRY token of X-Forefront-Antispam-Report), upper-cased,
+// or "" when absent or not a two-letter code
+func parseSenderCountry(header mail.Header) string {
+	country := strings.ToUpper(parseForefrontTokens(decodeHeaderValue(header.Get("X-Forefront-Antispam-Report")))["CTRY"])
+	if len(country) != 2 || strings.IndexFunc(country, func(r rune) bool { return r < 'A' || r > 'Z' }) >= 0 {
+		return ""
+	}
+	return country
+}
+
+// countryNames maps ISO 3166-1 alpha-2 codes to English short names, for
+// the Forefront CTRY token
+var countryNames = map[string]string{
+	"AD": "Andorra",
+	"AE": "United Arab Emirates",
+	"AF": "Afghanistan",
+	"AG": "Antigua and Barbuda",
+	"AI": "Anguilla",
+	"AL": "Albania",
+	"AM": "Armenia",
+	"AO": "Angola",
+	"AQ": "Antarctica",
+	"AR": "Argentina",
+	"AS": "American Samoa",
+	"AT": "Austria",
+	"AU": "Australia",
+	"AW": "Aruba",
+	"AX": "Åland Islands",
+	"AZ": "Azerbaijan",
+	"BA": "Bosnia and Herzegovina",
+	"BB": "Barbados",
+	"BD": "Bangladesh",
+	"BE": "Belgium",
+	"BF": "Burkina Faso",
+	"BG": "Bulgaria",
+	"BH": "Bahrain",
+	"BI": "Burundi",
+	"BJ": "Benin",
+	"BL": "Saint Barthélemy",
+	"BM": "Bermuda",
+	"BN": "Brunei Darussalam",
+	"BO": "Bolivia",
+	"BQ": "Bonaire, Sint Eustatius and Saba",
+	"BR": "Brazil",
+	"BS": "Bahamas",
+	"BT": "Bhutan",
+	"BV": "Bouvet Island",
+	"BW": "Botswana",
+	"BY": "Belarus",
+	"BZ": "Belize",
+	"CA": "Canada",
+	"CC": "Cocos (Keeling) Islands",
+	"CD": "Congo, The Democratic Republic of the",
+	"CF": "Central African Republic",
+	"CG": "Congo",
+	"CH": "Switzerland",
+	"CI": "Côte d'Ivoire",
+	"CK": "Cook Islands",
+	"CL": "Chile",
+	"CM": "Cameroon",
+	"CN": "China",
+	"CO": "Colombia",
+	"CR": "Costa Rica",
+	"CU": "Cuba",
+	"CV": "Cabo Verde",
+	"CW": "Curaçao",
+	"CX": "Christmas Island",
+	"CY": "Cyprus",
+	"CZ": "Czechia",
+	"DE": "Germany",
+	"DJ": "Djibouti",
+	"DK": "Denmark",
+	"DM": "Dominica",
+	"DO": "Dominican Republic",
+	"DZ": "Algeria",
+	"EC": "Ecuador",
+	"EE": "Estonia",
+	"EG": "Egypt",
+	"EH": "Western Sahara",
+	"ER": "Eritrea",
+	"ES": "Spain",
+	"ET": "Ethiopia",
+	"FI": "Finland",
+	"FJ": "Fiji",
+	"FK": "Falkland Islands (Malvinas)",
+	"FM": "Micronesia, Federated States of",
+	"FO": "Faroe Islands",
+	"FR": "France",
+	"GA": "Gabon",
+	"GB": "United Kingdom",
+	"GD": "Grenada",
+	"GE": "Georgia",
+	"GF": "French Guiana",
+	"GG": "Guernsey",
+	"GH": "Ghana",
+	"GI": "Gibraltar",
+	"GL": "Greenland",
+	"GM": "Gambia",
+	"GN": "Guinea",
+	"GP": "Guadeloupe",
+	"GQ": "Equatorial Guinea",
+	"GR": "Greece",
+	"GS": "South Georgia and the South Sandwich Islands",
+	"GT": "Guatemala",
+	"GU": "Guam",
+	"GW": "Guinea-Bissau",
+	"GY": "Guyana",
+	"HK": "Hong Kong",
+	"HM": "Heard Island and McDonald Islands",
+	"HN": "Honduras",
+	"HR": "Croatia",
+	"HT": "Haiti",
+	"HU": "Hungary",
+	"ID": "Indonesia",
+	"IE": "Ireland",
+	"IL": "Israel",
+	"IM": "Isle of Man",
+	"IN": "India",
+	"IO": "British Indian Ocean Territory",
+	"IQ": "Iraq",
+	"IR": "Iran",
+	"IS": "Iceland",
+	"IT": "Italy",
+	"JE": "Jersey",
+	"JM": "Jamaica",
+	"JO": "Jordan",
+	"JP": "Japan",
+	"KE": "Kenya",
+	"KG": "Kyrgyzstan",
+	"KH": "Cambodia",
+	"KI": "Kiribati",
+	"KM": "Comoros",
+	"KN": "Saint Kitts and Nevis",
+	"KP": "North Korea",
+	"KR": "South Korea",
+	"KW": "Kuwait",
+	"KY": "Cayman Islands",
+	"KZ": "Kazakhstan",
+	"LA": "Laos",
+	"LB": "Lebanon",
+	"LC": "Saint Lucia",
+	"LI": "Liechtenstein",
+	"LK": "Sri Lanka",
+	"LR": "Liberia",
+	"LS": "Lesotho",
+	"LT": "Lithuania",
+	"LU": "Luxembourg",
+	"LV": "Latvia",
+	"LY": "Libya",
+	"MA": "Morocco",
+	"MC": "Monaco",
+	"MD": "Moldova",
+	"ME": "Montenegro",
+	"MF": "Saint Martin (French part)",
+	"MG": "Madagascar",
+	"MH": "Marshall Islands",
+	"MK": "North Macedonia",
+	"ML": "Mali",
+	"MM": "Myanmar",
+	"MN": "Mongolia",
+	"MO": "Macao",
+	"MP": "Northern Mariana Islands",
+	"MQ": "Martinique",
+	"MR": "Mauritania",
+	"MS": "Montserrat",
+	"MT": "Malta",
+	"MU": "Mauritius",
+	"MV": "Maldives",
+	"MW": "Malawi",
+	"MX": "Mexico",
+	"MY": "Malaysia",
+	"MZ": "Mozambique",
+	"NA": "Namibia",
+	"NC": "New Caledonia",
+	"NE": "Niger",
+	"NF": "Norfolk Island",
+	"NG": "Nigeria",
+	"NI": "Nicaragua",
+	"NL": "Netherlands",
+	"NO": "Norway",
+	"NP": "Nepal",
+	"NR": "Nauru",
+	"NU": "Niue",
+	"NZ": "New Zealand",
+	"OM": "Oman",
+	"PA": "Panama",
+	"PE": "Peru",
+	"PF": "French Polynesia",
+	"PG": "Papua New Guinea",
+	"PH": "Philippines",
+	"PK": "Pakistan",
+	"PL": "Poland",
+	"PM": "Saint Pierre and Miquelon",
+	"PN": "Pitcairn",
+	"PR": "Puerto Rico",
+	"PS": "Palestine, State of",
+	"PT": "Portugal",
+	"PW": "Palau",
+	"PY": "Paraguay",
+	"QA": "Qatar",
+	"RE": "Réunion",
+	"RO": "Romania",
+	"RS": "Serbia",
+	"RU": "Russian Federation",
+	"RW": "Rwanda",
+	"SA": "Saudi Arabia",
+	"SB": "Solomon Islands",
+	"SC": "Seychelles",
+	"SD": "Sudan",
+	"SE": "Sweden",
+	"SG": "Singapore",
+	"SH": "Saint Helena, Ascension and Tristan da Cunha",
+	"SI": "Slovenia",
+	"SJ": "Svalbard and Jan Mayen",
+	"SK": "Slovakia",
+	"SL": "Sierra Leone",
+	"SM": "San Marino",
+	"SN": "Senegal",
+	"SO": "Somalia",
+	"SR": "Suriname",
+	"SS": "South Sudan",
+	"ST": "Sao Tome and Principe",
+	"SV": "El Salvador",
+	"SX": "Sint Maarten (Dutch part)",
+	"SY": "Syria",
+	"SZ": "Eswatini",
+	"TC": "Turks and Caicos Islands",
+	"TD": "Chad",
+	"TF": "French Southern Territories",
+	"TG": "Togo",
+	"TH": "Thailand",
+	"TJ": "Tajikistan",
+	"TK": "Tokelau",
+	"TL": "Timor-Leste",
+	"TM": "Turkmenistan",
+	"TN": "Tunisia",
+	"TO": "Tonga",
+	"TR": "Türkiye",
+	"TT": "Trinidad and Tobago",
+	"TV": "Tuvalu",
+	"TW": "Taiwan",
+	"TZ": "Tanzania",
+	"UA": "Ukraine",
+	"UG": "Uganda",
+	"UM": "United States Minor Outlying Islands",
+	"US": "United States",
+	"UY": "Uruguay",
+	"UZ": "Uzbekistan",
+	"VA": "Holy See (Vatican City State)",
+	"VC": "Saint Vincent and the Grenadines",
+	"VE": "Venezuela",
+	"VG": "Virgin Islands, British",
+	"VI": "Virgin Islands, U.S.",
+	"VN": "Vietnam",
+	"VU": "Vanuatu",
+	"WF": "Wallis and Futuna",
+	"WS": "Samoa",
+	"YE": "Yemen",
+	"YT": "Mayotte",
+	"ZA": "South Africa",
+	"ZM": "Zambia",
+	"ZW": "Zimbabwe",
+}
+
+// countryName returns the English name for an ISO 3166-1 alpha-2 code as
+// found in the CTRY token. Exchange Online writes "XX" when it could not
+// place the sender, which yields "Unknown"; an empty or unrecognized code
+// yields "".
+func countryName(code string) string {
+	if code == "XX" {
+		return "Unknown"
+	}
+	return countryNames[code]
+}
+
+// loadBaseline reads a baseline file: a JSON object mapping From domains to
+// their expected values, e.g.
+//
+//	{"example.com": {"cip_ranges": ["203.0.113.0/24"], "spf_domains":
+//	["bounces.example.com"], "dkim_selectors": ["s1", "s2"]}}
+//
+// Unknown keys and invalid ranges are rejected so typos do not silently
+// disable a check.
+func loadBaseline(path string) (Baseline, error) {
+	if strings.Contains(path, "..") {
+		return nil, eris.New("path traversal detected")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to read baseline file")
+	}
+	return parseBaseline(data)
+}
+
+// parseBaseline parses and validates baseline JSON (see loadBaseline)
+func parseBaseline(data []byte) (Baseline, error) {
+	var raw map[string]*BaselineEntry
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, eris.Wrap(err, "baseline must be an object mapping domains to cip_ranges, spf_domains and dkim_selectors")
+	}
+
+	baseline := make(Baseline, len(raw))
+	for _, domain := range sortedKeys(raw) {
+		entry := raw[domain]
+		if entry == nil {
+			return nil, eris.Errorf("baseline entry for %q is empty", domain)
+		}
+		for _, cidr := range entry.CIPRanges {
+			// A bare IP is a single-address range
+			if ip := net.ParseIP(cidr); ip != nil {
+				bits := 128
+				if v4 := ip.To4(); v4 != nil {
+					ip, bits = v4, 32
 				}
+				entry.networks = append(entry.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
 			}
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, eris.Errorf("baseline entry for %q has invalid cip_range %q", domain, cidr)
+			}
+			entry.networks = append(entry.networks, network)
+		}
+		baseline[strings.ToLower(domain)] = entry
+	}
+	return baseline, nil
+}
 
-			// Check uncompressed size
-			if f.UncompressedSize64 > MaxUncompressedSize {
-				return nil, eris.Errorf("uncompressed file too large: %d bytes (max %d)",
-					f.UncompressedSize64, MaxUncompressedSize)
-			}
+// loadAssertions reads an -assert rules file: a JSON array of AssertionRule
+func loadAssertions(path string) ([]AssertionRule, error) {
+	if strings.Contains(path, "..") {
+		return nil, eris.New("path traversal detected")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to read assertion rules")
+	}
+	return parseAssertions(data)
+}
 
-			// Common locations for email content in ZIP-based MSG
-			if strings.Contains(strings.ToLower(f.Name), "message") ||
-				strings.HasSuffix(strings.ToLower(f.Name), ".eml") {
+// loadScoreBands reads a -verdict-map file (see parseScoreBands)
+func loadScoreBands(path string) (map[string]ScoreBands, error) {
+	if strings.Contains(path, "..") {
+		return nil, eris.New("path traversal detected")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to read verdict map")
+	}
+	return parseScoreBands(data)
+}
 
-				rc, err := f.Open()
-				if err != nil {
-					continue
-				}
-				// Use anonymous function for proper defer scoping
-				data, err := func() ([]byte, error) {
-					defer func() { _ = rc.Close() }()
-					// Limit read size to prevent excessive memory use
-					limitReader := io.LimitReader(rc, MaxUncompressedSize)
-					return io.ReadAll(limitReader)
-				}()
-				if err != nil {
-					continue
-				}
+// parseScoreBands parses a -verdict-map: a JSON object from engine name to
+// its bands, e.g. {"spamassassin": {"low_spam": 3, "spam": 6, "high_confidence": 7}}.
+// Engines and bands left out keep their defaults. Unknown engines or keys and
+// bands out of ascending order are rejected so typos do not silently pass.
+func parseScoreBands(data []byte) (map[string]ScoreBands, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, eris.Wrap(err, "verdict map must be an object of engine names to score bands")
+	}
+	bands := maps.Clone(defaultScoreBands)
+	for engine, value := range raw {
+		engineBands, known := bands[engine]
+		if !known {
+			return nil, eris.Errorf("unknown engine %q (valid: %s); SCL bands are set with -profile or -scl-bands", engine, strings.Join(slices.Sorted(maps.Keys(defaultScoreBands)), ", "))
+		}
+		decoder := json.NewDecoder(bytes.NewReader(value))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&engineBands); err != nil {
+			return nil, eris.Wrapf(err, "%s bands must be an object of low_spam, spam and high_confidence scores", engine)
+		}
+		if engineBands.LowSpam > engineBands.Spam || engineBands.Spam > engineBands.HighConfidence {
+			return nil, eris.Errorf("%s bands must ascend: low_spam %g, spam %g, high_confidence %g", engine, engineBands.LowSpam, engineBands.Spam, engineBands.HighConfidence)
+		}
+		bands[engine] = engineBands
+	}
+	return bands, nil
+}
 
-				// Check if it looks like an email
-				if bytes.Contains(data, []byte("From:")) && bytes.Contains(data, []byte("Subject:")) {
-					return data, nil
-				}
+// parseAssertions parses -assert rules. Unknown keys, rules without
+// conditions and SCL values outside -1 to 9 are rejected so typos do not
+// silently pass.
+func parseAssertions(data []byte) ([]AssertionRule, error) {
+	var rules []AssertionRule
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rules); err != nil {
+		return nil, eris.Wrap(err, "assertion rules must be an array of {name, from_domain, expect} objects")
+	}
+	if len(rules) == 0 {
+		return nil, eris.New("assertion rules file holds no rules")
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		rule.FromDomain = strings.ToLower(strings.TrimSpace(rule.FromDomain))
+		if rule.Expect == (AssertionExpect{}) {
+			return nil, eris.Errorf("%s expects nothing; set scl, scl_max, spf, dkim, dmarc or cat", rule.Name)
+		}
+		for _, score := range []*int{rule.Expect.SCL, rule.Expect.SCLMax} {
+			if score != nil && (*score < -1 || *score > 9) {
+				return nil, eris.Errorf("%s has SCL %d outside -1 to 9", rule.Name, *score)
 			}
 		}
 	}
+	return rules, nil
+}
 
-	// Strategy 2: Read the entire file and search for embedded RFC822 headers
-	// This is a fallback that works for some MSG formats
-	data := make([]byte, size)
-	n, err := r.ReadAt(data, 0)
-	if err != nil && err != io.EOF {
-		return nil, eris.Wrap(err, "failed to read MSG file")
-	}
-	data = data[:n]
+// matches reports whether the rule applies to a message from fromDomain
+func (r AssertionRule) matches(fromDomain string) bool {
+	return r.FromDomain == "" || fromDomain == r.FromDomain || strings.HasSuffix(fromDomain, "."+r.FromDomain)
+}
 
-	// Look for RFC822 email headers in the binary data
-	// MSG files often contain the internet headers as a property
-	emailContent := extractRFC822FromBinary(data)
-	if emailContent != nil {
-		return emailContent, nil
+// check returns a description of each condition the report fails, e.g.
+// "spf is softfail, want pass"; a missing value is "missing"
+func (r AssertionRule) check(report *EmailSecurityReport) []string {
+	var failures []string
+	compare := func(name, actual, want string) {
+		if want != "" && !strings.EqualFold(actual, want) {
+			failures = append(failures, fmt.Sprintf("%s is %s, want %s", name, valueOrMissing(actual), strings.ToLower(want)))
+		}
 	}
 
-	// Strategy 3: Try to find MIME headers directly
-	// Some MSG files have embedded EML content
-	if idx := bytes.Index(data, []byte("Return-Path:")); idx != -1 {
-		return data[idx:], nil
+	scl, cat := "", ""
+	if report.SCL != nil {
+		scl, cat = strconv.Itoa(report.SCL.Score), report.SCL.CAT
 	}
-	if idx := bytes.Index(data, []byte("Received:")); idx != -1 {
-		return data[idx:], nil
+	if want := r.Expect.SCL; want != nil {
+		compare("scl", scl, strconv.Itoa(*want))
 	}
-	if idx := bytes.Index(data, []byte("From:")); idx != -1 && idx < 1000 {
-		return data[idx:], nil
+	if limit := r.Expect.SCLMax; limit != nil && (report.SCL == nil || report.SCL.Score > *limit) {
+		failures = append(failures, fmt.Sprintf("scl is %s, want at most %d", valueOrMissing(scl), *limit))
+	}
+	compare("spf", bestAuthResult(spfResultValues(report.SPFResults)), r.Expect.SPF)
+	compare("dkim", bestAuthResult(dkimResultValues(report.DKIMResults)), r.Expect.DKIM)
+	compare("dmarc", bestAuthResult(dmarcResultValues(report.DMARCResults)), r.Expect.DMARC)
+	if r.Expect.CAT != "" && !strings.EqualFold(cat, r.Expect.CAT) {
+		failures = append(failures, fmt.Sprintf("cat is %s, want %s", valueOrMissing(cat), strings.ToUpper(r.Expect.CAT)))
 	}
+	return failures
+}
 
-	return nil, eris.New("could not find RFC822 email headers in MSG file")
+// valueOrMissing returns value, or "missing" when it is empty
+func valueOrMissing(value string) string {
+	if value == "" {
+		return "missing"
+	}
+	return value
 }
 
-// extractRFC822FromBinary searches for RFC822 email content in binary MSG data
-func extractRFC822FromBinary(data []byte) []byte {
-	// .msg files store the Internet Headers in a specific property
-	// We'll search for the start of email headers and extract them
+// check compares a report with the entry for fromDomain, falling back to the
+// entry for its organizational domain. Values absent from the message are not
+// drift. Returns nil when the baseline has no entry for the sender.
+func (b Baseline) check(report *EmailSecurityReport, fromDomain string) *BaselineResult {
+	domain := fromDomain
+	entry, ok := b[domain]
+	if !ok {
+		domain = organizationalDomain(fromDomain)
+		if entry, ok = b[domain]; !ok {
+			return nil
+		}
+	}
 
-	// Strategy 1: Look for "Received:" which is typically the first header in transport messages
-	receivedIdx := bytes.Index(data, []byte("Received:"))
-	if receivedIdx != -1 && receivedIdx < 200000 {
-		// Found it! Now let's extract from here to the end of headers
-		// Headers end with a blank line (double newline)
-		start := receivedIdx
+	result := &BaselineResult{Domain: domain}
+	drift := func(field, actual string, expected []string) {
+		result.Drift = append(result.Drift, BaselineDrift{Field: field, Actual: actual, Expected: expected})
+	}
 
-		// Try to find where headers end
-		// Look for double newline patterns
-		end := len(data)
-		searchStart := start
-		iterations := 0
-		// Use MaxHeaderSearchBytes to prevent excessive searching
-		for searchStart < len(data)-4 && (searchStart-start) < MaxHeaderSearchBytes {
-			// Add iteration counter to prevent infinite loops
-			if iterations >= MaxHeaderSearchBytes {
-				break
+	if len(entry.networks) > 0 && report.SenderIP != nil {
+		ip := net.ParseIP(report.SenderIP.IP)
+		if !slices.ContainsFunc(entry.networks, func(network *net.IPNet) bool { return network.Contains(ip) }) {
+			drift("sender_ip", report.SenderIP.IP, entry.CIPRanges)
+		}
+	}
+
+	if len(entry.SPFDomains) > 0 {
+		seen := make(map[string]bool)
+		for _, spf := range report.SPFResults {
+			spfDomain := strings.ToLower(spf.Domain)
+			if strings.Contains(spfDomain, "@") {
+				spfDomain = addressDomain(spfDomain)
 			}
-			iterations++
+			if spfDomain == "" || seen[spfDomain] {
+				continue
+			}
+			seen[spfDomain] = true
+			if !slices.ContainsFunc(entry.SPFDomains, func(d string) bool { return strings.EqualFold(d, spfDomain) }) {
+				drift("spf_domain", spfDomain, entry.SPFDomains)
+			}
+		}
+	}
 
-			// Check for various double-newline patterns
-			if searchStart+3 < len(data) &&
-				data[searchStart] == '\r' && data[searchStart+1] == '\n' &&
-				data[searchStart+2] == '\r' && data[searchStart+3] == '\n' {
-				end = searchStart + 4
-				break
+	if len(entry.DKIMSelectors) > 0 {
+		seen := make(map[string]bool)
+		for _, dkim := range report.DKIMResults {
+			// Google's relay signature is not chosen by the sender
+			selector := strings.ToLower(dkim.Selector)
+			if selector == "" || dkim.Source == dkimSourceGoogle || seen[selector] {
+				continue
 			}
-			if searchStart+1 < len(data) &&
-				data[searchStart] == '\n' && data[searchStart+1] == '\n' {
-				end = searchStart + 2
-				break
+			seen[selector] = true
+			// Selectors are DNS labels, so they match case-insensitively
+			if !slices.ContainsFunc(entry.DKIMSelectors, func(s string) bool { return strings.EqualFold(s, selector) }) {
+				drift("dkim_selector", dkim.Selector, entry.DKIMSelectors)
 			}
-			searchStart++
 		}
+	}
 
-		headerData := data[start:min(end, len(data))]
+	result.Drifted = len(result.Drift) > 0
+	return result
+}
 
-		// Clean up the extracted headers - remove null bytes and invalid characters
-		cleanedHeaders := bytes.ReplaceAll(headerData, []byte{0}, []byte{})
+// parseAttachments walks the MIME structure of a message body, descending
+// into nested multiparts, and returns every part that carries a file: parts
+// with Content-Disposition attachment or with a filename, inline ones
+// included. Parts found before a malformed section are returned with the
+// error. Unterminated multiparts are always an error; strict also rejects an
+// invalid Content-Type and any part whose transfer encoding is unknown or
+// does not decode, which are otherwise tolerated.
+func parseAttachments(header mail.Header, body io.Reader, strict bool) ([]Attachment, error) {
+	var attachments []Attachment
+	err := walkMIMEPart(textproto.MIMEHeader(header), body, 0, strict, &attachments)
+	return attachments, err
+}
 
-		// Verify we have valid headers
-		if bytes.Contains(cleanedHeaders, []byte("From:")) ||
-			bytes.Contains(cleanedHeaders, []byte("Subject:")) {
-			return cleanedHeaders
+// walkMIMEPart appends the attachments in one MIME part to attachments
+func walkMIMEPart(header textproto.MIMEHeader, body io.Reader, depth int, strict bool, attachments *[]Attachment) error {
+	contentType := header.Get("Content-Type")
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		if strict && contentType != "" {
+			return eris.Wrapf(err, "invalid Content-Type %q", sanitizeHeader(contentType))
 		}
+		// RFC 2045: a missing or invalid Content-Type means text/plain
+		mediaType, params = "text/plain", nil
 	}
 
-	// Strategy 2: Look for "Return-Path:" which can be at the start
-	returnPathIdx := bytes.Index(data, []byte("Return-Path:"))
-	if returnPathIdx != -1 && returnPathIdx < 200000 {
-		start := returnPathIdx
-		end := len(data)
-		searchStart := start
-		iterations := 0
-
-		for searchStart < len(data)-4 && (searchStart-start) < MaxHeaderSearchBytes {
-			if iterations >= MaxHeaderSearchBytes {
-				break
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= MaxMIMEDepth {
+			return eris.Errorf("MIME nesting exceeds %d levels", MaxMIMEDepth)
+		}
+		boundary := params["boundary"]
+		if boundary == "" {
+			return eris.New("multipart part has no boundary")
+		}
+		reader := multipart.NewReader(body, boundary)
+		for {
+			// Raw parts keep their transfer encoding, so sizes are decoded uniformly
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
 			}
-			iterations++
-
-			if searchStart+3 < len(data) &&
-				data[searchStart] == '\r' && data[searchStart+1] == '\n' &&
-				data[searchStart+2] == '\r' && data[searchStart+3] == '\n' {
-				end = searchStart + 4
-				break
+			if err != nil {
+				return eris.Wrap(err, "failed to read MIME part")
 			}
-			if searchStart+1 < len(data) &&
-				data[searchStart] == '\n' && data[searchStart+1] == '\n' {
-				end = searchStart + 2
-				break
+			if err := walkMIMEPart(part.Header, part, depth+1, strict, attachments); err != nil {
+				return err
 			}
-			searchStart++
 		}
+	}
 
-		headerData := data[start:min(end, len(data))]
-		cleanedHeaders := bytes.ReplaceAll(headerData, []byte{0}, []byte{})
-
-		if bytes.Contains(cleanedHeaders, []byte("From:")) ||
-			bytes.Contains(cleanedHeaders, []byte("Subject:")) {
-			return cleanedHeaders
+	// A leaf of an unterminated multipart fails only when read to the end
+	if strict {
+		raw, err := io.ReadAll(io.LimitReader(body, MaxFileSizeBytes))
+		if err != nil {
+			return eris.Wrap(err, "unterminated MIME part (missing closing boundary)")
 		}
+		body = bytes.NewReader(raw)
 	}
 
-	// Strategy 3: Look for "Authentication-Results:" which contains security info
-	authResultsIdx := bytes.Index(data, []byte("Authentication-Results:"))
-	if authResultsIdx != -1 && authResultsIdx < 200000 {
-		// Found auth results, try to extract surrounding headers
-		// Walk backwards to find the start of headers
-		start := authResultsIdx
-		for start > 0 && start > authResultsIdx-10000 {
-			// Look for "Received:" which is typically first
-			if start >= 9 && bytes.Equal(data[start-9:start], []byte("Received:")) {
-				start = start - 9
-				break
-			}
-			if start >= 12 && bytes.Equal(data[start-12:start], []byte("Return-Path:")) {
-				start = start - 12
-				break
-			}
-			start--
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dispositionParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	if disposition != "attachment" && filename == "" {
+		// Message text, not a file; strict mode still checks that it decodes
+		if strict {
+			_, err := decodedSize(header.Get("Content-Transfer-Encoding"), body)
+			return err
 		}
+		return nil
+	}
+	if len(*attachments) >= MaxAttachments {
+		log.Printf("Warning: more than %d attachments, ignoring the rest", MaxAttachments)
+		return nil
+	}
 
-		// Find end of headers
-		end := len(data)
-		searchStart := authResultsIdx
-		iterations := 0
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(filename); err == nil {
+		filename = decoded
+	}
+	attachment := classifyAttachment(filename, mediaType)
+	attachment.Size, err = decodedSize(header.Get("Content-Transfer-Encoding"), body)
+	if err != nil && strict {
+		return eris.Wrapf(err, "attachment %s", attachment.Filename)
+	}
+	attachment.Inline = disposition == "inline"
+	*attachments = append(*attachments, attachment)
+	return nil
+}
 
-		for searchStart < len(data)-4 && (searchStart-start) < MaxHeaderSearchBytes {
-			if iterations >= MaxHeaderSearchBytes {
-				break
-			}
-			iterations++
+// decodedSize returns the size of body after undoing its transfer encoding.
+// A corrupt encoding counts the bytes decoded before the error, which is
+// returned along with the size; so is an unknown encoding, whose body is
+// counted as is.
+func decodedSize(encoding string, body io.Reader) (int64, error) {
+	var encodingErr error
+	switch encoding = strings.ToLower(strings.TrimSpace(encoding)); encoding {
+	case "base64":
+		// The decoder skips the CR/LF line breaks of encoded bodies
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "", "7bit", "8bit", "binary":
+	default:
+		encodingErr = eris.Errorf("unknown Content-Transfer-Encoding %q", sanitizeHeader(encoding))
+	}
+	size, err := io.Copy(io.Discard, io.LimitReader(body, MaxFileSizeBytes))
+	if err != nil {
+		return size, eris.Wrapf(err, "invalid %s encoding", encoding)
+	}
+	return size, encodingErr
+}
 
-			if searchStart+3 < len(data) &&
-				data[searchStart] == '\r' && data[searchStart+1] == '\n' &&
-				data[searchStart+2] == '\r' && data[searchStart+3] == '\n' {
-				end = searchStart + 4
-				break
-			}
-			if searchStart+1 < len(data) &&
-				data[searchStart] == '\n' && data[searchStart+1] == '\n' {
-				end = searchStart + 2
-				break
-			}
-			searchStart++
+// classifyAttachment flags risky extensions, double extensions, right-to-left
+// override tricks and declared types that contradict the extension
+func classifyAttachment(filename, contentType string) Attachment {
+	attachment := Attachment{ContentType: contentType}
+
+	// U+202E reverses the displayed name ("invoice\u202Efdp.exe" shows as
+	// "invoiceexe.pdf"); check before sanitizing
+	if strings.ContainsRune(filename, '\u202E') {
+		attachment.Risky = true
+		attachment.Reasons = append(attachment.Reasons, "right-to-left override hides the real extension")
+	}
+	attachment.Filename = sanitizeHeader(filename)
+
+	// Windows ignores trailing dots and spaces, so "a.exe. " runs as a.exe
+	name := strings.ToLower(strings.TrimRight(attachment.Filename, ". "))
+	ext := filepath.Ext(name)
+	if riskyExtensions[ext] {
+		attachment.Risky = true
+		attachment.Reasons = append(attachment.Reasons, "dangerous file type "+ext)
+		if inner := filepath.Ext(strings.TrimSuffix(name, ext)); decoyExtensions[inner] {
+			attachment.Reasons = append(attachment.Reasons, "double extension "+inner+ext)
 		}
+	}
 
-		headerData := data[start:min(end, len(data))]
-		cleanedHeaders := bytes.ReplaceAll(headerData, []byte{0}, []byte{})
+	if expected, known := extensionTypes[ext]; known && !genericContentTypes[contentType] && !slices.Contains(expected, contentType) {
+		attachment.TypeMismatch = true
+		attachment.Reasons = append(attachment.Reasons, fmt.Sprintf("declared type %s does not match %s", contentType, ext))
+	}
+	return attachment
+}
 
-		if bytes.Contains(cleanedHeaders, []byte("From:")) ||
-			bytes.Contains(cleanedHeaders, []byte("Authentication-Results:")) {
-			return cleanedHeaders
+// parseWebmailProvenance parses X-Originating-Email, X-Originating-IP and
+// X-Apparently-To. Values that are not a valid address or IP are dropped.
+// Returns nil when none of the headers yields a value. The run is recorded in
+// diag, which may be nil.
+func parseWebmailProvenance(header mail.Header, from string, diag *parserLog) *WebmailProvenance {
+	result := &WebmailProvenance{
+		OriginatingEmail: bracketedAddress(header.Get("X-Originating-Email")),
+		// X-Apparently-To is "user@example.com via 192.0.2.1; date"
+		ApparentlyTo: bracketedAddress(strings.SplitN(strings.TrimSpace(header.Get("X-Apparently-To")), " ", 2)[0]),
+	}
+	result.OriginatingIP = parseIPValue(header.Get("X-Originating-IP"))
+	if result.OriginatingEmail == "" && result.OriginatingIP == "" && result.ApparentlyTo == "" {
+		present := header.Get("X-Originating-Email") != "" || header.Get("X-Originating-IP") != "" || header.Get("X-Apparently-To") != ""
+		diag.recordUnused("webmail", false, present, "webmail headers present but not a valid address or IP")
+		return nil
+	}
+	diag.record("webmail", true, "")
+
+	if result.OriginatingEmail != "" {
+		if parsed, err := mail.ParseAddress(from); err == nil && !strings.EqualFold(parsed.Address, result.OriginatingEmail) {
+			result.FromMismatch = true
 		}
 	}
-
-	return nil
+	return result
 }
 
-// sanitizeHeader removes control characters and prevents header injection
-func sanitizeHeader(value string) string {
-	// Remove all CR/LF characters to prevent header injection
-	value = strings.ReplaceAll(value, "\r", "")
-	value = strings.ReplaceAll(value, "\n", "")
+// parseWebappOrigin parses X-PHP-Originating-Script ("1000:mailer.php"),
+// X-PHP-Script and cPanel's X-Source, X-Source-Args and X-Source-Dir.
+// Values are kept verbatim apart from sanitizing. Returns nil when none of
+// the headers is present.
+func parseWebappOrigin(header mail.Header) *WebappOrigin {
+	get := func(name string) string { return sanitizeHeader(header.Get(name)) }
+	result := &WebappOrigin{
+		Script:     get("X-PHP-Originating-Script"),
+		PHPScript:  get("X-PHP-Script"),
+		Source:     get("X-Source"),
+		SourceArgs: get("X-Source-Args"),
+		SourceDir:  get("X-Source-Dir"),
+	}
+	if *result == (WebappOrigin{}) {
+		return nil
+	}
+	// The UID prefix is only split off when numeric, so a script name
+	// containing a colon is left whole
+	if uid, script, found := strings.Cut(result.Script, ":"); found && uid != "" && strings.Trim(uid, "0123456789") == "" {
+		result.ScriptUID, result.Script = uid, strings.TrimSpace(script)
+	}
+	return result
+}
 
-	// Remove control characters except tab
-	value = strings.Map(func(r rune) rune {
-		if r < 32 && r != '\t' {
-			return -1
+// parseSenderSoftware parses X-Mailer, User-Agent and Organization and
+// checks the mailer against spamTools, case-insensitive substrings such as
+// defaultSpamTools. Returns nil when none of the headers is present.
+func parseSenderSoftware(header mail.Header, spamTools []string) *SenderSoftware {
+	get := func(name string) string { return sanitizeHeader(strings.TrimSpace(header.Get(name))) }
+	result := &SenderSoftware{
+		Mailer:       get("X-Mailer"),
+		UserAgent:    get("User-Agent"),
+		Organization: get("Organization"),
+	}
+	if *result == (SenderSoftware{}) {
+		return nil
+	}
+	for _, tool := range spamTools {
+		needle := strings.ToLower(tool)
+		if needle == "" {
+			continue
 		}
-		return r
-	}, value)
+		if strings.Contains(strings.ToLower(result.Mailer), needle) || strings.Contains(strings.ToLower(result.UserAgent), needle) {
+			result.SpamTool = tool
+			break
+		}
+	}
+	return result
+}
 
-	// Limit length to prevent buffer issues
-	if len(value) > MaxHeaderLength {
-		value = value[:MaxHeaderLength]
+// mailerName returns the program that composed the message: X-Mailer, or
+// User-Agent when it is absent
+func (s *SenderSoftware) mailerName() string {
+	if s == nil {
+		return ""
+	}
+	if s.Mailer != "" {
+		return s.Mailer
+	}
+	return s.UserAgent
+}
+
+// loadSpamTools reads a -spam-tools file: one X-Mailer / User-Agent
+// substring per line, blank lines and # comments ignored. The file replaces
+// defaultSpamTools, so an empty file disables the check.
+func loadSpamTools(path string) ([]string, error) {
+	if strings.Contains(path, "..") {
+		return nil, eris.New("path traversal detected")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to open spam tool list")
+	}
+	defer f.Close()
+	tools, err := readInputList(f)
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to read spam tool list")
+	}
+	return tools, nil
+}
+
+// bracketedAddress returns the lowercased address from a value like
+// "[user@example.com]", or "" when it is not a valid address
+func bracketedAddress(value string) string {
+	value = strings.Trim(strings.TrimSpace(value), "[]<>")
+	if len(value) > MaxHeaderLength || value == "" {
+		return ""
+	}
+	parsed, err := mail.ParseAddress(value)
+	if err != nil {
+		return ""
+	}
+	return sanitizeHeader(strings.ToLower(parsed.Address))
+}
+
+// organizationalDomain returns the registrable domain (eTLD+1 per the public
+// suffix list) of host, lowercased: mail.corp.example.co.uk becomes
+// example.co.uk. A host with no registrable part (an IP, a bare public
+// suffix) is returned normalized but otherwise unchanged.
+func organizationalDomain(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+	if host == "" {
+		return ""
+	}
+	if org, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return org
+	}
+	return host
+}
+
+// sameOrganization reports whether two domains share an organizational
+// domain, so bounces.example.co.uk and example.co.uk match while
+// example.co.uk and other.co.uk do not
+func sameOrganization(a, b string) bool {
+	orgA := organizationalDomain(a)
+	return orgA != "" && orgA == organizationalDomain(b)
+}
+
+// addressDomain returns the lowercased domain part of an address header value
+func addressDomain(value string) string {
+	addr := value
+	if parsed, err := mail.ParseAddress(value); err == nil {
+		addr = parsed.Address
+	} else if start := strings.LastIndex(value, "<"); start != -1 {
+		// Fall back to the angle-addr for values net/mail rejects
+		addr = strings.TrimSuffix(strings.TrimSpace(value[start+1:]), ">")
 	}
 
-	return strings.TrimSpace(value)
+	at := strings.LastIndex(addr, "@")
+	if at == -1 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(strings.Trim(addr[at+1:], "<>")))
+}
+
+// homographConfusables maps non-Latin characters to the ASCII letters they
+// are commonly used to impersonate. Add entries here as new lookalikes are
+// observed; the key is the deceptive character, the value its ASCII twin.
+var homographConfusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'с': 'c', 'ԁ': 'd', 'е': 'e', 'һ': 'h', 'і': 'i',
+	'ј': 'j', 'к': 'k', 'ӏ': 'l', 'м': 'm', 'п': 'n', 'о': 'o', 'р': 'p',
+	'ԛ': 'q', 'г': 'r', 'ѕ': 's', 'т': 't', 'ѵ': 'v', 'ԝ': 'w', 'х': 'x',
+	'у': 'y',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v',
+	'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'γ': 'y',
+	// Armenian
+	'ա': 'w', 'հ': 'h', 'ո': 'n', 'ս': 'u', 'օ': 'o', 'ց': 'g',
+	// Latin lookalikes outside ASCII
+	'ı': 'i', 'ɡ': 'g', 'ɑ': 'a',
 }
 
-// parseEmail parses RFC822 email data and extracts security headers
-func parseEmail(data []byte, includeRawHeaders bool) (*EmailSecurityReport, error) {
-	// Parse as RFC822 message
-	msg, err := mail.ReadMessage(bytes.NewReader(data))
-	if err != nil {
-		// Try to clean up the data and parse again
-		cleanData := cleanEmailData(data)
-		msg, err = mail.ReadMessage(bytes.NewReader(cleanData))
-		if err != nil {
-			return nil, eris.Wrap(err, "failed to parse email message")
-		}
+// homographScripts lists the scripts tracked for mixed-script detection
+var homographScripts = []struct {
+	name  string
+	table *unicode.RangeTable
+}{
+	{"Latin", unicode.Latin},
+	{"Cyrillic", unicode.Cyrillic},
+	{"Greek", unicode.Greek},
+	{"Armenian", unicode.Armenian},
+	{"Cherokee", unicode.Cherokee},
+	{"Arabic", unicode.Arabic},
+	{"Hebrew", unicode.Hebrew},
+	{"Han", unicode.Han},
+	{"Hiragana", unicode.Hiragana},
+	{"Katakana", unicode.Katakana},
+	{"Hangul", unicode.Hangul},
+	{"Thai", unicode.Thai},
+}
+
+// checkHomograph analyzes a domain for IDN homograph (lookalike) characters.
+// A domain is suspected when a label mixes scripts (e.g. Latin + Cyrillic) or
+// when every non-ASCII character in a label is a known Latin confusable and
+// another label (usually the TLD) is Latin, which is the pattern used to
+// impersonate an ASCII brand domain. A domain written wholly in another
+// script, such as москва.рф, is not flagged for its confusables alone.
+func checkHomograph(domain string) *HomographResult {
+	if domain == "" {
+		return nil
 	}
 
-	report := &EmailSecurityReport{
-		From:      sanitizeHeader(msg.Header.Get("From")),
-		To:        sanitizeHeader(msg.Header.Get("To")),
-		Subject:   sanitizeHeader(msg.Header.Get("Subject")),
-		Date:      sanitizeHeader(msg.Header.Get("Date")),
-		MessageID: sanitizeHeader(msg.Header.Get("Message-ID")),
+	unicodeDomain, err := idna.ToUnicode(domain)
+	if err != nil {
+		unicodeDomain = domain
+	}
+	asciiDomain, err := idna.ToASCII(unicodeDomain)
+	if err != nil {
+		asciiDomain = domain
 	}
 
-	if includeRawHeaders {
-		report.RawHeaders = make(map[string][]string)
-		for k, v := range msg.Header {
-			report.RawHeaders[k] = v
-		}
+	result := &HomographResult{
+		Domain:      sanitizeHeader(unicodeDomain),
+		ASCIIDomain: sanitizeHeader(asciiDomain),
 	}
 
-	// Extract SPF results
-	report.SPFResults = extractSPFResults(msg.Header)
-	report.ReceivedSPF = msg.Header.Get("Received-SPF")
+	seenScripts := make(map[string]bool)
+	var skeleton strings.Builder
+	var lookalikes []string // Labels built entirely from Latin confusables
+	latinLabels := 0
+	for _, label := range strings.Split(unicodeDomain, ".") {
+		labelScripts := make(map[string]bool)
+		nonASCII, confusable := 0, 0
 
-	// Extract DKIM results
-	report.DKIMResults = extractDKIMResults(msg.Header)
+		for _, r := range label {
+			for _, script := range homographScripts {
+				if unicode.Is(script.table, r) {
+					labelScripts[script.name] = true
+					seenScripts[script.name] = true
+					break
+				}
+			}
 
-	// Extract DMARC results
-	report.DMARCResults = extractDMARCResults(msg.Header)
+			if r > unicode.MaxASCII {
+				nonASCII++
+				if twin, ok := homographConfusables[r]; ok {
+					confusable++
+					result.Confusables = append(result.Confusables, fmt.Sprintf("%c (U+%04X) looks like %c", r, r, twin))
+					r = twin
+				}
+			}
+			skeleton.WriteRune(r)
+		}
+		skeleton.WriteRune('.')
+		if labelScripts["Latin"] {
+			latinLabels++
+		}
 
-	// Parse Authentication-Results headers
-	report.AuthResults = parseAuthenticationResults(msg.Header)
+		switch {
+		case isMixedScriptLabel(labelScripts):
+			result.HomographSuspected = true
+			result.Reason = fmt.Sprintf("label %q mixes %s scripts", label, strings.Join(sortedKeys(labelScripts), " and "))
+		case nonASCII > 0 && confusable == nonASCII:
+			lookalikes = append(lookalikes, label)
+		}
+	}
 
-	// Extract ARC results
-	report.ARCResults = extractARCResults(msg.Header)
+	// A lookalike label only imitates a Latin name next to other Latin labels
+	if len(lookalikes) > 0 && latinLabels > 0 && !result.HomographSuspected {
+		result.HomographSuspected = true
+		result.Reason = fmt.Sprintf("label %q is built entirely from Latin lookalike characters", lookalikes[0])
+	}
 
-	// Extract SCL (Spam Confidence Level) results
-	report.SCL = extractSCLResults(msg.Header)
+	result.Scripts = sortedKeys(seenScripts)
+	if len(result.Confusables) > 0 {
+		result.Skeleton = strings.TrimSuffix(skeleton.String(), ".")
+	}
 
-	return report, nil
+	return result
 }
 
-// cleanEmailData attempts to clean up malformed email data
-func cleanEmailData(data []byte) []byte {
-	// Remove null bytes
-	data = bytes.ReplaceAll(data, []byte{0}, []byte{})
-
-	// Ensure headers end with double newline
-	if !bytes.Contains(data[:min(len(data), 5000)], []byte("\n\n")) &&
-		!bytes.Contains(data[:min(len(data), 5000)], []byte("\r\n\r\n")) {
-		// Try to find where headers might end
-		lines := bytes.Split(data, []byte("\n"))
-		for i, line := range lines {
-			if len(bytes.TrimSpace(line)) == 0 ||
-				(!bytes.Contains(line, []byte(":")) && i > 5) {
-				// Insert double newline here
-				before := bytes.Join(lines[:i], []byte("\n"))
-				after := bytes.Join(lines[i:], []byte("\n"))
-				return append(append(before, []byte("\n\n")...), after...)
-			}
+// isMixedScriptLabel reports whether a label combines scripts that do not
+// legitimately appear together. Han, Hiragana, Katakana and Hangul may mix
+// with each other and with Latin, as in real Japanese and Korean domains.
+func isMixedScriptLabel(scripts map[string]bool) bool {
+	if len(scripts) < 2 {
+		return false
+	}
+	for name := range scripts {
+		switch name {
+		case "Latin", "Han", "Hiragana", "Katakana", "Hangul":
+		default:
+			return true
 		}
 	}
-
-	return data
+	return false
 }
 
-// extractSPFResults extracts SPF authentication results from headers
-func extractSPFResults(header mail.Header) []SPFResult {
-	var results []SPFResult
+// sortedKeys returns the keys of a string-keyed map in sorted order.
+// Use it whenever map contents are written out so output is byte-stable.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
 
-	// Check Received-SPF header
-	receivedSPF := header.Get("Received-SPF")
+// outputJSON outputs the report as JSON, indented unless compact is set.
+// Compact output is a single line with the same fields.
+func outputJSON(w io.Writer, report *EmailSecurityReport, compact bool) error {
+	sanitizeRawHeaders(report)
 
-	// Validate header length
-	if len(receivedSPF) > MaxHeaderLength {
-		log.Printf("Warning: Received-SPF header exceeds maximum length, truncating")
-		receivedSPF = receivedSPF[:MaxHeaderLength]
+	encoder := json.NewEncoder(w)
+	if !compact {
+		encoder.SetIndent("", "  ")
 	}
-
-	if receivedSPF != "" {
-		result := parseSPFHeader(receivedSPF)
-		if result != nil {
-			results = append(results, *result)
-		}
+	encoder.SetEscapeHTML(true)
+	if err := encoder.Encode(report); err != nil {
+		return eris.Wrap(err, "failed to encode JSON")
 	}
+	return nil
+}
 
-	// Also check Authentication-Results for SPF
-	authResults := header["Authentication-Results"]
-	for _, ar := range authResults {
-		// Validate header length
-		if len(ar) > MaxHeaderLength {
-			log.Printf("Warning: Authentication-Results header exceeds maximum length, truncating")
-			ar = ar[:MaxHeaderLength]
+// sanitizeRawHeaders makes captured raw headers valid UTF-8 before encoding
+func sanitizeRawHeaders(report *EmailSecurityReport) {
+	if report.RawHeaders != nil {
+		sanitized := make(map[string][]string)
+		for k, values := range report.RawHeaders {
+			sanitizedValues := make([]string, len(values))
+			for i, v := range values {
+				// Ensure UTF-8 validity
+				sanitizedValues[i] = strings.ToValidUTF8(v, "�")
+			}
+			sanitized[strings.ToValidUTF8(k, "�")] = sanitizedValues
 		}
-		spfResults := parseAuthResultsForSPF(ar)
-		results = append(results, spfResults...)
+		report.RawHeaders = sanitized
 	}
-
-	return results
 }
 
-// parseSPFHeader parses a Received-SPF header
-func parseSPFHeader(header string) *SPFResult {
-	result := &SPFResult{}
+// outputText outputs the report in human-readable text format
+func outputText(w io.Writer, report *EmailSecurityReport, verbose bool, locale string, thresholds SCLThresholds) {
+	fmt.Fprintln(w, "="+strings.Repeat("=", 79))
+	fmt.Fprintln(w, "EMAIL SECURITY ANALYSIS REPORT")
+	fmt.Fprintln(w, "="+strings.Repeat("=", 79))
+	fmt.Fprintln(w)
 
-	// Extract result (first word)
-	parts := strings.Fields(header)
-	if len(parts) > 0 {
-		result.Result = strings.ToLower(strings.TrimSuffix(parts[0], ";"))
+	// Basic Email Information
+	fmt.Fprintln(w, "EMAIL INFORMATION")
+	fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+	if report.File != "" {
+		if report.MessageIndex > 0 && report.MessageOffset != nil {
+			fmt.Fprintf(w, "File:       %s (message %d, byte offset %d)\n", report.File, report.MessageIndex, *report.MessageOffset)
+		} else if report.MessageIndex > 0 {
+			fmt.Fprintf(w, "File:       %s (message %d)\n", report.File, report.MessageIndex)
+		} else {
+			fmt.Fprintf(w, "File:       %s\n", report.File)
+		}
 	}
-
-	// Extract domain
-	if match := regexp.MustCompile(`domain=([^\s;]+)`).FindStringSubmatch(header); len(match) > 1 {
-		result.Domain = match[1]
+	fmt.Fprintf(w, "From:       %s\n", report.From)
+	fmt.Fprintf(w, "To:         %s\n", report.To)
+	if rc := report.Recipients; rc != nil {
+		fmt.Fprintf(w, "Recipients: %d (To %d, Cc %d)\n", rc.Total, rc.To, rc.Cc)
+		if rc.Excessive {
+			fmt.Fprintln(w, "⚠ Unusually many recipients (mass mailing or a leaked Cc list)")
+		}
+		if len(rc.ParseErrors) > 0 {
+			fmt.Fprintf(w, "⚠ %d recipient addresses could not be parsed and are not counted\n", len(rc.ParseErrors))
+		}
 	}
-
-	// Extract client IP
-	if match := regexp.MustCompile(`client-ip=([^\s;]+)`).FindStringSubmatch(header); len(match) > 1 {
-		result.ClientIP = match[1]
+	fmt.Fprintf(w, "Subject:    %s\n", report.Subject)
+	fmt.Fprintf(w, "Date:       %s\n", report.Date)
+	if report.DateAnomaly {
+		fmt.Fprintf(w, "⚠ %s\n", describeDateSkew(*report.DateSkewSeconds))
 	}
+	fmt.Fprintf(w, "Message-ID: %s\n", report.MessageID)
+	fmt.Fprintln(w)
 
-	// Extract explanation
-	result.Explanation = strings.TrimSpace(header)
-
-	return result
-}
-
-// parseAuthResultsForSPF extracts SPF results from Authentication-Results header
-func parseAuthResultsForSPF(authResult string) []SPFResult {
-	var results []SPFResult
+	// SPF Results
+	fmt.Fprintln(w, "SPF (SENDER POLICY FRAMEWORK) RESULTS")
+	fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+	fmt.Fprintln(w, "SPF validates that the sending server is authorized to send email for the domain.")
+	fmt.Fprintln(w)
+	if len(report.SPFResults) > 0 {
+		for i, spf := range report.SPFResults {
+			fmt.Fprintf(w, "SPF Check #%d:\n", i+1)
+			fmt.Fprintf(w, "  Result:     %s\n", formatResult(spf.Result))
+			if spf.Domain != "" {
+				fmt.Fprintf(w, "  Domain:     %s\n", spf.Domain)
+			}
+			if spf.ClientIP != "" {
+				fmt.Fprintf(w, "  Client IP:  %s\n", spf.ClientIP)
+			}
+			if spf.Source != "" {
+				fmt.Fprintf(w, "  Source:     %s\n", spf.Source)
+			}
+			if spf.Reason != "" {
+				fmt.Fprintf(w, "  Reason:     %s\n", spf.Reason)
+			}
+			if spf.Explanation != "" && verbose {
+				fmt.Fprintf(w, "  Details:    %s\n", spf.Explanation)
+			}
+			fmt.Fprintln(w)
+		}
+	} else {
+		fmt.Fprintln(w, "  No SPF results found")
+		fmt.Fprintln(w)
+	}
 
-	// Look for spf=result pattern with limited matches to prevent ReDoS
-	spfRegex := regexp.MustCompile(`spf=([a-z]+)(?:\s+\(([^)]+)\))?`)
-	matches := spfRegex.FindAllStringSubmatch(authResult, MaxRegexMatches)
+	if report.SPFDisagreement {
+		fmt.Fprintln(w, "⚠ Received-SPF and Authentication-Results disagree on the SPF result")
+		fmt.Fprintln(w)
+	}
 
-	for _, match := range matches {
-		result := SPFResult{
-			Result: match[1],
-		}
-		if len(match) > 2 {
-			result.Explanation = match[2]
+	if c := report.SPFConsensus; c != nil && len(c.Dissenting) > 0 {
+		fmt.Fprintf(w, "SPF Consensus: %s (%d of %d assertions, led by %s)\n", formatResult(c.Result), c.Agreeing, c.Assertions, c.Source)
+		for _, d := range c.Dissenting {
+			fmt.Fprintf(w, "  ⚠ Dissenting: %s reports %s\n", d.Source, d.Result)
 		}
+		fmt.Fprintln(w)
+	}
 
-		// Extract domain from the context
-		if domainMatch := regexp.MustCompile(`smtp\.mailfrom=([^\s;]+)`).FindStringSubmatch(authResult); len(domainMatch) > 1 {
-			result.Domain = domainMatch[1]
-		}
+	if report.SPFUnalignedPass {
+		fmt.Fprintln(w, "⚠ SPF passed for a domain unrelated to the From address (not aligned; From may be spoofed)")
+		fmt.Fprintln(w)
+	}
 
-		results = append(results, result)
+	if report.ReturnPathMismatch {
+		fmt.Fprintf(w, "⚠ Return-Path domain %s belongs to a different organization than the From address\n", report.ReturnPathDomain)
+		fmt.Fprintln(w)
 	}
 
-	return results
-}
+	if report.ReplyToMismatch {
+		fmt.Fprintf(w, "⚠ Reply-To domain %s differs from the From domain %s: replies go elsewhere (possible BEC)\n",
+			strings.Join(report.ReplyToDomains, ", "), report.FromDomain)
+		fmt.Fprintln(w)
+	}
 
-// extractDKIMResults extracts DKIM signature information and validation results
-func extractDKIMResults(header mail.Header) []DKIMResult {
-	var results []DKIMResult
+	if report.ReceivedSPF != "" && verbose {
+		fmt.Fprintf(w, "Received-SPF Header:\n  %s\n\n", report.ReceivedSPF)
+	}
 
-	// Parse DKIM-Signature headers
-	dkimSigs := header["Dkim-Signature"]
-	for _, sig := range dkimSigs {
-		result := parseDKIMSignature(sig)
-		if result != nil {
-			results = append(results, *result)
+	// DKIM Results
+	fmt.Fprintln(w, "DKIM (DOMAINKEYS IDENTIFIED MAIL) RESULTS")
+	fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+	fmt.Fprintln(w, "DKIM uses cryptographic signatures to verify email authenticity and integrity.")
+	fmt.Fprintln(w)
+	if len(report.DKIMResults) > 0 {
+		for i, dkim := range report.DKIMResults {
+			if dkim.Source == dkimSourceGoogle {
+				fmt.Fprintf(w, "DKIM Signature #%d (X-Google-DKIM-Signature, Google's own):\n", i+1)
+			} else {
+				fmt.Fprintf(w, "DKIM Signature #%d:\n", i+1)
+			}
+			if dkim.Result != "" {
+				fmt.Fprintf(w, "  Result:     %s\n", formatResult(dkim.Result))
+			}
+			if dkim.Domain != "" {
+				fmt.Fprintf(w, "  Domain:     %s\n", dkim.Domain)
+			}
+			if dkim.Selector != "" {
+				fmt.Fprintf(w, "  Selector:   %s\n", dkim.Selector)
+			}
+			if dkim.HeaderA != "" {
+				fmt.Fprintf(w, "  Algorithm:  %s\n", dkim.HeaderA)
+			}
+			if dkim.Reason != "" {
+				fmt.Fprintf(w, "  Reason:     %s\n", dkim.Reason)
+			}
+			if verbose && dkim.Signature != "" {
+				fmt.Fprintf(w, "  Signature:  %s...\n", truncate(dkim.Signature, 60))
+			}
+			fmt.Fprintln(w)
 		}
+	} else {
+		fmt.Fprintln(w, "  No DKIM signatures found")
+		fmt.Fprintln(w)
 	}
 
-	// Also check Authentication-Results for DKIM validation
-	authResults := header["Authentication-Results"]
-	for _, ar := range authResults {
-		dkimResults := parseAuthResultsForDKIM(ar)
+	for i, sig := range report.DKIMSignatures {
+		if sig.Timestamp == 0 && sig.Expiration == 0 && (!verbose || len(sig.SignedHeaders) == 0) {
+			continue
+		}
+		name := "DKIM-Signature"
+		if sig.Source == dkimSourceGoogle {
+			name = "X-Google-DKIM-Signature"
+		}
+		fmt.Fprintf(w, "%s Header #%d (d=%s, s=%s):\n", name, i+1, sig.Domain, sig.Selector)
+		if sig.Timestamp > 0 {
+			fmt.Fprintf(w, "  Signed:     %s\n", formatUnixTime(sig.Timestamp))
+		}
+		if sig.Expiration > 0 {
+			status := ""
+			if sig.Expired {
+				status = " ✗ EXPIRED"
+			}
+			fmt.Fprintf(w, "  Expires:    %s%s\n", formatUnixTime(sig.Expiration), status)
+		}
+		if verbose && len(sig.SignedHeaders) > 0 {
+			fmt.Fprintf(w, "  Signed headers: %s\n", strings.Join(sig.SignedHeaders, ", "))
+		}
+		fmt.Fprintln(w)
+	}
 
-		// Merge with signature info if available
-		for i := range dkimResults {
-			// Try to find matching signature
-			for j := range results {
-				if results[j].Domain == dkimResults[i].Domain {
-					// Update result status
-					if dkimResults[i].Result != "" {
-						results[j].Result = dkimResults[i].Result
-					}
-					break
-				}
+	// DMARC Results
+	fmt.Fprintln(w, "DMARC (DOMAIN MESSAGE AUTHENTICATION REPORTING & CONFORMANCE) RESULTS")
+	fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+	fmt.Fprintln(w, "DMARC builds on SPF and DKIM to specify how to handle authentication failures.")
+	fmt.Fprintln(w)
+	if len(report.DMARCResults) > 0 {
+		for i, dmarc := range report.DMARCResults {
+			fmt.Fprintf(w, "DMARC Check #%d:\n", i+1)
+			fmt.Fprintf(w, "  Result:      %s\n", formatResult(dmarc.Result))
+			if dmarc.Policy != "" {
+				fmt.Fprintf(w, "  Policy:      %s\n", dmarc.Policy)
 			}
-			// If no match, add as new result
-			if dkimResults[i].Result != "" {
-				found := false
-				for j := range results {
-					if results[j].Domain == dkimResults[i].Domain {
-						found = true
-						break
-					}
-				}
-				if !found {
-					results = append(results, dkimResults[i])
-				}
+			if dmarc.Domain != "" {
+				fmt.Fprintf(w, "  Domain:      %s\n", dmarc.Domain)
+			}
+			if dmarc.Disposition != "" {
+				fmt.Fprintf(w, "  Disposition: %s\n", dmarc.Disposition)
+			}
+			if dmarc.Reason != "" {
+				fmt.Fprintf(w, "  Reason:      %s\n", dmarc.Reason)
+			}
+			if dmarc.SPFAlignment != "" {
+				fmt.Fprintf(w, "  SPF Align:   %s\n", formatResult(dmarc.SPFAlignment))
 			}
+			if dmarc.DKIMAlignment != "" {
+				fmt.Fprintf(w, "  DKIM Align:  %s\n", formatResult(dmarc.DKIMAlignment))
+			}
+			fmt.Fprintln(w)
 		}
+	} else {
+		fmt.Fprintln(w, "  No DMARC results found")
+		fmt.Fprintln(w)
 	}
 
-	return results
-}
-
-// parseDKIMSignature parses a DKIM-Signature header
-func parseDKIMSignature(sig string) *DKIMResult {
-	result := &DKIMResult{
-		Signature: sig,
+	// ARC Results
+	if len(report.ARCResults) > 0 {
+		fmt.Fprintln(w, "ARC (AUTHENTICATED RECEIVED CHAIN) RESULTS")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		fmt.Fprintln(w, "ARC preserves authentication results across email forwarding.")
+		fmt.Fprintln(w)
+		for i, arc := range report.ARCResults {
+			fmt.Fprintf(w, "ARC Chain #%d:\n", i+1)
+			if arc.Instance > 0 {
+				fmt.Fprintf(w, "  Instance: %d\n", arc.Instance)
+			}
+			if arc.Result != "" {
+				fmt.Fprintf(w, "  Result:   %s\n", formatResult(arc.Result))
+			}
+			if arc.Chain != "" {
+				fmt.Fprintf(w, "  Chain:    %s\n", formatResult(arc.Chain))
+			}
+			fmt.Fprintln(w)
+		}
 	}
 
-	// Parse d= (domain)
-	if match := regexp.MustCompile(`d=([^\s;]+)`).FindStringSubmatch(sig); len(match) > 1 {
-		result.Domain = match[1]
-		result.HeaderD = match[1]
+	// ARC Chain Structure
+	if chain := report.ARCChain; chain != nil {
+		fmt.Fprintln(w, "ARC CHAIN (ARC-SEAL, ARC-MESSAGE-SIGNATURE)")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		fmt.Fprintln(w, "Whether each forwarder's ARC set is present and sealed; signatures are not verified.")
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "Chain:       %s\n", formatResult(chain.Status))
+		for _, set := range chain.Sets {
+			fmt.Fprintf(w, "Instance %d:  cv=%s, sealed by %s\n", set.Instance, valueOrMissing(set.ChainValidation), valueOrUnknown(set.SealDomain))
+		}
+		for _, problem := range chain.Problems {
+			fmt.Fprintf(w, "⚠ %s\n", problem)
+		}
+		fmt.Fprintln(w)
+	}
+
+	// Original Authentication Results
+	if report.OriginalAuth != nil {
+		orig := report.OriginalAuth
+		fmt.Fprintln(w, "ORIGINAL AUTHENTICATION RESULTS")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		fmt.Fprintln(w, "Verdicts a forwarder preserved from before it modified the message.")
+		fmt.Fprintln(w)
+		for _, spf := range orig.SPFResults {
+			fmt.Fprintf(w, "SPF:         %s (%s)\n", formatResult(spf.Result), valueOrUnknown(spf.Domain))
+		}
+		for _, dkim := range orig.DKIMResults {
+			fmt.Fprintf(w, "DKIM:        %s (%s)\n", formatResult(dkim.Result), valueOrUnknown(dkim.Domain))
+		}
+		for _, dmarc := range orig.DMARCResults {
+			fmt.Fprintf(w, "DMARC:       %s (%s)\n", formatResult(dmarc.Result), valueOrUnknown(dmarc.Domain))
+		}
+		for _, diff := range orig.Differences {
+			fmt.Fprintf(w, "⚠ Changed:   %s\n", diff)
+		}
+		fmt.Fprintln(w)
 	}
 
-	// Parse s= (selector)
-	if match := regexp.MustCompile(`s=([^\s;]+)`).FindStringSubmatch(sig); len(match) > 1 {
-		result.Selector = match[1]
-		result.HeaderS = match[1]
+	// SCL Results
+	if report.SCL != nil {
+		fmt.Fprintln(w, "SCL (SPAM CONFIDENCE LEVEL) RESULTS")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		fmt.Fprintln(w, "Microsoft's Spam Confidence Level indicates the likelihood of spam.")
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "SCL Score:   %d\n", report.SCL.Score)
+		fmt.Fprintf(w, "Assessment:  %s\n", report.SCL.Description)
+		fmt.Fprintf(w, "Source:      %s\n", report.SCL.HeaderSource)
+		for _, svc := range report.SCL.Services {
+			fmt.Fprintf(w, "Service:     %s (%s)\n", svc.Code, svc.Description)
+		}
+		if report.SCL.SFV != "" {
+			fmt.Fprintf(w, "Filter:      %s (%s)\n", report.SCL.SFV, describeToken(locale, "sfv", report.SCL.SFV))
+		}
+		if report.SCL.CAT != "" {
+			fmt.Fprintf(w, "Category:    %s (%s)\n", report.SCL.CAT, describeToken(locale, "cat", report.SCL.CAT))
+		}
+		if report.SCL.IPV != "" {
+			fmt.Fprintf(w, "IP Verdict:  %s (%s)\n", report.SCL.IPV, describeToken(locale, "ipv", report.SCL.IPV))
+		}
+		if report.SCL.OverriddenByRule {
+			fmt.Fprintln(w, "⚠ Verdict set by a rule or allow/block list; the SCL does not reflect content filtering")
+		}
+		if report.SCLCategoryConflict {
+			fmt.Fprintf(w, "⚠ SCL %d looks clean but category %s is malicious; do not trust the score alone\n", report.SCL.Score, report.SCL.CAT)
+		}
+		if report.SignalFingerprint != "" {
+			fmt.Fprintf(w, "Fingerprint: %s\n", report.SignalFingerprint)
+		}
+		if verbose && report.SCL.RawHeader != "" {
+			fmt.Fprintf(w, "Raw Header:  %s\n", truncate(report.SCL.RawHeader, 80))
+		}
+		fmt.Fprintln(w)
+	}
+
+	// Gateway Results
+	if len(report.Gateways) > 0 {
+		fmt.Fprintln(w, "MAIL SECURITY GATEWAYS")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		fmt.Fprintln(w, "Vendors whose headers are present on the message.")
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "Detected:    %s\n", strings.Join(report.Gateways, ", "))
+		fmt.Fprintln(w)
+	}
+
+	// SpamAssassin Results
+	if report.SpamAssassin != nil {
+		sa := report.SpamAssassin
+		fmt.Fprintln(w, "SPAMASSASSIN RESULTS")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		fmt.Fprintln(w, "SpamAssassin scores messages against rules; at or above the threshold is spam.")
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "Spam:        %s\n", formatYesNo(sa.IsSpam))
+		if sa.Required != 0 {
+			fmt.Fprintf(w, "Score:       %.1f (required %.1f)\n", sa.Score, sa.Required)
+		} else {
+			fmt.Fprintf(w, "Score:       %.1f\n", sa.Score)
+		}
+		if sa.Engine != "" {
+			fmt.Fprintf(w, "Engine:      %s\n", strings.TrimSpace(sa.Engine+" "+sa.EngineVersion))
+		}
+		if verbose && len(sa.Tests) > 0 {
+			fmt.Fprintf(w, "Tests:       %s\n", strings.Join(sa.Tests, ", "))
+		}
+		for i, rule := range sa.Rules {
+			label := ""
+			if i == 0 {
+				label = "Breakdown:"
+			}
+			fmt.Fprintf(w, "%-12s %+.1f %s", label, rule.Score, rule.Name)
+			if rule.Description != "" {
+				fmt.Fprintf(w, " (%s)", rule.Description)
+			}
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w)
+	}
+
+	// Mimecast Results
+	if report.Mimecast != nil {
+		fmt.Fprintln(w, "MIMECAST RESULTS")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		fmt.Fprintln(w, "Mimecast's spam score and signature, mapped to a common verdict.")
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "Score:       %d\n", report.Mimecast.Score)
+		if report.Mimecast.Signature != "" {
+			fmt.Fprintf(w, "Signature:   %s\n", report.Mimecast.Signature)
+		}
+		fmt.Fprintf(w, "Verdict:     %s\n", report.Mimecast.Verdict)
+		fmt.Fprintln(w)
+	}
+
+	// Consolidated Verdict
+	if report.Verdict != nil {
+		fmt.Fprintln(w, "CONSOLIDATED VERDICT")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		fmt.Fprintln(w, "The spam engines' verdicts combined into one under the verdict policy.")
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "Verdict:     %s (%s)\n", report.Verdict.Verdict, report.Verdict.Policy)
+		inputs := make([]string, len(report.Verdict.Inputs))
+		for i, v := range report.Verdict.Inputs {
+			inputs[i] = v.Source + "=" + v.Verdict
+		}
+		fmt.Fprintf(w, "Engines:     %s\n", strings.Join(inputs, ", "))
+		if report.Verdict.Disagreement {
+			fmt.Fprintln(w, "⚠ Engines disagree")
+		}
+		fmt.Fprintln(w)
+	}
+
+	// Thread Results
+	if report.Thread != nil {
+		fmt.Fprintln(w, "CONVERSATION THREAD")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		fmt.Fprintln(w, "Reply-chain phishing hijacks existing threads to borrow their credibility.")
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "Is Reply:    %s\n", formatYesNo(report.Thread.IsReply))
+		for _, id := range report.Thread.InReplyTo {
+			fmt.Fprintf(w, "In-Reply-To: %s\n", id)
+		}
+		fmt.Fprintf(w, "References:  %d message(s)\n", len(report.Thread.References))
+		if verbose {
+			for _, id := range report.Thread.References {
+				fmt.Fprintf(w, "  %s\n", id)
+			}
+		}
+		if len(report.Thread.ThreadDomains) > 0 {
+			fmt.Fprintf(w, "Domains:     %s\n", strings.Join(report.Thread.ThreadDomains, ", "))
+		}
+		if report.Thread.ReplyDomainMismatch {
+			fmt.Fprintln(w, "Assessment:  SENDER NOT PART OF THREAD ⚠ (possible thread hijacking)")
+		}
+		fmt.Fprintln(w)
 	}
 
-	// Parse a= (algorithm)
-	if match := regexp.MustCompile(`a=([^\s;]+)`).FindStringSubmatch(sig); len(match) > 1 {
-		result.HeaderA = match[1]
+	// Webmail Provenance
+	if report.Webmail != nil {
+		fmt.Fprintln(w, "WEBMAIL PROVENANCE")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		fmt.Fprintln(w, "Origin headers stamped by webmail providers; unauthenticated, so weak signals.")
+		fmt.Fprintln(w)
+		if report.Webmail.OriginatingEmail != "" {
+			fmt.Fprintf(w, "Originating: %s\n", report.Webmail.OriginatingEmail)
+		}
+		if report.Webmail.OriginatingIP != "" {
+			fmt.Fprintf(w, "Origin IP:   %s\n", report.Webmail.OriginatingIP)
+		}
+		if report.Webmail.ApparentlyTo != "" {
+			fmt.Fprintf(w, "Recipient:   %s\n", report.Webmail.ApparentlyTo)
+		}
+		if report.Webmail.FromMismatch {
+			fmt.Fprintln(w, "⚠ Originating email differs from the From address")
+		}
+		fmt.Fprintln(w)
 	}
 
-	return result
-}
-
-// parseAuthResultsForDKIM extracts DKIM results from Authentication-Results header
-func parseAuthResultsForDKIM(authResult string) []DKIMResult {
-	var results []DKIMResult
-
-	// Look for dkim=result pattern with limited matches to prevent ReDoS
-	dkimRegex := regexp.MustCompile(`dkim=([a-z]+)(?:\s+\(([^)]+)\))?`)
-	matches := dkimRegex.FindAllStringSubmatch(authResult, MaxRegexMatches)
-
-	for _, match := range matches {
-		result := DKIMResult{
-			Result: match[1],
+	// Web Application Origin
+	if origin := report.WebappOrigin; origin != nil {
+		fmt.Fprintln(w, "WEB APPLICATION ORIGIN (X-PHP-ORIGINATING-SCRIPT, X-SOURCE)")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		fmt.Fprintln(w, "Stamped by the web host on mail sent from a script; on spam, names the site to check.")
+		fmt.Fprintln(w)
+		if origin.Script != "" {
+			fmt.Fprintf(w, "Script:      %s\n", origin.Script)
 		}
-
-		// Extract domain from header.d
-		if domainMatch := regexp.MustCompile(`header\.d=([^\s;]+)`).FindStringSubmatch(authResult); len(domainMatch) > 1 {
-			result.Domain = domainMatch[1]
+		if origin.ScriptUID != "" {
+			fmt.Fprintf(w, "Script UID:  %s\n", origin.ScriptUID)
 		}
-
-		// Extract selector from header.s
-		if selectorMatch := regexp.MustCompile(`header\.s=([^\s;]+)`).FindStringSubmatch(authResult); len(selectorMatch) > 1 {
-			result.Selector = selectorMatch[1]
+		if origin.PHPScript != "" {
+			fmt.Fprintf(w, "PHP Script:  %s\n", origin.PHPScript)
 		}
-
-		results = append(results, result)
+		if origin.Source != "" {
+			fmt.Fprintf(w, "Source:      %s\n", origin.Source)
+		}
+		if origin.SourceArgs != "" {
+			fmt.Fprintf(w, "Source Args: %s\n", origin.SourceArgs)
+		}
+		if origin.SourceDir != "" {
+			fmt.Fprintf(w, "Source Dir:  %s\n", origin.SourceDir)
+		}
+		fmt.Fprintln(w)
 	}
 
-	return results
-}
-
-// extractDMARCResults extracts DMARC evaluation results from headers
-func extractDMARCResults(header mail.Header) []DMARCResult {
-	var results []DMARCResult
-
-	// Check Authentication-Results for DMARC
-	authResults := header["Authentication-Results"]
-	for _, ar := range authResults {
-		dmarcResults := parseAuthResultsForDMARC(ar)
-		results = append(results, dmarcResults...)
+	// Sender Software
+	if software := report.Software; software != nil {
+		fmt.Fprintln(w, "SENDER SOFTWARE (X-MAILER, USER-AGENT, ORGANIZATION)")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		fmt.Fprintln(w, "Set by the sender and easily forged; spam tools often leave their defaults.")
+		fmt.Fprintln(w)
+		if software.Mailer != "" {
+			fmt.Fprintf(w, "X-Mailer:     %s\n", software.Mailer)
+		}
+		if software.UserAgent != "" {
+			fmt.Fprintf(w, "User-Agent:   %s\n", software.UserAgent)
+		}
+		if software.Organization != "" {
+			fmt.Fprintf(w, "Organization: %s\n", software.Organization)
+		}
+		if software.SpamTool != "" {
+			fmt.Fprintf(w, "⚠ Known spam tool signature: %s\n", software.SpamTool)
+		}
+		fmt.Fprintln(w)
+	}
+
+	// Microsoft 365 Tenant
+	if report.Tenant != nil {
+		tenant := report.Tenant
+		fmt.Fprintln(w, "MICROSOFT 365 TENANT")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		fmt.Fprintln(w, "Tenant Exchange Online attributed the message to (X-MS-Exchange-CrossTenant-*).")
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "Tenant ID:   %s\n", valueOrUnknown(tenant.TenantID))
+		if tenant.UserPrincipalName != "" {
+			fmt.Fprintf(w, "User:        %s\n", tenant.UserPrincipalName)
+		}
+		if tenant.AuthAs != "" {
+			fmt.Fprintf(w, "Auth As:     %s\n", tenant.AuthAs)
+		}
+		if tenant.FromEntityHeader != "" {
+			fmt.Fprintf(w, "From Entity: %s\n", tenant.FromEntityHeader)
+		}
+		if tenant.OriginalArrivalTime != "" {
+			fmt.Fprintf(w, "Arrived:     %s\n", tenant.OriginalArrivalTime)
+		}
+		fmt.Fprintln(w)
+	}
+
+	// Legacy Sender-ID
+	if report.SenderID != nil {
+		fmt.Fprintln(w, "SENDER ID (LEGACY)")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		fmt.Fprintln(w, "Retired Microsoft Sender-ID check of the purported responsible address (X-SID-*).")
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "Result:      %s\n", formatResult(valueOrUnknown(report.SenderID.Result)))
+		if report.SenderID.PRA != "" {
+			fmt.Fprintf(w, "PRA:         %s\n", report.SenderID.PRA)
+		}
+		fmt.Fprintln(w)
+	}
+
+	// Sender IP
+	if report.SenderIP != nil {
+		fmt.Fprintln(w, "SENDER IP")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		fmt.Fprintln(w, "IP of the client that submitted the message, as recorded by a gateway.")
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "IP:          %s\n", report.SenderIP.IP)
+		fmt.Fprintf(w, "Source:      %s\n", report.SenderIP.Source)
+		if report.SenderCountry != "" {
+			if report.CountryName != "" {
+				fmt.Fprintf(w, "Country:     %s (%s)\n", report.SenderCountry, report.CountryName)
+			} else {
+				fmt.Fprintf(w, "Country:     %s\n", report.SenderCountry)
+			}
+		}
+		if rep := report.Reputation; rep != nil {
+			if rep.Error != "" {
+				fmt.Fprintf(w, "Reputation:  unavailable (%s)\n", rep.Error)
+			} else {
+				status := "✓"
+				if rep.AbuseConfidenceScore >= 50 {
+					status = "⚠ reported for abuse"
+				}
+				fmt.Fprintf(w, "Reputation:  abuse confidence %d/100, %d reports %s\n", rep.AbuseConfidenceScore, rep.TotalReports, status)
+				if rep.LastReportedAt != "" {
+					fmt.Fprintf(w, "Last Report: %s\n", rep.LastReportedAt)
+				}
+			}
+		}
+		fmt.Fprintln(w)
+	}
+
+	// Baseline
+	if report.Baseline != nil {
+		fmt.Fprintln(w, "BASELINE")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		fmt.Fprintln(w, "Comparison with the values expected for this sender (-baseline).")
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "Domain:      %s\n", report.Baseline.Domain)
+		if !report.Baseline.Drifted {
+			fmt.Fprintln(w, "Status:      matches baseline ✓")
+		}
+		for _, drift := range report.Baseline.Drift {
+			fmt.Fprintf(w, "⚠ %s %s not in expected %s\n", drift.Field, drift.Actual, strings.Join(drift.Expected, ", "))
+		}
+		fmt.Fprintln(w)
+	}
+
+	// Attachments
+	if len(report.Attachments) > 0 {
+		fmt.Fprintln(w, "ATTACHMENTS")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		fmt.Fprintln(w, "Files carried in the MIME body; executables and disguised types are phishing signals.")
+		fmt.Fprintln(w)
+		for _, attachment := range report.Attachments {
+			fmt.Fprintf(w, "File:        %s (%s, %d bytes", valueOrUnknown(attachment.Filename), attachment.ContentType, attachment.Size)
+			if attachment.Inline {
+				fmt.Fprint(w, ", inline")
+			}
+			fmt.Fprintln(w, ")")
+			for _, reason := range attachment.Reasons {
+				fmt.Fprintf(w, "  ⚠ %s\n", reason)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+
+	// Received Chain
+	if len(report.ReceivedChain) > 0 {
+		fmt.Fprintln(w, "RECEIVED CHAIN")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		fmt.Fprintln(w, "Relays the message passed through, oldest first, with times normalized to UTC.")
+		fmt.Fprintln(w)
+		for i, hop := range report.ReceivedChain {
+			fmt.Fprintf(w, "Hop %d:       %s -> %s", i+1, valueOrUnknown(hop.From), valueOrUnknown(hop.By))
+			if hop.With != "" {
+				fmt.Fprintf(w, " (%s)", hop.With)
+			}
+			fmt.Fprintln(w)
+			if hop.TimestampUTC != "" {
+				fmt.Fprintf(w, "  Time:      %s", hop.TimestampUTC)
+				if hop.TimestampLocal != "" {
+					fmt.Fprintf(w, " (%s)", hop.TimestampLocal)
+				}
+				fmt.Fprintln(w)
+				if i > 0 {
+					fmt.Fprintf(w, "  Delay:     %+ds\n", hop.DelaySeconds)
+				}
+			}
+			if hop.Timestamp != "" {
+				fmt.Fprintf(w, "  Original:  %s\n", hop.Timestamp)
+			}
+			if hop.FromIP != "" {
+				fmt.Fprintf(w, "  Source IP: %s (%s)\n", hop.FromIP, hop.FromIPScope)
+			}
+		}
+		fmt.Fprintf(w, "Transit Time: %ds\n", report.TransitSeconds)
+		fmt.Fprintf(w, "Hop Count:   %d\n", report.HopCount)
+		if report.ExcessiveHops {
+			fmt.Fprintln(w, "⚠ Unusually many hops (possible open relay or forwarding chain)")
+		}
+		if report.SuspiciousRouting {
+			fmt.Fprintf(w, "⚠ Implausible routing (possibly forged Received headers): %s\n", report.RoutingExplanation)
+		}
+		fmt.Fprintln(w)
 	}
 
-	return results
-}
-
-// parseAuthResultsForDMARC extracts DMARC results from Authentication-Results header
-func parseAuthResultsForDMARC(authResult string) []DMARCResult {
-	var results []DMARCResult
-
-	// Look for dmarc=result pattern with limited matches to prevent ReDoS
-	dmarcRegex := regexp.MustCompile(`dmarc=([a-z]+)(?:\s+\(([^)]+)\))?`)
-	matches := dmarcRegex.FindAllStringSubmatch(authResult, MaxRegexMatches)
-
-	for _, match := range matches {
-		result := DMARCResult{
-			Result: match[1],
+	// List-Unsubscribe Results
+	if report.ListUnsubscribe != nil {
+		fmt.Fprintln(w, "LIST-UNSUBSCRIBE (BULK MAIL INDICATORS)")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		fmt.Fprintln(w, "Legitimate bulk senders advertise unsubscribe links; targeted threats rarely do.")
+		fmt.Fprintln(w)
+		for _, u := range report.ListUnsubscribe.URLs {
+			fmt.Fprintf(w, "URL:         %s\n", u)
 		}
-
-		// Extract policy
-		if policyMatch := regexp.MustCompile(`policy\.([a-z-]+)=([^\s;]+)`).FindStringSubmatch(authResult); len(policyMatch) > 2 {
-			if policyMatch[1] == "dmarc" || policyMatch[1] == "policy" {
-				result.Policy = policyMatch[2]
+		for _, m := range report.ListUnsubscribe.Mailtos {
+			fmt.Fprintf(w, "Mailto:      %s\n", m)
+		}
+		fmt.Fprintf(w, "One-Click:   %s\n", formatYesNo(report.ListUnsubscribe.OneClickUnsubscribe))
+		fmt.Fprintln(w)
+	}
+
+	// Precedence and Auto-Submitted
+	if auto := report.Automation; auto != nil {
+		fmt.Fprintln(w, "AUTOMATED MAIL (PRECEDENCE, AUTO-SUBMITTED)")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		fmt.Fprintln(w, "Bulk and machine-generated mail declares itself; a targeted message rarely does.")
+		fmt.Fprintln(w)
+		if auto.Precedence != "" {
+			fmt.Fprintf(w, "Precedence:  %s\n", auto.Precedence)
+		}
+		if auto.AutoSubmitted != "" {
+			fmt.Fprintf(w, "Auto-Submitted: %s\n", auto.AutoSubmitted)
+		}
+		fmt.Fprintf(w, "Bulk:        %s\n", formatYesNo(auto.Bulk))
+		fmt.Fprintf(w, "Automated:   %s\n", formatYesNo(auto.Automated))
+		fmt.Fprintln(w)
+	}
+
+	// Homograph Results
+	if report.Homograph != nil && (report.Homograph.HomographSuspected || report.Homograph.Domain != report.Homograph.ASCIIDomain) {
+		fmt.Fprintln(w, "FROM DOMAIN HOMOGRAPH CHECK")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		fmt.Fprintln(w, "Internationalized domains can use lookalike characters to impersonate brands.")
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "Domain:      %s\n", report.Homograph.Domain)
+		fmt.Fprintf(w, "ASCII Form:  %s\n", report.Homograph.ASCIIDomain)
+		if report.Homograph.Skeleton != "" {
+			fmt.Fprintf(w, "Looks Like:  %s\n", report.Homograph.Skeleton)
+		}
+		if len(report.Homograph.Scripts) > 0 {
+			fmt.Fprintf(w, "Scripts:     %s\n", strings.Join(report.Homograph.Scripts, ", "))
+		}
+		if report.Homograph.HomographSuspected {
+			fmt.Fprintf(w, "Assessment:  HOMOGRAPH SUSPECTED ✗ (%s)\n", report.Homograph.Reason)
+		}
+		if verbose {
+			for _, c := range report.Homograph.Confusables {
+				fmt.Fprintf(w, "  %s\n", c)
 			}
 		}
+		fmt.Fprintln(w)
+	}
 
-		// Alternative policy extraction
-		if result.Policy == "" {
-			if policyMatch := regexp.MustCompile(`p=([^\s;]+)`).FindStringSubmatch(authResult); len(policyMatch) > 1 {
-				result.Policy = policyMatch[1]
+	// Authentication Results Summary
+	if len(report.AuthResults) > 0 && verbose {
+		fmt.Fprintln(w, "AUTHENTICATION-RESULTS HEADERS")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		for i, ar := range report.AuthResults {
+			fmt.Fprintf(w, "Auth Server #%d: %s\n", i+1, ar.AuthServID)
+			for _, method := range ar.Methods {
+				fmt.Fprintf(w, "  %s: %s", strings.ToUpper(method.Method), formatResult(method.Result))
+				if len(method.Properties) > 0 {
+					fmt.Fprintf(w, " (")
+					for i, k := range sortedKeys(method.Properties) {
+						if i > 0 {
+							fmt.Fprintf(w, ", ")
+						}
+						fmt.Fprintf(w, "%s=%s", k, method.Properties[k])
+					}
+					fmt.Fprintf(w, ")")
+				}
+				if method.Reason != "" {
+					fmt.Fprintf(w, " reason: %s", method.Reason)
+				}
+				fmt.Fprintln(w)
 			}
+			fmt.Fprintln(w)
 		}
+	}
 
-		// Extract disposition
-		if dispMatch := regexp.MustCompile(`action=([^\s;]+)`).FindStringSubmatch(authResult); len(dispMatch) > 1 {
-			result.Disposition = dispMatch[1]
+	// Parser Diagnostics (if verbose)
+	if verbose && len(report.Diagnostics) > 0 {
+		fmt.Fprintln(w, "PARSER DIAGNOSTICS")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		for _, run := range report.Diagnostics {
+			status := "no data"
+			if run.Matched {
+				status = "matched"
+			}
+			fmt.Fprintf(w, "%-32s %s", run.Parser, status)
+			if run.Error != "" {
+				fmt.Fprintf(w, " ⚠ %s", run.Error)
+			}
+			fmt.Fprintln(w)
 		}
-
-		// Extract domain
-		if domainMatch := regexp.MustCompile(`header\.from=([^\s;]+)`).FindStringSubmatch(authResult); len(domainMatch) > 1 {
-			result.Domain = domainMatch[1]
+		if report.ProcessingDuration > 0 {
+			fmt.Fprintf(w, "%-32s %s\n", "processing time", report.ProcessingDuration.Round(time.Microsecond))
 		}
-
-		results = append(results, result)
+		fmt.Fprintln(w)
 	}
 
-	return results
-}
-
-// parseAuthenticationResults parses Authentication-Results headers comprehensively
-func parseAuthenticationResults(header mail.Header) []AuthResult {
-	var results []AuthResult
-
-	authHeaders := header["Authentication-Results"]
-	for _, ah := range authHeaders {
-		result := parseAuthResultHeader(ah)
-		if result != nil {
-			results = append(results, *result)
+	// Raw Headers (if verbose)
+	if verbose && report.RawHeaders != nil && len(report.RawHeaders) > 0 {
+		fmt.Fprintln(w, "RAW EMAIL HEADERS")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		for _, key := range sortedKeys(report.RawHeaders) {
+			for _, value := range report.RawHeaders[key] {
+				fmt.Fprintf(w, "%s: %s\n", key, value)
+			}
 		}
+		fmt.Fprintln(w)
 	}
 
-	return results
+	// Summary
+	fmt.Fprintln(w, "SECURITY SUMMARY")
+	fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+	summarizeSecurity(w, report, thresholds)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "="+strings.Repeat("=", 79))
 }
 
-// parseAuthResultHeader parses a single Authentication-Results header
-func parseAuthResultHeader(header string) *AuthResult {
-	result := &AuthResult{
-		Methods: []AuthMethod{},
+// outputPretty writes the report grouped into Spam Verdict, Authentication,
+// Sender and Routing sections (-pretty). It renders the same data as
+// outputText; only the layout differs.
+func outputPretty(w io.Writer, report *EmailSecurityReport, verbose bool, locale string, thresholds SCLThresholds) {
+	section := func(title string) {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, title)
+		fmt.Fprintln(w, strings.Repeat("=", len(title)))
+	}
+	// line writes a label/value pair at the given indentation depth, keeping
+	// values in one column whatever the depth
+	line := func(depth int, label, format string, args ...any) {
+		fmt.Fprintf(w, "%s%-*s %s\n", strings.Repeat("  ", depth), 18-2*depth, label+":", fmt.Sprintf(format, args...))
+	}
+	warn := func(depth int, format string, args ...any) {
+		fmt.Fprintf(w, "%s⚠ %s\n", strings.Repeat("  ", depth), fmt.Sprintf(format, args...))
+	}
+
+	fmt.Fprintln(w, "Email Security Analysis")
+	fmt.Fprintln(w, strings.Repeat("=", 23))
+	if report.File != "" {
+		if report.MessageIndex > 0 && report.MessageOffset != nil {
+			line(0, "File", "%s (message %d, byte offset %d)", report.File, report.MessageIndex, *report.MessageOffset)
+		} else if report.MessageIndex > 0 {
+			line(0, "File", "%s (message %d)", report.File, report.MessageIndex)
+		} else {
+			line(0, "File", "%s", report.File)
+		}
 	}
-
-	// Extract authserv-id (first component before semicolon)
-	parts := strings.SplitN(header, ";", 2)
-	if len(parts) > 0 {
-		result.AuthServID = strings.TrimSpace(parts[0])
+	line(0, "Subject", "%s", report.Subject)
+	line(0, "Date", "%s", report.Date)
+	if report.DateAnomaly {
+		warn(1, "%s", describeDateSkew(*report.DateSkewSeconds))
 	}
+	line(0, "Message-ID", "%s", report.MessageID)
 
-	if len(parts) < 2 {
-		return result
+	section("Spam Verdict")
+	if report.Verdict != nil {
+		line(1, "Verdict", "%s (%s)", report.Verdict.Verdict, report.Verdict.Policy)
+		if report.Verdict.Disagreement {
+			warn(2, "Engines disagree")
+		}
 	}
-
-	// Parse method results
-	methodsStr := parts[1]
-
-	// Split by method types
-	methods := []string{"spf", "dkim", "dmarc", "arc"}
-	for _, method := range methods {
-		// Find all occurrences of this method with limited matches to prevent ReDoS
-		methodRegex := regexp.MustCompile(method + `=([a-z]+)(?:\s+([^;]+))?`)
-		matches := methodRegex.FindAllStringSubmatch(methodsStr, MaxRegexMatches)
-
-		for _, match := range matches {
-			authMethod := AuthMethod{
-				Method:     method,
-				Result:     match[1],
-				Properties: make(map[string]string),
-			}
-
-			// Parse properties
-			if len(match) > 2 && match[2] != "" {
-				props := strings.Fields(match[2])
-				for _, prop := range props {
-					if strings.Contains(prop, "=") {
-						kv := strings.SplitN(prop, "=", 2)
-						authMethod.Properties[kv[0]] = kv[1]
-					}
-				}
-			}
-
-			result.Methods = append(result.Methods, authMethod)
+	if scl := report.SCL; scl != nil {
+		line(1, "SCL", "%d - %s", scl.Score, scl.Description)
+		line(2, "Source", "%s", scl.HeaderSource)
+		for _, svc := range scl.Services {
+			line(2, "Service", "%s (%s)", svc.Code, svc.Description)
+		}
+		if scl.SFV != "" {
+			line(2, "Filter", "%s (%s)", scl.SFV, describeToken(locale, "sfv", scl.SFV))
+		}
+		if scl.CAT != "" {
+			line(2, "Category", "%s (%s)", scl.CAT, describeToken(locale, "cat", scl.CAT))
+		}
+		if scl.IPV != "" {
+			line(2, "IP Verdict", "%s (%s)", scl.IPV, describeToken(locale, "ipv", scl.IPV))
+		}
+		if scl.OverriddenByRule {
+			warn(2, "Verdict set by a rule or allow/block list")
+		}
+		if report.SCLCategoryConflict {
+			warn(2, "SCL %d looks clean but category %s is malicious", scl.Score, scl.CAT)
+		}
+		if report.SignalFingerprint != "" {
+			line(2, "Fingerprint", "%s", report.SignalFingerprint)
 		}
 	}
-
-	return result
-}
-
-// extractARCResults extracts ARC (Authenticated Received Chain) results
-func extractARCResults(header mail.Header) []ARCResult {
-	var results []ARCResult
-
-	// Check for ARC-Authentication-Results headers
-	arcAuthResults := header["Arc-Authentication-Results"]
-	for _, ar := range arcAuthResults {
-		result := parseARCHeader(ar)
-		if result != nil {
-			results = append(results, *result)
+	if report.Allowlisted {
+		line(1, "Allowlisted", "yes (spam filtering was skipped)")
+	}
+	if sa := report.SpamAssassin; sa != nil {
+		if sa.Required != 0 {
+			line(1, "SpamAssassin", "%s, score %.1f (required %.1f)", formatYesNo(sa.IsSpam), sa.Score, sa.Required)
+		} else {
+			line(1, "SpamAssassin", "%s, score %.1f", formatYesNo(sa.IsSpam), sa.Score)
+		}
+		if verbose && len(sa.Tests) > 0 {
+			line(2, "Tests", "%s", strings.Join(sa.Tests, ", "))
+		}
+		for _, rule := range sa.Rules {
+			line(2, fmt.Sprintf("%+.1f", rule.Score), "%s", strings.TrimSpace(rule.Name+" "+rule.Description))
 		}
 	}
-
-	// Check Authentication-Results for ARC chain validation
-	authResults := header["Authentication-Results"]
-	for _, ar := range authResults {
-		arcChainResult := parseAuthResultsForARC(ar)
-		if arcChainResult != nil {
-			results = append(results, *arcChainResult)
+	if mc := report.Mimecast; mc != nil {
+		line(1, "Mimecast", "%s, score %d", mc.Verdict, mc.Score)
+	}
+	if lu := report.ListUnsubscribe; lu != nil {
+		line(1, "Bulk Mail", "unsubscribe advertised, one-click %s", formatYesNo(lu.OneClickUnsubscribe))
+	}
+	if auto := report.Automation; auto != nil {
+		var marks []string
+		if auto.Precedence != "" {
+			marks = append(marks, "Precedence "+auto.Precedence)
+		}
+		if auto.AutoSubmitted != "" {
+			marks = append(marks, "Auto-Submitted "+auto.AutoSubmitted)
 		}
+		line(1, "Automated", "%s", strings.Join(marks, ", "))
 	}
-
-	return results
-}
-
-// parseARCHeader parses an ARC-Authentication-Results header
-func parseARCHeader(header string) *ARCResult {
-	result := &ARCResult{}
-
-	// Extract i= (instance)
-	if match := regexp.MustCompile(`i=(\d+)`).FindStringSubmatch(header); len(match) > 1 {
-		if instance, err := strconv.Atoi(match[1]); err == nil {
-			result.Instance = instance
+	for _, attachment := range report.Attachments {
+		line(1, "Attachment", "%s (%s, %d bytes)", valueOrUnknown(attachment.Filename), attachment.ContentType, attachment.Size)
+		for _, reason := range attachment.Reasons {
+			warn(2, "%s", reason)
 		}
 	}
+	if report.SCL == nil && report.SpamAssassin == nil && report.Mimecast == nil {
+		fmt.Fprintln(w, "  No spam filter verdicts found")
+	}
 
-	return result
-}
-
-// parseAuthResultsForARC extracts ARC chain validation from Authentication-Results
-func parseAuthResultsForARC(authResult string) *ARCResult {
-	// Look for arc=result pattern
-	arcRegex := regexp.MustCompile(`arc=([a-z]+)`)
-	matches := arcRegex.FindStringSubmatch(authResult)
-
-	if len(matches) > 1 {
-		result := &ARCResult{
-			Result: matches[1],
-			Chain:  matches[1],
+	section("Authentication")
+	if len(report.SPFResults) == 0 {
+		line(1, "SPF", "none found")
+	}
+	for _, spf := range report.SPFResults {
+		line(1, "SPF", "%s (%s)", formatResult(spf.Result), valueOrUnknown(spf.Domain))
+		if spf.ClientIP != "" {
+			line(2, "Client IP", "%s", spf.ClientIP)
+		}
+		if spf.Reason != "" {
+			line(2, "Reason", "%s", spf.Reason)
+		}
+		if verbose && spf.Explanation != "" {
+			line(2, "Details", "%s", spf.Explanation)
 		}
-		return result
 	}
-
-	return nil
-}
-
-// extractSCLResults extracts Microsoft Spam Confidence Level from X-Forefront-Antispam-Report headers
-//
-// SECURITY NOTE: X-Forefront-Antispam-Report headers can be spoofed by attackers.
-// This header should ONLY be trusted when the email is received from authenticated
-// Microsoft Exchange Online servers. Always verify the Received headers and
-// authentication results (SPF/DKIM/DMARC) to ensure the email actually originated
-// from Microsoft infrastructure before trusting the SCL score for security decisions.
-func extractSCLResults(header mail.Header) *SCLResult {
-	// Check X-Forefront-Antispam-Report header (trusted)
-	forefrontReport := header.Get("X-Forefront-Antispam-Report")
-	if forefrontReport != "" {
-		// Validate header length
-		if len(forefrontReport) > MaxHeaderLength {
-			log.Printf("Warning: X-Forefront-Antispam-Report header exceeds maximum length, truncating")
-			forefrontReport = forefrontReport[:MaxHeaderLength]
+	if report.SPFDisagreement {
+		warn(2, "Received-SPF and Authentication-Results disagree")
+	}
+	if c := report.SPFConsensus; c != nil && len(c.Dissenting) > 0 {
+		line(1, "SPF Consensus", "%s (%d of %d assertions)", formatResult(c.Result), c.Agreeing, c.Assertions)
+		for _, d := range c.Dissenting {
+			warn(2, "%s reports %s", d.Source, d.Result)
 		}
-
-		result := parseSCLHeader(forefrontReport, "X-Forefront-Antispam-Report")
-		if result != nil {
-			return result
+	}
+	if report.SPFUnalignedPass {
+		warn(2, "SPF passed for a domain unrelated to the From address")
+	}
+	if len(report.DKIMResults) == 0 {
+		line(1, "DKIM", "none found")
+	}
+	for _, dkim := range report.DKIMResults {
+		label := "DKIM"
+		if dkim.Source == dkimSourceGoogle {
+			label = "DKIM (Google)"
+		}
+		line(1, label, "%s (%s, s=%s)", formatResult(dkim.Result), valueOrUnknown(dkim.Domain), valueOrUnknown(dkim.Selector))
+		if dkim.Reason != "" {
+			line(2, "Reason", "%s", dkim.Reason)
 		}
 	}
-
-	// Check X-Forefront-Antispam-Report-Untrusted header (alternative source)
-	forefrontUntrusted := header.Get("X-Forefront-Antispam-Report-Untrusted")
-	if forefrontUntrusted != "" {
-		// Validate header length
-		if len(forefrontUntrusted) > MaxHeaderLength {
-			log.Printf("Warning: X-Forefront-Antispam-Report-Untrusted header exceeds maximum length, truncating")
-			forefrontUntrusted = forefrontUntrusted[:MaxHeaderLength]
+	for _, sig := range report.DKIMSignatures {
+		if sig.Expired {
+			warn(2, "Signature d=%s, s=%s expired %s", sig.Domain, sig.Selector, formatUnixTime(sig.Expiration))
 		}
-
-		result := parseSCLHeader(forefrontUntrusted, "X-Forefront-Antispam-Report-Untrusted")
-		if result != nil {
-			return result
+	}
+	if len(report.DMARCResults) == 0 {
+		line(1, "DMARC", "none found")
+	}
+	for _, dmarc := range report.DMARCResults {
+		line(1, "DMARC", "%s (%s)", formatResult(dmarc.Result), valueOrUnknown(dmarc.Domain))
+		if dmarc.Policy != "" {
+			line(2, "Policy", "%s", dmarc.Policy)
+		}
+		if dmarc.Reason != "" {
+			line(2, "Reason", "%s", dmarc.Reason)
+		}
+		if dmarc.SPFAlignment != "" || dmarc.DKIMAlignment != "" {
+			line(2, "Alignment", "SPF %s, DKIM %s", formatResult(valueOrUnknown(dmarc.SPFAlignment)), formatResult(valueOrUnknown(dmarc.DKIMAlignment)))
 		}
 	}
-
-	return nil
-}
-
-// parseSCLHeader parses SCL value from X-Forefront-Antispam-Report header
-func parseSCLHeader(header string, headerSource string) *SCLResult {
-	// Use regex to extract SCL:value pattern
-	// Pattern is safe from ReDoS: simple literal + digit capture group with no backtracking
-	sclRegex := regexp.MustCompile(`SCL:(-?\d+)`)
-	matches := sclRegex.FindStringSubmatch(header)
-
-	if len(matches) > 1 {
-		// Use strconv.Atoi for robust integer parsing with proper error handling
-		score, err := strconv.Atoi(matches[1])
-		if err != nil {
-			log.Printf("Warning: Failed to parse SCL score from value '%s': %v", matches[1], err)
-			return nil
+	for _, arc := range report.ARCResults {
+		line(1, "ARC", "%s (instance %d, chain %s)", formatResult(arc.Result), arc.Instance, formatResult(valueOrUnknown(arc.Chain)))
+	}
+	if chain := report.ARCChain; chain != nil {
+		line(1, "ARC Chain", "%s (%d instances)", formatResult(chain.Status), len(chain.Sets))
+		for _, problem := range chain.Problems {
+			warn(2, "%s", problem)
 		}
-
-		// Validate score range - reject out-of-range values
-		// Microsoft SCL valid range is -1 to 9
-		if score < -1 || score > 9 {
-			log.Printf("Warning: SCL score %d out of valid range [-1, 9], rejecting value", score)
-			return nil
+	}
+	if sid := report.SenderID; sid != nil {
+		line(1, "Sender-ID", "%s (%s, legacy)", formatResult(valueOrUnknown(sid.Result)), valueOrUnknown(sid.PRA))
+	}
+	if orig := report.OriginalAuth; orig != nil {
+		for _, diff := range orig.Differences {
+			warn(2, "Changed since origin: %s", diff)
 		}
+	}
 
-		result := &SCLResult{
-			Score:        score,
-			Description:  getSCLDescription(score),
-			HeaderSource: sanitizeHeader(headerSource),
-			RawHeader:    sanitizeHeader(header),
+	section("Sender")
+	line(1, "From", "%s", report.From)
+	line(1, "To", "%s", report.To)
+	if rc := report.Recipients; rc != nil {
+		line(1, "Recipients", "%d (To %d, Cc %d)", rc.Total, rc.To, rc.Cc)
+		if rc.Excessive {
+			warn(2, "Unusually many recipients (mass mailing or a leaked Cc list)")
+		}
+		if len(rc.ParseErrors) > 0 {
+			warn(2, "%d recipient addresses could not be parsed and are not counted", len(rc.ParseErrors))
 		}
-
-		return result
 	}
-
-	return nil
-}
-
-// getSCLDescription returns a human-readable description for an SCL score
-func getSCLDescription(score int) string {
-	switch score {
-	case -1:
-		return "Skipped spam filtering (safe sender or SCL override)"
-	case 0, 1:
-		return "Not spam"
-	case 5, 6:
-		return "Spam"
-	case 7, 8, 9:
-		return "High confidence spam"
-	default:
-		if score >= 2 && score <= 4 {
-			return "Low spam probability"
+	if report.ReturnPathMismatch {
+		warn(2, "Return-Path domain %s belongs to a different organization", report.ReturnPathDomain)
+	}
+	if len(report.ReplyToDomains) > 0 {
+		line(1, "Reply-To", "%s", strings.Join(report.ReplyToDomains, ", "))
+		if report.ReplyToMismatch {
+			warn(2, "Reply-To differs from the From domain %s: replies go elsewhere (possible BEC)", report.FromDomain)
 		}
-		return "Unknown spam confidence level"
 	}
-}
-
-// outputJSON outputs the report as JSON
-func outputJSON(report *EmailSecurityReport) {
-	// Sanitize raw headers if present
-	if report.RawHeaders != nil {
-		sanitized := make(map[string][]string)
-		for k, values := range report.RawHeaders {
-			sanitizedValues := make([]string, len(values))
-			for i, v := range values {
-				// Ensure UTF-8 validity
-				sanitizedValues[i] = strings.ToValidUTF8(v, "�")
+	if h := report.Homograph; h != nil && h.HomographSuspected {
+		warn(2, "Homograph suspected: %s looks like %s (%s)", h.Domain, h.Skeleton, h.Reason)
+	}
+	if ip := report.SenderIP; ip != nil {
+		line(1, "IP", "%s (%s)", ip.IP, ip.Source)
+		if rep := report.Reputation; rep != nil {
+			if rep.Error != "" {
+				line(2, "Reputation", "unavailable (%s)", rep.Error)
+			} else {
+				line(2, "Reputation", "abuse confidence %d/100, %d reports", rep.AbuseConfidenceScore, rep.TotalReports)
 			}
-			sanitized[strings.ToValidUTF8(k, "�")] = sanitizedValues
 		}
-		report.RawHeaders = sanitized
 	}
-
-	encoder := json.NewEncoder(os.Stdout)
-	encoder.SetIndent("", "  ")
-	encoder.SetEscapeHTML(true)
-	if err := encoder.Encode(report); err != nil {
-		log.Printf("Error encoding JSON: %v", err)
-		os.Exit(1)
+	if tenant := report.Tenant; tenant != nil {
+		line(1, "M365 Tenant", "%s", valueOrUnknown(tenant.TenantID))
+		if tenant.UserPrincipalName != "" {
+			line(2, "User", "%s", tenant.UserPrincipalName)
+		}
 	}
-}
-
-// outputText outputs the report in human-readable text format
-func outputText(report *EmailSecurityReport, verbose bool) {
-	fmt.Println("=" + strings.Repeat("=", 79))
-	fmt.Println("EMAIL SECURITY ANALYSIS REPORT")
-	fmt.Println("=" + strings.Repeat("=", 79))
-	fmt.Println()
-
-	// Basic Email Information
-	fmt.Println("EMAIL INFORMATION")
-	fmt.Println("-" + strings.Repeat("-", 79))
-	fmt.Printf("From:       %s\n", report.From)
-	fmt.Printf("To:         %s\n", report.To)
-	fmt.Printf("Subject:    %s\n", report.Subject)
-	fmt.Printf("Date:       %s\n", report.Date)
-	fmt.Printf("Message-ID: %s\n", report.MessageID)
-	fmt.Println()
-
-	// SPF Results
-	fmt.Println("SPF (SENDER POLICY FRAMEWORK) RESULTS")
-	fmt.Println("-" + strings.Repeat("-", 79))
-	fmt.Println("SPF validates that the sending server is authorized to send email for the domain.")
-	fmt.Println()
-	if len(report.SPFResults) > 0 {
-		for i, spf := range report.SPFResults {
-			fmt.Printf("SPF Check #%d:\n", i+1)
-			fmt.Printf("  Result:     %s\n", formatResult(spf.Result))
-			if spf.Domain != "" {
-				fmt.Printf("  Domain:     %s\n", spf.Domain)
-			}
-			if spf.ClientIP != "" {
-				fmt.Printf("  Client IP:  %s\n", spf.ClientIP)
-			}
-			if spf.Explanation != "" && verbose {
-				fmt.Printf("  Details:    %s\n", spf.Explanation)
-			}
-			fmt.Println()
+	if webmail := report.Webmail; webmail != nil {
+		if webmail.OriginatingEmail != "" {
+			line(1, "Webmail", "%s", webmail.OriginatingEmail)
+		}
+		if webmail.OriginatingIP != "" {
+			line(2, "Origin IP", "%s", webmail.OriginatingIP)
+		}
+		if webmail.FromMismatch {
+			warn(2, "Originating email differs from the From address")
 		}
-	} else {
-		fmt.Println("  No SPF results found")
-		fmt.Println()
 	}
-
-	if report.ReceivedSPF != "" && verbose {
-		fmt.Printf("Received-SPF Header:\n  %s\n\n", report.ReceivedSPF)
+	if origin := report.WebappOrigin; origin != nil {
+		switch {
+		case origin.Script != "":
+			line(1, "Web Script", "%s", origin.Script)
+		case origin.PHPScript != "":
+			line(1, "Web Script", "%s", origin.PHPScript)
+		case origin.SourceArgs != "":
+			line(1, "Web Script", "%s", origin.SourceArgs)
+		default:
+			line(1, "Web Script", "%s", valueOrUnknown(origin.Source))
+		}
+		if origin.SourceDir != "" {
+			line(2, "Source Dir", "%s", origin.SourceDir)
+		}
 	}
-
-	// DKIM Results
-	fmt.Println("DKIM (DOMAINKEYS IDENTIFIED MAIL) RESULTS")
-	fmt.Println("-" + strings.Repeat("-", 79))
-	fmt.Println("DKIM uses cryptographic signatures to verify email authenticity and integrity.")
-	fmt.Println()
-	if len(report.DKIMResults) > 0 {
-		for i, dkim := range report.DKIMResults {
-			fmt.Printf("DKIM Signature #%d:\n", i+1)
-			if dkim.Result != "" {
-				fmt.Printf("  Result:     %s\n", formatResult(dkim.Result))
-			}
-			if dkim.Domain != "" {
-				fmt.Printf("  Domain:     %s\n", dkim.Domain)
-			}
-			if dkim.Selector != "" {
-				fmt.Printf("  Selector:   %s\n", dkim.Selector)
-			}
-			if dkim.HeaderA != "" {
-				fmt.Printf("  Algorithm:  %s\n", dkim.HeaderA)
-			}
-			if verbose && dkim.Signature != "" {
-				fmt.Printf("  Signature:  %s...\n", truncate(dkim.Signature, 60))
-			}
-			fmt.Println()
+	if software := report.Software; software != nil {
+		if mailer := software.mailerName(); mailer != "" {
+			line(1, "Mailer", "%s", mailer)
+		}
+		if software.Organization != "" {
+			line(1, "Organization", "%s", software.Organization)
+		}
+		if software.SpamTool != "" {
+			warn(2, "Known spam tool signature: %s", software.SpamTool)
 		}
-	} else {
-		fmt.Println("  No DKIM signatures found")
-		fmt.Println()
 	}
-
-	// DMARC Results
-	fmt.Println("DMARC (DOMAIN MESSAGE AUTHENTICATION REPORTING & CONFORMANCE) RESULTS")
-	fmt.Println("-" + strings.Repeat("-", 79))
-	fmt.Println("DMARC builds on SPF and DKIM to specify how to handle authentication failures.")
-	fmt.Println()
-	if len(report.DMARCResults) > 0 {
-		for i, dmarc := range report.DMARCResults {
-			fmt.Printf("DMARC Check #%d:\n", i+1)
-			fmt.Printf("  Result:      %s\n", formatResult(dmarc.Result))
-			if dmarc.Policy != "" {
-				fmt.Printf("  Policy:      %s\n", dmarc.Policy)
-			}
-			if dmarc.Domain != "" {
-				fmt.Printf("  Domain:      %s\n", dmarc.Domain)
-			}
-			if dmarc.Disposition != "" {
-				fmt.Printf("  Disposition: %s\n", dmarc.Disposition)
-			}
-			if dmarc.SPFAlignment != "" {
-				fmt.Printf("  SPF Align:   %s\n", formatResult(dmarc.SPFAlignment))
-			}
-			if dmarc.DKIMAlignment != "" {
-				fmt.Printf("  DKIM Align:  %s\n", formatResult(dmarc.DKIMAlignment))
-			}
-			fmt.Println()
+	if thread := report.Thread; thread != nil {
+		line(1, "Reply", "%s, %d referenced message(s)", formatYesNo(thread.IsReply), len(thread.References))
+		if thread.ReplyDomainMismatch {
+			warn(2, "Sender is not part of the thread (possible thread hijacking)")
 		}
-	} else {
-		fmt.Println("  No DMARC results found")
-		fmt.Println()
 	}
-
-	// ARC Results
-	if len(report.ARCResults) > 0 {
-		fmt.Println("ARC (AUTHENTICATED RECEIVED CHAIN) RESULTS")
-		fmt.Println("-" + strings.Repeat("-", 79))
-		fmt.Println("ARC preserves authentication results across email forwarding.")
-		fmt.Println()
-		for i, arc := range report.ARCResults {
-			fmt.Printf("ARC Chain #%d:\n", i+1)
-			if arc.Instance > 0 {
-				fmt.Printf("  Instance: %d\n", arc.Instance)
-			}
-			if arc.Result != "" {
-				fmt.Printf("  Result:   %s\n", formatResult(arc.Result))
-			}
-			if arc.Chain != "" {
-				fmt.Printf("  Chain:    %s\n", formatResult(arc.Chain))
-			}
-			fmt.Println()
+	if baseline := report.Baseline; baseline != nil {
+		if !baseline.Drifted {
+			line(1, "Baseline", "matches %s ✓", baseline.Domain)
+		}
+		for _, drift := range baseline.Drift {
+			warn(2, "Baseline %s %s not in expected %s", drift.Field, drift.Actual, strings.Join(drift.Expected, ", "))
 		}
 	}
 
-	// SCL Results
-	if report.SCL != nil {
-		fmt.Println("SCL (SPAM CONFIDENCE LEVEL) RESULTS")
-		fmt.Println("-" + strings.Repeat("-", 79))
-		fmt.Println("Microsoft's Spam Confidence Level indicates the likelihood of spam.")
-		fmt.Println()
-		fmt.Printf("SCL Score:   %d\n", report.SCL.Score)
-		fmt.Printf("Assessment:  %s\n", report.SCL.Description)
-		fmt.Printf("Source:      %s\n", report.SCL.HeaderSource)
-		if verbose && report.SCL.RawHeader != "" {
-			fmt.Printf("Raw Header:  %s\n", truncate(report.SCL.RawHeader, 80))
+	section("Routing")
+	if len(report.Gateways) > 0 {
+		line(1, "Gateways", "%s", strings.Join(report.Gateways, ", "))
+	}
+	line(1, "Hops", "%d, transit %ds", report.HopCount, report.TransitSeconds)
+	if report.ExcessiveHops {
+		warn(2, "Unusually many hops (possible open relay or forwarding chain)")
+	}
+	if report.SuspiciousRouting {
+		warn(2, "Implausible routing: %s", report.RoutingExplanation)
+	}
+	for i, hop := range report.ReceivedChain {
+		hopLine := fmt.Sprintf("%s -> %s", valueOrUnknown(hop.From), valueOrUnknown(hop.By))
+		if hop.FromIP != "" {
+			hopLine += fmt.Sprintf(" from %s (%s)", hop.FromIP, hop.FromIPScope)
+		}
+		if hop.TimestampUTC != "" {
+			hopLine += " at " + hop.TimestampUTC
 		}
-		fmt.Println()
+		line(2, fmt.Sprintf("Hop %d", i+1), "%s", hopLine)
 	}
 
-	// Authentication Results Summary
-	if len(report.AuthResults) > 0 && verbose {
-		fmt.Println("AUTHENTICATION-RESULTS HEADERS")
-		fmt.Println("-" + strings.Repeat("-", 79))
-		for i, ar := range report.AuthResults {
-			fmt.Printf("Auth Server #%d: %s\n", i+1, ar.AuthServID)
-			for _, method := range ar.Methods {
-				fmt.Printf("  %s: %s", strings.ToUpper(method.Method), formatResult(method.Result))
-				if len(method.Properties) > 0 {
-					fmt.Printf(" (")
-					first := true
-					for k, v := range method.Properties {
-						if !first {
-							fmt.Printf(", ")
-						}
-						fmt.Printf("%s=%s", k, v)
-						first = false
-					}
-					fmt.Printf(")")
-				}
-				fmt.Println()
+	if verbose && len(report.Diagnostics) > 0 {
+		section("Parser Diagnostics")
+		for _, run := range report.Diagnostics {
+			status := "no data"
+			if run.Matched {
+				status = "matched"
 			}
-			fmt.Println()
+			fmt.Fprintf(w, "  %-32s %s\n", run.Parser, status)
+			if run.Error != "" {
+				warn(2, "%s", run.Error)
+			}
+		}
+		if report.ProcessingDuration > 0 {
+			fmt.Fprintf(w, "  %-32s %s\n", "processing time", report.ProcessingDuration.Round(time.Microsecond))
 		}
 	}
 
-	// Raw Headers (if verbose)
-	if verbose && report.RawHeaders != nil && len(report.RawHeaders) > 0 {
-		fmt.Println("RAW EMAIL HEADERS")
-		fmt.Println("-" + strings.Repeat("-", 79))
-		for key, values := range report.RawHeaders {
-			for _, value := range values {
-				fmt.Printf("%s: %s\n", key, value)
+	if verbose && len(report.RawHeaders) > 0 {
+		section("Raw Headers")
+		for _, key := range sortedKeys(report.RawHeaders) {
+			for _, value := range report.RawHeaders[key] {
+				fmt.Fprintf(w, "  %s: %s\n", key, value)
 			}
 		}
-		fmt.Println()
 	}
 
-	// Summary
-	fmt.Println("SECURITY SUMMARY")
-	fmt.Println("-" + strings.Repeat("-", 79))
-	summarizeSecurity(report)
-	fmt.Println()
-	fmt.Println("=" + strings.Repeat("=", 79))
+	section("Summary")
+	summarizeSecurity(w, report, thresholds)
+}
+
+// describeDateSkew explains a flagged Date skew for text output
+func describeDateSkew(seconds int64) string {
+	if seconds > 0 {
+		return fmt.Sprintf("Date is %s ahead of delivery (future-dated)", time.Duration(seconds)*time.Second)
+	}
+	return fmt.Sprintf("Date is %s before delivery (stale)", time.Duration(-seconds)*time.Second)
 }
 
 // formatResult formats a result string with color/styling indicators
@@ -1548,16 +9672,21 @@ func formatResult(result string) string {
 	}
 }
 
-// truncate truncates a string to a maximum length
+// truncate truncates a string to at most maxLen bytes, backing off to a
+// character boundary so valid UTF-8 stays valid
 func truncate(s string, maxLen int) string {
 	if len(s) <= maxLen {
 		return s
 	}
+	for maxLen > 0 && !utf8.RuneStart(s[maxLen]) {
+		maxLen--
+	}
 	return s[:maxLen]
 }
 
-// summarizeSecurity provides a security assessment summary
-func summarizeSecurity(report *EmailSecurityReport) {
+// summarizeSecurity provides a security assessment summary; thresholds decide
+// whether the SCL counts as spam
+func summarizeSecurity(w io.Writer, report *EmailSecurityReport, thresholds SCLThresholds) {
 	spfPass := false
 	dkimPass := false
 	dmarcPass := false
@@ -1588,32 +9717,63 @@ func summarizeSecurity(report *EmailSecurityReport) {
 	}
 
 	// Check SCL for spam
-	if report.SCL != nil && report.SCL.Score >= 5 {
+	if report.SCL != nil && report.SCL.Score >= thresholds.SpamThreshold {
 		isSpam = true
 	}
 
-	fmt.Printf("SPF Authentication:   %s\n", formatBool(spfPass))
-	fmt.Printf("DKIM Authentication:  %s\n", formatBool(dkimPass))
-	fmt.Printf("DMARC Authentication: %s\n", formatBool(dmarcPass))
+	fmt.Fprintf(w, "SPF Authentication:   %s\n", formatBool(spfPass))
+	fmt.Fprintf(w, "DKIM Authentication:  %s\n", formatBool(dkimPass))
+	fmt.Fprintf(w, "DMARC Authentication: %s\n", formatBool(dmarcPass))
 	if report.SCL != nil {
-		fmt.Printf("Spam Confidence (SCL): %d (%s)\n", report.SCL.Score, report.SCL.Description)
+		fmt.Fprintf(w, "Spam Confidence (SCL): %d (%s)\n", report.SCL.Score, report.SCL.Description)
 	}
-	fmt.Println()
+	if report.Homograph != nil && report.Homograph.HomographSuspected {
+		fmt.Fprintf(w, "From Domain Homograph: SUSPECTED ✗ (%s)\n", report.Homograph.ASCIIDomain)
+	}
+	if report.ReplyToMismatch {
+		fmt.Fprintf(w, "Reply-To Mismatch:    YES ✗ (%s, From %s)\n", strings.Join(report.ReplyToDomains, ", "), report.FromDomain)
+	}
+	fmt.Fprintf(w, "Analysis Confidence:  %d/100\n", report.AnalysisConfidence)
+	fmt.Fprintln(w)
 
 	// Overall assessment
 	if isSpam {
-		fmt.Println("Overall Assessment: SPAM DETECTED ✗")
-		fmt.Printf("This email has a spam confidence level of %d. Exercise extreme caution.\n", report.SCL.Score)
+		fmt.Fprintln(w, "Overall Assessment: SPAM DETECTED ✗")
+		fmt.Fprintf(w, "This email has a spam confidence level of %d. Exercise extreme caution.\n", report.SCL.Score)
 	} else if spfPass && dkimPass && dmarcPass {
-		fmt.Println("Overall Assessment: SECURE ✓")
-		fmt.Println("This email passed all major authentication checks.")
+		fmt.Fprintln(w, "Overall Assessment: SECURE ✓")
+		fmt.Fprintln(w, "This email passed all major authentication checks.")
 	} else if spfPass || dkimPass {
-		fmt.Println("Overall Assessment: PARTIALLY SECURE ⚠")
-		fmt.Println("This email passed some authentication checks but not all.")
+		fmt.Fprintln(w, "Overall Assessment: PARTIALLY SECURE ⚠")
+		fmt.Fprintln(w, "This email passed some authentication checks but not all.")
 	} else {
-		fmt.Println("Overall Assessment: INSECURE ✗")
-		fmt.Println("This email failed authentication checks. Exercise caution.")
+		fmt.Fprintln(w, "Overall Assessment: INSECURE ✗")
+		fmt.Fprintln(w, "This email failed authentication checks. Exercise caution.")
+	}
+}
+
+// formatYesNo formats a boolean as a yes/no string
+func formatYesNo(b bool) string {
+	if b {
+		return "Yes"
+	}
+	return "No"
+}
+
+// valueOrNone returns s, or "none" when s is empty
+func valueOrNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+// valueOrUnknown returns s, or "unknown" when s is empty
+func valueOrUnknown(s string) string {
+	if s == "" {
+		return "unknown"
 	}
+	return s
 }
 
 // formatBool formats a boolean as a pass/fail string
@@ -1624,6 +9784,333 @@ func formatBool(b bool) string {
 	return "FAIL ✗"
 }
 
+// ============================================================================
+// Redaction Functions
+// ============================================================================
+
+// RedactionMask replaces every -redact-pattern match
+const RedactionMask = "[REDACTED]"
+
+// Redactor scrubs organization-specific identifiers (employee IDs, internal
+// hostnames) from reports before they are shared. A nil Redactor leaves
+// reports unchanged.
+type Redactor struct {
+	patterns []*regexp.Regexp
+}
+
+// NewRedactor compiles patterns once for reuse across every report; the
+// result is safe for concurrent use. Returns nil when there are no
+// patterns. Empty patterns are rejected because they would match between
+// every character.
+func NewRedactor(patterns []string) (*Redactor, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	r := &Redactor{}
+	for _, pattern := range patterns {
+		if pattern == "" {
+			return nil, eris.New("empty redaction pattern")
+		}
+		// RE2 matching runs in linear time, so user patterns cannot cause ReDoS
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, eris.Wrapf(err, "invalid redaction pattern %q", pattern)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+// Redact replaces matches of every pattern with RedactionMask in all string
+// fields of report, including nested results, slices and map values (raw
+// headers, Authentication-Results properties). Map keys are left as is.
+func (r *Redactor) Redact(report *EmailSecurityReport) {
+	if r == nil || report == nil {
+		return
+	}
+	r.redactValue(reflect.ValueOf(report).Elem())
+}
+
+// redactValue walks v, rewriting each settable string in place
+func (r *Redactor) redactValue(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		value := v.String()
+		for _, re := range r.patterns {
+			value = re.ReplaceAllLiteralString(value, RedactionMask)
+		}
+		v.SetString(value)
+	case reflect.Pointer:
+		if !v.IsNil() {
+			r.redactValue(v.Elem())
+		}
+	case reflect.Struct:
+		for i := range v.NumField() {
+			if v.Type().Field(i).IsExported() {
+				r.redactValue(v.Field(i))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := range v.Len() {
+			r.redactValue(v.Index(i))
+		}
+	case reflect.Map:
+		// Map values are not addressable, so redact a copy and store it back
+		iter := v.MapRange()
+		for iter.Next() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(iter.Value())
+			r.redactValue(value)
+			v.SetMapIndex(iter.Key(), value)
+		}
+	}
+}
+
+// redactingSink applies a Redactor to each report before the wrapped sink
+// writes it (-redact-pattern)
+type redactingSink struct {
+	ResultSink
+	redactor *Redactor
+}
+
+func (s *redactingSink) Write(report *EmailSecurityReport) error {
+	s.redactor.Redact(report)
+	return s.ResultSink.Write(report)
+}
+
+// normalizeReport canonicalizes values that providers spell differently
+// (-normalize-output), so Pass and pass or EXAMPLE.COM. and example.com
+// index alike. Domains and host names are trimmed, lowercased and lose a
+// trailing dot; authentication results and verdicts are trimmed and
+// lowercased; the country code is trimmed and uppercased (ISO 3166).
+// Addresses, raw headers and free text are left as is.
+func normalizeReport(report *EmailSecurityReport) {
+	domain := func(s *string) {
+		*s = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(*s)), ".")
+	}
+	result := func(values ...*string) {
+		for _, s := range values {
+			*s = strings.ToLower(strings.TrimSpace(*s))
+		}
+	}
+	authResults := func(spf []SPFResult, dkim []DKIMResult, dmarc []DMARCResult) {
+		for i := range spf {
+			domain(&spf[i].Domain)
+			result(&spf[i].Result)
+		}
+		for i := range dkim {
+			domain(&dkim[i].Domain)
+			domain(&dkim[i].HeaderD)
+			result(&dkim[i].Result)
+		}
+		for i := range dmarc {
+			d := &dmarc[i]
+			domain(&d.Domain)
+			result(&d.Result, &d.Policy, &d.Disposition, &d.SPFAlignment, &d.DKIMAlignment, &d.SubdomainPolicy)
+		}
+	}
+
+	authResults(report.SPFResults, report.DKIMResults, report.DMARCResults)
+	if orig := report.OriginalAuth; orig != nil {
+		authResults(orig.SPFResults, orig.DKIMResults, orig.DMARCResults)
+	}
+	for i := range report.DKIMSignatures {
+		domain(&report.DKIMSignatures[i].Domain)
+	}
+	for i := range report.AuthResults {
+		for j := range report.AuthResults[i].Methods {
+			m := &report.AuthResults[i].Methods[j]
+			result(&m.Method, &m.Result)
+		}
+	}
+	for i := range report.ARCResults {
+		result(&report.ARCResults[i].Result, &report.ARCResults[i].Chain)
+	}
+	if c := report.SPFConsensus; c != nil {
+		result(&c.Result)
+		for i := range c.Dissenting {
+			domain(&c.Dissenting[i].Domain)
+			result(&c.Dissenting[i].Result)
+		}
+	}
+	if report.SenderID != nil {
+		result(&report.SenderID.Result)
+	}
+	if report.Verdict != nil {
+		result(&report.Verdict.Verdict)
+	}
+	domain(&report.ReturnPathDomain)
+	domain(&report.FromDomain)
+	for i := range report.ReplyToDomains {
+		domain(&report.ReplyToDomains[i])
+	}
+	if report.Homograph != nil {
+		domain(&report.Homograph.Domain)
+		domain(&report.Homograph.ASCIIDomain)
+	}
+	if report.Thread != nil {
+		for i := range report.Thread.ThreadDomains {
+			domain(&report.Thread.ThreadDomains[i])
+		}
+	}
+	for i := range report.ReceivedChain {
+		domain(&report.ReceivedChain[i].From)
+		domain(&report.ReceivedChain[i].By)
+	}
+	report.SenderCountry = strings.ToUpper(strings.TrimSpace(report.SenderCountry))
+}
+
+// ============================================================================
+// Network Enrichment Functions
+// ============================================================================
+
+// fetchJSON sends a GET request for url with the given extra headers through
+// the Analyzer's HTTPClient and decodes the JSON response into v. Non-2xx
+// statuses and bodies larger than MaxHTTPResponseBytes are errors.
+func (a *Analyzer) fetchJSON(ctx context.Context, url string, header http.Header, v any) error {
+	client := a.HTTPClient
+	if client == nil {
+		client = newDefaultHTTPClient()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return eris.Wrap(err, "failed to build HTTP request")
+	}
+	maps.Copy(req.Header, header)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return eris.Wrap(err, "HTTP request failed")
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return eris.Errorf("unexpected HTTP status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MaxHTTPResponseBytes+1))
+	if err != nil {
+		return eris.Wrap(err, "failed to read HTTP response")
+	}
+	if len(body) > MaxHTTPResponseBytes {
+		return eris.Errorf("HTTP response exceeds maximum allowed size of %d bytes", MaxHTTPResponseBytes)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return eris.Wrap(err, "failed to decode JSON response")
+	}
+	return nil
+}
+
+// reputationResponse is the expected -reputation-api response shape, that
+// of AbuseIPDB's check endpoint
+type reputationResponse struct {
+	Data struct {
+		AbuseConfidenceScore *int   `json:"abuseConfidenceScore"`
+		TotalReports         int    `json:"totalReports"`
+		LastReportedAt       string `json:"lastReportedAt"`
+	} `json:"data"`
+}
+
+// lookupReputation returns the reputation of ip from the cache or the
+// configured API. Private, loopback and other non-routable addresses are not
+// sent and return nil. A caller that misses the cache while another request
+// for ip is under way waits for that request and shares its result. A failed
+// lookup is logged and returned with Error set; failures are not cached, so
+// a later message retries.
+func (a *Analyzer) lookupReputation(ctx context.Context, ip string) *ReputationResult {
+	l := a.Reputation
+	parsed := net.ParseIP(ip)
+	if parsed == nil || !parsed.IsGlobalUnicast() || parsed.IsPrivate() {
+		return nil
+	}
+
+	ctx, span := a.startSpan(ctx, "email.lookupReputation", attribute.String("net.peer.ip", ip))
+	defer span.End()
+
+	failed := func(err error) *ReputationResult {
+		log.Printf("Warning: reputation lookup for %s failed: %v", ip, err)
+		span.SetStatus(codes.Error, "lookup failed")
+		return &ReputationResult{IP: ip, Error: "lookup failed"}
+	}
+
+	l.mu.Lock()
+	if cached, ok := l.cache[ip]; ok {
+		l.mu.Unlock()
+		span.SetAttributes(attribute.Bool("email.cache_hit", true))
+		return cached
+	}
+	if call, ok := l.inflight[ip]; ok {
+		l.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.result
+		case <-ctx.Done():
+			return failed(ctx.Err())
+		}
+	}
+	call := &reputationCall{done: make(chan struct{})}
+	if l.inflight == nil {
+		l.inflight = make(map[string]*reputationCall)
+	}
+	l.inflight[ip] = call
+	l.mu.Unlock()
+
+	result, err := a.queryReputation(ctx, ip)
+	if err != nil {
+		result = failed(err)
+	}
+	call.result = result
+
+	l.mu.Lock()
+	delete(l.inflight, ip)
+	if err == nil {
+		if l.cache == nil {
+			l.cache = make(map[string]*ReputationResult)
+		}
+		l.cache[ip] = result
+	}
+	l.mu.Unlock()
+	close(call.done)
+	return result
+}
+
+// queryReputation sends one reputation API request for ip once the
+// Analyzer's Limiter allows it
+func (a *Analyzer) queryReputation(ctx context.Context, ip string) (*ReputationResult, error) {
+	l := a.Reputation
+	if err := a.waitLookup(ctx); err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(l.URL)
+	if err != nil {
+		return nil, eris.Wrap(err, "invalid reputation API URL")
+	}
+	query := u.Query()
+	query.Set("ipAddress", ip)
+	u.RawQuery = query.Encode()
+
+	header := make(http.Header)
+	if l.Key != "" {
+		header.Set("Key", l.Key)
+	}
+	var response reputationResponse
+	if err := a.fetchJSON(ctx, u.String(), header, &response); err != nil {
+		return nil, err
+	}
+	if response.Data.AbuseConfidenceScore == nil {
+		return nil, eris.New("response has no data.abuseConfidenceScore")
+	}
+	return &ReputationResult{
+		IP:                   ip,
+		AbuseConfidenceScore: min(max(*response.Data.AbuseConfidenceScore, 0), 100),
+		TotalReports:         response.Data.TotalReports,
+		LastReportedAt:       sanitizeHeader(response.Data.LastReportedAt),
+	}, nil
+}
+
 // ============================================================================
 // DMARC Aggregate Report Parsing Functions
 // ============================================================================
@@ -1972,7 +10459,7 @@ func analyzeDMARCReport(report *DMARCAggregateReport) *DMARCReportAnalysis {
 	analysis.TopASNs = topNDMARCASNs(asnStats, 10)
 
 	// Sort failing sources by count
-	sort.Slice(failingSources, func(i, j int) bool {
+	sort.SliceStable(failingSources, func(i, j int) bool {
 		return failingSources[i].FailCount > failingSources[j].FailCount
 	})
 	if len(failingSources) > 10 {
@@ -2010,8 +10497,12 @@ func topNDMARCCountries(stats map[string]*DMARCCountryStat, n int) []DMARCCountr
 	for _, stat := range stats {
 		result = append(result, *stat)
 	}
+	// Break ties by country code so output is stable across runs
 	sort.Slice(result, func(i, j int) bool {
-		return result[i].EmailCount > result[j].EmailCount
+		if result[i].EmailCount != result[j].EmailCount {
+			return result[i].EmailCount > result[j].EmailCount
+		}
+		return result[i].CountryCode < result[j].CountryCode
 	})
 	if len(result) > n {
 		result = result[:n]
@@ -2025,8 +10516,12 @@ func topNDMARCASNs(stats map[uint]*DMARCASNStat, n int) []DMARCASNStat {
 	for _, stat := range stats {
 		result = append(result, *stat)
 	}
+	// Break ties by ASN so output is stable across runs
 	sort.Slice(result, func(i, j int) bool {
-		return result[i].EmailCount > result[j].EmailCount
+		if result[i].EmailCount != result[j].EmailCount {
+			return result[i].EmailCount > result[j].EmailCount
+		}
+		return result[i].ASN < result[j].ASN
 	})
 	if len(result) > n {
 		result = result[:n]
@@ -2274,99 +10769,100 @@ func threatLevelFromScore(score float64) string {
 // ============================================================================
 
 // outputDMARCJSON outputs the DMARC report as JSON
-func outputDMARCJSON(report *DMARCAggregateReport) {
-	encoder := json.NewEncoder(os.Stdout)
+func outputDMARCJSON(w io.Writer, report *DMARCAggregateReport) error {
+	encoder := json.NewEncoder(w)
 	encoder.SetIndent("", "  ")
 	encoder.SetEscapeHTML(true)
 	if err := encoder.Encode(report); err != nil {
-		log.Printf("Error encoding JSON: %v", err)
-		os.Exit(1)
+		return eris.Wrap(err, "failed to encode JSON")
 	}
+	return nil
 }
 
 // outputDMARCText outputs the DMARC report in human-readable text format
-func outputDMARCText(report *DMARCAggregateReport, verbose bool) {
-	fmt.Println("=" + strings.Repeat("=", 79))
-	fmt.Println("DMARC AGGREGATE REPORT ANALYSIS")
-	fmt.Println("=" + strings.Repeat("=", 79))
-	fmt.Println()
+func outputDMARCText(w io.Writer, report *DMARCAggregateReport, verbose bool) {
+	fmt.Fprintln(w, "="+strings.Repeat("=", 79))
+	fmt.Fprintln(w, "DMARC AGGREGATE REPORT ANALYSIS")
+	fmt.Fprintln(w, "="+strings.Repeat("=", 79))
+	fmt.Fprintln(w)
 
 	// Report Metadata
-	fmt.Println("REPORT INFORMATION")
-	fmt.Println("-" + strings.Repeat("-", 79))
-	fmt.Printf("Organization:  %s\n", report.Metadata.OrgName)
-	fmt.Printf("Report ID:     %s\n", report.Metadata.ReportID)
-	fmt.Printf("Email:         %s\n", report.Metadata.Email)
-	fmt.Printf("Period:        %s to %s\n",
+	fmt.Fprintln(w, "REPORT INFORMATION")
+	fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+	fmt.Fprintf(w, "Organization:  %s\n", report.Metadata.OrgName)
+	fmt.Fprintf(w, "Report ID:     %s\n", report.Metadata.ReportID)
+	fmt.Fprintf(w, "Email:         %s\n", report.Metadata.Email)
+	fmt.Fprintf(w, "Period:        %s to %s\n",
 		formatUnixTime(report.Metadata.DateRange.Begin),
 		formatUnixTime(report.Metadata.DateRange.End))
-	fmt.Println()
+	fmt.Fprintln(w)
 
 	// Policy Published
-	fmt.Println("DOMAIN POLICY")
-	fmt.Println("-" + strings.Repeat("-", 79))
-	fmt.Printf("Domain:        %s\n", report.PolicyPublished.Domain)
-	fmt.Printf("Policy (p):    %s\n", formatDMARCPolicy(report.PolicyPublished.Policy))
-	fmt.Printf("Subdomain (sp): %s\n", formatDMARCPolicy(report.PolicyPublished.SubdomainPolicy))
-	fmt.Printf("DKIM Align:    %s\n", formatDMARCAlignment(report.PolicyPublished.ADKIM))
-	fmt.Printf("SPF Align:     %s\n", formatDMARCAlignment(report.PolicyPublished.ASPF))
-	fmt.Printf("Percentage:    %d%%\n", report.PolicyPublished.Percentage)
-	fmt.Println()
+	fmt.Fprintln(w, "DOMAIN POLICY")
+	fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+	fmt.Fprintf(w, "Domain:        %s\n", report.PolicyPublished.Domain)
+	fmt.Fprintf(w, "Policy (p):    %s\n", formatDMARCPolicy(report.PolicyPublished.Policy))
+	fmt.Fprintf(w, "Subdomain (sp): %s\n", formatDMARCPolicy(report.PolicyPublished.SubdomainPolicy))
+	fmt.Fprintf(w, "DKIM Align:    %s\n", formatDMARCAlignment(report.PolicyPublished.ADKIM))
+	fmt.Fprintf(w, "SPF Align:     %s\n", formatDMARCAlignment(report.PolicyPublished.ASPF))
+	fmt.Fprintf(w, "Percentage:    %d%%\n", report.PolicyPublished.Percentage)
+	fmt.Fprintln(w)
 
 	// Analysis Summary
 	if report.Analysis != nil {
-		fmt.Println("AUTHENTICATION SUMMARY")
-		fmt.Println("-" + strings.Repeat("-", 79))
-		fmt.Printf("Total Emails:     %d\n", report.Analysis.TotalEmails)
-		fmt.Printf("Overall Pass:     %.1f%% %s\n",
+		fmt.Fprintln(w, "AUTHENTICATION SUMMARY")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		fmt.Fprintf(w, "Total Emails:     %d\n", report.Analysis.TotalEmails)
+		fmt.Fprintf(w, "Overall Pass:     %.1f%% %s\n",
 			report.Analysis.PassRate, passRateSymbol(report.Analysis.PassRate))
-		fmt.Printf("SPF Pass Rate:    %.1f%% %s\n",
+		fmt.Fprintf(w, "SPF Pass Rate:    %.1f%% %s\n",
 			report.Analysis.SPFPassRate, passRateSymbol(report.Analysis.SPFPassRate))
-		fmt.Printf("DKIM Pass Rate:   %.1f%% %s\n",
+		fmt.Fprintf(w, "DKIM Pass Rate:   %.1f%% %s\n",
 			report.Analysis.DKIMPassRate, passRateSymbol(report.Analysis.DKIMPassRate))
-		fmt.Println()
+		fmt.Fprintln(w)
 
 		// Disposition breakdown
-		fmt.Println("Disposition:")
-		for disp, count := range report.Analysis.DispositionStats {
+		fmt.Fprintln(w, "Disposition:")
+		for _, disp := range sortedKeys(report.Analysis.DispositionStats) {
+			count := report.Analysis.DispositionStats[disp]
 			pct := 0.0
 			if report.Analysis.TotalEmails > 0 {
 				pct = float64(count) / float64(report.Analysis.TotalEmails) * 100
 			}
-			fmt.Printf("  %-12s %6d (%.1f%%)\n", disp+":", count, pct)
+			fmt.Fprintf(w, "  %-12s %6d (%.1f%%)\n", disp+":", count, pct)
 		}
-		fmt.Println()
+		fmt.Fprintln(w)
 
 		// Top source countries
 		if len(report.Analysis.TopSourceCountries) > 0 {
-			fmt.Println("TOP SOURCE COUNTRIES")
-			fmt.Println("-" + strings.Repeat("-", 79))
+			fmt.Fprintln(w, "TOP SOURCE COUNTRIES")
+			fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
 			limit := min(5, len(report.Analysis.TopSourceCountries))
 			for i := 0; i < limit; i++ {
 				cs := report.Analysis.TopSourceCountries[i]
-				fmt.Printf("  %d. %s (%s): %d emails, %d failures\n",
+				fmt.Fprintf(w, "  %d. %s (%s): %d emails, %d failures\n",
 					i+1, cs.Country, cs.CountryCode, cs.EmailCount, cs.FailCount)
 			}
-			fmt.Println()
+			fmt.Fprintln(w)
 		}
 
 		// Top ASNs
 		if len(report.Analysis.TopASNs) > 0 {
-			fmt.Println("TOP SOURCE ORGANIZATIONS")
-			fmt.Println("-" + strings.Repeat("-", 79))
+			fmt.Fprintln(w, "TOP SOURCE ORGANIZATIONS")
+			fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
 			limit := min(5, len(report.Analysis.TopASNs))
 			for i := 0; i < limit; i++ {
 				asn := report.Analysis.TopASNs[i]
-				fmt.Printf("  %d. %s (AS%d): %d emails, %d failures\n",
+				fmt.Fprintf(w, "  %d. %s (AS%d): %d emails, %d failures\n",
 					i+1, asn.Organization, asn.ASN, asn.EmailCount, asn.FailCount)
 			}
-			fmt.Println()
+			fmt.Fprintln(w)
 		}
 
 		// Failing sources
 		if len(report.Analysis.FailingSources) > 0 {
-			fmt.Println("FAILING SOURCES")
-			fmt.Println("-" + strings.Repeat("-", 79))
+			fmt.Fprintln(w, "FAILING SOURCES")
+			fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
 			limit := min(10, len(report.Analysis.FailingSources))
 			for i := 0; i < limit; i++ {
 				fs := report.Analysis.FailingSources[i]
@@ -2378,180 +10874,181 @@ func outputDMARCText(report *DMARCAggregateReport, verbose bool) {
 				if fs.Organization != "" {
 					org = fmt.Sprintf(" - %s", fs.Organization)
 				}
-				fmt.Printf("  %s%s%s: %d failures - %s\n",
+				fmt.Fprintf(w, "  %s%s%s: %d failures - %s\n",
 					fs.IP, location, org, fs.FailCount, fs.FailReason)
 			}
-			fmt.Println()
+			fmt.Fprintln(w)
 		}
 
 		// Recommendations
 		if len(report.Analysis.Recommendations) > 0 {
-			fmt.Println("RECOMMENDATIONS")
-			fmt.Println("-" + strings.Repeat("-", 79))
+			fmt.Fprintln(w, "RECOMMENDATIONS")
+			fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
 			for _, rec := range report.Analysis.Recommendations {
-				fmt.Printf("  [%s] %s\n", strings.ToUpper(rec.Priority), rec.Title)
-				fmt.Printf("         %s\n", rec.Description)
-				fmt.Printf("         Action: %s\n", rec.Action)
-				fmt.Println()
+				fmt.Fprintf(w, "  [%s] %s\n", strings.ToUpper(rec.Priority), rec.Title)
+				fmt.Fprintf(w, "         %s\n", rec.Description)
+				fmt.Fprintf(w, "         Action: %s\n", rec.Action)
+				fmt.Fprintln(w)
 			}
 		}
 
 		// Threat assessment
-		fmt.Println("THREAT ASSESSMENT")
-		fmt.Println("-" + strings.Repeat("-", 79))
-		fmt.Printf("Overall Threat Level: %s %s\n",
+		fmt.Fprintln(w, "THREAT ASSESSMENT")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
+		fmt.Fprintf(w, "Overall Threat Level: %s %s\n",
 			strings.ToUpper(report.Analysis.OverallThreatLevel),
 			threatSymbol(report.Analysis.OverallThreatLevel))
 	}
 
 	// Verbose: show all records
 	if verbose {
-		fmt.Println()
-		fmt.Println("DETAILED RECORDS")
-		fmt.Println("-" + strings.Repeat("-", 79))
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "DETAILED RECORDS")
+		fmt.Fprintln(w, "-"+strings.Repeat("-", 79))
 		for i, record := range report.Records {
-			fmt.Printf("\nRecord #%d:\n", i+1)
-			fmt.Printf("  Source IP:    %s\n", record.Row.SourceIP)
-			fmt.Printf("  Count:        %d\n", record.Row.Count)
-			fmt.Printf("  SPF:          %s\n", formatResult(record.Row.PolicyEvaluated.SPF))
-			fmt.Printf("  DKIM:         %s\n", formatResult(record.Row.PolicyEvaluated.DKIM))
-			fmt.Printf("  Disposition:  %s\n", record.Row.PolicyEvaluated.Disposition)
-			fmt.Printf("  Header From:  %s\n", record.Identifiers.HeaderFrom)
+			fmt.Fprintf(w, "\nRecord #%d:\n", i+1)
+			fmt.Fprintf(w, "  Source IP:    %s\n", record.Row.SourceIP)
+			fmt.Fprintf(w, "  Count:        %d\n", record.Row.Count)
+			fmt.Fprintf(w, "  SPF:          %s\n", formatResult(record.Row.PolicyEvaluated.SPF))
+			fmt.Fprintf(w, "  DKIM:         %s\n", formatResult(record.Row.PolicyEvaluated.DKIM))
+			fmt.Fprintf(w, "  Disposition:  %s\n", record.Row.PolicyEvaluated.Disposition)
+			fmt.Fprintf(w, "  Header From:  %s\n", record.Identifiers.HeaderFrom)
 			if record.Enrichment != nil {
 				if record.Enrichment.Country != "" {
-					fmt.Printf("  Location:     %s, %s\n", record.Enrichment.City, record.Enrichment.Country)
+					fmt.Fprintf(w, "  Location:     %s, %s\n", record.Enrichment.City, record.Enrichment.Country)
 				}
 				if record.Enrichment.Organization != "" {
-					fmt.Printf("  Organization: %s (AS%d)\n", record.Enrichment.Organization, record.Enrichment.ASN)
+					fmt.Fprintf(w, "  Organization: %s (AS%d)\n", record.Enrichment.Organization, record.Enrichment.ASN)
 				}
-				fmt.Printf("  Threat Score: %.0f (%s)\n", record.Enrichment.ThreatScore, record.Enrichment.ThreatLevel)
+				fmt.Fprintf(w, "  Threat Score: %.0f (%s)\n", record.Enrichment.ThreatScore, record.Enrichment.ThreatLevel)
 			}
 		}
 	}
 
-	fmt.Println()
-	fmt.Println("=" + strings.Repeat("=", 79))
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "="+strings.Repeat("=", 79))
 }
 
 // outputDMARCMarkdown outputs the DMARC report in Markdown format
-func outputDMARCMarkdown(report *DMARCAggregateReport, verbose bool) {
-	fmt.Println("# DMARC Aggregate Report Analysis")
-	fmt.Println()
+func outputDMARCMarkdown(w io.Writer, report *DMARCAggregateReport, verbose bool) {
+	fmt.Fprintln(w, "# DMARC Aggregate Report Analysis")
+	fmt.Fprintln(w)
 
 	// Metadata
-	fmt.Println("## Report Information")
-	fmt.Println()
-	fmt.Println("| Field | Value |")
-	fmt.Println("|-------|-------|")
-	fmt.Printf("| Organization | %s |\n", escapeMarkdown(report.Metadata.OrgName))
-	fmt.Printf("| Report ID | `%s` |\n", report.Metadata.ReportID)
-	fmt.Printf("| Email | %s |\n", report.Metadata.Email)
-	fmt.Printf("| Period | %s to %s |\n",
+	fmt.Fprintln(w, "## Report Information")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "| Field | Value |")
+	fmt.Fprintln(w, "|-------|-------|")
+	fmt.Fprintf(w, "| Organization | %s |\n", escapeMarkdown(report.Metadata.OrgName))
+	fmt.Fprintf(w, "| Report ID | `%s` |\n", report.Metadata.ReportID)
+	fmt.Fprintf(w, "| Email | %s |\n", report.Metadata.Email)
+	fmt.Fprintf(w, "| Period | %s to %s |\n",
 		formatUnixTime(report.Metadata.DateRange.Begin),
 		formatUnixTime(report.Metadata.DateRange.End))
-	fmt.Println()
+	fmt.Fprintln(w)
 
 	// Policy
-	fmt.Println("## Domain Policy")
-	fmt.Println()
-	fmt.Printf("- **Domain**: %s\n", report.PolicyPublished.Domain)
-	fmt.Printf("- **Policy**: `%s`\n", report.PolicyPublished.Policy)
-	fmt.Printf("- **Subdomain Policy**: `%s`\n", report.PolicyPublished.SubdomainPolicy)
-	fmt.Printf("- **DKIM Alignment**: %s\n", alignmentDescription(report.PolicyPublished.ADKIM))
-	fmt.Printf("- **SPF Alignment**: %s\n", alignmentDescription(report.PolicyPublished.ASPF))
-	fmt.Printf("- **Percentage**: %d%%\n", report.PolicyPublished.Percentage)
-	fmt.Println()
+	fmt.Fprintln(w, "## Domain Policy")
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "- **Domain**: %s\n", report.PolicyPublished.Domain)
+	fmt.Fprintf(w, "- **Policy**: `%s`\n", report.PolicyPublished.Policy)
+	fmt.Fprintf(w, "- **Subdomain Policy**: `%s`\n", report.PolicyPublished.SubdomainPolicy)
+	fmt.Fprintf(w, "- **DKIM Alignment**: %s\n", alignmentDescription(report.PolicyPublished.ADKIM))
+	fmt.Fprintf(w, "- **SPF Alignment**: %s\n", alignmentDescription(report.PolicyPublished.ASPF))
+	fmt.Fprintf(w, "- **Percentage**: %d%%\n", report.PolicyPublished.Percentage)
+	fmt.Fprintln(w)
 
 	if report.Analysis != nil {
 		// Summary table
-		fmt.Println("## Authentication Summary")
-		fmt.Println()
-		fmt.Println("| Metric | Value | Status |")
-		fmt.Println("|--------|-------|--------|")
-		fmt.Printf("| Total Emails | %d | - |\n", report.Analysis.TotalEmails)
-		fmt.Printf("| Overall Pass Rate | %.1f%% | %s |\n",
+		fmt.Fprintln(w, "## Authentication Summary")
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "| Metric | Value | Status |")
+		fmt.Fprintln(w, "|--------|-------|--------|")
+		fmt.Fprintf(w, "| Total Emails | %d | - |\n", report.Analysis.TotalEmails)
+		fmt.Fprintf(w, "| Overall Pass Rate | %.1f%% | %s |\n",
 			report.Analysis.PassRate, markdownStatus(report.Analysis.PassRate))
-		fmt.Printf("| SPF Pass Rate | %.1f%% | %s |\n",
+		fmt.Fprintf(w, "| SPF Pass Rate | %.1f%% | %s |\n",
 			report.Analysis.SPFPassRate, markdownStatus(report.Analysis.SPFPassRate))
-		fmt.Printf("| DKIM Pass Rate | %.1f%% | %s |\n",
+		fmt.Fprintf(w, "| DKIM Pass Rate | %.1f%% | %s |\n",
 			report.Analysis.DKIMPassRate, markdownStatus(report.Analysis.DKIMPassRate))
-		fmt.Println()
+		fmt.Fprintln(w)
 
 		// Disposition
-		fmt.Println("### Disposition Breakdown")
-		fmt.Println()
-		fmt.Println("| Disposition | Count | Percentage |")
-		fmt.Println("|-------------|-------|------------|")
-		for disp, count := range report.Analysis.DispositionStats {
+		fmt.Fprintln(w, "### Disposition Breakdown")
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "| Disposition | Count | Percentage |")
+		fmt.Fprintln(w, "|-------------|-------|------------|")
+		for _, disp := range sortedKeys(report.Analysis.DispositionStats) {
+			count := report.Analysis.DispositionStats[disp]
 			pct := 0.0
 			if report.Analysis.TotalEmails > 0 {
 				pct = float64(count) / float64(report.Analysis.TotalEmails) * 100
 			}
-			fmt.Printf("| %s | %d | %.1f%% |\n", disp, count, pct)
+			fmt.Fprintf(w, "| %s | %d | %.1f%% |\n", disp, count, pct)
 		}
-		fmt.Println()
+		fmt.Fprintln(w)
 
 		// Top countries table
 		if len(report.Analysis.TopSourceCountries) > 0 {
-			fmt.Println("## Top Source Countries")
-			fmt.Println()
-			fmt.Println("| Country | Code | Emails | Failures |")
-			fmt.Println("|---------|------|--------|----------|")
+			fmt.Fprintln(w, "## Top Source Countries")
+			fmt.Fprintln(w)
+			fmt.Fprintln(w, "| Country | Code | Emails | Failures |")
+			fmt.Fprintln(w, "|---------|------|--------|----------|")
 			limit := min(10, len(report.Analysis.TopSourceCountries))
 			for i := 0; i < limit; i++ {
 				cs := report.Analysis.TopSourceCountries[i]
-				fmt.Printf("| %s | %s | %d | %d |\n",
+				fmt.Fprintf(w, "| %s | %s | %d | %d |\n",
 					escapeMarkdown(cs.Country), cs.CountryCode, cs.EmailCount, cs.FailCount)
 			}
-			fmt.Println()
+			fmt.Fprintln(w)
 		}
 
 		// Failing sources
 		if len(report.Analysis.FailingSources) > 0 {
-			fmt.Println("## Failing Sources")
-			fmt.Println()
-			fmt.Println("| IP Address | Country | Organization | Failures | Reason |")
-			fmt.Println("|------------|---------|--------------|----------|--------|")
+			fmt.Fprintln(w, "## Failing Sources")
+			fmt.Fprintln(w)
+			fmt.Fprintln(w, "| IP Address | Country | Organization | Failures | Reason |")
+			fmt.Fprintln(w, "|------------|---------|--------------|----------|--------|")
 			limit := min(10, len(report.Analysis.FailingSources))
 			for i := 0; i < limit; i++ {
 				fs := report.Analysis.FailingSources[i]
-				fmt.Printf("| %s | %s | %s | %d | %s |\n",
+				fmt.Fprintf(w, "| %s | %s | %s | %d | %s |\n",
 					fs.IP, fs.Country, escapeMarkdown(fs.Organization), fs.FailCount, fs.FailReason)
 			}
-			fmt.Println()
+			fmt.Fprintln(w)
 		}
 
 		// Recommendations
 		if len(report.Analysis.Recommendations) > 0 {
-			fmt.Println("## Recommendations")
-			fmt.Println()
+			fmt.Fprintln(w, "## Recommendations")
+			fmt.Fprintln(w)
 			for _, rec := range report.Analysis.Recommendations {
-				fmt.Printf("### %s %s\n", priorityEmoji(rec.Priority), rec.Title)
-				fmt.Println()
-				fmt.Printf("%s\n", rec.Description)
-				fmt.Println()
-				fmt.Printf("**Action**: %s\n", rec.Action)
-				fmt.Println()
+				fmt.Fprintf(w, "### %s %s\n", priorityEmoji(rec.Priority), rec.Title)
+				fmt.Fprintln(w)
+				fmt.Fprintf(w, "%s\n", rec.Description)
+				fmt.Fprintln(w)
+				fmt.Fprintf(w, "**Action**: %s\n", rec.Action)
+				fmt.Fprintln(w)
 			}
 		}
 
 		// Threat assessment
-		fmt.Println("## Threat Assessment")
-		fmt.Println()
-		fmt.Printf("**Overall Threat Level**: %s %s\n",
+		fmt.Fprintln(w, "## Threat Assessment")
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "**Overall Threat Level**: %s %s\n",
 			strings.ToUpper(report.Analysis.OverallThreatLevel),
 			threatEmoji(report.Analysis.OverallThreatLevel))
 	}
 
 	// Verbose: all records as table
 	if verbose && len(report.Records) > 0 {
-		fmt.Println()
-		fmt.Println("## Detailed Records")
-		fmt.Println()
-		fmt.Println("| # | Source IP | Count | SPF | DKIM | Disposition | Header From |")
-		fmt.Println("|---|-----------|-------|-----|------|-------------|-------------|")
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "## Detailed Records")
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "| # | Source IP | Count | SPF | DKIM | Disposition | Header From |")
+		fmt.Fprintln(w, "|---|-----------|-------|-----|------|-------------|-------------|")
 		for i, record := range report.Records {
-			fmt.Printf("| %d | %s | %d | %s | %s | %s | %s |\n",
+			fmt.Fprintf(w, "| %d | %s | %d | %s | %s | %s | %s |\n",
 				i+1,
 				record.Row.SourceIP,
 				record.Row.Count,
@@ -1,10 +1,36 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
 	"net/mail"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/yeka/zip"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/time/rate"
 )
 
 // TestParseSCLHeader tests the parseSCLHeader function with various SCL values
@@ -1185,3 +1211,5907 @@ func TestEscapeMarkdown(t *testing.T) {
 		}
 	}
 }
+
+// ============================================================================
+// Output Tests
+// ============================================================================
+
+// TestWriteOutputFile tests atomic report writing to a file
+func TestWriteOutputFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nested", "reports", "out.json")
+
+	err := writeOutput(path, false, func(w io.Writer) error {
+		_, err := io.WriteString(w, "{\"scl\":5}\n")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("writeOutput returned error: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read output file: %v", err)
+	}
+	if string(data) != "{\"scl\":5}\n" {
+		t.Errorf("unexpected output file contents: %q", data)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0o644 {
+		t.Errorf("expected a new report to have mode 0644, got %v", info.Mode().Perm())
+	}
+
+	// A replaced report keeps its mode
+	if err := os.Chmod(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	write := func(w io.Writer) error {
+		_, err := io.WriteString(w, "{\"scl\":5}\n")
+		return err
+	}
+	if err := writeOutput(path, false, write); err != nil {
+		t.Fatalf("writeOutput returned error: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0o600 {
+		t.Errorf("expected the replaced report to keep mode 0600, got %v", info.Mode().Perm())
+	}
+
+	// A failed write must not replace the existing report or leave temp files behind
+	err = writeOutput(path, false, func(w io.Writer) error {
+		_, _ = io.WriteString(w, "partial")
+		return fmt.Errorf("write failed")
+	})
+	if err == nil {
+		t.Fatal("expected error from failing writer")
+	}
+
+	data, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read output file: %v", err)
+	}
+	if string(data) != "{\"scl\":5}\n" {
+		t.Errorf("existing report was overwritten by failed write: %q", data)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("failed to list output directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the report file in output directory, found %d entries", len(entries))
+	}
+}
+
+// TestWriteOutputCompressed tests gzip output selected by a .gz path or
+// -compress, including that a failed write still closes the gzip stream
+func TestWriteOutputCompressed(t *testing.T) {
+	dir := t.TempDir()
+	readGzip := func(data []byte) (string, error) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return "", err
+		}
+		out, err := io.ReadAll(zr)
+		return string(out), err
+	}
+
+	for name, compress := range map[string]bool{"out.ndjson.gz": false, "out.ndjson": true} {
+		path := filepath.Join(dir, name)
+		err := writeOutput(path, compress, func(w io.Writer) error {
+			_, err := io.WriteString(w, "{\"scl\":5}\n")
+			return err
+		})
+		if err != nil {
+			t.Fatalf("%s: writeOutput returned error: %v", name, err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%s: failed to read output file: %v", name, err)
+		}
+		if out, err := readGzip(data); err != nil || out != "{\"scl\":5}\n" {
+			t.Errorf("%s: expected gzipped report, got %q (%v)", name, out, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	err := writeCompressed(&buf, true, func(w io.Writer) error {
+		_, _ = io.WriteString(w, "partial\n")
+		return fmt.Errorf("write failed")
+	})
+	if err == nil || err.Error() != "write failed" {
+		t.Fatalf("Expected the write error, got %v", err)
+	}
+	if out, err := readGzip(buf.Bytes()); err != nil || out != "partial\n" {
+		t.Errorf("Expected a complete gzip stream of the partial output, got %q (%v)", out, err)
+	}
+}
+
+// ============================================================================
+// Sender Analysis Tests
+// ============================================================================
+
+// TestAddressDomain tests domain extraction from address header values
+func TestAddressDomain(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`"Example Company" <sender@Example.COM>`, "example.com"},
+		{"user@example.org", "example.org"},
+		{"Broken <<user@example.net>", "example.net"},
+		{"no address here", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			if result := addressDomain(tt.input); result != tt.expected {
+				t.Errorf("addressDomain(%q) = %q, want %q", tt.input, result, tt.expected)
+			}
+		})
+	}
+}
+
+// TestCheckHomograph tests IDN homograph detection on From domains
+func TestCheckHomograph(t *testing.T) {
+	tests := []struct {
+		name            string
+		domain          string
+		expectSuspected bool
+		expectASCII     string
+		expectUnicode   string
+		expectSkeleton  string
+	}{
+		{
+			name:            "plain ASCII domain",
+			domain:          "paypal.com",
+			expectSuspected: false,
+			expectASCII:     "paypal.com",
+			expectUnicode:   "paypal.com",
+		},
+		{
+			name:            "Cyrillic a mixed with Latin",
+			domain:          "pаypal.com",
+			expectSuspected: true,
+			expectASCII:     "xn--pypal-4ve.com",
+			expectUnicode:   "pаypal.com",
+			expectSkeleton:  "paypal.com",
+		},
+		{
+			name:            "punycode form is decoded",
+			domain:          "xn--pypal-4ve.com",
+			expectSuspected: true,
+			expectASCII:     "xn--pypal-4ve.com",
+			expectUnicode:   "pаypal.com",
+			expectSkeleton:  "paypal.com",
+		},
+		{
+			name:            "whole-script Cyrillic confusable",
+			domain:          "аррӏе.com",
+			expectSuspected: true,
+			expectASCII:     "xn--80ak6aa92e.com",
+			expectUnicode:   "аррӏе.com",
+			expectSkeleton:  "apple.com",
+		},
+		{
+			name:            "legitimate non-Latin domain",
+			domain:          "пример.рф",
+			expectSuspected: false,
+			expectASCII:     "xn--e1afmkfd.xn--p1ai",
+			expectUnicode:   "пример.рф",
+		},
+		{
+			name:            "Cyrillic domain made of confusables under a Cyrillic TLD",
+			domain:          "москва.рф",
+			expectSuspected: false,
+			expectASCII:     "xn--80adxhks.xn--p1ai",
+			expectUnicode:   "москва.рф",
+			expectSkeleton:  "mockba.pф",
+		},
+		{
+			name:            "Japanese domain mixing Han and Latin",
+			domain:          "example日本.jp",
+			expectSuspected: false,
+			expectUnicode:   "example日本.jp",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := checkHomograph(tt.domain)
+			if result == nil {
+				t.Fatal("Expected non-nil result, got nil")
+			}
+			if result.HomographSuspected != tt.expectSuspected {
+				t.Errorf("HomographSuspected = %v, want %v (reason: %s)", result.HomographSuspected, tt.expectSuspected, result.Reason)
+			}
+			if tt.expectASCII != "" && result.ASCIIDomain != tt.expectASCII {
+				t.Errorf("ASCIIDomain = %q, want %q", result.ASCIIDomain, tt.expectASCII)
+			}
+			if result.Domain != tt.expectUnicode {
+				t.Errorf("Domain = %q, want %q", result.Domain, tt.expectUnicode)
+			}
+			if tt.expectSkeleton != "" && result.Skeleton != tt.expectSkeleton {
+				t.Errorf("Skeleton = %q, want %q", result.Skeleton, tt.expectSkeleton)
+			}
+		})
+	}
+
+	if checkHomograph("") != nil {
+		t.Error("Expected nil result for empty domain")
+	}
+}
+
+// ============================================================================
+// Threshold Profile Tests
+// ============================================================================
+
+// TestResolveSCLThresholds tests profile selection and explicit overrides
+func TestResolveSCLThresholds(t *testing.T) {
+	tests := []struct {
+		name          string
+		profile       string
+		spamThreshold int
+		bands         string
+		explicit      map[string]bool
+		expected      SCLThresholds
+		expectErr     bool
+	}{
+		{
+			name:     "balanced matches defaults",
+			profile:  "balanced",
+			expected: SCLThresholds{LowSpam: 2, Spam: 5, HighConfidence: 7, SpamThreshold: 5},
+		},
+		{
+			name:     "strict profile",
+			profile:  "STRICT",
+			expected: SCLThresholds{LowSpam: 2, Spam: 4, HighConfidence: 6, SpamThreshold: 4},
+		},
+		{
+			name:          "unset flags do not override profile",
+			profile:       "lenient",
+			spamThreshold: 5,
+			bands:         "2,5,7",
+			expected:      SCLThresholds{LowSpam: 3, Spam: 6, HighConfidence: 8, SpamThreshold: 7},
+		},
+		{
+			name:          "explicit threshold overrides profile",
+			profile:       "lenient",
+			spamThreshold: 3,
+			explicit:      map[string]bool{"spam-threshold": true},
+			expected:      SCLThresholds{LowSpam: 3, Spam: 6, HighConfidence: 8, SpamThreshold: 3},
+		},
+		{
+			name:     "explicit bands override profile",
+			profile:  "balanced",
+			bands:    "1, 4, 9",
+			explicit: map[string]bool{"scl-bands": true},
+			expected: SCLThresholds{LowSpam: 1, Spam: 4, HighConfidence: 9, SpamThreshold: 5},
+		},
+		{name: "unknown profile", profile: "paranoid", expectErr: true},
+		{name: "bands out of order", profile: "balanced", bands: "5,2,7", explicit: map[string]bool{"scl-bands": true}, expectErr: true},
+		{name: "bands wrong count", profile: "balanced", bands: "2,5", explicit: map[string]bool{"scl-bands": true}, expectErr: true},
+		{name: "threshold out of range", profile: "balanced", spamThreshold: 12, explicit: map[string]bool{"spam-threshold": true}, expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := resolveSCLThresholds(tt.profile, tt.spamThreshold, tt.bands, tt.explicit)
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("Expected error, got %+v", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, result)
+			}
+		})
+	}
+}
+
+// TestDescribeSCLWithProfiles tests that profiles shift the description bands
+func TestDescribeSCLWithProfiles(t *testing.T) {
+	tests := []struct {
+		profile  string
+		score    int
+		expected string
+	}{
+		{"strict", 4, "Spam"},
+		{"strict", 6, "High confidence spam"},
+		{"balanced", 4, "Low spam probability"},
+		{"lenient", 2, "Not spam"},
+		{"lenient", 7, "Spam"},
+		{"lenient", -1, "Skipped spam filtering (safe sender or SCL override)"},
+		{"lenient", 10, "Unknown spam confidence level"},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s_%d", tt.profile, tt.score), func(t *testing.T) {
+			result := describeSCL(tt.score, sclProfiles[tt.profile])
+			if result != tt.expected {
+				t.Errorf("describeSCL(%d, %s) = %q, want %q", tt.score, tt.profile, result, tt.expected)
+			}
+		})
+	}
+}
+
+// TestParseListUnsubscribe tests List-Unsubscribe and one-click parsing
+func TestParseListUnsubscribe(t *testing.T) {
+	tests := []struct {
+		name           string
+		headers        map[string][]string
+		expectNil      bool
+		expectURLs     int
+		expectMailtos  int
+		expectPost     bool
+		expectOneClick bool
+	}{
+		{
+			name:      "header absent",
+			headers:   map[string][]string{"Subject": {"hello"}},
+			expectNil: true,
+		},
+		{
+			name: "mailto and https with one-click",
+			headers: map[string][]string{
+				"List-Unsubscribe":      {"<mailto:unsub@example.com?subject=unsubscribe>, <https://example.com/unsub?id=123>"},
+				"List-Unsubscribe-Post": {"List-Unsubscribe=One-Click"},
+			},
+			expectURLs:     1,
+			expectMailtos:  1,
+			expectPost:     true,
+			expectOneClick: true,
+		},
+		{
+			name: "mailto only",
+			headers: map[string][]string{
+				"List-Unsubscribe": {"<mailto:leave@lists.example.org>"},
+			},
+			expectMailtos: 1,
+		},
+		{
+			name: "post header with unexpected value",
+			headers: map[string][]string{
+				"List-Unsubscribe":      {"<https://example.com/u>"},
+				"List-Unsubscribe-Post": {"something-else"},
+			},
+			expectURLs: 1,
+			expectPost: true,
+		},
+		{
+			name: "unsupported scheme ignored",
+			headers: map[string][]string{
+				"List-Unsubscribe": {"<ftp://example.com/u>, <HTTPS://EXAMPLE.com/u>"},
+			},
+			expectURLs: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(mail.Header)
+			for key, values := range tt.headers {
+				header[key] = append(header[key], values...)
+			}
+
+			result := parseListUnsubscribe(header)
+			if tt.expectNil {
+				if result != nil {
+					t.Errorf("Expected nil result, got %+v", result)
+				}
+				return
+			}
+			if result == nil {
+				t.Fatal("Expected non-nil result, got nil")
+			}
+			if len(result.URLs) != tt.expectURLs {
+				t.Errorf("Expected %d URLs, got %v", tt.expectURLs, result.URLs)
+			}
+			if len(result.Mailtos) != tt.expectMailtos {
+				t.Errorf("Expected %d mailtos, got %v", tt.expectMailtos, result.Mailtos)
+			}
+			if result.PostPresent != tt.expectPost {
+				t.Errorf("PostPresent = %v, want %v", result.PostPresent, tt.expectPost)
+			}
+			if result.OneClickUnsubscribe != tt.expectOneClick {
+				t.Errorf("OneClickUnsubscribe = %v, want %v", result.OneClickUnsubscribe, tt.expectOneClick)
+			}
+		})
+	}
+}
+
+// ============================================================================
+// Batch Processing Tests
+// ============================================================================
+
+// writeTestEmail writes a minimal .eml file with the given extra headers
+func writeTestEmail(t *testing.T, dir, name, extraHeaders string) string {
+	t.Helper()
+	content := "From: sender@example.com\r\nTo: rcpt@example.org\r\nSubject: test\r\n" +
+		extraHeaders + "\r\nbody\r\n"
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write test email: %v", err)
+	}
+	return path
+}
+
+// TestCollectInputFiles tests directory expansion of input paths
+func TestCollectInputFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeTestEmail(t, dir, "b.eml", "")
+	writeTestEmail(t, dir, "a.MSG", "")
+	writeTestEmail(t, dir, "notes.txt", "")
+	if err := os.Mkdir(filepath.Join(dir, "sub.eml"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	files, isDir, err := collectInputFiles(dir, "", &dirWalk{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !isDir {
+		t.Error("Expected directory input to be detected")
+	}
+	if len(files) != 2 || filepath.Base(files[0]) != "a.MSG" || filepath.Base(files[1]) != "b.eml" {
+		t.Errorf("Unexpected files: %v", files)
+	}
+
+	single := filepath.Join(dir, "b.eml")
+	files, isDir, err = collectInputFiles(single, "", &dirWalk{})
+	if err != nil || isDir || len(files) != 1 || files[0] != single {
+		t.Errorf("Expected single file passthrough, got %v (dir=%v, err=%v)", files, isDir, err)
+	}
+
+	if _, _, err := collectInputFiles(filepath.Join(dir, "missing.eml"), "", &dirWalk{}); err == nil {
+		t.Error("Expected error for missing path")
+	}
+}
+
+// TestCollectInputs tests collecting files from a mix of arguments
+func TestCollectInputs(t *testing.T) {
+	dir := t.TempDir()
+	single := writeTestEmail(t, dir, "single.eml", "")
+	inbox := filepath.Join(dir, "inbox")
+	if err := os.Mkdir(inbox, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestEmail(t, inbox, "a.eml", "")
+	writeTestEmail(t, inbox, "b.msg", "")
+	mbox := writeTestEmail(t, dir, "box.mbox", "")
+
+	tests := []struct {
+		name        string
+		args        []string
+		expectFiles []string
+		expectBatch bool
+		expectFail  int
+	}{
+		{"single file", []string{single}, []string{single}, false, 0},
+		{"single mbox", []string{mbox}, []string{mbox}, true, 0},
+		{"single directory", []string{inbox}, []string{filepath.Join(inbox, "a.eml"), filepath.Join(inbox, "b.msg")}, true, 0},
+		{
+			"files, directories and a missing path",
+			[]string{single, filepath.Join(dir, "missing.eml"), inbox},
+			[]string{single, filepath.Join(inbox, "a.eml"), filepath.Join(inbox, "b.msg")},
+			true, 1,
+		},
+		{"two files", []string{single, single}, []string{single, single}, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, batch, failed := collectInputs(tt.args, "", &dirWalk{})
+			if !slices.Equal(files, tt.expectFiles) {
+				t.Errorf("Expected files %v, got %v", tt.expectFiles, files)
+			}
+			if batch != tt.expectBatch {
+				t.Errorf("Expected batch=%v, got %v", tt.expectBatch, batch)
+			}
+			if failed != tt.expectFail {
+				t.Errorf("Expected %d failed arguments, got %d", tt.expectFail, failed)
+			}
+		})
+	}
+}
+
+// TestCountSCLBands tests SCL band tallying across a batch
+func TestCountSCLBands(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{
+		writeTestEmail(t, dir, "skipped.eml", "X-Forefront-Antispam-Report: SCL:-1;\r\n"),
+		writeTestEmail(t, dir, "clean.eml", "X-Forefront-Antispam-Report: SCL:1;\r\n"),
+		writeTestEmail(t, dir, "low.eml", "X-Forefront-Antispam-Report: SCL:3;\r\n"),
+		writeTestEmail(t, dir, "spam.eml", "X-Forefront-Antispam-Report: SCL:6;\r\n"),
+		writeTestEmail(t, dir, "high.eml", "X-Forefront-Antispam-Report: SCL:9;\r\n"),
+		writeTestEmail(t, dir, "none.eml", ""),
+		filepath.Join(dir, "missing.eml"),
+	}
+
+	counts, err := countSCLBands(context.Background(), files, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := SCLBandCounts{
+		Total: 7, Skipped: 1, NotSpam: 1, LowSpam: 1, Spam: 1, HighConfidence: 1, NoSCL: 1, Errors: 1,
+	}
+	if counts != expected {
+		t.Errorf("Expected %+v, got %+v", expected, counts)
+	}
+}
+
+// TestOutputHistogram tests bar scaling to the available width
+func TestOutputHistogram(t *testing.T) {
+	counts := SCLBandCounts{Total: 111, NotSpam: 100, Spam: 10, HighConfidence: 1}
+
+	var out strings.Builder
+	outputHistogram(&out, counts, 60, false)
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("Expected 6 bands, got %d:\n%s", len(lines), out.String())
+	}
+	// 60 columns minus label (20), spacing (3) and a 3-digit count
+	widths := []int{0, 34, 0, 3, 1, 0}
+	for i, line := range lines {
+		if len(line) != 60 {
+			t.Errorf("Line %d is %d columns, expected 60: %q", i, len(line), line)
+		}
+		if got := strings.Count(line, "#"); got != widths[i] {
+			t.Errorf("Line %d has a bar of %d, expected %d: %q", i, got, widths[i], line)
+		}
+	}
+
+	out.Reset()
+	outputHistogram(&out, counts, 10, true)
+	if !strings.Contains(out.String(), strings.Repeat("█", 10)+" 100") {
+		t.Errorf("Expected a minimum-width block bar on a terminal, got:\n%s", out.String())
+	}
+
+	out.Reset()
+	outputHistogram(&out, SCLBandCounts{}, 80, false)
+	if strings.Contains(out.String(), "#") {
+		t.Errorf("Expected empty bars for no messages, got:\n%s", out.String())
+	}
+}
+
+// TestParseThreadInfo tests reply-chain parsing and thread mismatch detection
+func TestParseThreadInfo(t *testing.T) {
+	tests := []struct {
+		name           string
+		headers        map[string][]string
+		fromDomain     string
+		expectNil      bool
+		expectReply    bool
+		expectRefs     int
+		expectMismatch bool
+	}{
+		{
+			name:      "no thread headers",
+			headers:   map[string][]string{"Subject": {"hi"}},
+			expectNil: true,
+		},
+		{
+			name: "first reply from new participant is not flagged",
+			headers: map[string][]string{
+				"In-Reply-To": {"<abc@mail.partner.com>"},
+				"References":  {"<abc@mail.partner.com>"},
+			},
+			fromDomain:  "example.com",
+			expectReply: true,
+			expectRefs:  1,
+		},
+		{
+			name: "established thread including sender",
+			headers: map[string][]string{
+				"In-Reply-To": {"<m2@mail.partner.com>"},
+				"References":  {"<m1@example.com> <m2@mail.partner.com>"},
+			},
+			fromDomain:  "example.com",
+			expectReply: true,
+			expectRefs:  2,
+		},
+		{
+			name: "subdomain of thread domain matches",
+			headers: map[string][]string{
+				"In-Reply-To": {"<m2@partner.com>"},
+				"References":  {"<m1@outbound.example.com>\r\n <m2@partner.com>"},
+			},
+			fromDomain:  "example.com",
+			expectReply: true,
+			expectRefs:  2,
+		},
+		{
+			name: "established thread hijacked by outsider",
+			headers: map[string][]string{
+				"In-Reply-To": {"<m2@partner.com>"},
+				"References":  {"<m1@example.com> <m2@partner.com>"},
+			},
+			fromDomain:     "attacker.net",
+			expectReply:    true,
+			expectRefs:     2,
+			expectMismatch: true,
+		},
+		{
+			name: "references without in-reply-to",
+			headers: map[string][]string{
+				"References": {"<m1@example.com> <m2@partner.com>"},
+			},
+			fromDomain: "attacker.net",
+			expectRefs: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(mail.Header)
+			for key, values := range tt.headers {
+				header[key] = append(header[key], values...)
+			}
+
+			result := parseThreadInfo(header, tt.fromDomain)
+			if tt.expectNil {
+				if result != nil {
+					t.Errorf("Expected nil result, got %+v", result)
+				}
+				return
+			}
+			if result == nil {
+				t.Fatal("Expected non-nil result, got nil")
+			}
+			if result.IsReply != tt.expectReply {
+				t.Errorf("IsReply = %v, want %v", result.IsReply, tt.expectReply)
+			}
+			if len(result.References) != tt.expectRefs {
+				t.Errorf("Expected %d references, got %v", tt.expectRefs, result.References)
+			}
+			if result.ReplyDomainMismatch != tt.expectMismatch {
+				t.Errorf("ReplyDomainMismatch = %v, want %v (domains %v)", result.ReplyDomainMismatch, tt.expectMismatch, result.ThreadDomains)
+			}
+		})
+	}
+}
+
+// collectingSink is a ResultSink that records reports for assertions
+type collectingSink struct {
+	reports []*EmailSecurityReport
+	closed  bool
+}
+
+func (s *collectingSink) Write(report *EmailSecurityReport) error {
+	s.reports = append(s.reports, report)
+	return nil
+}
+
+func (s *collectingSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+// TestAnalyzeFilesSink tests that results reach a custom sink in input order
+func TestAnalyzeFilesSink(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{
+		writeTestEmail(t, dir, "b.eml", "X-Forefront-Antispam-Report: SCL:6;\r\n"),
+		filepath.Join(dir, "missing.eml"),
+		writeTestEmail(t, dir, "a.eml", "X-Forefront-Antispam-Report: SCL:1;\r\n"),
+	}
+
+	sink := &collectingSink{}
+	failed, err := AnalyzeFiles(context.Background(), files, false, sink, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if failed != 1 {
+		t.Errorf("Expected 1 failure, got %d", failed)
+	}
+	if len(sink.reports) != 2 {
+		t.Fatalf("Expected 2 reports, got %d", len(sink.reports))
+	}
+	if sink.reports[0].File != files[0] || sink.reports[1].File != files[2] {
+		t.Errorf("Reports out of order: %s, %s", sink.reports[0].File, sink.reports[1].File)
+	}
+	if sink.closed {
+		t.Error("AnalyzeFiles must leave closing the sink to the caller")
+	}
+}
+
+// TestAnalyzerAnalyzeFiles tests that batch helpers use their own Analyzer
+// rather than the default one
+func TestAnalyzerAnalyzeFiles(t *testing.T) {
+	dir := t.TempDir()
+	file := writeTestEmail(t, dir, "spam.eml", "X-Forefront-Antispam-Report: SCL:6;\r\n")
+	headers := filepath.Join(dir, "headers.txt")
+	if err := os.WriteFile(headers, []byte("From: a@example.com\nX-Mimecast-Spam-Score: 2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewAnalyzer()
+	a.Dedupe = NewDeduper()
+	a.IncludeRawHeaders = true
+	sink := &collectingSink{}
+	failed, err := a.AnalyzeFiles(context.Background(), []string{file, file}, sink, nil)
+	if err != nil || failed != 0 {
+		t.Fatalf("Expected no failures, got %d, %v", failed, err)
+	}
+	if len(sink.reports) != 1 || sink.reports[0].RawHeaders == nil {
+		t.Errorf("Expected one deduplicated report with raw headers, got %d", len(sink.reports))
+	}
+	if defaultAnalyzer.Dedupe != nil {
+		t.Error("AnalyzeFiles must not configure the default analyzer")
+	}
+
+	// The default analyzer would read a .txt file as eml and fail
+	a.InputFormat = "raw-header"
+	probe, err := a.probeHeaderFiles(context.Background(), []string{headers}, nil)
+	if err != nil || probe.Messages != 1 || probe.Errors != 0 {
+		t.Errorf("Expected the forced format to parse, got %+v, %v", probe, err)
+	}
+}
+
+// cancelingSink cancels its context once it has received limit reports
+type cancelingSink struct {
+	collectingSink
+	limit  int
+	cancel context.CancelFunc
+}
+
+func (s *cancelingSink) Write(report *EmailSecurityReport) error {
+	_ = s.collectingSink.Write(report)
+	if len(s.reports) == s.limit {
+		s.cancel()
+	}
+	return nil
+}
+
+// cancelingHTTPClient cancels the run while a request is in flight
+type cancelingHTTPClient struct{ cancel context.CancelFunc }
+
+func (c cancelingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	c.cancel()
+	return nil, req.Context().Err()
+}
+
+// TestAnalyzeFilesCanceled tests that a done context stops a batch between
+// messages and during a message's lookups, keeping the completed results
+func TestAnalyzeFilesCanceled(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{
+		writeTestEmail(t, dir, "a.eml", "X-Forefront-Antispam-Report: SCL:1;\r\n"),
+		writeTestEmail(t, dir, "b.eml", "X-Forefront-Antispam-Report: SCL:6;\r\n"),
+	}
+	mbox := filepath.Join(dir, "box.mbox")
+	mboxContent := "From x Mon Jan  1 00:00:00 2024\nFrom: a@example.com\nSubject: one\n\nbody\n\n" +
+		"From y Mon Jan  1 00:00:00 2024\nFrom: b@example.com\nSubject: two\n\nbody\n"
+	if err := os.WriteFile(mbox, []byte(mboxContent), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sink := &cancelingSink{limit: 1, cancel: cancel}
+	failed, err := AnalyzeFiles(ctx, files, false, sink, nil)
+	if err != context.Canceled || failed != 0 {
+		t.Fatalf("Expected cancellation, got failed=%d err=%v", failed, err)
+	}
+	if len(sink.reports) != 1 || sink.reports[0].File != files[0] {
+		t.Errorf("Expected only the first report, got %d", len(sink.reports))
+	}
+
+	// Cancellation also stops between messages of one mbox
+	ctx, cancel = context.WithCancel(context.Background())
+	sink = &cancelingSink{limit: 1, cancel: cancel}
+	if _, err := AnalyzeFiles(ctx, []string{mbox}, false, sink, nil); err != context.Canceled {
+		t.Fatalf("Expected cancellation, got %v", err)
+	}
+	if len(sink.reports) != 1 || sink.reports[0].Subject != "one" {
+		t.Errorf("Expected only the first mbox message, got %d", len(sink.reports))
+	}
+
+	// A message whose lookup is cut short is dropped, not written incomplete
+	ctx, cancel = context.WithCancel(context.Background())
+	defaultAnalyzer.Reputation, _ = NewReputationLookup("https://api.example.com/check", "")
+	defaultAnalyzer.HTTPClient = cancelingHTTPClient{cancel: cancel}
+	defer func() {
+		defaultAnalyzer.Reputation = nil
+		defaultAnalyzer.HTTPClient = newDefaultHTTPClient()
+	}()
+	withIP := writeTestEmail(t, dir, "c.eml", "X-Forefront-Antispam-Report: CIP:203.0.113.5;SCL:1;\r\n")
+	collected := &collectingSink{}
+	failed, err = AnalyzeFiles(ctx, []string{withIP}, false, collected, nil)
+	if err != context.Canceled || failed != 0 || len(collected.reports) != 0 {
+		t.Fatalf("Expected the interrupted message to be dropped, got failed=%d err=%v reports=%d", failed, err, len(collected.reports))
+	}
+
+	counts, err := countSCLBands(ctx, files, nil)
+	if err != context.Canceled || counts.Total != 0 {
+		t.Errorf("Expected canceled empty counts, got %+v (err=%v)", counts, err)
+	}
+}
+
+// TestCSVSink tests CSV output including formula-injection neutralization
+func TestCSVSink(t *testing.T) {
+	var buf strings.Builder
+	sink := NewAnalyzer().newResultSink("csv", &buf, false, false)
+
+	report := &EmailSecurityReport{
+		File:         "msg.eml",
+		From:         "=HYPERLINK(\"http://evil\")",
+		Subject:      "Quarterly, results",
+		SPFResults:   []SPFResult{{Result: "fail"}, {Result: "pass"}},
+		DKIMResults:  []DKIMResult{{Result: "FAIL"}},
+		SCL:          &SCLResult{Score: -1, Description: "Skipped", HeaderSource: "X-Forefront-Antispam-Report"},
+		DMARCResults: nil,
+	}
+	if err := sink.Write(report); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected header and one row, got %d lines: %q", len(lines), buf.String())
+	}
+	if !strings.HasPrefix(lines[0], "file,from,to,subject") {
+		t.Errorf("Unexpected header row: %q", lines[0])
+	}
+	for _, want := range []string{`"'=HYPERLINK(""http://evil"")"`, `"Quarterly, results"`, ",pass,fail,,-1,"} {
+		if !strings.Contains(lines[1], want) {
+			t.Errorf("Expected row to contain %q, got %q", want, lines[1])
+		}
+	}
+}
+
+// TestParseSRVToken tests SRV service classification parsing
+func TestParseSRVToken(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    string
+		expected  []string
+		expectNil bool
+	}{
+		{name: "empty SRV", header: "CIP:10.0.0.1;SCL:1;SRV:;IPV:NLI;", expectNil: true},
+		{name: "no SRV token", header: "SCL:1;IPV:NLI;", expectNil: true},
+		{name: "bulk", header: "SCL:6;SRV:BULK;IPV:NLI;", expected: []string{"BULK"}},
+		{name: "at start of header", header: "SRV:bulk;SCL:6;", expected: []string{"BULK"}},
+		{name: "multiple values", header: "SCL:6;SRV:BULK,NEWCODE;", expected: []string{"BULK", "NEWCODE"}},
+		{name: "does not match inside other tokens", header: "SCL:1;XSRV:BULK;", expectNil: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := parseSRVToken(tt.header)
+			if tt.expectNil {
+				if result != nil {
+					t.Errorf("Expected nil, got %+v", result)
+				}
+				return
+			}
+			if len(result) != len(tt.expected) {
+				t.Fatalf("Expected %d services, got %+v", len(tt.expected), result)
+			}
+			for i, code := range tt.expected {
+				if result[i].Code != code {
+					t.Errorf("Service %d code = %q, want %q", i, result[i].Code, code)
+				}
+				if result[i].Description == "" {
+					t.Errorf("Service %d has empty description", i)
+				}
+			}
+		})
+	}
+
+	// SRV values are attached to the SCL result
+	scl := parseSCLHeader("SCL:6;SRV:BULK;", "X-Forefront-Antispam-Report")
+	if scl == nil || len(scl.Services) != 1 || scl.Services[0].Code != "BULK" {
+		t.Errorf("Expected BULK service on SCL result, got %+v", scl)
+	}
+}
+
+// TestOutputDeterministic tests that identical input produces byte-identical output
+func TestOutputDeterministic(t *testing.T) {
+	email := "From: sender@example.com\r\n" +
+		"To: user@example.org\r\n" +
+		"Subject: Stable\r\n" +
+		"Authentication-Results: mx.example.org; spf=pass smtp.mailfrom=example.com smtp.helo=mail.example.com; " +
+		"dkim=pass header.d=example.com header.s=s1 header.b=abc; dmarc=pass header.from=example.com policy.dmarc=none\r\n" +
+		"X-Forefront-Antispam-Report: CIP:10.0.0.1;SCL:1;SRV:;IPV:NLI;\r\n" +
+		"X-Custom-A: one\r\n" +
+		"X-Custom-B: two\r\n" +
+		"X-Custom-C: three\r\n" +
+		"\r\n" +
+		"Body\r\n"
+
+	render := func() (string, string) {
+		report, err := parseEmail([]byte(email), true)
+		if err != nil {
+			t.Fatalf("parseEmail failed: %v", err)
+		}
+		var js, text strings.Builder
+		if err := outputJSON(&js, report, false); err != nil {
+			t.Fatalf("outputJSON failed: %v", err)
+		}
+		outputText(&text, report, true, "", sclProfiles["balanced"])
+		return js.String(), text.String()
+	}
+
+	firstJSON, firstText := render()
+	for i := 0; i < 20; i++ {
+		js, text := render()
+		if js != firstJSON {
+			t.Fatalf("JSON output differs between runs:\n%s\n---\n%s", firstJSON, js)
+		}
+		if text != firstText {
+			t.Fatalf("Text output differs between runs:\n%s\n---\n%s", firstText, text)
+		}
+	}
+}
+
+// TestOutputJSONCompact tests that compact JSON is one line with the same fields
+func TestOutputJSONCompact(t *testing.T) {
+	email := "From: a@example.com\r\nSubject: <compact>\r\n" +
+		"X-Forefront-Antispam-Report: CIP:10.0.0.1;SCL:5;\r\n\r\nBody\r\n"
+	report, err := parseEmail([]byte(email), false)
+	if err != nil {
+		t.Fatalf("parseEmail failed: %v", err)
+	}
+
+	var pretty, compact strings.Builder
+	if err := outputJSON(&pretty, report, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := outputJSON(&compact, report, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Count(compact.String(), "\n") != 1 || !strings.HasSuffix(compact.String(), "\n") {
+		t.Errorf("Expected a single line, got %q", compact.String())
+	}
+	var minified bytes.Buffer
+	if err := json.Compact(&minified, []byte(strings.TrimSuffix(pretty.String(), "\n"))); err != nil {
+		t.Fatal(err)
+	}
+	if minified.String() != strings.TrimSuffix(compact.String(), "\n") {
+		t.Errorf("Compact output differs from minified pretty output:\n%s\n---\n%s", minified.String(), compact.String())
+	}
+}
+
+// TestParseSCLSourcePriority tests SCL header precedence configuration
+func TestParseSCLSourcePriority(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		expected    []string
+		expectError bool
+	}{
+		{
+			name:     "default order",
+			value:    "X-Forefront-Antispam-Report,X-Forefront-Antispam-Report-Untrusted",
+			expected: []string{"X-Forefront-Antispam-Report", "X-Forefront-Antispam-Report-Untrusted"},
+		},
+		{
+			name:     "inverted, case-insensitive, spaces",
+			value:    "x-forefront-antispam-report-untrusted, X-FOREFRONT-ANTISPAM-REPORT",
+			expected: []string{"X-Forefront-Antispam-Report-Untrusted", "X-Forefront-Antispam-Report"},
+		},
+		{
+			name:     "single source",
+			value:    "X-Forefront-Antispam-Report-Untrusted",
+			expected: []string{"X-Forefront-Antispam-Report-Untrusted"},
+		},
+		{name: "typo", value: "X-Forefront-Antispam-Reprot", expectError: true},
+		{name: "duplicate", value: "X-Forefront-Antispam-Report,x-forefront-antispam-report", expectError: true},
+		{name: "empty", value: " , ", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseSCLSourcePriority(tt.value)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error, got %v", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if strings.Join(result, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("Expected %v, got %v", tt.expected, result)
+			}
+		})
+	}
+
+	// The supplied order decides which header wins
+	header := mail.Header{
+		"X-Forefront-Antispam-Report":           {"SCL:2;SRV:;"},
+		"X-Forefront-Antispam-Report-Untrusted": {"SCL:8;SRV:;"},
+	}
+	inverted := []string{"X-Forefront-Antispam-Report-Untrusted", "X-Forefront-Antispam-Report"}
+	result := (&Analyzer{Thresholds: sclProfiles["balanced"], SCLSources: inverted}).extractSCL(header, nil)
+	if result == nil || result.Score != 8 || result.HeaderSource != "X-Forefront-Antispam-Report-Untrusted" {
+		t.Errorf("Expected untrusted SCL 8 to win, got %+v", result)
+	}
+}
+
+// ============================================================================
+// Analyzer Tests
+// ============================================================================
+
+// TestAnalyzerConfiguration tests that each Analyzer applies its own configuration
+func TestAnalyzerConfiguration(t *testing.T) {
+	header := mail.Header{
+		"From":                                  {"sender@example.com"},
+		"X-Forefront-Antispam-Report":           {"SCL:4;SRV:;"},
+		"X-Forefront-Antispam-Report-Untrusted": {"SCL:6;SRV:;"},
+	}
+
+	balanced := NewAnalyzer()
+	report := balanced.Analyze(header)
+	if report.SCL == nil || report.SCL.Score != 4 || report.SCL.Description != "Low spam probability" {
+		t.Errorf("Balanced analyzer: unexpected SCL %+v", report.SCL)
+	}
+	if report.RawHeaders != nil {
+		t.Errorf("Expected no raw headers by default")
+	}
+
+	strict := &Analyzer{
+		Thresholds:        sclProfiles["strict"],
+		SCLSources:        []string{"X-Forefront-Antispam-Report-Untrusted"},
+		IncludeRawHeaders: true,
+	}
+	report = strict.Analyze(header)
+	if report.SCL == nil || report.SCL.Score != 6 || report.SCL.Description != "High confidence spam" {
+		t.Errorf("Strict analyzer: unexpected SCL %+v", report.SCL)
+	}
+	if len(report.RawHeaders) != len(header) {
+		t.Errorf("Expected %d raw headers, got %d", len(header), len(report.RawHeaders))
+	}
+
+	// Configuring one analyzer must not affect the default
+	if defaultAnalyzer.Thresholds != sclProfiles["balanced"] {
+		t.Errorf("Default analyzer thresholds changed: %+v", defaultAnalyzer.Thresholds)
+	}
+}
+
+// TestParseReceivedSPF tests Received-SPF parsing and disagreement detection
+func TestParseReceivedSPF(t *testing.T) {
+	tests := []struct {
+		name           string
+		headers        map[string][]string
+		expectedResult string
+		expectedDomain string
+		expectNil      bool
+		disagree       bool
+	}{
+		{
+			name: "Gmail style",
+			headers: map[string][]string{
+				"Received-Spf": {"pass (google.com: domain of bounce@mail.example.com designates 203.0.113.5 as permitted sender) client-ip=203.0.113.5;"},
+			},
+			expectedResult: "pass",
+			expectedDomain: "mail.example.com",
+		},
+		{
+			name: "domain= key takes precedence",
+			headers: map[string][]string{
+				"Received-Spf": {"softfail (domain of transitioning a@b.com) domain=example.org; client-ip=10.0.0.1"},
+			},
+			expectedResult: "softfail",
+			expectedDomain: "example.org",
+		},
+		{
+			name: "agrees with Authentication-Results",
+			headers: map[string][]string{
+				"Received-Spf":           {"pass (google.com: domain of a@example.com designates 203.0.113.5 as permitted sender)"},
+				"Authentication-Results": {"mx.google.com; spf=pass smtp.mailfrom=example.com"},
+			},
+			expectedResult: "pass",
+			expectedDomain: "example.com",
+		},
+		{
+			name: "disagrees with Authentication-Results",
+			headers: map[string][]string{
+				"Received-Spf":           {"softfail (google.com: domain of transitioning a@example.com does not designate 198.51.100.7 as permitted sender)"},
+				"Authentication-Results": {"mx.google.com; spf=pass smtp.mailfrom=example.com"},
+			},
+			expectedResult: "softfail",
+			expectedDomain: "example.com",
+			disagree:       true,
+		},
+		{
+			name: "absent",
+			headers: map[string][]string{
+				"Authentication-Results": {"mx.google.com; spf=pass smtp.mailfrom=example.com"},
+			},
+			expectNil: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(mail.Header)
+			for key, values := range tt.headers {
+				header[key] = append(header[key], values...)
+			}
+
+			result := parseReceivedSPF(header)
+			if tt.expectNil {
+				if result != nil {
+					t.Errorf("Expected nil, got %+v", result)
+				}
+				return
+			}
+			if result == nil {
+				t.Fatalf("Expected result, got nil")
+			}
+			if result.Result != tt.expectedResult || result.Domain != tt.expectedDomain {
+				t.Errorf("Expected %s/%s, got %s/%s", tt.expectedResult, tt.expectedDomain, result.Result, result.Domain)
+			}
+			if result.Source != "received-spf" {
+				t.Errorf("Expected source received-spf, got %q", result.Source)
+			}
+
+			if got := spfResultsDisagree(extractSPFResults(header, nil)); got != tt.disagree {
+				t.Errorf("Expected disagreement %v, got %v", tt.disagree, got)
+			}
+		})
+	}
+}
+
+// TestSPFAlignment tests organizational-domain alignment of SPF with From
+func TestSPFAlignment(t *testing.T) {
+	tests := []struct {
+		name          string
+		authResults   string
+		from          string
+		expectAligned bool
+		expectFlag    bool
+	}{
+		{"exact domain", "mx; spf=pass smtp.mailfrom=example.com", "a@example.com", true, false},
+		{"bounce subdomain", "mx; spf=pass smtp.mailfrom=bounces@em.example.com", "a@example.com", true, false},
+		{"multi-label suffix", "mx; spf=pass smtp.mailfrom=mail.corp.example.co.uk", "a@example.co.uk", true, false},
+		{"sibling under suffix", "mx; spf=pass smtp.mailfrom=other.co.uk", "a@example.co.uk", false, true},
+		{"unrelated bounce domain", "mx; spf=pass smtp.mailfrom=sendgrid.net", "CEO <ceo@example.com>", false, true},
+		{"failed spf", "mx; spf=fail smtp.mailfrom=attacker.test", "a@example.com", false, false},
+		{"no from", "mx; spf=pass smtp.mailfrom=example.com", "", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := mail.Header{"Authentication-Results": {tt.authResults}, "From": {tt.from}}
+			report := NewAnalyzer().Analyze(header)
+			if report.SPFAligned != tt.expectAligned {
+				t.Errorf("Expected aligned=%v, got %v", tt.expectAligned, report.SPFAligned)
+			}
+			if report.SPFUnalignedPass != tt.expectFlag {
+				t.Errorf("Expected unaligned pass=%v, got %v", tt.expectFlag, report.SPFUnalignedPass)
+			}
+		})
+	}
+}
+
+// TestOrganizationalDomain tests eTLD+1 extraction, including multi-label
+// public suffixes
+func TestOrganizationalDomain(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"example.com", "example.com"},
+		{"Mail.Example.COM.", "example.com"},
+		{"mail.corp.example.co.uk", "example.co.uk"},
+		{"example.co.uk", "example.co.uk"},
+		{"a.b.example.com.au", "example.com.au"},
+		{"shop.example.kawasaki.jp", "shop.example.kawasaki.jp"},
+		{"user.github.io", "user.github.io"},
+		{"co.uk", "co.uk"},
+		{"192.0.2.1", "192.0.2.1"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := organizationalDomain(tt.host); got != tt.expected {
+				t.Errorf("organizationalDomain(%q) = %q, expected %q", tt.host, got, tt.expected)
+			}
+		})
+	}
+
+	if !sameOrganization("bounces.example.co.uk", "example.co.uk") {
+		t.Error("Expected a subdomain to share the organizational domain")
+	}
+	if sameOrganization("example.co.uk", "other.co.uk") || sameOrganization("alice.github.io", "mallory.github.io") {
+		t.Error("Expected siblings under a public suffix not to match")
+	}
+}
+
+// TestDomainAlignment tests DKIM, DMARC and Return-Path alignment with From
+func TestDomainAlignment(t *testing.T) {
+	header := mail.Header{
+		"From":        {"Alice <alice@example.co.uk>"},
+		"Return-Path": {"<bounce@mailer.example.co.uk>"},
+		"Authentication-Results": {"mx.example.net; spf=pass smtp.mailfrom=esp.test; " +
+			"dkim=pass header.d=news.example.co.uk header.s=s1; dmarc=pass header.from=example.co.uk"},
+	}
+	report := NewAnalyzer().Analyze(header)
+	if !report.DKIMAligned || report.SPFAligned || !report.SPFUnalignedPass {
+		t.Errorf("Expected DKIM aligned and SPF unaligned, got dkim=%v spf=%v", report.DKIMAligned, report.SPFAligned)
+	}
+	if report.ReturnPathDomain != "mailer.example.co.uk" || report.ReturnPathMismatch {
+		t.Errorf("Expected aligned Return-Path, got %q (mismatch=%v)", report.ReturnPathDomain, report.ReturnPathMismatch)
+	}
+	if len(report.DMARCResults) != 1 || report.DMARCResults[0].SPFAlignment != "fail" || report.DMARCResults[0].DKIMAlignment != "pass" {
+		t.Errorf("Unexpected DMARC alignment: %+v", report.DMARCResults)
+	}
+
+	header["Return-Path"] = []string{"<bounce@other.co.uk>"}
+	if report := NewAnalyzer().Analyze(header); !report.ReturnPathMismatch {
+		t.Error("Expected a Return-Path under another organization to mismatch")
+	}
+}
+
+// TestParseBaseline tests baseline file validation
+func TestParseBaseline(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		expectError bool
+	}{
+		{"valid", `{"Example.com": {"cip_ranges": ["203.0.113.0/24", "2001:db8::1"], "dkim_selectors": ["s1"]}}`, false},
+		{"unknown field", `{"example.com": {"cip_range": ["203.0.113.0/24"]}}`, true},
+		{"invalid range", `{"example.com": {"cip_ranges": ["203.0.113.0/33"]}}`, true},
+		{"null entry", `{"example.com": null}`, true},
+		{"not an object", `["example.com"]`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			baseline, err := parseBaseline([]byte(tt.data))
+			if tt.expectError {
+				if err == nil {
+					t.Error("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if entry := baseline["example.com"]; entry == nil || len(entry.networks) != 2 {
+				t.Errorf("Expected lowercased domain with two networks, got %+v", baseline)
+			}
+		})
+	}
+}
+
+// TestBaselineDrift tests drift detection against a sender's baseline
+func TestBaselineDrift(t *testing.T) {
+	baseline, err := parseBaseline([]byte(`{
+		"example.com": {"cip_ranges": ["203.0.113.0/24"], "spf_domains": ["bounces.example.com"], "dkim_selectors": ["s1", "s2"]}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := func(from, cip, mailfrom, selector string) mail.Header {
+		return mail.Header{
+			"From":                        {from},
+			"X-Forefront-Antispam-Report": {"CIP:" + cip + ";SCL:1;"},
+			"Authentication-Results": {"mx; spf=pass smtp.mailfrom=" + mailfrom +
+				"; dkim=pass header.d=example.com header.s=" + selector},
+		}
+	}
+
+	tests := []struct {
+		name         string
+		header       mail.Header
+		expectNil    bool
+		expectDomain string
+		expectFields []string
+	}{
+		{"matches", message("a@example.com", "203.0.113.7", "bounce@bounces.example.com", "s2"), false, "example.com", nil},
+		{"subdomain sender", message("a@news.example.com", "203.0.113.7", "bounces.example.com", "s1"), false, "example.com", nil},
+		{"selector in another case", message("a@example.com", "203.0.113.7", "bounces.example.com", "S2"), false, "example.com", nil},
+		{
+			"compromised sender", message("a@example.com", "198.51.100.9", "evil.test", "k9"), false, "example.com",
+			[]string{"sender_ip", "spf_domain", "dkim_selector"},
+		},
+		{"unknown sender", message("a@other.test", "198.51.100.9", "evil.test", "k9"), true, "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAnalyzer()
+			a.Baseline = baseline
+			result := a.Analyze(tt.header).Baseline
+			if tt.expectNil {
+				if result != nil {
+					t.Errorf("Expected nil, got %+v", result)
+				}
+				return
+			}
+			if result == nil {
+				t.Fatal("Expected result, got nil")
+			}
+			var fields []string
+			for _, drift := range result.Drift {
+				fields = append(fields, drift.Field)
+			}
+			if result.Domain != tt.expectDomain || !slices.Equal(fields, tt.expectFields) || result.Drifted != (len(tt.expectFields) > 0) {
+				t.Errorf("Expected %s drift %v, got %+v", tt.expectDomain, tt.expectFields, result)
+			}
+		})
+	}
+
+	if NewAnalyzer().Analyze(message("a@example.com", "198.51.100.9", "evil.test", "k9")).Baseline != nil {
+		t.Error("Expected no baseline result without a baseline")
+	}
+}
+
+// TestLimitFiles tests the -max-files guard
+func TestLimitFiles(t *testing.T) {
+	files := []string{"a.eml", "b.eml", "c.eml"}
+	tests := []struct {
+		name          string
+		max           int
+		expectedCount int
+		expectLimited bool
+	}{
+		{name: "no limit", max: 0, expectedCount: 3},
+		{name: "under limit", max: 5, expectedCount: 3},
+		{name: "exactly at limit", max: 3, expectedCount: 3},
+		{name: "over limit", max: 2, expectedCount: 2, expectLimited: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, limited := limitFiles(files, tt.max)
+			if len(kept) != tt.expectedCount || limited != tt.expectLimited {
+				t.Errorf("Expected %d files (limited=%v), got %d (limited=%v)",
+					tt.expectedCount, tt.expectLimited, len(kept), limited)
+			}
+		})
+	}
+}
+
+// TestParseDKIMSignatureTags tests raw DKIM-Signature tag parsing
+func TestParseDKIMSignatureTags(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name     string
+		sig      string
+		expected DKIMSignature
+	}{
+		{
+			name: "full signature with folding whitespace",
+			sig:  "v=1; a=rsa-sha256; c=relaxed/relaxed; d=Example.com; s=s1;\r\n\th=From:To:Subject:\r\n\t Date; bh=abc\r\n\tdef=; t=1699990000; x=1700086400;\r\n\tb=sig",
+			expected: DKIMSignature{
+				Domain: "example.com", Selector: "s1", Algorithm: "rsa-sha256",
+				SignedHeaders: []string{"from", "to", "subject", "date"},
+				BodyHash:      "abcdef=", Timestamp: 1699990000, Expiration: 1700086400,
+			},
+		},
+		{
+			name: "expired signature",
+			sig:  "v=1; a=rsa-sha256; d=example.com; s=s1; t=1600000000; x=1600086400; bh=x; b=y",
+			expected: DKIMSignature{
+				Domain: "example.com", Selector: "s1", Algorithm: "rsa-sha256",
+				BodyHash: "x", Timestamp: 1600000000, Expiration: 1600086400, Expired: true,
+			},
+		},
+		{
+			name:     "bh= does not leak into other tags",
+			sig:      "d=example.com; s=sel; bh=d=s=",
+			expected: DKIMSignature{Domain: "example.com", Selector: "sel", BodyHash: "d=s="},
+		},
+		{
+			name:     "malformed timestamps ignored",
+			sig:      "d=example.com; s=sel; t=soon; x=later",
+			expected: DKIMSignature{Domain: "example.com", Selector: "sel"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseDKIMSignatureTags(tt.sig, now)
+			if fmt.Sprintf("%+v", got) != fmt.Sprintf("%+v", tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, got)
+			}
+		})
+	}
+
+	header := mail.Header{"Dkim-Signature": {"d=a.example; s=one", "d=b.example; s=two"}}
+	if sigs := parseDKIMSignatures(header); len(sigs) != 2 || sigs[1].Domain != "b.example" {
+		t.Errorf("Expected two signatures, got %+v", sigs)
+	}
+}
+
+// TestGoogleDKIMSignature tests that X-Google-DKIM-Signature is reported
+// alongside DKIM-Signature and tagged by source
+func TestGoogleDKIMSignature(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   mail.Header
+		expected []DKIMResult // Domain, Selector, Result and Source only
+	}{
+		{name: "neither present", header: mail.Header{"From": {"a@example.com"}}},
+		{
+			name: "author and google signatures",
+			header: mail.Header{
+				"Dkim-Signature":          {"v=1; a=rsa-sha256; d=example.com; s=s1; b=x"},
+				"X-Google-Dkim-Signature": {"v=1; a=rsa-sha256; d=1e100.net; s=20230601; b=y"},
+				"Authentication-Results":  {"mx.google.com; dkim=pass header.d=example.com header.s=s1; dkim=pass header.i=@1e100.net header.d=1e100.net"},
+			},
+			expected: []DKIMResult{
+				{Domain: "example.com", Selector: "s1", Result: "pass", Source: dkimSourceSignature},
+				// Receivers do not verify Google's signature, so its result stays separate
+				{Domain: "1e100.net", Selector: "20230601", Source: dkimSourceGoogle},
+				{Domain: "1e100.net", Result: "pass", Source: dkimSourceAuthResults},
+			},
+		},
+		{
+			name:     "google signature only",
+			header:   mail.Header{"X-Google-Dkim-Signature": {"v=1; d=1e100.net; s=20230601; b=y"}},
+			expected: []DKIMResult{{Domain: "1e100.net", Selector: "20230601", Source: dkimSourceGoogle}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []DKIMResult
+			for _, r := range extractDKIMResults(tt.header, nil) {
+				got = append(got, DKIMResult{Domain: r.Domain, Selector: r.Selector, Result: r.Result, Source: r.Source})
+			}
+			if !slices.Equal(got, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, got)
+			}
+
+			sigs := parseDKIMSignatures(tt.header)
+			var sources []string
+			for _, sig := range sigs {
+				sources = append(sources, sig.Source)
+			}
+			var wantSources []string
+			for _, r := range tt.expected {
+				if r.Source != dkimSourceAuthResults {
+					wantSources = append(wantSources, r.Source)
+				}
+			}
+			if !slices.Equal(sources, wantSources) {
+				t.Errorf("Expected signature sources %v, got %v", wantSources, sources)
+			}
+		})
+	}
+}
+
+// TestExtractSCLNoTruncate tests that NoTruncate keeps the full raw SCL header
+func TestExtractSCLNoTruncate(t *testing.T) {
+	long := "SCL:5;SRV:;" + strings.Repeat("X", MaxHeaderLength+500) + "\r\n;END"
+	header := mail.Header{"X-Forefront-Antispam-Report": {long}}
+
+	truncated := NewAnalyzer().extractSCL(header, nil)
+	if truncated == nil || len(truncated.RawHeader) > MaxHeaderLength {
+		t.Fatalf("Expected raw header truncated to %d bytes, got %+v", MaxHeaderLength, truncated)
+	}
+
+	a := NewAnalyzer()
+	a.NoTruncate = true
+	full := a.extractSCL(header, nil)
+	if full == nil {
+		t.Fatal("Expected SCL result")
+	}
+	if !strings.HasSuffix(full.RawHeader, ";END") {
+		t.Errorf("Expected full raw header, got %d bytes", len(full.RawHeader))
+	}
+	if strings.ContainsAny(full.RawHeader, "\r\n") {
+		t.Error("Expected CR/LF to be stripped from the full raw header")
+	}
+	if full.Score != 5 {
+		t.Errorf("Expected score 5, got %d", full.Score)
+	}
+}
+
+// TestComputeAnalysisConfidence tests the signal-weighted confidence score
+func TestComputeAnalysisConfidence(t *testing.T) {
+	total := 0
+	for _, w := range confidenceWeights {
+		total += w
+	}
+	if total != 100 {
+		t.Fatalf("Confidence weights must sum to 100, got %d", total)
+	}
+
+	tests := []struct {
+		name     string
+		headers  map[string][]string
+		expected int
+	}{
+		{
+			name:     "no signals",
+			headers:  map[string][]string{"From": {"a@example.com"}},
+			expected: 0,
+		},
+		{
+			name: "SCL only",
+			headers: map[string][]string{
+				"X-Forefront-Antispam-Report": {"SCL:1;SRV:;"},
+			},
+			expected: 15,
+		},
+		{
+			name: "all signals",
+			headers: map[string][]string{
+				"Authentication-Results": {"mx.microsoft.com; spf=pass smtp.mailfrom=example.com; dkim=pass header.d=example.com; " +
+					"dmarc=pass action=none header.from=example.com; arc=pass; compauth=pass reason=100"},
+				"X-Forefront-Antispam-Report": {"SCL:1;SRV:;"},
+			},
+			expected: 100,
+		},
+		{
+			name: "DKIM signature without a verification result",
+			headers: map[string][]string{
+				"Dkim-Signature": {"v=1; d=example.com; s=s1; b=abc"},
+			},
+			expected: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(mail.Header)
+			for key, values := range tt.headers {
+				header[key] = append(header[key], values...)
+			}
+			report := NewAnalyzer().Analyze(header)
+			if report.AnalysisConfidence != tt.expected {
+				t.Errorf("Expected confidence %d, got %d", tt.expected, report.AnalysisConfidence)
+			}
+		})
+	}
+}
+
+// TestExtractEmailFromEmlx tests Apple Mail .emlx framing removal
+func TestExtractEmailFromEmlx(t *testing.T) {
+	message := "From: a@example.com\nSubject: Hi\n\nBody\n"
+	plist := "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<plist version=\"1.0\"><dict></dict></plist>\n"
+
+	tests := []struct {
+		name        string
+		data        string
+		expectError bool
+	}{
+		{name: "valid", data: fmt.Sprintf("%d\n%s%s", len(message), message, plist)},
+		{name: "padded length line", data: fmt.Sprintf("%d        \n%s%s", len(message), message, plist)},
+		{name: "no plist", data: fmt.Sprintf("%d\n%s", len(message), message)},
+		{name: "missing length line", data: message, expectError: true},
+		{name: "non-numeric length", data: "abc\n" + message + plist, expectError: true},
+		{name: "length too long", data: fmt.Sprintf("%d\n%s", len(message)+100, message), expectError: true},
+		{name: "trailer is not a plist", data: fmt.Sprintf("%d\n%sgarbage", len(message)-5, message), expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractEmailFromEmlx([]byte(tt.data))
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if string(got) != message {
+				t.Errorf("Expected message %q, got %q", message, got)
+			}
+		})
+	}
+
+	// End to end through file loading
+	dir := t.TempDir()
+	path := filepath.Join(dir, "12345.emlx")
+	if err := os.WriteFile(path, []byte(fmt.Sprintf("%d\n%s%s", len(message), message, plist)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	report, err := NewAnalyzer().AnalyzeFileContext(context.Background(), path)
+	if err != nil {
+		t.Fatalf("AnalyzeFileContext failed: %v", err)
+	}
+	if report.Subject != "Hi" {
+		t.Errorf("Expected subject Hi, got %q", report.Subject)
+	}
+}
+
+// ============================================================================
+// Authentication-Results Normalization Tests
+// ============================================================================
+
+// TestSplitAuthResultClauses tests clause splitting of Authentication-Results
+func TestSplitAuthResultClauses(t *testing.T) {
+	header := "mx.example.org;\r\n\tspf=pass (sender; ok) smtp.mailfrom=a.example;\r\n\t dkim=pass\r\n\t header.d=b.example ;dmarc=pass header.from=a.example;"
+	expected := []string{
+		"mx.example.org",
+		"spf=pass (sender; ok) smtp.mailfrom=a.example",
+		"dkim=pass header.d=b.example",
+		"dmarc=pass header.from=a.example",
+	}
+	got := splitAuthResultClauses(header)
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+// TestAuthResultsDeduplication tests duplicated and multi-method Authentication-Results
+func TestAuthResultsDeduplication(t *testing.T) {
+	restamped := "mx.example.org; spf=pass smtp.mailfrom=example.com; dkim=pass header.d=example.com header.s=s1; dmarc=pass header.from=example.com"
+	folded := "mx.example.org;\r\n\tspf=pass smtp.mailfrom=example.com;\r\n\tdkim=pass header.d=example.com\r\n\t header.s=s1; dmarc=pass header.from=example.com"
+
+	tests := []struct {
+		name          string
+		authResults   []string
+		expectedSPF   []string
+		expectedDKIM  []string
+		expectedDMARC []string
+		expectedAR    int
+	}{
+		{
+			name:          "identical headers re-stamped",
+			authResults:   []string{restamped, restamped},
+			expectedSPF:   []string{"example.com/pass"},
+			expectedDKIM:  []string{"example.com/pass"},
+			expectedDMARC: []string{"example.com/pass"},
+			expectedAR:    1,
+		},
+		{
+			name:          "same results folded differently",
+			authResults:   []string{restamped, folded},
+			expectedSPF:   []string{"example.com/pass"},
+			expectedDKIM:  []string{"example.com/pass"},
+			expectedDMARC: []string{"example.com/pass"},
+			expectedAR:    1,
+		},
+		{
+			name: "multiple methods keep their own domains",
+			authResults: []string{
+				"mx.example.org; spf=fail smtp.mailfrom=bounce.example.net; spf=pass smtp.mailfrom=example.com; " +
+					"dkim=pass header.d=example.com; dkim=fail header.d=other.example",
+			},
+			expectedSPF:   []string{"bounce.example.net/fail", "example.com/pass"},
+			expectedDKIM:  []string{"example.com/pass", "other.example/fail"},
+			expectedDMARC: nil,
+			expectedAR:    1,
+		},
+		{
+			name: "distinct results preserved",
+			authResults: []string{
+				"mx1.example.org; spf=pass smtp.mailfrom=example.com",
+				"mx2.example.org; spf=softfail smtp.mailfrom=example.com",
+			},
+			expectedSPF: []string{"example.com/pass", "example.com/softfail"},
+			expectedAR:  2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := mail.Header{"Authentication-Results": tt.authResults}
+
+			var spf, dkim, dmarc []string
+			for _, r := range extractSPFResults(header, nil) {
+				spf = append(spf, r.Domain+"/"+r.Result)
+			}
+			for _, r := range extractDKIMResults(header, nil) {
+				dkim = append(dkim, r.Domain+"/"+r.Result)
+			}
+			for _, r := range extractDMARCResults(header) {
+				dmarc = append(dmarc, r.Domain+"/"+r.Result)
+			}
+
+			if strings.Join(spf, ",") != strings.Join(tt.expectedSPF, ",") {
+				t.Errorf("SPF: expected %v, got %v", tt.expectedSPF, spf)
+			}
+			if strings.Join(dkim, ",") != strings.Join(tt.expectedDKIM, ",") {
+				t.Errorf("DKIM: expected %v, got %v", tt.expectedDKIM, dkim)
+			}
+			if strings.Join(dmarc, ",") != strings.Join(tt.expectedDMARC, ",") {
+				t.Errorf("DMARC: expected %v, got %v", tt.expectedDMARC, dmarc)
+			}
+			if got := len(parseAuthenticationResults(header, nil)); got != tt.expectedAR {
+				t.Errorf("Expected %d Authentication-Results entries, got %d", tt.expectedAR, got)
+			}
+		})
+	}
+}
+
+// TestProgressReporter tests in-place and periodic progress output
+func TestProgressReporter(t *testing.T) {
+	clock := time.Unix(1700000000, 0)
+	newReporter := func(tty bool) (*progressReporter, *strings.Builder) {
+		var out strings.Builder
+		p := newProgressReporter(&out, tty)
+		p.now = func() time.Time { return clock }
+		p.start = clock
+		return p, &out
+	}
+
+	// Non-TTY: first update, then at most one line per interval, plus the final line
+	p, out := newReporter(false)
+	for done := 1; done <= 100; done++ {
+		clock = clock.Add(time.Second)
+		p.Update(done, 100)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	// 1 (first) + one per 10s over 100s + final
+	if len(lines) < 10 || len(lines) > 12 {
+		t.Errorf("Expected about 11 periodic lines, got %d:\n%s", len(lines), out.String())
+	}
+	if !strings.Contains(lines[len(lines)-1], "100/100 files (100.0%)") {
+		t.Errorf("Expected final line to report completion, got %q", lines[len(lines)-1])
+	}
+	if strings.Contains(out.String(), "\r") {
+		t.Error("Non-TTY output must not use carriage returns")
+	}
+
+	// TTY: redrawn in place and terminated with a newline when complete
+	p, out = newReporter(true)
+	for done := 1; done <= 3; done++ {
+		clock = clock.Add(time.Second)
+		p.Update(done, 3)
+	}
+	if !strings.HasPrefix(out.String(), "\r") || !strings.HasSuffix(out.String(), "\n") {
+		t.Errorf("Expected in-place TTY output, got %q", out.String())
+	}
+	if strings.Count(out.String(), "\n") != 1 {
+		t.Errorf("Expected a single newline at completion, got %q", out.String())
+	}
+
+	// Every attempted file is reported, including failures
+	dir := t.TempDir()
+	good := writeTestEmail(t, dir, "good.eml", "")
+	bad := filepath.Join(dir, "bad.eml")
+	if err := os.WriteFile(bad, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var calls []string
+	record := func(done, total int) { calls = append(calls, fmt.Sprintf("%d/%d", done, total)) }
+	if _, err := AnalyzeFiles(context.Background(), []string{good, bad}, false, &collectingSink{}, record); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(calls, ",") != "1/2,2/2" {
+		t.Errorf("Expected progress 1/2,2/2, got %v", calls)
+	}
+}
+
+// ============================================================================
+// Spam Engine Tests
+// ============================================================================
+
+// TestParseSpamAssassin tests X-Spam-* header parsing and engine provenance
+func TestParseSpamAssassin(t *testing.T) {
+	tests := []struct {
+		name            string
+		headers         map[string][]string
+		expectNil       bool
+		expectedSpam    bool
+		expectedScore   float64
+		expectedTests   int
+		expectedEngine  string
+		expectedVersion string
+	}{
+		{
+			name: "full SpamAssassin stamp",
+			headers: map[string][]string{
+				"X-Spam-Status":          {"Yes, score=7.2 required=5.0 tests=BAYES_99,\r\n\tHTML_MESSAGE,URIBL_BLACK autolearn=no\r\n\tautolearn_force=no version=3.4.6"},
+				"X-Spam-Flag":            {"YES"},
+				"X-Spam-Checker-Version": {"SpamAssassin 3.4.6 (2021-04-09) on mail.example.com"},
+			},
+			expectedSpam:    true,
+			expectedScore:   7.2,
+			expectedTests:   3,
+			expectedEngine:  "SpamAssassin",
+			expectedVersion: "3.4.6",
+		},
+		{
+			name: "clean with negative score and no tests",
+			headers: map[string][]string{
+				"X-Spam-Status": {"No, score=-0.1 required=5.0 tests=none autolearn=ham"},
+			},
+			expectedScore: -0.1,
+		},
+		{
+			name: "checker version only",
+			headers: map[string][]string{
+				"X-Spam-Checker-Version": {"Rspamd"},
+			},
+			expectedEngine: "Rspamd",
+		},
+		{
+			name: "score header only",
+			headers: map[string][]string{
+				"X-Spam-Score": {"3.5"},
+			},
+			expectedScore: 3.5,
+		},
+		{
+			name:      "absent",
+			headers:   map[string][]string{"Subject": {"hello"}},
+			expectNil: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(mail.Header)
+			for key, values := range tt.headers {
+				header[key] = append(header[key], values...)
+			}
+
+			result := parseSpamAssassin(header)
+			if tt.expectNil {
+				if result != nil {
+					t.Errorf("Expected nil, got %+v", result)
+				}
+				return
+			}
+			if result == nil {
+				t.Fatal("Expected result, got nil")
+			}
+			if result.IsSpam != tt.expectedSpam || result.Score != tt.expectedScore || len(result.Tests) != tt.expectedTests {
+				t.Errorf("Unexpected verdict %+v", result)
+			}
+			if result.Engine != tt.expectedEngine || result.EngineVersion != tt.expectedVersion {
+				t.Errorf("Expected engine %q %q, got %q %q", tt.expectedEngine, tt.expectedVersion, result.Engine, result.EngineVersion)
+			}
+		})
+	}
+}
+
+// ============================================================================
+// Input Format Tests
+// ============================================================================
+
+// TestDetectInputFormat tests forced and extension-based parser selection
+func TestDetectInputFormat(t *testing.T) {
+	tests := []struct {
+		filename    string
+		forced      string
+		expected    string
+		expectError bool
+	}{
+		{filename: "a.eml", expected: "eml"},
+		{filename: "a.MSG", expected: "msg"},
+		{filename: "a.emlx", expected: "emlx"},
+		{filename: "archive.mbox", expected: "mbox"},
+		{filename: "archive.MBOX.GZ", expected: "mbox"},
+		{filename: "archive.mbox.bz2", expected: "mbox"},
+		{filename: "a.eml.gz", expectError: true},
+		{filename: "headers.txt", expectError: true},
+		{filename: "headers.txt", forced: "raw-header", expected: "raw-header"},
+		{filename: "a.eml", forced: "mbox", expected: "mbox"},
+		{filename: "a.eml", forced: "pst", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filename+"/"+tt.forced, func(t *testing.T) {
+			got, err := detectInputFormat(tt.filename, tt.forced)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error, got %q", got)
+				}
+				return
+			}
+			if err != nil || got != tt.expected {
+				t.Errorf("Expected %q, got %q (err=%v)", tt.expected, got, err)
+			}
+		})
+	}
+}
+
+// TestForEachMboxMessage tests mbox splitting
+func TestForEachMboxMessage(t *testing.T) {
+	mbox := "From a@example.com Mon Jan  1 00:00:00 2024\n" +
+		"From: a@example.com\nSubject: one\n\nHello\n>From the body\n\n" +
+		"From b@example.com Mon Jan  1 00:00:01 2024\n" +
+		"From: b@example.com\nSubject: two\n\nHi\nFrom here on, not a separator\n"
+
+	var messages []string
+	var offsets []int64
+	err := forEachMboxMessage(strings.NewReader(mbox), func(index int, offset int64, data []byte) error {
+		if index != len(messages)+1 {
+			t.Errorf("Expected index %d, got %d", len(messages)+1, index)
+		}
+		messages = append(messages, string(data))
+		offsets = append(offsets, offset)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d: %q", len(messages), messages)
+	}
+	// Offsets point at the separator lines in the original stream
+	if second := int64(strings.Index(mbox, "From b@")); !slices.Equal(offsets, []int64{0, second}) {
+		t.Errorf("Expected offsets [0 %d], got %v", second, offsets)
+	}
+	if !strings.Contains(messages[0], "\nFrom the body\n") {
+		t.Errorf("Expected >From to be unquoted, got %q", messages[0])
+	}
+	if !strings.Contains(messages[1], "From here on, not a separator") {
+		t.Errorf("Expected From line without preceding blank to stay in the body, got %q", messages[1])
+	}
+
+	if err := forEachMboxMessage(strings.NewReader("Subject: no separator\n"), func(int, int64, []byte) error { return nil }); err == nil {
+		t.Error("Expected error for content before the first From line")
+	}
+	if err := forEachMboxMessage(strings.NewReader(""), func(int, int64, []byte) error { return nil }); err == nil {
+		t.Error("Expected error for an empty mbox")
+	}
+}
+
+// TestForcedInputFormats tests raw-header and mbox input end to end
+func TestForcedInputFormats(t *testing.T) {
+	dir := t.TempDir()
+
+	dump := filepath.Join(dir, "headers.txt")
+	content := "\nFrom: a@example.com\nSubject: dump\nX-Forefront-Antispam-Report: SCL:5;"
+	if err := os.WriteFile(dump, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a := NewAnalyzer()
+	if _, err := a.AnalyzeFile(dump); err == nil {
+		t.Error("Expected unknown extension to be rejected without a forced format")
+	}
+	a.InputFormat = "raw-header"
+	report, err := a.AnalyzeFile(dump)
+	if err != nil {
+		t.Fatalf("raw-header analysis failed: %v", err)
+	}
+	if report.Subject != "dump" || report.SCL == nil || report.SCL.Score != 5 {
+		t.Errorf("Unexpected raw-header report: subject=%q scl=%+v", report.Subject, report.SCL)
+	}
+
+	mbox := filepath.Join(dir, "box.mbox")
+	mboxContent := "From x Mon Jan  1 00:00:00 2024\nFrom: a@example.com\nSubject: one\n\nbody\n\n" +
+		"From y Mon Jan  1 00:00:00 2024\nFrom: b@example.com\nSubject: two\n\nbody\n"
+	if err := os.WriteFile(mbox, []byte(mboxContent), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sink := &collectingSink{}
+	failed, err := AnalyzeFiles(context.Background(), []string{mbox}, false, sink, nil)
+	if err != nil || failed != 0 {
+		t.Fatalf("AnalyzeFiles failed: failed=%d err=%v", failed, err)
+	}
+	if len(sink.reports) != 2 || sink.reports[1].Subject != "two" || sink.reports[1].MessageIndex != 2 {
+		t.Fatalf("Expected two mbox reports with indexes, got %d", len(sink.reports))
+	}
+	second := sink.reports[1]
+	if second.File != mbox || second.MessageOffset == nil || *second.MessageOffset != int64(strings.Index(mboxContent, "From y")) {
+		t.Errorf("Expected file and separator offset on the second report, got %q %v", second.File, second.MessageOffset)
+	}
+	column := slices.Index(csvHeader, "message_index")
+	if record := csvRecord(second); !slices.Equal(record[column:column+2], []string{"2", strconv.Itoa(strings.Index(mboxContent, "From y"))}) {
+		t.Errorf("Expected CSV message index and offset columns, got %q", record)
+	}
+}
+
+// TestCompressedMbox tests gzip and bzip2 mailboxes end to end
+func TestCompressedMbox(t *testing.T) {
+	dir := t.TempDir()
+	mboxContent := "From x Mon Jan  1 00:00:00 2024\nFrom: a@example.com\nSubject: one\n\nbody\n\n" +
+		"From y Mon Jan  1 00:00:00 2024\nFrom: b@example.com\nSubject: two\n\nbody\n"
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	if _, err := zw.Write([]byte(mboxContent)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The standard library has no bzip2 writer; this is mboxContent through bzip2 -9
+	bz, err := base64.StdEncoding.DecodeString("QlpoOTFBWSZTWZy6VUUAAB/fgAAQQAF0EEESCAA+F9bgIABqCqqPypo9TRoAeoep+qBVU0AAAACu14ne9IXZrM0qtoWcG1JuaJINaGTxIa7XFBBCxoj9Ss1zNj27bLXidFeQ1VsYUYdPLBkn8vHVSP4u5IpwoSE5dKqK")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archives := map[string][]byte{
+		"box.mbox.gz":  gz.Bytes(),
+		"box.mbox.bz2": bz,
+		"gzipped.mbox": gz.Bytes(), // Detected by content, not name
+	}
+	for name, data := range archives {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			sink := &collectingSink{}
+			failed, err := AnalyzeFiles(context.Background(), []string{path}, false, sink, nil)
+			if err != nil || failed != 0 {
+				t.Fatalf("AnalyzeFiles failed: failed=%d err=%v", failed, err)
+			}
+			if len(sink.reports) != 2 || sink.reports[1].Subject != "two" || sink.reports[1].MessageIndex != 2 {
+				t.Errorf("Expected two mbox reports with indexes, got %d", len(sink.reports))
+			}
+		})
+	}
+
+	// The cap fails instead of silently truncating
+	capped := &cappedReader{r: strings.NewReader(mboxContent), remaining: 10}
+	if _, err := io.ReadAll(capped); err == nil {
+		t.Error("Expected an error past the decompressed size cap")
+	}
+	exact := &cappedReader{r: strings.NewReader(mboxContent), remaining: int64(len(mboxContent))}
+	if data, err := io.ReadAll(exact); err != nil || string(data) != mboxContent {
+		t.Errorf("Expected content at exactly the cap to be read, got err=%v", err)
+	}
+}
+
+// TestDetectGateways tests gateway detection from header presence
+func TestDetectGateways(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  []string
+		expected []string
+	}{
+		{name: "none", headers: []string{"From", "Subject"}, expected: nil},
+		{name: "microsoft", headers: []string{"X-Forefront-Antispam-Report", "X-Microsoft-Antispam"}, expected: []string{"Microsoft"}},
+		{
+			name:     "several vendors, sorted",
+			headers:  []string{"X-Proofpoint-Virus-Version", "X-Mimecast-Spam-Score", "X-Barracuda-Connect", "X-Forefront-Antispam-Report"},
+			expected: []string{"Barracuda", "Microsoft", "Mimecast", "Proofpoint"},
+		},
+		{name: "case-insensitive", headers: []string{"X-Ironport-Av"}, expected: []string{"Cisco"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(mail.Header)
+			for _, name := range tt.headers {
+				header[name] = []string{"x"}
+			}
+			got := detectGateways(header)
+			if strings.Join(got, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestParseMimecast tests Mimecast score and signature normalization
+func TestParseMimecast(t *testing.T) {
+	tests := []struct {
+		name      string
+		headers   map[string]string
+		expectNil bool
+		score     int
+		verdict   string
+	}{
+		{name: "no mimecast headers", headers: map[string]string{"X-Spam-Flag": "YES"}, expectNil: true},
+		{name: "clean", headers: map[string]string{"X-Mimecast-Spam-Score": "0"}, score: 0, verdict: VerdictNotSpam},
+		{name: "low score", headers: map[string]string{"X-Mimecast-Spam-Score": "3"}, score: 3, verdict: VerdictLowSpam},
+		{name: "high score", headers: map[string]string{"X-Mimecast-Spam-Score": "14"}, score: 14, verdict: VerdictHighConfidence},
+		{
+			name:    "bulk signature raises clean score",
+			headers: map[string]string{"X-Mimecast-Spam-Score": "1", "X-Mimecast-Spam-Signature": "bulk"},
+			score:   1, verdict: VerdictLowSpam,
+		},
+		{
+			name:    "score outranks signature",
+			headers: map[string]string{"X-Mimecast-Spam-Score": "11", "X-Mimecast-Spam-Signature": "bulk"},
+			score:   11, verdict: VerdictHighConfidence,
+		},
+		{name: "other mimecast header only", headers: map[string]string{"X-Mimecast-Mfc-Agg-Id": "abc"}, verdict: VerdictNotSpam},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(mail.Header)
+			for k, v := range tt.headers {
+				header[k] = []string{v}
+			}
+			result := parseMimecast(header, defaultScoreBands["mimecast"])
+			if tt.expectNil {
+				if result != nil {
+					t.Errorf("Expected nil, got %+v", result)
+				}
+				return
+			}
+			if result == nil {
+				t.Fatal("Expected result, got nil")
+			}
+			if result.Score != tt.score || result.Verdict != tt.verdict {
+				t.Errorf("Expected score %d verdict %s, got %d %s", tt.score, tt.verdict, result.Score, result.Verdict)
+			}
+		})
+	}
+}
+
+// TestConsolidateVerdicts tests combining engine verdicts under each policy
+func TestConsolidateVerdicts(t *testing.T) {
+	mixed := []SpamVerdict{
+		{Source: "scl", Verdict: VerdictNotSpam},
+		{Source: "spamassassin", Verdict: VerdictSpam},
+		{Source: "mimecast", Verdict: VerdictNotSpam},
+	}
+
+	tests := []struct {
+		name         string
+		verdicts     []SpamVerdict
+		policy       string
+		verdict      string
+		contributors []string
+		disagreement bool
+	}{
+		{name: "most-severe", verdicts: mixed, policy: "most-severe", verdict: VerdictSpam, contributors: []string{"spamassassin"}, disagreement: true},
+		{name: "majority", verdicts: mixed, policy: "majority", verdict: VerdictNotSpam, contributors: []string{"scl", "mimecast"}, disagreement: true},
+		{name: "first", verdicts: mixed, policy: "first", verdict: VerdictNotSpam, contributors: []string{"scl"}, disagreement: true},
+		{
+			name:         "majority tie goes to more severe",
+			verdicts:     mixed[:2],
+			policy:       "majority",
+			verdict:      VerdictSpam,
+			contributors: []string{"spamassassin"},
+			disagreement: true,
+		},
+		{
+			name:         "agreement",
+			verdicts:     []SpamVerdict{{Source: "scl", Verdict: VerdictSpam}, {Source: "mimecast", Verdict: VerdictSpam}},
+			policy:       "most-severe",
+			verdict:      VerdictSpam,
+			contributors: []string{"scl", "mimecast"},
+		},
+		{name: "unknown policy falls back", verdicts: mixed, policy: "bogus", verdict: VerdictSpam, contributors: []string{"spamassassin"}, disagreement: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := consolidateVerdicts(tt.verdicts, tt.policy)
+			if result.Verdict != tt.verdict {
+				t.Errorf("Expected verdict %s, got %s", tt.verdict, result.Verdict)
+			}
+			var sources []string
+			for _, c := range result.Contributors {
+				sources = append(sources, c.Source)
+			}
+			if strings.Join(sources, ",") != strings.Join(tt.contributors, ",") {
+				t.Errorf("Expected contributors %v, got %v", tt.contributors, sources)
+			}
+			if result.Disagreement != tt.disagreement {
+				t.Errorf("Expected disagreement %v, got %v", tt.disagreement, result.Disagreement)
+			}
+		})
+	}
+}
+
+// TestParseForefrontTokens tests splitting a Forefront header into tokens
+func TestParseForefrontTokens(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		expected map[string]string
+	}{
+		{
+			name:   "typical header",
+			header: "CIP:10.0.0.1;CTRY:US;LANG:en;SCL:1;SRV:;IPV:NLI;SFV:NSPM;H:mail.example.com;",
+			expected: map[string]string{
+				"CIP": "10.0.0.1", "CTRY": "US", "LANG": "en", "SCL": "1", "SRV": "",
+				"IPV": "NLI", "SFV": "NSPM", "H": "mail.example.com",
+			},
+		},
+		{name: "duplicate keys keep first", header: "SCL:2;CIP:10.0.0.1;SCL:8;", expected: map[string]string{"SCL": "2", "CIP": "10.0.0.1"}},
+		{name: "whitespace and folding", header: "CIP:10.0.0.1;\r\n SCL:3; CTRY:US", expected: map[string]string{"CIP": "10.0.0.1", "SCL": "3", "CTRY": "US"}},
+		{name: "value containing colons", header: "CIP:2001:db8::1;SCL:1;", expected: map[string]string{"CIP": "2001:db8::1", "SCL": "1"}},
+		{name: "segments without colon ignored", header: "garbage;SCL:5;;:x;", expected: map[string]string{"SCL": "5"}},
+		{name: "empty header", header: "", expected: map[string]string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := parseForefrontTokens(tt.header)
+			if len(result) != len(tt.expected) {
+				t.Fatalf("Expected %d tokens, got %d: %v", len(tt.expected), len(result), result)
+			}
+			for k, v := range tt.expected {
+				if got, ok := result[k]; !ok || got != v {
+					t.Errorf("Token %s: expected %q, got %q (present %v)", k, v, got, ok)
+				}
+			}
+		})
+	}
+}
+
+// TestParseReceivedDate tests timezone normalization of Received dates
+func TestParseReceivedDate(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     string
+		expected  string
+		expectErr bool
+	}{
+		{name: "numeric offset", value: "Mon, 1 Jan 2024 10:00:00 -0500", expected: "2024-01-01T15:00:00Z"},
+		{name: "offset with comment", value: " Mon, 1 Jan 2024 10:00:00 -0500 (EST)", expected: "2024-01-01T15:00:00Z"},
+		{name: "named zone", value: "Mon, 1 Jan 2024 07:00:00 PST", expected: "2024-01-01T15:00:00Z"},
+		{name: "obsolete UT", value: "Mon, 1 Jan 2024 15:00:00 UT", expected: "2024-01-01T15:00:00Z"},
+		{name: "GMT", value: "1 Jan 2024 15:00:00 GMT", expected: "2024-01-01T15:00:00Z"},
+		{name: "folded whitespace", value: "Mon, 1 Jan 2024\r\n\t16:00:00 +0100", expected: "2024-01-01T15:00:00Z"},
+		{name: "garbage", value: "yesterday-ish", expectErr: true},
+		{name: "empty", value: " ", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseReceivedDate(tt.value)
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("Expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if s := got.UTC().Format(time.RFC3339); s != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, s)
+			}
+		})
+	}
+}
+
+// TestParseReceivedChain tests hop order, delays and transit time
+func TestParseReceivedChain(t *testing.T) {
+	header := mail.Header{"Received": {
+		"from mx.example.com by inbox.example.com with ESMTPS; Mon, 1 Jan 2024 15:00:12 +0000",
+		"from relay.example.net by mx.example.com; not a date",
+		"from sender.example.org by relay.example.net with SMTP; Mon, 1 Jan 2024 10:00:00 -0500 (EST)",
+	}}
+	berlin := time.FixedZone("CET", 3600)
+
+	hops, transit := parseReceivedChain(header, berlin, nil)
+	if len(hops) != 3 {
+		t.Fatalf("Expected 3 hops, got %d", len(hops))
+	}
+	if hops[0].From != "sender.example.org" || hops[0].By != "relay.example.net" || hops[0].With != "SMTP" {
+		t.Errorf("Unexpected oldest hop: %+v", hops[0])
+	}
+	if hops[0].TimestampUTC != "2024-01-01T15:00:00Z" || hops[0].TimestampLocal != "2024-01-01T16:00:00+01:00" {
+		t.Errorf("Unexpected timestamps: %+v", hops[0])
+	}
+	if hops[1].TimestampUTC != "" || hops[1].Timestamp != "not a date" {
+		t.Errorf("Unparseable date should keep only the original: %+v", hops[1])
+	}
+	// The delay skips the hop without a parseable date
+	if hops[2].DelaySeconds != 12 || transit != 12 {
+		t.Errorf("Expected delay and transit of 12s, got %d and %d", hops[2].DelaySeconds, transit)
+	}
+
+	if hops, transit := parseReceivedChain(mail.Header{}, nil, nil); hops != nil || transit != 0 {
+		t.Errorf("Expected no chain, got %v %d", hops, transit)
+	}
+}
+
+// TestHopCount tests Received hop counting and the -max-hops threshold
+func TestHopCount(t *testing.T) {
+	received := func(n int) mail.Header {
+		header := make(mail.Header)
+		for i := 0; i < n; i++ {
+			value := fmt.Sprintf("from relay%d.example.com by relay%d.example.com; Tue, 2 Jan 2024 10:00:%02d +0000", i, i+1, i)
+			if i%2 == 1 {
+				value = "garbage without a date"
+			}
+			header["Received"] = append(header["Received"], value)
+		}
+		return header
+	}
+
+	tests := []struct {
+		name            string
+		hops            int
+		maxHops         int
+		expectExcessive bool
+	}{
+		{"no received headers", 0, DefaultMaxHops, false},
+		{"at threshold", 15, DefaultMaxHops, false},
+		{"above threshold", 16, DefaultMaxHops, true},
+		{"beyond parsed chain", MaxRegexMatches + 10, DefaultMaxHops, true},
+		{"custom threshold", 4, 3, true},
+		{"disabled", 40, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAnalyzer()
+			a.MaxHops = tt.maxHops
+			report := a.Analyze(received(tt.hops))
+			if report.HopCount != tt.hops {
+				t.Errorf("Expected %d hops, got %d", tt.hops, report.HopCount)
+			}
+			if report.ExcessiveHops != tt.expectExcessive {
+				t.Errorf("Expected excessive=%v, got %v", tt.expectExcessive, report.ExcessiveHops)
+			}
+		})
+	}
+}
+
+// TestMessageExitCode tests -exit-code statuses, including the allowlisted band
+func TestMessageExitCode(t *testing.T) {
+	balanced := sclProfiles["balanced"]
+	tests := []struct {
+		name        string
+		scl         *SCLResult
+		allowlisted bool
+		expected    int
+	}{
+		{name: "no SCL", scl: nil, allowlisted: true, expected: 0},
+		{name: "not spam", scl: &SCLResult{Score: 1}, expected: 0},
+		{name: "spam", scl: &SCLResult{Score: 5}, expected: ExitSpam},
+		{name: "allowlisted without option", scl: &SCLResult{Score: -1}, expected: 0},
+		{name: "allowlisted with option", scl: &SCLResult{Score: -1}, allowlisted: true, expected: ExitAllowlisted},
+		{name: "SCL 0 is not allowlisted", scl: &SCLResult{Score: 0}, allowlisted: true, expected: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := &EmailSecurityReport{SCL: tt.scl, Allowlisted: tt.scl != nil && tt.scl.Score == -1}
+			if got := messageExitCode(report, balanced, tt.allowlisted); got != tt.expected {
+				t.Errorf("Expected exit code %d, got %d", tt.expected, got)
+			}
+		})
+	}
+
+	// In a batch, spam outranks allowlisted regardless of order
+	sink := &exitCodeSink{ResultSink: &collectingSink{}, thresholds: balanced, allowlisted: true}
+	for _, score := range []int{-1, 6, -1, 0} {
+		if err := sink.Write(&EmailSecurityReport{SCL: &SCLResult{Score: score}, Allowlisted: score == -1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sink.code != ExitSpam {
+		t.Errorf("Expected batch exit code %d, got %d", ExitSpam, sink.code)
+	}
+
+	header := mail.Header{"X-Forefront-Antispam-Report": {"CIP:10.0.0.1;SCL:-1;"}}
+	if report := NewAnalyzer().Analyze(header); !report.Allowlisted || report.SCL.Description != "Skipped spam filtering (safe sender or SCL override)" {
+		t.Errorf("Expected allowlisted report with unchanged description, got %+v", report.SCL)
+	}
+}
+
+// TestExitReason tests the -explain-exit rationale for each exit status
+func TestExitReason(t *testing.T) {
+	balanced := sclProfiles["balanced"]
+	tests := []struct {
+		name     string
+		code     int
+		report   *EmailSecurityReport
+		expected string
+	}{
+		{name: "clean batch", code: 0, expected: "no message reached spam-threshold 5"},
+		{
+			name:     "spam",
+			code:     ExitSpam,
+			report:   &EmailSecurityReport{SCL: &SCLResult{Score: 7}},
+			expected: "SCL 7 >= spam-threshold 5 (high confidence spam)",
+		},
+		{
+			name:     "spam in mbox",
+			code:     ExitSpam,
+			report:   &EmailSecurityReport{File: "box.mbox", MessageIndex: 3, SCL: &SCLResult{Score: 5}},
+			expected: "SCL 5 >= spam-threshold 5 (spam) in box.mbox (message 3)",
+		},
+		{
+			name:     "allowlisted",
+			code:     ExitAllowlisted,
+			report:   &EmailSecurityReport{File: "a.eml", SCL: &SCLResult{Score: -1}, Allowlisted: true},
+			expected: "SCL -1, spam filtering was skipped (-exit-allowlisted) in a.eml",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitReason(tt.code, tt.report, balanced); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+
+	// The first message that reached the final status decides the reason
+	sink := &exitCodeSink{ResultSink: &collectingSink{}, thresholds: balanced, allowlisted: true}
+	for i, score := range []int{-1, 8, 6} {
+		if err := sink.Write(&EmailSecurityReport{MessageIndex: i + 1, SCL: &SCLResult{Score: score}, Allowlisted: score == -1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sink.decider == nil || sink.decider.MessageIndex != 2 {
+		t.Errorf("Expected message 2 to decide the exit code, got %+v", sink.decider)
+	}
+}
+
+// TestParseWebmailProvenance tests webmail origin header parsing
+func TestParseWebmailProvenance(t *testing.T) {
+	tests := []struct {
+		name      string
+		headers   map[string]string
+		from      string
+		expectNil bool
+		expected  WebmailProvenance
+	}{
+		{name: "absent", headers: map[string]string{}, from: "a@example.com", expectNil: true},
+		{
+			name:     "hotmail corroborates from",
+			headers:  map[string]string{"X-Originating-Email": "[Alice@Hotmail.com]", "X-Originating-Ip": "[192.0.2.10]"},
+			from:     "Alice <alice@hotmail.com>",
+			expected: WebmailProvenance{OriginatingEmail: "alice@hotmail.com", OriginatingIP: "192.0.2.10"},
+		},
+		{
+			name:     "contradicts from",
+			headers:  map[string]string{"X-Originating-Email": "[mallory@hotmail.com]"},
+			from:     "CEO <ceo@example.com>",
+			expected: WebmailProvenance{OriginatingEmail: "mallory@hotmail.com", FromMismatch: true},
+		},
+		{
+			name:     "yahoo apparently-to",
+			headers:  map[string]string{"X-Apparently-To": "bob@yahoo.com via 98.138.0.1; Tue, 02 Jan 2024 10:00:00 +0000"},
+			from:     "a@example.com",
+			expected: WebmailProvenance{ApparentlyTo: "bob@yahoo.com"},
+		},
+		{
+			name:      "invalid values dropped",
+			headers:   map[string]string{"X-Originating-Email": "[not an address]", "X-Originating-Ip": "[999.1.1.1]"},
+			from:      "a@example.com",
+			expectNil: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(mail.Header)
+			for k, v := range tt.headers {
+				header[k] = []string{v}
+			}
+			result := parseWebmailProvenance(header, tt.from, nil)
+			if tt.expectNil {
+				if result != nil {
+					t.Errorf("Expected nil, got %+v", result)
+				}
+				return
+			}
+			if result == nil {
+				t.Fatal("Expected result, got nil")
+			}
+			if *result != tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, *result)
+			}
+		})
+	}
+}
+
+// TestParseSenderIP tests sender IP extraction from Forefront and gateway headers
+func TestParseSenderIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		headers   map[string]string
+		expectNil bool
+		expected  SenderIP
+	}{
+		{name: "absent", headers: map[string]string{}, expectNil: true},
+		{
+			name:     "forefront cip preferred",
+			headers:  map[string]string{"X-Forefront-Antispam-Report": "CIP:203.0.113.5;CTRY:US;SCL:1;", "X-Sender-Ip": "198.51.100.1"},
+			expected: SenderIP{IP: "203.0.113.5", Source: "X-Forefront-Antispam-Report (CIP)"},
+		},
+		{
+			name:     "ipv6 cip",
+			headers:  map[string]string{"X-Forefront-Antispam-Report": "CIP:2001:db8::1;SCL:1;"},
+			expected: SenderIP{IP: "2001:db8::1", Source: "X-Forefront-Antispam-Report (CIP)"},
+		},
+		{
+			name:     "x-sender-ip",
+			headers:  map[string]string{"X-Sender-Ip": "198.51.100.1"},
+			expected: SenderIP{IP: "198.51.100.1", Source: "X-Sender-IP"},
+		},
+		{
+			name:     "x-senderip bracketed",
+			headers:  map[string]string{"X-Senderip": "[198.51.100.2]"},
+			expected: SenderIP{IP: "198.51.100.2", Source: "X-SenderIP"},
+		},
+		{
+			name:     "invalid value skipped",
+			headers:  map[string]string{"X-Forefront-Antispam-Report": "CIP:unknown;SCL:1;", "X-Sender-Ip": "999.1.1.1", "X-Source-Ip": "192.0.2.7"},
+			expected: SenderIP{IP: "192.0.2.7", Source: "X-Source-IP"},
+		},
+		{
+			name:      "only invalid values",
+			headers:   map[string]string{"X-Source-Ip": "localhost"},
+			expectNil: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(mail.Header)
+			for k, v := range tt.headers {
+				header[k] = []string{v}
+			}
+			result := parseSenderIP(header, nil)
+			if tt.expectNil {
+				if result != nil {
+					t.Errorf("Expected nil, got %+v", result)
+				}
+				return
+			}
+			if result == nil {
+				t.Fatal("Expected result, got nil")
+			}
+			if *result != tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, *result)
+			}
+		})
+	}
+}
+
+// TestClassifyAttachment tests risky extension and type mismatch detection
+func TestClassifyAttachment(t *testing.T) {
+	tests := []struct {
+		name           string
+		filename       string
+		contentType    string
+		expectRisky    bool
+		expectMismatch bool
+		expectReasons  int
+	}{
+		{"plain pdf", "report.pdf", "application/pdf", false, false, 0},
+		{"octet-stream pdf", "report.pdf", "application/octet-stream", false, false, 0},
+		{"executable", "setup.EXE", "application/x-msdownload", true, false, 1},
+		{"disk image", "invoice.iso", "application/octet-stream", true, false, 1},
+		{"double extension", "invoice.pdf.exe", "application/octet-stream", true, false, 2},
+		{"trailing dot", "invoice.pdf.exe.", "application/octet-stream", true, false, 2},
+		{"exe declared as pdf", "invoice.exe", "application/pdf", true, true, 2},
+		{"pdf declared as image", "invoice.pdf", "image/png", false, true, 1},
+		{"right-to-left override", "invoice\u202Efdp.exe", "application/octet-stream", true, false, 2},
+		{"unknown extension", "data.xyz", "text/csv", false, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attachment := classifyAttachment(tt.filename, tt.contentType)
+			if attachment.Risky != tt.expectRisky {
+				t.Errorf("Expected risky=%v, got %v (%v)", tt.expectRisky, attachment.Risky, attachment.Reasons)
+			}
+			if attachment.TypeMismatch != tt.expectMismatch {
+				t.Errorf("Expected mismatch=%v, got %v", tt.expectMismatch, attachment.TypeMismatch)
+			}
+			if len(attachment.Reasons) != tt.expectReasons {
+				t.Errorf("Expected %d reasons, got %v", tt.expectReasons, attachment.Reasons)
+			}
+		})
+	}
+}
+
+// TestParseAttachments tests MIME walking across nested multiparts and encodings
+func TestParseAttachments(t *testing.T) {
+	email := "From: a@example.com\r\n" +
+		"Subject: invoice\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=outer\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/related; boundary=inner\r\n" +
+		"\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"\r\n" +
+		"<p>See attached</p>\r\n" +
+		"--inner\r\n" +
+		"Content-Type: image/png; name=logo.png\r\n" +
+		"Content-Disposition: inline\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"AAECAwQF\r\nBgcICQ==\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=\"=?utf-8?q?Rechnung.pdf.exe?=\"\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"MZ=3D=3D\r\n" +
+		"--outer--\r\n"
+
+	msg, err := mail.ReadMessage(strings.NewReader(email))
+	if err != nil {
+		t.Fatal(err)
+	}
+	attachments, err := parseAttachments(msg.Header, msg.Body, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(attachments) != 2 {
+		t.Fatalf("Expected 2 attachments, got %+v", attachments)
+	}
+
+	logo := attachments[0]
+	if logo.Filename != "logo.png" || logo.ContentType != "image/png" || logo.Size != 10 || !logo.Inline || logo.Risky {
+		t.Errorf("Unexpected inline image: %+v", logo)
+	}
+	payload := attachments[1]
+	if payload.Filename != "Rechnung.pdf.exe" || payload.Size != 4 || payload.Inline || !payload.Risky {
+		t.Errorf("Unexpected attachment: %+v", payload)
+	}
+
+	// Deep analysis is opt-in
+	a := NewAnalyzer()
+	report, err := a.AnalyzeMessage([]byte(email))
+	if err != nil || report.Attachments != nil {
+		t.Errorf("Expected no attachments without Deep, got %+v (err=%v)", report.Attachments, err)
+	}
+	a.Deep = true
+	report, err = a.AnalyzeMessage([]byte(email))
+	if err != nil || len(report.Attachments) != 2 {
+		t.Errorf("Expected 2 attachments with Deep, got %+v (err=%v)", report.Attachments, err)
+	}
+
+	// A multipart without a boundary keeps the header analysis
+	broken := "From: a@example.com\r\nContent-Type: multipart/mixed\r\n\r\nbody\r\n"
+	if report, err := a.AnalyzeMessage([]byte(broken)); err != nil || report.From != "a@example.com" || report.Attachments != nil {
+		t.Errorf("Expected header analysis without attachments, got %+v (err=%v)", report, err)
+	}
+}
+
+// failingReader fails the test if anything reads from it
+type failingReader struct{ t *testing.T }
+
+func (r failingReader) Read([]byte) (int, error) {
+	r.t.Error("Read past the header boundary")
+	return 0, io.ErrUnexpectedEOF
+}
+
+// TestAnalyzeReader tests analysis from a stream
+func TestAnalyzeReader(t *testing.T) {
+	headers := "From: a@example.com\r\nSubject: streamed\r\n" +
+		"X-Forefront-Antispam-Report: SCL:6;\r\n\r\n"
+
+	// Without Deep nothing after the header block is read
+	report, err := NewAnalyzer().AnalyzeReader(io.MultiReader(strings.NewReader(headers), failingReader{t}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if report.Subject != "streamed" || report.SCL == nil || report.SCL.Score != 6 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+
+	a := NewAnalyzer()
+	a.Deep = true
+	body := "--b\r\nContent-Type: application/zip\r\nContent-Disposition: attachment; filename=a.zip\r\n\r\nPK\r\n--b--\r\n"
+	report, err = a.AnalyzeReader(strings.NewReader("Content-Type: multipart/mixed; boundary=b\r\n" + headers + body))
+	if err != nil || len(report.Attachments) != 1 || report.Attachments[0].Filename != "a.zip" {
+		t.Errorf("Expected one attachment with Deep, got %+v (err=%v)", report, err)
+	}
+
+	if _, err := a.AnalyzeReader(strings.NewReader("")); err == nil {
+		t.Error("Expected error for an empty stream")
+	}
+}
+
+// TestSortReports tests -sort parsing and ordering
+func TestSortReports(t *testing.T) {
+	specs := []struct {
+		spec      string
+		key       string
+		desc      bool
+		expectErr bool
+	}{
+		{spec: "score", key: "score", desc: true},
+		{spec: "score:asc", key: "score", desc: false},
+		{spec: "Filename", key: "filename", desc: false},
+		{spec: "date:desc", key: "date", desc: true},
+		{spec: "size", expectErr: true},
+		{spec: "date:up", expectErr: true},
+	}
+	for _, tt := range specs {
+		key, desc, err := parseSortSpec(tt.spec)
+		if tt.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.spec)
+			}
+			continue
+		}
+		if err != nil || key != tt.key || desc != tt.desc {
+			t.Errorf("%s: expected %s/%v, got %s/%v (%v)", tt.spec, tt.key, tt.desc, key, desc, err)
+		}
+	}
+
+	reports := []*EmailSecurityReport{
+		{File: "c.eml", SCL: &SCLResult{Score: 1}, Date: "Tue, 2 Jan 2024 10:00:00 +0000"},
+		{File: "a.eml", Date: "garbage"},
+		{File: "b.mbox", MessageIndex: 2, SCL: &SCLResult{Score: 8}, Date: "Mon, 1 Jan 2024 10:00:00 +0000"},
+		{File: "b.mbox", MessageIndex: 1, SCL: &SCLResult{Score: 5}, Date: "Wed, 3 Jan 2024 10:00:00 +0000"},
+	}
+	order := func() string {
+		var names []string
+		for _, r := range reports {
+			names = append(names, fmt.Sprintf("%s#%d", r.File, r.MessageIndex))
+		}
+		return strings.Join(names, ",")
+	}
+
+	tests := []struct {
+		key      string
+		desc     bool
+		expected string
+	}{
+		{key: "score", desc: true, expected: "b.mbox#2,b.mbox#1,c.eml#0,a.eml#0"},
+		{key: "score", desc: false, expected: "c.eml#0,b.mbox#1,b.mbox#2,a.eml#0"},
+		{key: "filename", desc: false, expected: "a.eml#0,b.mbox#1,b.mbox#2,c.eml#0"},
+		{key: "date", desc: false, expected: "b.mbox#2,c.eml#0,b.mbox#1,a.eml#0"},
+		{key: "date", desc: true, expected: "b.mbox#1,c.eml#0,b.mbox#2,a.eml#0"},
+	}
+	for _, tt := range tests {
+		sortReports(reports, tt.key, tt.desc)
+		if got := order(); got != tt.expected {
+			t.Errorf("%s desc=%v: expected %s, got %s", tt.key, tt.desc, tt.expected, got)
+		}
+	}
+
+	// The sorting sink writes nothing until Close
+	inner := &collectingSink{}
+	sink := &sortingSink{ResultSink: inner, key: "score", desc: true}
+	for _, r := range reports {
+		if err := sink.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(inner.reports) != 0 {
+		t.Fatalf("Expected buffering before Close, got %d reports", len(inner.reports))
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(inner.reports) != 4 || inner.reports[0].SCL.Score != 8 {
+		t.Errorf("Expected 4 reports with the worst first, got %d", len(inner.reports))
+	}
+}
+
+// TestSCLOverriddenByRule tests SFV-based rule override detection
+func TestSCLOverriddenByRule(t *testing.T) {
+	tests := []struct {
+		sfv        string
+		overridden bool
+	}{
+		{sfv: "SKS", overridden: true},
+		{sfv: "SKN", overridden: true},
+		{sfv: "SKA", overridden: true},
+		{sfv: "SKB", overridden: true},
+		{sfv: "skb", overridden: true},
+		{sfv: "SPM", overridden: false},
+		{sfv: "NSPM", overridden: false},
+		{sfv: "SFE", overridden: false},
+		{sfv: "SKI", overridden: false},
+		{sfv: "SKQ", overridden: false},
+		{sfv: "", overridden: false},
+	}
+
+	for _, tt := range tests {
+		t.Run("SFV "+tt.sfv, func(t *testing.T) {
+			result := parseSCLHeader("CIP:10.0.0.1;SCL:9;SFV:"+tt.sfv+";IPV:NLI;", "X-Forefront-Antispam-Report")
+			if result == nil {
+				t.Fatal("Expected SCL result, got nil")
+			}
+			if result.OverriddenByRule != tt.overridden {
+				t.Errorf("Expected OverriddenByRule %v, got %v", tt.overridden, result.OverriddenByRule)
+			}
+			if result.SFV != strings.ToUpper(tt.sfv) {
+				t.Errorf("Expected SFV %q, got %q", strings.ToUpper(tt.sfv), result.SFV)
+			}
+		})
+	}
+}
+
+// TestCatalog tests that the catalog mirrors the parser description maps
+func TestCatalog(t *testing.T) {
+	a := NewAnalyzer()
+	a.Thresholds = sclProfiles["strict"]
+	catalog := a.Catalog()
+
+	if len(catalog.SCL) != 11 {
+		t.Errorf("Expected SCL entries for -1..9, got %d", len(catalog.SCL))
+	}
+	if catalog.SCL["4"] != "Spam" || catalog.SCL["-1"] != describeSCL(-1, a.Thresholds) {
+		t.Errorf("SCL descriptions do not follow the thresholds: %v", catalog.SCL)
+	}
+	for code := range sfvRuleOverrides {
+		if _, ok := catalog.SFV[code]; !ok {
+			t.Errorf("Rule override SFV code %s missing from catalog", code)
+		}
+	}
+	if catalog.SRV["BULK"] != srvDescriptions["BULK"] || catalog.CAT["PHSH"] != catDescriptions["PHSH"] || catalog.IPV["CAL"] != ipvDescriptions["CAL"] {
+		t.Error("Catalog does not match the parser maps")
+	}
+
+	// Callers get copies
+	catalog.SFV["SPM"] = "changed"
+	if sfvDescriptions["SPM"] != "Spam" {
+		t.Error("Modifying the catalog changed the parser map")
+	}
+
+	result := parseSCLHeader("CIP:10.0.0.1;SCL:6;SFV:SPM;CAT:phsh;IPV:NLI;", "X-Forefront-Antispam-Report")
+	if result == nil || result.CAT != "PHSH" || result.IPV != "NLI" {
+		t.Errorf("Expected CAT and IPV tokens, got %+v", result)
+	}
+}
+
+// TestParseHeaderJSON tests JSON header input validation and conversion
+func TestParseHeaderJSON(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		expectErr string
+		check     func(t *testing.T, header mail.Header)
+	}{
+		{
+			name:  "canonicalizes names",
+			input: `{"x-forefront-antispam-report": ["CIP:10.0.0.1;SCL:6;"], "FROM": ["a@example.com"]}`,
+			check: func(t *testing.T, header mail.Header) {
+				if header.Get("X-Forefront-Antispam-Report") != "CIP:10.0.0.1;SCL:6;" || header.Get("From") != "a@example.com" {
+					t.Errorf("Unexpected header: %v", header)
+				}
+			},
+		},
+		{
+			name:  "merges case variants",
+			input: `{"Received": ["by b"], "received": ["by a"]}`,
+			check: func(t *testing.T, header mail.Header) {
+				if len(header["Received"]) != 2 || header["Received"][0] != "by b" {
+					t.Errorf("Expected merged Received values in sorted-key order, got %v", header["Received"])
+				}
+			},
+		},
+		{name: "not an object", input: `["From"]`, expectErr: "must be an object"},
+		{name: "malformed", input: `{"From": [`, expectErr: "must be an object"},
+		{name: "string value", input: `{"From": "a@example.com"}`, expectErr: `header "From" must be an array of strings`},
+		{name: "non-string element", input: `{"Subject": [1]}`, expectErr: "must be an array of strings"},
+		{name: "empty object", input: `{}`, expectErr: "no headers"},
+		{name: "invalid name", input: `{"Bad Name": ["x"]}`, expectErr: "invalid header name"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := parseHeaderJSON([]byte(tt.input))
+			if tt.expectErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectErr) {
+					t.Errorf("Expected error containing %q, got %v", tt.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			tt.check(t, header)
+		})
+	}
+
+	// End to end through a forced input format
+	path := filepath.Join(t.TempDir(), "headers.json")
+	if err := os.WriteFile(path, []byte(`{"X-Forefront-Antispam-Report": ["SCL:7;"], "Subject": ["json"]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a := NewAnalyzer()
+	a.InputFormat = "json-headers"
+	report, err := a.AnalyzeFile(path)
+	if err != nil {
+		t.Fatalf("json-headers analysis failed: %v", err)
+	}
+	if report.Subject != "json" || report.SCL == nil || report.SCL.Score != 7 {
+		t.Errorf("Unexpected report: subject=%q scl=%+v", report.Subject, report.SCL)
+	}
+}
+
+// TestLowercaseHeaderKeys tests that hand-built headers with any casing resolve
+func TestLowercaseHeaderKeys(t *testing.T) {
+	header := mail.Header{
+		"x-forefront-antispam-report": {"CIP:10.0.0.1;SCL:6;SFV:SPM;"},
+		"authentication-results":      {"mx.example.com; spf=pass smtp.mailfrom=example.com; dkim=pass header.d=example.com"},
+		"dkim-signature":              {"v=1; a=rsa-sha256; d=example.com; s=sel; h=from; bh=abc; b=def"},
+		"RECEIVED":                    {"from a by b; Mon, 1 Jan 2024 10:00:00 +0000"},
+		"received":                    {"from c by a; Mon, 1 Jan 2024 09:59:00 +0000"},
+		"from":                        {"a@example.com"},
+	}
+
+	if scl := extractSCLResults(header); scl == nil || scl.Score != 6 {
+		t.Fatalf("Expected SCL 6 from a lowercase header key, got %+v", scl)
+	}
+
+	report := NewAnalyzer().Analyze(header)
+	if report.From != "a@example.com" {
+		t.Errorf("Expected From, got %q", report.From)
+	}
+	if len(report.SPFResults) == 0 || len(report.DKIMResults) == 0 || len(report.DKIMSignatures) != 1 {
+		t.Errorf("Expected SPF, DKIM and DKIM-Signature results, got %d/%d/%d",
+			len(report.SPFResults), len(report.DKIMResults), len(report.DKIMSignatures))
+	}
+	if len(report.ReceivedChain) != 2 {
+		t.Errorf("Expected case variants of Received to merge, got %d hops", len(report.ReceivedChain))
+	}
+
+	// Already canonical headers are returned as is
+	canonical := mail.Header{"From": {"a@example.com"}}
+	if got := canonicalHeader(canonical); fmt.Sprintf("%p", got) != fmt.Sprintf("%p", canonical) {
+		t.Error("Expected a canonical header to be returned unchanged")
+	}
+}
+
+// TestMaildirWatcher tests new-message detection in a Maildir
+func TestMaildirWatcher(t *testing.T) {
+	root := t.TempDir()
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.Mkdir(filepath.Join(root, sub), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deliver := func(name, subject string) {
+		// Deliveries are written to tmp/ and renamed into new/
+		tmp := filepath.Join(root, "tmp", name)
+		content := "From: a@example.com\nSubject: " + subject + "\nX-Forefront-Antispam-Report: SCL:5;\n\nbody\n"
+		if err := os.WriteFile(tmp, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, filepath.Join(root, "new", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deliver("1.existing", "old")
+	w, err := newMaildirWatcher(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := w.poll(); len(files) != 0 {
+		t.Errorf("Expected existing messages to be skipped, got %v", files)
+	}
+
+	deliver("2.new", "fresh")
+	files, _ := w.poll()
+	if len(files) != 1 || filepath.Base(files[0]) != "2.new" {
+		t.Fatalf("Expected the new delivery, got %v", files)
+	}
+	if again, _ := w.poll(); len(again) != 0 {
+		t.Errorf("Expected no re-processing, got %v", again)
+	}
+
+	// A client moving the message to cur/ before analysis is followed
+	moved := filepath.Join(root, "cur", "2.new:2,S")
+	if err := os.Rename(files[0], moved); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.resolve(files[0]); got != moved {
+		t.Errorf("Expected %s, got %s", moved, got)
+	}
+	if _, err := w.poll(); err != nil || w.seen["2.new"] {
+		t.Error("Expected moved messages to be forgotten")
+	}
+
+	// One pass of the watch loop analyzes new deliveries; the sink ends the
+	// watch after the first report
+	deliver("3.next", "streamed")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sink := &cancelingSink{limit: 1, cancel: cancel}
+	if err := watchMaildir(ctx, w, *NewAnalyzer(), sink, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.reports) != 1 || sink.reports[0].Subject != "streamed" || sink.reports[0].SCL == nil {
+		t.Fatalf("Expected one streamed report, got %d", len(sink.reports))
+	}
+	if want := filepath.Join(root, "new", "3.next"); sink.reports[0].File != want {
+		t.Errorf("Expected file %s, got %s", want, sink.reports[0].File)
+	}
+
+	// A canceled watch stops without reporting the pending message as broken
+	deliver("4.late", "unread")
+	late := &collectingSink{}
+	if err := watchMaildir(ctx, w, *NewAnalyzer(), late, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if len(late.reports) != 0 {
+		t.Errorf("Expected no reports after cancellation, got %d", len(late.reports))
+	}
+
+	var buf strings.Builder
+	if err := (&ndjsonSink{w: &buf}).Write(sink.reports[0]); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(buf.String(), "\n") != 1 {
+		t.Errorf("Expected a single NDJSON line, got %q", buf.String())
+	}
+}
+
+// TestParseOriginalAuthResults tests Authentication-Results-Original parsing
+func TestParseOriginalAuthResults(t *testing.T) {
+	tests := []struct {
+		name        string
+		headers     mail.Header
+		expectNil   bool
+		dmarc       string
+		differences []string
+	}{
+		{
+			name:      "absent",
+			headers:   mail.Header{"Authentication-Results": {"mx.example.com; spf=pass smtp.mailfrom=example.com"}},
+			expectNil: true,
+		},
+		{
+			name: "forwarded mail failing at the boundary",
+			headers: mail.Header{
+				"Authentication-Results":          {"mx.corp.example; spf=fail smtp.mailfrom=sender.example; dmarc=fail header.from=sender.example"},
+				"Authentication-Results-Original": {"mx.list.example; spf=pass smtp.mailfrom=sender.example; dkim=pass header.d=sender.example; dmarc=pass header.from=sender.example"},
+			},
+			dmarc: "pass",
+			differences: []string{
+				"spf: pass originally, fail now",
+				"dkim: pass originally, none now",
+				"dmarc: pass originally, fail now",
+			},
+		},
+		{
+			name: "unchanged verdicts",
+			headers: mail.Header{
+				"Authentication-Results":          {"mx.corp.example; dmarc=pass header.from=sender.example"},
+				"Authentication-Results-Original": {"mx.list.example; dmarc=pass header.from=sender.example"},
+			},
+			dmarc: "pass",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := NewAnalyzer().Analyze(tt.headers)
+			orig := report.OriginalAuth
+			if tt.expectNil {
+				if orig != nil {
+					t.Errorf("Expected nil, got %+v", orig)
+				}
+				return
+			}
+			if orig == nil {
+				t.Fatal("Expected original results, got nil")
+			}
+			if len(orig.DMARCResults) != 1 || orig.DMARCResults[0].Result != tt.dmarc {
+				t.Errorf("Expected original DMARC %s, got %+v", tt.dmarc, orig.DMARCResults)
+			}
+			if strings.Join(orig.Differences, ";") != strings.Join(tt.differences, ";") {
+				t.Errorf("Expected differences %v, got %v", tt.differences, orig.Differences)
+			}
+			for _, spf := range orig.SPFResults {
+				if spf.Source != "authentication-results-original" {
+					t.Errorf("Expected original SPF source, got %q", spf.Source)
+				}
+			}
+		})
+	}
+}
+
+// TestWaitLookup tests the shared lookup rate limiter
+func TestWaitLookup(t *testing.T) {
+	a := NewAnalyzer()
+	if a.Limiter != nil {
+		t.Fatalf("Expected no default limit, got %v", a.Limiter.Limit())
+	}
+	for range 3 {
+		if err := a.waitLookup(context.Background()); err != nil {
+			t.Errorf("Expected no limit without a Limiter, got %v", err)
+		}
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := a.waitLookup(canceled); err == nil {
+		t.Error("Expected a canceled context to stop the lookup")
+	}
+
+	// Copies share one limiter, so the burst is spent across all of them
+	a.Limiter = rate.NewLimiter(rate.Every(time.Hour), 1)
+	copied := *a
+	if err := a.waitLookup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancelWait := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelWait()
+	if err := copied.waitLookup(ctx); err == nil {
+		t.Error("Expected the copy to wait on the shared limiter")
+	}
+
+	for limiter, want := range map[*rate.Limiter]string{
+		nil:                          "unlimited",
+		rate.NewLimiter(rate.Inf, 1): "unlimited",
+		rate.NewLimiter(2.5, 1):      "2.5 queries/second",
+	} {
+		if got := describeLookupLimit(limiter); got != want {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+	}
+}
+
+// TestParserDiagnostics tests the per-parser diagnostics recorded with -v
+func TestParserDiagnostics(t *testing.T) {
+	header := mail.Header{
+		"X-Forefront-Antispam-Report": {"CIP:10.0.0.1;SCL:12;"},
+		"Received":                    {"from a by b; not a date"},
+		"Authentication-Results":      {"mx.example.com; spf=pass smtp.mailfrom=example.com"},
+	}
+
+	if report := NewAnalyzer().Analyze(header); report.Diagnostics != nil {
+		t.Errorf("Expected no diagnostics by default, got %d", len(report.Diagnostics))
+	}
+
+	a := NewAnalyzer()
+	a.Diagnostics = true
+	report := a.Analyze(header)
+	runs := make(map[string]ParserRun)
+	for _, run := range report.Diagnostics {
+		runs[run.Parser] = run
+	}
+
+	tests := []struct {
+		parser  string
+		matched bool
+		err     string
+	}{
+		{parser: "spf", matched: true},
+		{parser: "scl", matched: false, err: "out of range"},
+		{parser: "received", matched: true, err: "1 of 1 Received dates"},
+		{parser: "mimecast", matched: false},
+	}
+	for _, tt := range tests {
+		run, ok := runs[tt.parser]
+		if !ok {
+			t.Errorf("Missing diagnostics for %s", tt.parser)
+			continue
+		}
+		if run.Matched != tt.matched {
+			t.Errorf("%s: expected matched %v, got %v", tt.parser, tt.matched, run.Matched)
+		}
+		if (tt.err == "") != (run.Error == "") || !strings.Contains(run.Error, tt.err) {
+			t.Errorf("%s: expected error containing %q, got %q", tt.parser, tt.err, run.Error)
+		}
+	}
+
+	// Parsers record their own runs as they parse; a nil log records nothing
+	diag := &parserLog{}
+	if ip := parseSenderIP(mail.Header{"X-Sender-Ip": {"not an ip"}}, diag); ip != nil {
+		t.Fatalf("Expected no sender IP, got %+v", ip)
+	}
+	if len(diag.runs) != 1 || diag.runs[0].Parser != "sender-ip" || diag.runs[0].Error == "" {
+		t.Errorf("Expected one failed sender-ip run, got %+v", diag.runs)
+	}
+	if ip := parseSenderIP(mail.Header{"X-Sender-Ip": {"203.0.113.5"}}, nil); ip == nil {
+		t.Error("Expected a sender IP without a parser log")
+	}
+}
+
+func TestParseTenantProvenance(t *testing.T) {
+	tests := []struct {
+		name      string
+		headers   map[string]string
+		expectNil bool
+		expected  TenantProvenance
+	}{
+		{name: "non-microsoft message", headers: map[string]string{"Received-Spf": "pass"}, expectNil: true},
+		{
+			name: "inbound internet mail",
+			headers: map[string]string{
+				"X-Ms-Exchange-Crosstenant-Id":                  "72F988BF-86F1-41AF-91AB-2D7CD011DB47",
+				"X-Ms-Exchange-Crosstenant-Authas":              "Anonymous",
+				"X-Ms-Exchange-Crosstenant-Fromentityheader":    "Internet",
+				"X-Ms-Exchange-Crosstenant-Network-Message-Id":  "0b7d5c3e-1111-2222-3333-444455556666",
+				"X-Ms-Exchange-Crosstenant-Originalarrivaltime": "15 Oct 2026 10:00:00.0000 (UTC)",
+			},
+			expected: TenantProvenance{
+				TenantID:            "72f988bf-86f1-41af-91ab-2d7cd011db47",
+				AuthAs:              "Anonymous",
+				FromEntityHeader:    "Internet",
+				NetworkMessageID:    "0b7d5c3e-1111-2222-3333-444455556666",
+				OriginalArrivalTime: "15 Oct 2026 10:00:00.0000 (UTC)",
+			},
+		},
+		{
+			name: "internal with attributed user",
+			headers: map[string]string{
+				"X-Ms-Exchange-Crosstenant-Id":                "72f988bf-86f1-41af-91ab-2d7cd011db47",
+				"X-Ms-Exchange-Crosstenant-Userprincipalname": "alice@contoso.com",
+				"X-Ms-Exchange-Crosstenant-Authas":            "Internal",
+				"X-Ms-Exchange-Crosstenant-Authsource":        "BN8PR12MB1234.namprd12.prod.outlook.com",
+			},
+			expected: TenantProvenance{
+				TenantID:          "72f988bf-86f1-41af-91ab-2d7cd011db47",
+				UserPrincipalName: "alice@contoso.com",
+				AuthAs:            "Internal",
+				AuthSource:        "BN8PR12MB1234.namprd12.prod.outlook.com",
+			},
+		},
+		{
+			name:     "invalid tenant id dropped",
+			headers:  map[string]string{"X-Ms-Exchange-Crosstenant-Id": "not-a-guid", "X-Ms-Exchange-Crosstenant-Authas": "Internal"},
+			expected: TenantProvenance{AuthAs: "Internal"},
+		},
+		{
+			name:      "only invalid tenant id",
+			headers:   map[string]string{"X-Ms-Exchange-Crosstenant-Id": "not-a-guid"},
+			expectNil: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(mail.Header)
+			for k, v := range tt.headers {
+				header[k] = []string{v}
+			}
+			result := parseTenantProvenance(header)
+			if tt.expectNil {
+				if result != nil {
+					t.Errorf("Expected nil, got %+v", result)
+				}
+				return
+			}
+			if result == nil {
+				t.Fatal("Expected tenant provenance, got nil")
+			}
+			if *result != tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, *result)
+			}
+		})
+	}
+}
+
+// TestConfidenceFilterSink tests that -min-confidence drops and counts
+// low-confidence reports
+func TestConfidenceFilterSink(t *testing.T) {
+	collected := &collectingSink{}
+	sink := &confidenceFilterSink{ResultSink: collected, min: 50}
+	for i, confidence := range []int{15, 50, 100, 0} {
+		if err := sink.Write(&EmailSecurityReport{MessageIndex: i + 1, AnalysisConfidence: confidence}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sink.filtered != 2 || sink.written != 2 {
+		t.Errorf("Expected 2 filtered and 2 written, got %d and %d", sink.filtered, sink.written)
+	}
+	if len(collected.reports) != 2 || collected.reports[0].MessageIndex != 2 || collected.reports[1].MessageIndex != 3 {
+		t.Errorf("Expected messages 2 and 3 to pass the filter, got %d reports", len(collected.reports))
+	}
+
+	// The default of 0 keeps everything
+	off := &confidenceFilterSink{ResultSink: &collectingSink{}}
+	if err := off.Write(&EmailSecurityReport{}); err != nil || off.filtered != 0 {
+		t.Errorf("Expected nothing filtered at 0, got %d (err=%v)", off.filtered, err)
+	}
+}
+
+// stubHTTPClient answers every request with a canned status and body and
+// records the last request
+type stubHTTPClient struct {
+	status  int
+	body    string
+	err     error
+	request *http.Request
+	calls   int
+}
+
+func (c *stubHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	c.request = req
+	c.calls++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &http.Response{StatusCode: c.status, Body: io.NopCloser(strings.NewReader(c.body)), Header: make(http.Header)}, nil
+}
+
+// TestFetchJSON tests that enrichment requests go through the injected HTTPClient
+func TestFetchJSON(t *testing.T) {
+	tests := []struct {
+		name        string
+		client      *stubHTTPClient
+		expectError bool
+	}{
+		{name: "success", client: &stubHTTPClient{status: 200, body: `{"score": 42}`}},
+		{name: "server error", client: &stubHTTPClient{status: 503, body: `{}`}, expectError: true},
+		{name: "invalid JSON", client: &stubHTTPClient{status: 200, body: `<html>`}, expectError: true},
+		{name: "oversized body", client: &stubHTTPClient{status: 200, body: `"` + strings.Repeat("x", MaxHTTPResponseBytes) + `"`}, expectError: true},
+		{name: "transport error", client: &stubHTTPClient{err: fmt.Errorf("offline")}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAnalyzer()
+			a.HTTPClient = tt.client
+			var result struct {
+				Score int `json:"score"`
+			}
+			err := a.fetchJSON(context.Background(), "https://api.example.com/check?ip=192.0.2.1", http.Header{"Key": {"secret"}}, &result)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error, got %+v", result)
+				}
+				return
+			}
+			if err != nil || result.Score != 42 {
+				t.Fatalf("Expected score 42, got %+v (err=%v)", result, err)
+			}
+			if req := tt.client.request; req.Header.Get("Key") != "secret" || req.Header.Get("Accept") != "application/json" || req.URL.Host != "api.example.com" {
+				t.Errorf("Unexpected request: %s %v", req.URL, req.Header)
+			}
+		})
+	}
+
+	if client, ok := NewAnalyzer().HTTPClient.(*http.Client); !ok || client.Timeout != DefaultHTTPTimeout {
+		t.Errorf("Expected a default http.Client with a %s timeout", DefaultHTTPTimeout)
+	}
+}
+
+// TestLookupReputation tests the reputation API lookup, its cache and the
+// addresses it refuses to send
+func TestLookupReputation(t *testing.T) {
+	lookup, err := NewReputationLookup("https://api.example.com/api/v2/check?maxAgeInDays=90", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &stubHTTPClient{status: 200, body: `{"data": {"ipAddress": "203.0.113.5", "abuseConfidenceScore": 87, "totalReports": 12, "lastReportedAt": "2026-10-01T12:00:00+00:00"}}`}
+	a := NewAnalyzer()
+	a.HTTPClient = client
+	a.Reputation = lookup
+	a.Limiter = nil
+
+	header := mail.Header{"X-Forefront-Antispam-Report": {"CIP:203.0.113.5;SCL:5;"}}
+	report := a.Analyze(header)
+	expected := ReputationResult{IP: "203.0.113.5", AbuseConfidenceScore: 87, TotalReports: 12, LastReportedAt: "2026-10-01T12:00:00+00:00"}
+	if report.Reputation == nil || *report.Reputation != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, report.Reputation)
+	}
+	query := client.request.URL.Query()
+	if query.Get("ipAddress") != "203.0.113.5" || query.Get("maxAgeInDays") != "90" || client.request.Header.Get("Key") != "secret" {
+		t.Errorf("Unexpected request: %s", client.request.URL)
+	}
+
+	// A second message from the same IP is answered from the cache
+	a.Analyze(header)
+	if client.calls != 1 {
+		t.Errorf("Expected one request for a repeated IP, got %d", client.calls)
+	}
+
+	// Internal addresses are never sent
+	if rep := a.lookupReputation(context.Background(), "10.0.0.1"); rep != nil || client.calls != 1 {
+		t.Errorf("Expected private IP to be skipped, got %+v after %d calls", rep, client.calls)
+	}
+
+	// Failures are reported on the result and not cached
+	failing := &stubHTTPClient{status: 200, body: `{"data": {}}`}
+	a.HTTPClient = failing
+	for range 2 {
+		if rep := a.lookupReputation(context.Background(), "198.51.100.9"); rep == nil || rep.Error == "" {
+			t.Errorf("Expected a failed lookup result, got %+v", rep)
+		}
+	}
+	if failing.calls != 2 {
+		t.Errorf("Expected failed lookups to be retried, got %d calls", failing.calls)
+	}
+
+	// Without a key no Key header is sent
+	a.HTTPClient = client
+	a.Reputation, _ = NewReputationLookup("https://api.example.com/check", "")
+	a.lookupReputation(context.Background(), "203.0.113.5")
+	if _, ok := client.request.Header["Key"]; ok {
+		t.Errorf("Expected no Key header without a key, got %q", client.request.Header.Get("Key"))
+	}
+
+	// A canceled context stops a lookup waiting on the rate limiter
+	a.Reputation, _ = NewReputationLookup("https://api.example.com/check", "")
+	a.Limiter = rate.NewLimiter(rate.Every(time.Hour), 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls := client.calls
+	if rep := a.lookupReputation(ctx, "203.0.113.5"); rep == nil || rep.Error == "" || client.calls != calls {
+		t.Errorf("Expected a canceled lookup to fail without a request, got %+v", rep)
+	}
+
+	for _, bad := range []string{"", "ftp://api.example.com", "api.example.com/check"} {
+		if _, err := NewReputationLookup(bad, ""); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+// TestAnalyzeContextEntryPoints tests that the file and message entry points
+// pass their context on to enrichment lookups and drop the interrupted report
+func TestAnalyzeContextEntryPoints(t *testing.T) {
+	client := &stubHTTPClient{status: 200, body: `{"data": {"abuseConfidenceScore": 87}}`}
+	a := NewAnalyzer()
+	a.HTTPClient = client
+	a.Limiter = nil
+	a.Reputation, _ = NewReputationLookup("https://api.example.com/check", "")
+	data := []byte("From: a@example.com\r\nX-Forefront-Antispam-Report: CIP:203.0.113.5;SCL:5;\r\n\r\nBody\r\n")
+	path := filepath.Join(t.TempDir(), "message.eml")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	entryPoints := map[string]func() (*EmailSecurityReport, error){
+		"AnalyzeMessageContext": func() (*EmailSecurityReport, error) { return a.AnalyzeMessageContext(ctx, data) },
+		"AnalyzeFileContext":    func() (*EmailSecurityReport, error) { return a.AnalyzeFileContext(ctx, path) },
+	}
+	for name, analyze := range entryPoints {
+		if report, err := analyze(); err != context.Canceled {
+			t.Errorf("%s: expected cancellation, got %+v (err=%v)", name, report, err)
+		}
+	}
+	if client.calls != 0 {
+		t.Errorf("Expected no requests after cancellation, got %d", client.calls)
+	}
+}
+
+// gatedHTTPClient holds every request until release is closed
+type gatedHTTPClient struct {
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (c *gatedHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	c.calls.Add(1)
+	<-c.release
+	body := `{"data": {"abuseConfidenceScore": 50}}`
+	return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+}
+
+// TestLookupReputationShared tests that concurrent cache misses for one IP
+// share a single request
+func TestLookupReputationShared(t *testing.T) {
+	client := &gatedHTTPClient{release: make(chan struct{})}
+	a := NewAnalyzer()
+	a.HTTPClient = client
+	a.Reputation, _ = NewReputationLookup("https://api.example.com/check", "secret")
+
+	results := make(chan *ReputationResult, 5)
+	lookup := func() { results <- a.lookupReputation(context.Background(), "203.0.113.5") }
+	go lookup()
+	for client.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for range 4 {
+		go lookup()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(client.release)
+
+	for range 5 {
+		if rep := <-results; rep == nil || rep.AbuseConfidenceScore != 50 {
+			t.Errorf("Expected a shared result, got %+v", rep)
+		}
+	}
+	if calls := client.calls.Load(); calls != 1 {
+		t.Errorf("Expected one request for concurrent lookups, got %d", calls)
+	}
+}
+
+// TestParseHeaderBlock tests building a mail.Header from raw header text
+func TestParseHeaderBlock(t *testing.T) {
+	tests := []struct {
+		name        string
+		raw         string
+		expected    mail.Header
+		expectError bool
+	}{
+		{
+			name:     "single header without trailing newline",
+			raw:      "Subject: hello",
+			expected: mail.Header{"Subject": {"hello"}},
+		},
+		{
+			name: "folded header is unfolded",
+			raw:  "Authentication-Results: mx.example.com;\r\n\tspf=pass smtp.mailfrom=example.com;\r\n dkim=pass header.d=example.com\r\n",
+			expected: mail.Header{
+				"Authentication-Results": {"mx.example.com; spf=pass smtp.mailfrom=example.com; dkim=pass header.d=example.com"},
+			},
+		},
+		{
+			name:     "duplicate headers keep order",
+			raw:      "Received: from b by c\nReceived: from a by b\nx-forefront-antispam-report: SCL:1;\n",
+			expected: mail.Header{"Received": {"from b by c", "from a by b"}, "X-Forefront-Antispam-Report": {"SCL:1;"}},
+		},
+		{
+			name:     "body after blank line ignored",
+			raw:      "\nFrom: a@example.com\n\nNot: a header\n",
+			expected: mail.Header{"From": {"a@example.com"}},
+		},
+		{name: "empty", raw: "\r\n", expectError: true},
+		{name: "malformed line", raw: "From: a@example.com\ngarbage\n", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := ParseHeaderBlock(tt.raw)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error, got %v", header)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if fmt.Sprint(header) != fmt.Sprint(tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, header)
+			}
+		})
+	}
+
+	header, err := ParseHeaderBlock("X-Forefront-Antispam-Report: CIP:203.0.113.5;\r\n SCL:6;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := NewAnalyzer().Analyze(header); report.SCL == nil || report.SCL.Score != 6 {
+		t.Errorf("Expected the parsed block to analyze to SCL 6, got %+v", report.SCL)
+	}
+}
+
+// TestSCLCategoryConflict tests the cross-check of a low SCL against a
+// malicious CAT category
+func TestSCLCategoryConflict(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		expected bool
+	}{
+		{name: "SCL 0 with phishing", header: "SCL:0;CAT:PHSH;", expected: true},
+		{name: "SCL 1 with malware", header: "SCL:1;CAT:MALW;", expected: true},
+		{name: "SCL 4 with high confidence spam", header: "SCL:4;CAT:HSPM;", expected: true},
+		{name: "allowlisted high confidence phishing", header: "SCL:-1;SFV:SKA;CAT:HPHSH;", expected: true},
+		{name: "lowercase category", header: "SCL:0;CAT:phsh;", expected: true},
+		{name: "SCL in spam band with phishing", header: "SCL:5;CAT:PHSH;", expected: false},
+		{name: "SCL 9 with malware", header: "SCL:9;CAT:MALW;", expected: false},
+		{name: "low SCL with benign category", header: "SCL:1;CAT:NONE;", expected: false},
+		{name: "low SCL with bulk", header: "SCL:1;CAT:BULK;", expected: false},
+		{name: "no category", header: "SCL:0;", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := mail.Header{"X-Forefront-Antispam-Report": {tt.header}}
+			if got := NewAnalyzer().Analyze(header).SCLCategoryConflict; got != tt.expected {
+				t.Errorf("Expected conflict %v, got %v", tt.expected, got)
+			}
+		})
+	}
+
+	// The spam band follows the profile: SCL 4 is spam under strict
+	if sclCategoryConflict(&SCLResult{Score: 4, CAT: "PHSH"}, sclProfiles["strict"]) {
+		t.Error("Expected no conflict for SCL 4 under the strict profile")
+	}
+	if sclCategoryConflict(nil, sclProfiles["balanced"]) {
+		t.Error("Expected no conflict without an SCL")
+	}
+}
+
+// TestOutputPretty tests that -pretty groups the report into its sections
+func TestOutputPretty(t *testing.T) {
+	email := "From: a@example.com\r\n" +
+		"To: b@example.org\r\n" +
+		"Subject: hi\r\n" +
+		"Received-SPF: pass (example.com: domain of a@example.com designates 198.51.100.7 as permitted sender) client-ip=198.51.100.7;\r\n" +
+		"X-Forefront-Antispam-Report: CIP:203.0.113.5;SFV:SPM;CAT:PHSH;SCL:1;\r\n" +
+		"\r\n" +
+		"Body\r\n"
+	report, err := parseEmail([]byte(email), false)
+	if err != nil {
+		t.Fatalf("parseEmail failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	sink := NewAnalyzer().newResultSink("pretty", &buf, false, false)
+	if err := sink.Write(report); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	out := buf.String()
+
+	last := -1
+	for _, heading := range []string{"Spam Verdict\n", "Authentication\n", "Sender\n", "Routing\n", "Summary\n"} {
+		i := strings.Index(out, heading)
+		if i < 0 {
+			t.Fatalf("Expected section %q in output:\n%s", strings.TrimSpace(heading), out)
+		}
+		if i < last {
+			t.Errorf("Section %q out of order", strings.TrimSpace(heading))
+		}
+		last = i
+	}
+	for _, want := range []string{
+		"  SCL:             1 - ",
+		"    Category:      PHSH",
+		"  SPF:             PASS ✓ (example.com)",
+		"  From:            a@example.com",
+		"  IP:              203.0.113.5",
+		"⚠ SCL 1 looks clean but category PHSH is malicious",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in output:\n%s", want, out)
+		}
+	}
+
+	var plain bytes.Buffer
+	outputText(&plain, report, false, "", sclProfiles["balanced"])
+	if strings.Contains(plain.String(), "Spam Verdict\n") {
+		t.Error("Default text output should keep the compact layout")
+	}
+
+	// With -v the parser diagnostics and timing get their own section
+	report.Diagnostics = []ParserRun{{Parser: "scl", Error: "SCL header present but no valid SCL value"}, {Parser: "spf", Matched: true}}
+	report.ProcessingDuration = 1500 * time.Microsecond
+	buf.Reset()
+	outputPretty(&buf, report, true, "", sclProfiles["balanced"])
+	for _, want := range []string{
+		"Parser Diagnostics\n",
+		"  scl                              no data\n    ⚠ SCL header present but no valid SCL value\n",
+		"  spf                              matched\n",
+		"  processing time                  1.5ms\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected %q in verbose output:\n%s", want, buf.String())
+		}
+	}
+	buf.Reset()
+	outputPretty(&buf, report, false, "", sclProfiles["balanced"])
+	if strings.Contains(buf.String(), "Parser Diagnostics") {
+		t.Error("Diagnostics should only be shown with -v")
+	}
+}
+
+// TestListenUnix tests the one-message-per-connection socket protocol
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "email.sock")
+	ln, err := listenUnixSocket(path)
+	if err != nil {
+		t.Fatalf("listenUnixSocket failed: %v", err)
+	}
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() { done <- listenUnix(ln, *NewAnalyzer(), nil, stop) }()
+
+	exchange := func(message string) map[string]any {
+		t.Helper()
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		defer conn.Close()
+		if _, err := io.WriteString(conn, message); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := conn.(*net.UnixConn).CloseWrite(); err != nil {
+			t.Fatalf("CloseWrite failed: %v", err)
+		}
+		var reply map[string]any
+		if err := json.NewDecoder(conn).Decode(&reply); err != nil {
+			t.Fatalf("Decoding reply failed: %v", err)
+		}
+		return reply
+	}
+
+	reply := exchange("From: a@example.com\r\nSubject: hi\r\nX-Forefront-Antispam-Report: SCL:6;\r\n\r\nBody\r\n")
+	if reply["subject"] != "hi" {
+		t.Errorf("Expected subject hi, got %v", reply["subject"])
+	}
+	if scl, _ := reply["scl"].(map[string]any); scl == nil || scl["score"] != float64(6) {
+		t.Errorf("Expected SCL 6, got %v", reply["scl"])
+	}
+
+	reply = exchange("not a message")
+	if reply["error"] != "failed to parse message" {
+		t.Errorf("Expected a parse error reply, got %v", reply)
+	}
+
+	// A second listener must not steal a live socket
+	if _, err := listenUnixSocket(path); err == nil {
+		t.Error("Expected an error for a socket already in use")
+	}
+
+	close(stop)
+	if err := <-done; err != nil {
+		t.Errorf("listenUnix returned %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket file to be removed, got %v", err)
+	}
+
+	// A regular file in the way is never deleted
+	file := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(file, []byte("x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnixSocket(file); err == nil {
+		t.Error("Expected an error for a path that is not a socket")
+	}
+}
+
+// TestSignalFingerprint tests that campaign signals hash stably and that
+// per-message noise does not change the fingerprint
+func TestSignalFingerprint(t *testing.T) {
+	fingerprint := func(forefront string) string {
+		return signalFingerprint(mail.Header{"X-Forefront-Antispam-Report": {forefront}})
+	}
+
+	base := fingerprint("CIP:203.0.113.5;CTRY:US;SFV:SPM;SFS:(13230040)(4636009)(366016);CAT:PHSH;SCL:9;")
+	if len(base) != 16 {
+		t.Fatalf("Expected a 16 hex digit fingerprint, got %q", base)
+	}
+
+	tests := []struct {
+		name      string
+		forefront string
+		same      bool
+	}{
+		{"same /24, reordered and repeated rules, other tokens", "SCL:5;CAT:phsh;SFS:(366016)(4636009)(13230040)(366016);SFV:spm;CIP:203.0.113.200;CTRY:GB;", true},
+		{"different /24", "CIP:203.0.114.5;SFV:SPM;SFS:(13230040)(4636009)(366016);CAT:PHSH;", false},
+		{"different rule", "CIP:203.0.113.5;SFV:SPM;SFS:(13230040)(4636009);CAT:PHSH;", false},
+		{"different category", "CIP:203.0.113.5;SFV:SPM;SFS:(13230040)(4636009)(366016);CAT:SPM;", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := fingerprint(tt.forefront)
+			if (got == base) != tt.same {
+				t.Errorf("fingerprint %q vs base %q, expected same=%v", got, base, tt.same)
+			}
+		})
+	}
+
+	// The documented recipe reproduces the value
+	sum := sha256.Sum256([]byte("cat=PHSH;sfv=SPM;sfs=366016,4636009,13230040;net=203.0.113.0/24"))
+	if want := hex.EncodeToString(sum[:8]); base != want {
+		t.Errorf("Expected %s from the documented recipe, got %s", want, base)
+	}
+
+	if got := fingerprint("SCL:1;CTRY:US;"); got != "" {
+		t.Errorf("Expected no fingerprint without campaign tokens, got %q", got)
+	}
+	if got := signalFingerprint(mail.Header{}); got != "" {
+		t.Errorf("Expected no fingerprint without a Forefront header, got %q", got)
+	}
+}
+
+// TestParseSpamReport tests the X-Spam-Report rule breakdown in both layouts
+func TestParseSpamReport(t *testing.T) {
+	starList := "Spam detection software, running on the system \"mail.example.com\",\r\n" +
+		"\thas identified this incoming email as possible spam.\r\n" +
+		"\t*  3.5 BAYES_99 BODY: Bayes spam probability is 99 to 100%\r\n" +
+		"\t*      [score: 1.0000]\r\n" +
+		"\t*  1.7 URIBL_BLACK Contains an URL listed in the URIBL blacklist\r\n" +
+		"\t*      [URIs: example.net]\r\n" +
+		"\t* -0.0 SPF_PASS SPF: sender matches SPF record\r\n" +
+		"\t*  0.0 HTML_MESSAGE BODY: HTML included in message"
+	table := "Content analysis details:   (5.2 points, 5.0 required)\r\n" +
+		"\t\r\n" +
+		"\t pts rule name              description\r\n" +
+		"\t---- ---------------------- --------------------------------------------------\r\n" +
+		"\t 3.5 BAYES_99               BODY: Bayes spam probability is 99 to 100%\r\n" +
+		"\t                            [score: 1.0000]\r\n" +
+		"\t 1.7 URIBL_BLACK            Contains an URL listed in the URIBL blacklist\r\n" +
+		"\t                            [URIs: example.net]\r\n" +
+		"\t-0.0 SPF_PASS               SPF: sender matches SPF record\r\n" +
+		"\t 0.0 HTML_MESSAGE           BODY: HTML included in message"
+
+	want := []SpamAssassinRule{
+		{Name: "BAYES_99", Score: 3.5, Description: "BODY: Bayes spam probability is 99 to 100% [score: 1.0000]"},
+		{Name: "URIBL_BLACK", Score: 1.7, Description: "Contains an URL listed in the URIBL blacklist [URIs: example.net]"},
+		{Name: "SPF_PASS", Score: 0, Description: "SPF: sender matches SPF record"},
+		{Name: "HTML_MESSAGE", Score: 0, Description: "BODY: HTML included in message"},
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		want  []SpamAssassinRule
+	}{
+		{"starred list", starList, want},
+		{"aligned table", table, want},
+		{"no rules", "Spam detection software has not identified anything", nil},
+		{"empty", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseSpamReport(tt.value)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parseSpamReport() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+
+	// The report alone is enough to produce a SpamAssassin result
+	result := parseSpamAssassin(mail.Header{"X-Spam-Report": {starList}})
+	if result == nil || len(result.Rules) != 4 {
+		t.Fatalf("Expected 4 rules from X-Spam-Report alone, got %+v", result)
+	}
+}
+
+// TestClassFilterSink tests -only-spam and -only-clean classification
+func TestClassFilterSink(t *testing.T) {
+	reports := []*EmailSecurityReport{
+		{MessageIndex: 1, SCL: &SCLResult{Score: 1}},
+		{MessageIndex: 2, SCL: &SCLResult{Score: 5}},
+		{MessageIndex: 3, SCL: &SCLResult{Score: -1}},
+		{MessageIndex: 4},
+		{MessageIndex: 5, SCL: &SCLResult{Score: 9}},
+	}
+	tests := []struct {
+		name string
+		spam bool
+		want []int
+	}{
+		{"only spam", true, []int{2, 5}},
+		{"only clean", false, []int{1, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collected := &collectingSink{}
+			sink := &classFilterSink{ResultSink: collected, thresholds: sclProfiles["balanced"], spam: tt.spam}
+			for _, report := range reports {
+				if err := sink.Write(report); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var got []int
+			for _, report := range collected.reports {
+				got = append(got, report.MessageIndex)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Expected messages %v, got %v", tt.want, got)
+			}
+			if sink.written != len(tt.want) || sink.filtered != len(reports)-len(tt.want) {
+				t.Errorf("Expected %d written and %d filtered, got %d and %d", len(tt.want), len(reports)-len(tt.want), sink.written, sink.filtered)
+			}
+		})
+	}
+}
+
+// TestRawHeaderValidUTF8 tests that invalid bytes in a header never reach
+// RawHeader, so reports always encode as valid JSON
+func TestRawHeaderValidUTF8(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"Latin-1 bytes", "SCL:5;SRV:;CTRY:DE;LANG:de;PTR:m\xfcnchen.example;H:caf\xe9;"},
+		{"invalid sequences", "SCL:5;H:\xff\xfe\xc3;"},
+		{"multibyte character cut by truncation", "SCL:5;H:x" + strings.Repeat("é", MaxHeaderLength)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, noTruncate := range []bool{false, true} {
+				a := NewAnalyzer()
+				a.NoTruncate = noTruncate
+				result := a.extractSCL(mail.Header{"X-Forefront-Antispam-Report": {tt.value}}, nil)
+				if result == nil {
+					t.Fatal("Expected SCL result")
+				}
+				if !utf8.ValidString(result.RawHeader) {
+					t.Errorf("RawHeader is not valid UTF-8 (noTruncate=%v), ends %q", noTruncate, result.RawHeader[max(0, len(result.RawHeader)-12):])
+				}
+				if !strings.HasPrefix(result.RawHeader, "SCL:5;") {
+					t.Errorf("Expected the valid prefix to be kept, got %q", truncate(result.RawHeader, 40))
+				}
+
+				data, err := json.Marshal(result)
+				if err != nil {
+					t.Fatalf("Marshal failed: %v", err)
+				}
+				var decoded SCLResult
+				if err := json.Unmarshal(data, &decoded); err != nil || decoded.RawHeader != result.RawHeader {
+					t.Errorf("RawHeader did not round-trip through JSON (err=%v)", err)
+				}
+			}
+		})
+	}
+
+	if got := sanitizeHeader("caf\xe9"); got != "caf\uFFFD" {
+		t.Errorf("Expected invalid byte replaced with U+FFFD, got %q", got)
+	}
+}
+
+// TestRedactor tests pattern redaction across nested report fields
+func TestRedactor(t *testing.T) {
+	email := "From: Jane <jane@corp.example>\r\n" +
+		"To: emp-12345@corp.example\r\n" +
+		"Subject: Ticket for EMP-98765 on build01.corp.internal\r\n" +
+		"Received: from build01.corp.internal (build01.corp.internal [10.1.2.3]) by mx.example.org; Mon, 2 Jan 2006 15:04:05 +0000\r\n" +
+		"Authentication-Results: mx.example.org; spf=pass smtp.mailfrom=build01.corp.internal\r\n" +
+		"\r\n" +
+		"Body\r\n"
+	report, err := parseEmail([]byte(email), true)
+	if err != nil {
+		t.Fatalf("parseEmail failed: %v", err)
+	}
+
+	redactor, err := NewRedactor([]string{`(?i)emp-\d+`, `[a-z0-9-]+\.corp\.internal`})
+	if err != nil {
+		t.Fatalf("NewRedactor failed: %v", err)
+	}
+	redactor.Redact(report)
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(data)
+	for _, secret := range []string{"12345", "98765", "build01"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("Expected %q to be redacted from every field", secret)
+		}
+	}
+	if report.Subject != "Ticket for [REDACTED] on [REDACTED]" {
+		t.Errorf("Unexpected subject %q", report.Subject)
+	}
+	if !strings.Contains(out, "jane@corp.example") {
+		t.Error("Expected text not matching any pattern to be kept")
+	}
+
+	// No patterns means no redactor, which is a no-op
+	none, err := NewRedactor(nil)
+	if err != nil || none != nil {
+		t.Fatalf("Expected a nil redactor for no patterns, got %v (err=%v)", none, err)
+	}
+	none.Redact(report)
+
+	for _, pattern := range []string{"", "("} {
+		if _, err := NewRedactor([]string{pattern}); err == nil {
+			t.Errorf("Expected pattern %q to be rejected", pattern)
+		}
+	}
+}
+
+// TestDetectSuspiciousRouting tests hop address scopes and the implausible
+// routing heuristic
+func TestDetectSuspiciousRouting(t *testing.T) {
+	received := func(from, ip, by string) string {
+		return "from " + from + " (" + from + " [" + ip + "]) by " + by + " with ESMTP; Mon, 1 Jan 2024 10:00:00 +0000"
+	}
+	// Relays prepend, so each chain is listed newest first like a real header
+	tests := []struct {
+		name       string
+		received   []string
+		suspicious bool
+	}{
+		{
+			name: "sender LAN, Internet, recipient LAN",
+			received: []string{
+				received("mx.recipient.example", "10.0.0.5", "mbx.recipient.example"),
+				received("out.sender.example", "198.51.100.7", "mx.recipient.example"),
+				received("client.sender.example", "192.168.1.20", "out.sender.example"),
+			},
+		},
+		{
+			name: "local content filter",
+			received: []string{
+				received("localhost", "127.0.0.1", "mx.recipient.example"),
+				received("mx.recipient.example", "127.0.0.1", "localhost"),
+				received("out.sender.example", "198.51.100.7", "mx.recipient.example"),
+			},
+		},
+		{
+			name: "same private hop on both sides of the Internet",
+			received: []string{
+				received("relay.example", "10.1.2.3", "gw.example"),
+				received("gw.example", "198.51.100.7", "mx.example.net"),
+				received("relay.example", "10.1.2.3", "gw.example"),
+			},
+			suspicious: true,
+		},
+		{
+			name: "two organisations numbering a relay 10.0.0.1",
+			received: []string{
+				received("relay.recipient.example", "10.0.0.1", "mbx.recipient.example"),
+				received("out.sender.example", "198.51.100.7", "mx.recipient.example"),
+				received("relay.sender.example", "10.0.0.1", "out.sender.example"),
+			},
+		},
+		{
+			name: "non-routable source",
+			received: []string{
+				received("out.sender.example", "198.51.100.7", "mx.recipient.example"),
+				received("bank.example", "0.0.0.0", "out.sender.example"),
+			},
+			suspicious: true,
+		},
+		{
+			name: "unspecified HELO literal with a public peer",
+			received: []string{
+				received("out.sender.example", "198.51.100.7", "mx.recipient.example"),
+				"from [0.0.0.0] (cpe-1.isp.example [203.0.113.5]) by out.sender.example with ESMTP; Mon, 1 Jan 2024 10:00:00 +0000",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hops, _ := parseReceivedChain(mail.Header{"Received": tt.received}, nil, nil)
+			explanation := detectSuspiciousRouting(hops)
+			if (explanation != "") != tt.suspicious {
+				t.Errorf("Expected suspicious=%v, got %q", tt.suspicious, explanation)
+			}
+		})
+	}
+
+	hops, _ := parseReceivedChain(mail.Header{"Received": {
+		"from [0.0.0.0] (cpe-1.isp.example [203.0.113.5]) by BN8PR12MB.namprd12.prod.example; Mon, 1 Jan 2024 10:00:00 +0000",
+		"from BN8PR12MB.namprd12.prod.example (2603:10b6:408:1::15) by BN6PR.prod.example with HTTPS; Mon, 1 Jan 2024 10:00:00 +0000",
+		"from [IPv6:fd00::1] (helo=client) by relay.example; Mon, 1 Jan 2024 10:00:00 +0000",
+		"from mail.example ([100.64.1.1]) by relay.example (Postfix [192.0.2.1]); Mon, 1 Jan 2024 10:00:00 +0000",
+		"from unknown by relay.example; Mon, 1 Jan 2024 10:00:00 +0000",
+	}}, nil, nil)
+	want := [][2]string{{"", ""}, {"100.64.1.1", ScopePrivate}, {"fd00::1", ScopePrivate}, {"2603:10b6:408:1::15", ScopePublic}, {"203.0.113.5", ScopePublic}}
+	for i, hop := range hops {
+		if hop.FromIP != want[i][0] || hop.FromIPScope != want[i][1] {
+			t.Errorf("Hop %d: expected %v, got %q %q", i+1, want[i], hop.FromIP, hop.FromIPScope)
+		}
+	}
+}
+
+// TestDateAnomaly tests the Date header comparison with delivery time
+func TestDateAnomaly(t *testing.T) {
+	seconds := func(n int64) *int64 { return &n }
+	received := "Received: from relay.example.net by mx.example.com; Mon, 1 Jan 2024 12:00:00 +0000\r\n"
+	tests := []struct {
+		name        string
+		headers     string
+		wantSkew    *int64
+		wantAnomaly bool
+	}{
+		{"on time", "Date: Mon, 1 Jan 2024 11:59:30 +0000\r\n" + received, seconds(-30), false},
+		{"named zone within threshold", "Date: Mon, 1 Jan 2024 07:00:00 EST\r\n" + received, seconds(0), false},
+		{"future-dated", "Date: Thu, 4 Jan 2024 12:00:00 +0000\r\n" + received, seconds(3 * 24 * 3600), true},
+		{"stale", "Date: Fri, 1 Dec 2023 12:00:00 +0000\r\n" + received, seconds(-31 * 24 * 3600), true},
+		{"missing Date", received, nil, false},
+		{"unparseable Date", "Date: yesterday\r\n" + received, nil, false},
+		{"missing Received", "Date: Thu, 4 Jan 2024 12:00:00 +0000\r\n", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := NewAnalyzer().AnalyzeMessage([]byte("From: a@example.com\r\n" + tt.headers + "\r\nBody\r\n"))
+			if err != nil {
+				t.Fatalf("AnalyzeMessage failed: %v", err)
+			}
+			if (report.DateSkewSeconds == nil) != (tt.wantSkew == nil) || (tt.wantSkew != nil && *report.DateSkewSeconds != *tt.wantSkew) {
+				t.Errorf("Expected skew %v, got %v", tt.wantSkew, report.DateSkewSeconds)
+			}
+			if report.DateAnomaly != tt.wantAnomaly {
+				t.Errorf("Expected anomaly %v, got %v", tt.wantAnomaly, report.DateAnomaly)
+			}
+		})
+	}
+
+	// A zero threshold disables the flag but still reports the skew
+	a := NewAnalyzer()
+	a.MaxDateSkew = 0
+	report, err := a.AnalyzeMessage([]byte("From: a@example.com\r\nDate: Thu, 4 Jan 2024 12:00:00 +0000\r\n" + received + "\r\nBody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.DateAnomaly || report.DateSkewSeconds == nil {
+		t.Errorf("Expected skew without anomaly, got %v %v", report.DateSkewSeconds, report.DateAnomaly)
+	}
+}
+
+// TestGroupingSink tests -group-by keys, ordering and output formats
+func TestGroupingSink(t *testing.T) {
+	reports := []*EmailSecurityReport{
+		{From: "a@example.com", SenderIP: &SenderIP{IP: "203.0.113.5"}, SenderCountry: "US", SCL: &SCLResult{Score: 1}},
+		{From: "b@mail.example.com", SenderIP: &SenderIP{IP: "203.0.113.200"}, SenderCountry: "US", SCL: &SCLResult{Score: 9}},
+		{From: "c@example.org", SenderIP: &SenderIP{IP: "198.51.100.1"}, SCL: &SCLResult{Score: 5}},
+		{From: "d@example.org"},
+	}
+	tests := []struct {
+		key  string
+		want []string // group:total, in output order
+	}{
+		{"from-domain", []string{"example.org:2", "example.com:1", "mail.example.com:1"}},
+		{"cip-net", []string{"203.0.113.0/24:2", "(none):1", "198.51.100.0/24:1"}},
+		{"country", []string{"(none):2", "US:2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			sink := newGroupingSink(io.Discard, "text", tt.key, sclProfiles["balanced"])
+			for _, report := range reports {
+				if err := sink.Write(report); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var got []string
+			for _, g := range sink.summary().Groups {
+				got = append(got, g.Group+":"+strconv.Itoa(g.Counts.Total))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Expected groups %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	sink := newGroupingSink(&buf, "json", "country", sclProfiles["balanced"])
+	for _, report := range reports {
+		sink.Write(report)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var summary GroupedSummary
+	if err := json.Unmarshal(buf.Bytes(), &summary); err != nil {
+		t.Fatalf("Invalid JSON: %v\n%s", err, buf.String())
+	}
+	us := summary.Groups[1]
+	if summary.GroupBy != "country" || us.Group != "US" || us.Counts.NotSpam != 1 || us.Counts.HighConfidence != 1 {
+		t.Errorf("Unexpected summary %+v", summary)
+	}
+
+	buf.Reset()
+	sink = newGroupingSink(&buf, "csv", "country", sclProfiles["balanced"])
+	sink.Write(reports[0])
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "country,total,skipped,not_spam,low_spam,spam,high_confidence,no_scl\nUS,1,0,1,0,0,0,0\n"; buf.String() != want {
+		t.Errorf("Expected CSV %q, got %q", want, buf.String())
+	}
+}
+
+// TestZipPassword tests reading messages from encrypted zip archives
+func TestZipPassword(t *testing.T) {
+	dir := t.TempDir()
+	message := "From: a@example.com\r\nSubject: quarantined\r\nX-Forefront-Antispam-Report: SCL:7;\r\n\r\nbody\r\n"
+	writeZip := func(name string, enc zip.EncryptionMethod) string {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		var w io.Writer
+		var err error
+		if enc == 0 {
+			w, err = zw.Create("sample.eml")
+		} else {
+			w, err = zw.Encrypt("sample.eml", "infected", enc)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, message); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	plain := writeZip("plain.zip", 0)
+	zipCrypto := writeZip("zipcrypto.zip", zip.StandardEncryption)
+	aes := writeZip("aes.zip", zip.AES256Encryption)
+
+	tests := []struct {
+		name     string
+		file     string
+		password string
+		wantErr  string
+	}{
+		{"unencrypted", plain, "", ""},
+		{"unencrypted ignores password", plain, "infected", ""},
+		{"zipcrypto", zipCrypto, "infected", ""},
+		{"aes", aes, "infected", ""},
+		{"zipcrypto wrong password", zipCrypto, "wrong", "Wrong -zip-password for the encrypted archive."},
+		{"aes wrong password", aes, "wrong", "Wrong -zip-password for the encrypted archive."},
+		{"missing password", aes, "", "The archive is encrypted; pass its password with -zip-password."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := *defaultAnalyzer
+			a.ZipPassword = tt.password
+			report, err := a.AnalyzeFile(tt.file)
+			if tt.wantErr != "" {
+				if err == nil {
+					t.Fatalf("Expected an error, got report %q", report.Subject)
+				}
+				if got := describeZipPasswordError(err); got != tt.wantErr {
+					t.Errorf("describeZipPasswordError() = %q, want %q (err %v)", got, tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AnalyzeFile failed: %v", err)
+			}
+			if report.Subject != "quarantined" || report.SCL == nil || report.SCL.Score != 7 {
+				t.Errorf("Expected the archived message, got subject %q", report.Subject)
+			}
+		})
+	}
+
+	if got := describeZipPasswordError(fmt.Errorf("failed to open ZIP archive")); got != "" {
+		t.Errorf("Expected no password explanation for other errors, got %q", got)
+	}
+}
+
+// TestJSONArraySink tests the single-array JSON batch output
+func TestJSONArraySink(t *testing.T) {
+	tests := []struct {
+		name     string
+		subjects []string
+		compact  bool
+	}{
+		{"empty batch", nil, false},
+		{"empty batch compact", nil, true},
+		{"two reports", []string{"one", "two"}, false},
+		{"two reports compact", []string{"one", "two"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			sink := NewAnalyzer().newResultSink("json-array", &buf, false, tt.compact)
+			for _, subject := range tt.subjects {
+				if err := sink.Write(&EmailSecurityReport{Subject: subject}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if buf.Len() != 0 {
+				t.Fatalf("Expected no output before Close, got %q", buf.String())
+			}
+			if err := sink.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var reports []EmailSecurityReport
+			if err := json.Unmarshal(buf.Bytes(), &reports); err != nil {
+				t.Fatalf("Expected one valid JSON array, got %q: %v", buf.String(), err)
+			}
+			if len(tt.subjects) == 0 && strings.TrimSpace(buf.String()) != "[]" {
+				t.Errorf("Expected [] for an empty batch, got %q", buf.String())
+			}
+			if len(reports) != len(tt.subjects) {
+				t.Fatalf("Expected %d reports, got %d", len(tt.subjects), len(reports))
+			}
+			for i, subject := range tt.subjects {
+				if reports[i].Subject != subject {
+					t.Errorf("Report %d subject = %q, want %q", i, reports[i].Subject, subject)
+				}
+			}
+			if lines := strings.Count(strings.TrimSpace(buf.String()), "\n"); tt.compact && lines != 0 {
+				t.Errorf("Expected a single line with -compact, got %d line breaks", lines)
+			}
+		})
+	}
+}
+
+// TestSPFConsensus tests reconciling SPF assertions across headers
+func TestSPFConsensus(t *testing.T) {
+	tests := []struct {
+		name       string
+		headers    map[string][]string
+		expectNil  bool
+		result     string
+		source     string
+		agreeing   int
+		assertions int
+		dissenting []string
+	}{
+		{
+			name:      "no SPF anywhere",
+			headers:   map[string][]string{"Subject": {"hi"}},
+			expectNil: true,
+		},
+		{
+			name: "all agree",
+			headers: map[string][]string{
+				"Received-Spf":           {"pass (mx.example.net: domain of a@example.com designates 192.0.2.1 as permitted sender)"},
+				"Authentication-Results": {"mx.example.net; spf=pass smtp.mailfrom=example.com"},
+			},
+			result: "pass", source: "authentication-results", agreeing: 2, assertions: 2,
+		},
+		{
+			name: "tie goes to Authentication-Results",
+			headers: map[string][]string{
+				"Received-Spf":           {"softfail (mx.example.net: domain of transitioning a@example.com does not designate 192.0.2.1 as permitted sender)"},
+				"Authentication-Results": {"mx.example.net; spf=pass smtp.mailfrom=example.com"},
+			},
+			result: "pass", source: "authentication-results", agreeing: 1, assertions: 2,
+			dissenting: []string{"received-spf:softfail"},
+		},
+		{
+			name: "ARC majority outvotes the top header",
+			headers: map[string][]string{
+				"Authentication-Results": {"mx.example.net; spf=fail smtp.mailfrom=example.com"},
+				"Arc-Authentication-Results": {
+					"i=1; relay.example.org; spf=pass smtp.mailfrom=example.com",
+					"i=2; list.example.org; spf=pass smtp.mailfrom=example.com",
+				},
+			},
+			result: "pass", source: "arc-authentication-results (i=2)", agreeing: 2, assertions: 3,
+			dissenting: []string{"authentication-results:fail"},
+		},
+		{
+			name: "ARC only",
+			headers: map[string][]string{
+				"Arc-Authentication-Results": {"i=1; relay.example.org; spf=neutral smtp.mailfrom=example.com"},
+			},
+			result: "neutral", source: "arc-authentication-results (i=1)", agreeing: 1, assertions: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(mail.Header)
+			for key, values := range tt.headers {
+				header[key] = append(header[key], values...)
+			}
+
+			got := spfConsensus(extractSPFResults(header, nil), header)
+			if tt.expectNil {
+				if got != nil {
+					t.Errorf("Expected nil, got %+v", got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatal("Expected a consensus, got nil")
+			}
+			if got.Result != tt.result || got.Source != tt.source || got.Agreeing != tt.agreeing || got.Assertions != tt.assertions {
+				t.Errorf("Expected %s from %s (%d of %d), got %s from %s (%d of %d)",
+					tt.result, tt.source, tt.agreeing, tt.assertions, got.Result, got.Source, got.Agreeing, got.Assertions)
+			}
+			var dissenting []string
+			for _, d := range got.Dissenting {
+				dissenting = append(dissenting, d.Source+":"+d.Result)
+			}
+			if !slices.Equal(dissenting, tt.dissenting) {
+				t.Errorf("Expected dissenting %v, got %v", tt.dissenting, dissenting)
+			}
+		})
+	}
+}
+
+// TestDirWalk tests recursive directory expansion, depth limits and symlinks
+func TestDirWalk(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	writeTestEmail(t, root, "a.eml", "")
+	sub := filepath.Join(root, "sub")
+	deep := filepath.Join(sub, "deep")
+	if err := os.MkdirAll(deep, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestEmail(t, sub, "b.eml", "")
+	writeTestEmail(t, deep, "c.eml", "")
+	target := writeTestEmail(t, outside, "x.eml", "")
+	if err := os.Symlink(target, filepath.Join(root, "f.eml")); err != nil {
+		t.Skipf("Symlinks unsupported: %v", err)
+	}
+	// A link back to the root would loop forever if followed blindly
+	if err := os.Symlink(root, filepath.Join(sub, "loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	rel := func(files []string) []string {
+		var names []string
+		for _, f := range files {
+			name, _ := filepath.Rel(root, f)
+			names = append(names, filepath.ToSlash(name))
+		}
+		return names
+	}
+
+	tests := []struct {
+		name    string
+		walk    dirWalk
+		files   []string
+		tooDeep int
+		loops   int
+	}{
+		{"top level only", dirWalk{}, []string{"a.eml"}, 0, 0},
+		{"recursive", dirWalk{recursive: true, maxDepth: DefaultMaxDepth}, []string{"a.eml", "sub/b.eml", "sub/deep/c.eml"}, 0, 0},
+		{"depth limit", dirWalk{recursive: true, maxDepth: 1}, []string{"a.eml", "sub/b.eml"}, 1, 0},
+		{"depth zero", dirWalk{recursive: true}, []string{"a.eml"}, 1, 0},
+		{"follow symlinks", dirWalk{followSymlinks: true}, []string{"a.eml", "f.eml"}, 0, 0},
+		{
+			"recursive through a symlink loop",
+			dirWalk{recursive: true, maxDepth: DefaultMaxDepth, followSymlinks: true},
+			[]string{"a.eml", "f.eml", "sub/b.eml", "sub/deep/c.eml"}, 0, 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			walk := tt.walk
+			files, isDir, err := collectInputFiles(root, "", &walk)
+			if err != nil || !isDir {
+				t.Fatalf("collectInputFiles failed: dir=%v err=%v", isDir, err)
+			}
+			if got := rel(files); !slices.Equal(got, tt.files) {
+				t.Errorf("Expected files %v, got %v", tt.files, got)
+			}
+			if walk.tooDeep != tt.tooDeep || walk.loops != tt.loops {
+				t.Errorf("Expected %d too deep and %d loops, got %d and %d", tt.tooDeep, tt.loops, walk.tooDeep, walk.loops)
+			}
+		})
+	}
+}
+
+// recordingTracer records every span started through it
+type recordingTracer struct {
+	noop.Tracer
+	spans []*recordedSpan
+}
+
+// recordedSpan keeps what was set on a span for inspection
+type recordedSpan struct {
+	noop.Span
+	name   string
+	parent *recordedSpan
+	attrs  map[attribute.Key]attribute.Value
+	status codes.Code
+	ended  bool
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	span := &recordedSpan{name: name, attrs: make(map[attribute.Key]attribute.Value)}
+	span.parent, _ = trace.SpanFromContext(ctx).(*recordedSpan)
+	config := trace.NewSpanStartConfig(opts...)
+	span.SetAttributes(config.Attributes()...)
+	t.spans = append(t.spans, span)
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+func (s *recordedSpan) IsRecording() bool { return true }
+
+func (s *recordedSpan) SetAttributes(kv ...attribute.KeyValue) {
+	for _, attr := range kv {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *recordedSpan) SetStatus(code codes.Code, _ string) { s.status = code }
+
+func (s *recordedSpan) End(...trace.SpanEndOption) { s.ended = true }
+
+// TestTracing tests the analysis and enrichment spans and that tracing is
+// off without a Tracer
+func TestTracing(t *testing.T) {
+	header := mail.Header{"X-Forefront-Antispam-Report": {"CIP:203.0.113.5;SCL:7;"}}
+	newAnalyzer := func(client *stubHTTPClient) *Analyzer {
+		lookup, err := NewReputationLookup("https://api.example.com/check", "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := NewAnalyzer()
+		a.HTTPClient = client
+		a.Reputation = lookup
+		a.Limiter = nil
+		return a
+	}
+
+	tracer := &recordingTracer{}
+	a := newAnalyzer(&stubHTTPClient{status: 200, body: `{"data": {"abuseConfidenceScore": 10}}`})
+	a.Tracer = tracer
+	parentCtx, parent := tracer.Start(context.Background(), "request")
+	a.AnalyzeContext(parentCtx, header)
+
+	if len(tracer.spans) != 3 {
+		t.Fatalf("Expected request, analysis and lookup spans, got %d", len(tracer.spans))
+	}
+	analysis, lookup := tracer.spans[1], tracer.spans[2]
+	if analysis.name != "email.Analyze" || analysis.parent != parent || !analysis.ended {
+		t.Errorf("Expected an ended email.Analyze span under the caller's span, got %+v", analysis)
+	}
+	if analysis.attrs["email.scl"].AsInt64() != 7 || analysis.attrs["email.verdict"].AsString() == "" {
+		t.Errorf("Expected SCL and verdict attributes, got %v", analysis.attrs)
+	}
+	if lookup.name != "email.lookupReputation" || lookup.parent != analysis || !lookup.ended {
+		t.Errorf("Expected an ended lookup span under the analysis span, got %+v", lookup)
+	}
+	if lookup.attrs["net.peer.ip"].AsString() != "203.0.113.5" || lookup.status != codes.Unset {
+		t.Errorf("Unexpected lookup span attributes %v, status %v", lookup.attrs, lookup.status)
+	}
+	if parent.(*recordedSpan).ended {
+		t.Error("Expected the caller's span to be left open")
+	}
+
+	// A failed lookup marks its span as an error
+	tracer.spans = nil
+	a.HTTPClient = &stubHTTPClient{status: 503}
+	a.lookupReputation(context.Background(), "198.51.100.9")
+	if len(tracer.spans) != 1 || tracer.spans[0].status != codes.Error {
+		t.Errorf("Expected one errored lookup span, got %+v", tracer.spans)
+	}
+
+	// Without a Tracer nothing is recorded and the caller's span is untouched
+	untraced := newAnalyzer(&stubHTTPClient{status: 200, body: `{"data": {"abuseConfidenceScore": 10}}`})
+	caller := &recordedSpan{attrs: make(map[attribute.Key]attribute.Value)}
+	if report := untraced.AnalyzeContext(trace.ContextWithSpan(context.Background(), caller), header); report.SCL == nil || report.SCL.Score != 7 {
+		t.Fatalf("Expected an untraced analysis, got %+v", report.SCL)
+	}
+	if caller.ended || len(caller.attrs) != 0 {
+		t.Errorf("Expected the caller's span untouched without a Tracer, got %+v", caller)
+	}
+	if _, span := untraced.startSpan(context.Background(), "noop"); span.IsRecording() {
+		t.Error("Expected a no-op span without a Tracer")
+	}
+}
+
+// TestParseSenderID tests the legacy Sender-ID headers
+func TestParseSenderID(t *testing.T) {
+	tests := []struct {
+		name      string
+		headers   map[string]string
+		expectNil bool
+		expected  SenderIDResult
+	}{
+		{name: "modern message", headers: map[string]string{"Authentication-Results": "mx.example.net; spf=pass"}, expectNil: true},
+		{
+			name:     "pass with display name",
+			headers:  map[string]string{"X-Sid-Pra": "Alice <alice@example.com>", "X-Sid-Result": "Pass"},
+			expected: SenderIDResult{PRA: "alice@example.com", Result: "pass"},
+		},
+		{
+			name:     "result with comment",
+			headers:  map[string]string{"X-Sid-Pra": "bounce@example.org", "X-Sid-Result": "SoftFail (transitioning)"},
+			expected: SenderIDResult{PRA: "bounce@example.org", Result: "softfail"},
+		},
+		{
+			name:     "PRA only",
+			headers:  map[string]string{"X-Sid-Pra": "alice@example.com"},
+			expected: SenderIDResult{PRA: "alice@example.com"},
+		},
+		{
+			name:     "unknown result dropped",
+			headers:  map[string]string{"X-Sid-Pra": "alice@example.com", "X-Sid-Result": "Maybe"},
+			expected: SenderIDResult{PRA: "alice@example.com"},
+		},
+		{name: "only an unknown result", headers: map[string]string{"X-Sid-Result": "Maybe"}, expectNil: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(mail.Header)
+			for k, v := range tt.headers {
+				header[k] = []string{v}
+			}
+			result := parseSenderID(header, nil)
+			if tt.expectNil {
+				if result != nil {
+					t.Errorf("Expected nil, got %+v", result)
+				}
+				return
+			}
+			if result == nil || *result != tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, result)
+			}
+		})
+	}
+}
+
+// TestNormalizeReport tests -normalize-output canonicalization
+func TestNormalizeReport(t *testing.T) {
+	report := &EmailSecurityReport{
+		Subject:          " Mixed Case ",
+		SPFResults:       []SPFResult{{Result: "Pass", Domain: " EXAMPLE.COM. ", Explanation: "Designates IP"}},
+		DKIMResults:      []DKIMResult{{Result: "PASS", Domain: "Mail.Example.com", HeaderD: "Mail.Example.com", Selector: "Sel1"}},
+		DMARCResults:     []DMARCResult{{Result: "Fail", Policy: "Reject", Disposition: "Quarantine ", SPFAlignment: "PASS", Domain: "Example.COM"}},
+		AuthResults:      []AuthResult{{AuthServID: "MX.Example.net", Methods: []AuthMethod{{Method: "SPF", Result: "Pass"}}}},
+		ARCResults:       []ARCResult{{Instance: 1, Result: "Pass", Chain: "None"}},
+		SPFConsensus:     &SPFConsensus{Result: "Pass", Dissenting: []SPFAssertion{{Source: "received-spf", Result: "SoftFail", Domain: "Example.com"}}},
+		SenderID:         &SenderIDResult{PRA: "Alice@Example.com", Result: "pass"},
+		ReturnPathDomain: "Bounces.Example.com",
+		Thread:           &ThreadInfo{ThreadDomains: []string{"Example.ORG"}},
+		ReceivedChain:    []ReceivedHop{{From: "MAIL.example.com.", By: "MX.Example.net"}},
+		SenderCountry:    " de",
+	}
+	normalizeReport(report)
+
+	checks := []struct {
+		field, got, want string
+	}{
+		{"spf result", report.SPFResults[0].Result, "pass"},
+		{"spf domain", report.SPFResults[0].Domain, "example.com"},
+		{"spf explanation kept", report.SPFResults[0].Explanation, "Designates IP"},
+		{"dkim result", report.DKIMResults[0].Result, "pass"},
+		{"dkim domain", report.DKIMResults[0].Domain, "mail.example.com"},
+		{"dkim d=", report.DKIMResults[0].HeaderD, "mail.example.com"},
+		{"dkim selector kept", report.DKIMResults[0].Selector, "Sel1"},
+		{"dmarc result", report.DMARCResults[0].Result, "fail"},
+		{"dmarc policy", report.DMARCResults[0].Policy, "reject"},
+		{"dmarc disposition", report.DMARCResults[0].Disposition, "quarantine"},
+		{"dmarc alignment", report.DMARCResults[0].SPFAlignment, "pass"},
+		{"dmarc domain", report.DMARCResults[0].Domain, "example.com"},
+		{"auth method", report.AuthResults[0].Methods[0].Method, "spf"},
+		{"auth result", report.AuthResults[0].Methods[0].Result, "pass"},
+		{"arc chain", report.ARCResults[0].Chain, "none"},
+		{"consensus", report.SPFConsensus.Result, "pass"},
+		{"dissent", report.SPFConsensus.Dissenting[0].Result, "softfail"},
+		{"sender-id PRA kept", report.SenderID.PRA, "Alice@Example.com"},
+		{"return path", report.ReturnPathDomain, "bounces.example.com"},
+		{"thread domain", report.Thread.ThreadDomains[0], "example.org"},
+		{"hop from", report.ReceivedChain[0].From, "mail.example.com"},
+		{"hop by", report.ReceivedChain[0].By, "mx.example.net"},
+		{"country", report.SenderCountry, "DE"},
+		{"subject kept", report.Subject, " Mixed Case "},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s: got %q, want %q", c.field, c.got, c.want)
+		}
+	}
+
+	// The Analyzer applies it only when asked
+	header := mail.Header{"Received": {"from relay.example.org by MX.Example.NET; Mon, 1 Jan 2024 00:00:00 +0000"}}
+	a := NewAnalyzer()
+	if chain := a.Analyze(header).ReceivedChain; len(chain) != 1 || chain[0].By != "MX.Example.NET" {
+		t.Errorf("Expected values untouched by default, got %+v", chain)
+	}
+	a.Normalize = true
+	if chain := a.Analyze(header).ReceivedChain; len(chain) != 1 || chain[0].By != "mx.example.net" {
+		t.Errorf("Expected a normalized host, got %+v", chain)
+	}
+}
+
+// TestProcessingDuration tests per-message timing and its batch total
+func TestProcessingDuration(t *testing.T) {
+	data := []byte("From: a@example.com\r\nSubject: timed\r\nX-Forefront-Antispam-Report: SCL:1;\r\n\r\nbody\r\n")
+
+	a := NewAnalyzer()
+	report, err := a.AnalyzeMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ProcessingDuration != 0 {
+		t.Errorf("Expected no timing without Diagnostics, got %s", report.ProcessingDuration)
+	}
+	var buf bytes.Buffer
+	if err := outputJSON(&buf, report, true); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "processing_duration_ns") {
+		t.Error("Expected default JSON to omit the timing")
+	}
+
+	a.Diagnostics = true
+	entryPoints := map[string]func() (*EmailSecurityReport, error){
+		"AnalyzeMessage": func() (*EmailSecurityReport, error) { return a.AnalyzeMessage(data) },
+		"AnalyzeReader":  func() (*EmailSecurityReport, error) { return a.AnalyzeReader(bytes.NewReader(data)) },
+		"AnalyzeHeaderJSON": func() (*EmailSecurityReport, error) {
+			return a.AnalyzeHeaderJSON([]byte(`{"Subject": ["timed"]}`))
+		},
+		"Analyze": func() (*EmailSecurityReport, error) { return a.Analyze(mail.Header{"Subject": {"timed"}}), nil },
+	}
+	for name, analyze := range entryPoints {
+		report, err := analyze()
+		if err != nil {
+			t.Fatalf("%s failed: %v", name, err)
+		}
+		if report.ProcessingDuration <= 0 {
+			t.Errorf("%s: expected a processing duration with Diagnostics", name)
+		}
+	}
+
+	bands := &bandCountingSink{ResultSink: &collectingSink{}, thresholds: sclProfiles["balanced"]}
+	for _, d := range []time.Duration{2 * time.Millisecond, 4 * time.Millisecond} {
+		if err := bands.Write(&EmailSecurityReport{ProcessingDuration: d}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bands.processing != 6*time.Millisecond {
+		t.Errorf("Expected a 6ms total, got %s", bands.processing)
+	}
+}
+
+func TestDecodeHeaderValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"plain ASCII", "CIP:192.0.2.1;CTRY:US;SCL:1;", "CIP:192.0.2.1;CTRY:US;SCL:1;"},
+		{"literal equals left alone", "SFS:(a=b);SCL:2;", "SFS:(a=b);SCL:2;"},
+		{"bare quoted-printable", "CIP=3A192.0.2.1=3BCTRY=3AUS=3BSCL=3A5=3B", "CIP:192.0.2.1;CTRY:US;SCL:5;"},
+		{"Q encoded-word", "=?utf-8?Q?CTRY=3ADE=3BSCL=3A6=3B?=", "CTRY:DE;SCL:6;"},
+		{"B encoded-word", "=?utf-8?B?U0NMOjc7?=", "SCL:7;"},
+		{"decoded once", "=?utf-8?Q?SCL=3A1=3B_note=3D3A?=", "SCL:1; note=3A"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decodeHeaderValue(tt.value); got != tt.want {
+				t.Errorf("decodeHeaderValue(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+
+	data := []byte("From: a@example.com\r\nX-Forefront-Antispam-Report: CIP=3A192.0.2.1=3BCTRY=3Afr=3BSCL=3A5=3B\r\n\r\nbody\r\n")
+	report, err := NewAnalyzer().AnalyzeMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.SCL == nil || report.SCL.Score != 5 {
+		t.Fatalf("Expected SCL 5 from a quoted-printable Forefront header, got %+v", report.SCL)
+	}
+}
+
+func TestReadInputList(t *testing.T) {
+	list := "# quarantine export\n/data/a.eml\n\n   \n  /data/b c.msg  \n#/data/skipped.eml\n/data/with#hash.eml\n"
+	got, err := readInputList(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/data/a.eml", "/data/b c.msg", "/data/with#hash.eml"}
+	if !slices.Equal(got, want) {
+		t.Errorf("readInputList() = %q, want %q", got, want)
+	}
+
+	got, err = readInputList(strings.NewReader("# nothing here\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("Expected no paths from a comment-only list, got %q", got)
+	}
+
+	// A missing entry fails alone; the rest of the list is still collected
+	dir := t.TempDir()
+	present := filepath.Join(dir, "present.eml")
+	if err := os.WriteFile(present, []byte("Subject: x\r\n\r\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	files, _, failed := collectInputs([]string{filepath.Join(dir, "missing.eml"), present}, "", &dirWalk{})
+	if failed != 1 || !slices.Equal(files, []string{present}) {
+		t.Errorf("Expected one failure and %q, got %d and %q", present, failed, files)
+	}
+}
+
+func TestCountryName(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"US", "United States"},
+		{"RU", "Russian Federation"},
+		{"CN", "China"},
+		{"TW", "Taiwan"},
+		{"XX", "Unknown"},
+		{"", ""},
+		{"QQ", ""},
+	}
+	for _, tt := range tests {
+		if got := countryName(tt.code); got != tt.want {
+			t.Errorf("countryName(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+
+	for token, want := range map[string]string{"CTRY:ru;": "Russian Federation", "CTRY:XX;": "Unknown", "CTRY:;": ""} {
+		report := NewAnalyzer().Analyze(mail.Header{"X-Forefront-Antispam-Report": {token + "SCL:1;"}})
+		if report.CountryName != want {
+			t.Errorf("%s: CountryName = %q, want %q", token, report.CountryName, want)
+		}
+	}
+}
+
+func TestSampleFiles(t *testing.T) {
+	var files []string
+	for i := range 100 {
+		files = append(files, fmt.Sprintf("msg%03d.eml", i))
+	}
+
+	sample := sampleFiles(files, 10, 0, 42)
+	if len(sample) != 10 {
+		t.Fatalf("Expected 10 files, got %d", len(sample))
+	}
+	if !slices.IsSorted(sample) {
+		t.Errorf("Expected the sample to keep input order, got %q", sample)
+	}
+	if again := sampleFiles(files, 10, 0, 42); !slices.Equal(sample, again) {
+		t.Errorf("Expected the same seed to pick the same files, got %q and %q", sample, again)
+	}
+	if other := sampleFiles(files, 10, 0, 43); slices.Equal(sample, other) {
+		t.Error("Expected a different seed to pick different files")
+	}
+
+	tests := []struct {
+		name    string
+		n       int
+		percent float64
+		total   int
+		want    int
+	}{
+		{"percent", 0, 25, 100, 25},
+		{"percent rounds up", 0, 1, 10, 1},
+		{"whole input", 0, 100, 100, 100},
+		{"larger than input", 500, 0, 100, 100},
+		{"empty input", 5, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sampleFiles(files[:tt.total], tt.n, tt.percent, 1); len(got) != tt.want {
+				t.Errorf("Expected %d files, got %d", tt.want, len(got))
+			}
+		})
+	}
+}
+
+func TestCountRecipients(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  mail.Header
+		want    *RecipientCount
+		maxRcpt int
+	}{
+		{"no recipients", mail.Header{"Subject": {"x"}}, nil, DefaultMaxRecipients},
+		{
+			"to and cc",
+			mail.Header{"To": {`"Doe, Jane" <jane@example.com>, bob@example.com`}, "Cc": {"carol@example.com"}},
+			&RecipientCount{To: 2, Cc: 1, Total: 3},
+			DefaultMaxRecipients,
+		},
+		{
+			"group syntax",
+			mail.Header{"To": {"undisclosed-recipients:;"}},
+			&RecipientCount{},
+			DefaultMaxRecipients,
+		},
+		{
+			"malformed entries counted separately",
+			mail.Header{"To": {`a@example.com, not an address, "Smith, Bo" <bo@example.com>`}},
+			&RecipientCount{To: 2, Total: 2, ParseErrors: []string{"not an address"}},
+			DefaultMaxRecipients,
+		},
+		{
+			"above threshold",
+			mail.Header{"Cc": {"a@example.com, b@example.com, c@example.com"}},
+			&RecipientCount{Cc: 3, Total: 3, Excessive: true},
+			2,
+		},
+		{
+			"threshold disabled",
+			mail.Header{"Cc": {"a@example.com, b@example.com, c@example.com"}},
+			&RecipientCount{Cc: 3, Total: 3},
+			0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAnalyzer()
+			a.MaxRecipients = tt.maxRcpt
+			got := a.Analyze(tt.header).Recipients
+			if tt.want == nil {
+				if got != nil {
+					t.Errorf("Expected no recipient count, got %+v", got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatal("Expected a recipient count, got nil")
+			}
+			if got.To != tt.want.To || got.Cc != tt.want.Cc || got.Total != tt.want.Total || got.Excessive != tt.want.Excessive {
+				t.Errorf("Expected %+v, got %+v", tt.want, got)
+			}
+			if !slices.Equal(got.ParseErrors, tt.want.ParseErrors) {
+				t.Errorf("Expected parse errors %q, got %q", tt.want.ParseErrors, got.ParseErrors)
+			}
+		})
+	}
+}
+
+func TestStrictMIME(t *testing.T) {
+	const head = "From: a@example.com\r\nSubject: mime\r\nMIME-Version: 1.0\r\n"
+	tests := []struct {
+		name      string
+		message   string
+		wantError string
+	}{
+		{
+			"well-formed",
+			head + "Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: text/plain\r\n\r\nhi\r\n" +
+				"--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=a.pdf\r\nContent-Transfer-Encoding: base64\r\n\r\nJVBERi0=\r\n--b--\r\n",
+			"",
+		},
+		{
+			"unterminated boundary",
+			head + "Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: text/plain\r\n\r\nhi\r\n",
+			"unterminated MIME part",
+		},
+		{
+			"invalid base64 attachment",
+			head + "Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: application/pdf\r\n" +
+				"Content-Disposition: attachment; filename=a.pdf\r\nContent-Transfer-Encoding: base64\r\n\r\n!!not base64!!\r\n--b--\r\n",
+			"invalid base64 encoding",
+		},
+		{
+			"invalid quoted-printable text",
+			head + "Content-Type: text/plain\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nraw \x00 byte\r\n",
+			"invalid quoted-printable encoding",
+		},
+		{
+			"unknown transfer encoding",
+			head + "Content-Type: text/plain\r\nContent-Transfer-Encoding: x-uuencode\r\n\r\nhi\r\n",
+			"unknown Content-Transfer-Encoding",
+		},
+		{
+			"invalid Content-Type",
+			head + "Content-Type: text/plain; charset\r\n\r\nhi\r\n",
+			"invalid Content-Type",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAnalyzer()
+			a.Deep = true
+			if _, err := a.AnalyzeMessage([]byte(tt.message)); err != nil {
+				t.Fatalf("Expected lenient deep analysis to succeed, got %v", err)
+			}
+
+			a.StrictMIME = true
+			report, err := a.AnalyzeMessage([]byte(tt.message))
+			if tt.wantError == "" {
+				if err != nil || len(report.Attachments) != 1 {
+					t.Fatalf("Expected one attachment and no error, got %+v (err=%v)", report, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Fatalf("Expected an error containing %q, got %v", tt.wantError, err)
+			}
+			if !strings.HasPrefix(describeStrictMIMEError(err), "Malformed MIME (-strict-mime): ") {
+				t.Errorf("Expected a -strict-mime explanation, got %q", describeStrictMIMEError(err))
+			}
+		})
+	}
+}
+
+func TestForEachRecord(t *testing.T) {
+	input := "==== MESSAGE ====\r\n" +
+		"From: a@example.com\r\nX-Forefront-Antispam-Report: SCL:1;\r\n" +
+		"  ==== MESSAGE ====  \r\n" +
+		"\r\n" +
+		"==== MESSAGE ====\r\n" +
+		"From: b@example.com\r\nX-Forefront-Antispam-Report: SCL:9;\r\n"
+
+	type record struct {
+		index  int
+		offset int64
+		from   string
+		scl    int
+	}
+	var got []record
+	err := forEachRecord(strings.NewReader(input), "==== MESSAGE ====", func(index int, offset int64, data []byte) error {
+		report, err := NewAnalyzer().AnalyzeMessage(data)
+		if err != nil {
+			return err
+		}
+		got = append(got, record{index, offset, report.From, report.SCL.Score})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := int64(strings.LastIndex(input, "From: b@"))
+	want := []record{{1, 19, "a@example.com", 1}, {2, second, "b@example.com", 9}}
+	if !slices.Equal(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+
+	// Without a leading separator the first record starts at offset 0
+	var offsets []int64
+	err = forEachRecord(strings.NewReader("From: a@example.com\n--\nFrom: b@example.com\n--\n"), "--", func(_ int, offset int64, _ []byte) error {
+		offsets = append(offsets, offset)
+		return nil
+	})
+	if err != nil || !slices.Equal(offsets, []int64{0, 23}) {
+		t.Errorf("Expected offsets [0 23], got %v (err=%v)", offsets, err)
+	}
+
+	if err := forEachRecord(strings.NewReader("--\n\n--\n"), "--", func(int, int64, []byte) error { return nil }); err == nil {
+		t.Error("Expected an error for input without records")
+	}
+}
+
+func TestAssertions(t *testing.T) {
+	rules, err := parseAssertions([]byte(`[
+		{"name": "partner skips filtering", "from_domain": "Partner.com", "expect": {"scl": -1, "spf": "PASS"}},
+		{"expect": {"scl_max": 4, "cat": "none"}}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules[0].FromDomain != "partner.com" || rules[1].Name != "rule 2" {
+		t.Errorf("Expected a lowercased domain and a default name, got %+v", rules)
+	}
+
+	for _, invalid := range []string{
+		`{}`,
+		`[]`,
+		`[{"expect": {}}]`,
+		`[{"expect": {"scl": 12}}]`,
+		`[{"expect": {"spff": "pass"}}]`,
+	} {
+		if _, err := parseAssertions([]byte(invalid)); err == nil {
+			t.Errorf("Expected %s to be rejected", invalid)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		report  *EmailSecurityReport
+		failing []string
+	}{
+		{
+			"partner passes",
+			&EmailSecurityReport{
+				From:       "Relay <relay@mail.partner.com>",
+				SCL:        &SCLResult{Score: -1, CAT: "NONE"},
+				SPFResults: []SPFResult{{Result: "pass"}},
+			},
+			nil,
+		},
+		{
+			"partner fails SCL and SPF",
+			&EmailSecurityReport{
+				From:       "a@partner.com",
+				SCL:        &SCLResult{Score: 5, CAT: "SPM"},
+				SPFResults: []SPFResult{{Result: "softfail"}},
+			},
+			[]string{
+				"partner skips filtering: scl is 5, want -1",
+				"partner skips filtering: spf is softfail, want pass",
+				"rule 2: scl is 5, want at most 4",
+				"rule 2: cat is SPM, want NONE",
+			},
+		},
+		{
+			"other sender without SCL",
+			&EmailSecurityReport{From: "a@notpartner.com"},
+			[]string{"rule 2: scl is missing, want at most 4", "rule 2: cat is missing, want NONE"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			sink := &assertionSink{ResultSink: &collectingSink{}, rules: rules, w: &out}
+			if err := sink.Write(tt.report); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+				if _, failure, ok := strings.Cut(line, tt.report.From+": "); ok {
+					got = append(got, failure)
+				}
+			}
+			if !slices.Equal(got, tt.failing) {
+				t.Errorf("Expected failures %q, got %q", tt.failing, got)
+			}
+			if wantFailed := min(len(tt.failing), 1); sink.failed != wantFailed || sink.checked != 1 {
+				t.Errorf("Expected checked=1 failed=%d, got checked=%d failed=%d", wantFailed, sink.checked, sink.failed)
+			}
+		})
+	}
+}
+
+func TestParseAutomation(t *testing.T) {
+	tests := []struct {
+		name   string
+		header mail.Header
+		want   *AutomationInfo
+	}{
+		{"absent", mail.Header{"Subject": {"hi"}}, nil},
+		{"bulk newsletter", mail.Header{"Precedence": {" Bulk "}}, &AutomationInfo{Precedence: "bulk", Bulk: true}},
+		{"mailing list", mail.Header{"Precedence": {"list"}}, &AutomationInfo{Precedence: "list", Bulk: true}},
+		{"other precedence", mail.Header{"Precedence": {"first-class"}}, &AutomationInfo{Precedence: "first-class"}},
+		{
+			"auto-reply with parameters",
+			mail.Header{"Auto-Submitted": {"Auto-Replied; owner-email=\"ooo@example.com\""}},
+			&AutomationInfo{AutoSubmitted: "auto-replied", Automated: true},
+		},
+		{"explicit no", mail.Header{"Auto-Submitted": {"no (human)"}}, &AutomationInfo{AutoSubmitted: "no"}},
+		{
+			"both",
+			mail.Header{"Precedence": {"junk"}, "Auto-Submitted": {"auto-generated"}},
+			&AutomationInfo{Precedence: "junk", AutoSubmitted: "auto-generated", Bulk: true, Automated: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseAutomation(tt.header)
+			if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+				t.Errorf("parseAutomation() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// BenchmarkAnalyzeBatch analyzes a small batch of realistic header blocks and
+// redacts each report, as a -redact-pattern batch run does. Run with
+// -benchmem to compare per-message allocations.
+func BenchmarkAnalyzeBatch(b *testing.B) {
+	messages := make([][]byte, 0, 8)
+	for i := range 8 {
+		messages = append(messages, []byte(fmt.Sprintf("Received: from mail%d.example.com (mail%d.example.com [203.0.113.%d]) by mx.example.net with ESMTPS; Mon, 2 Jan 2006 15:04:05 -0700 (MST)\r\n"+
+			"Received: from [10.0.0.%d] by mail%d.example.com with ESMTP; Mon, 2 Jan 2006 15:04:01 -0700\r\n"+
+			"Authentication-Results: mx.example.net; spf=pass (sender IP is 203.0.113.%d) smtp.mailfrom=example.com; dkim=pass (signature was verified) header.d=example.com header.s=s1; dmarc=pass action=none header.from=example.com; compauth=pass reason=100\r\n"+
+			"Received-SPF: Pass (mx.example.net: domain of example.com designates 203.0.113.%d as permitted sender) client-ip=203.0.113.%d\r\n"+
+			"DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=s1; h=from:to:subject; bh=abc=; b=def=\r\n"+
+			"ARC-Authentication-Results: i=1; mx.example.net; spf=pass smtp.mailfrom=example.com; dkim=pass header.d=example.com; arc=none\r\n"+
+			"X-Forefront-Antispam-Report: CIP:203.0.113.%d;CTRY:US;LANG:en;SCL:1;SRV:;IPV:NLI;SFV:NSPM;CAT:NONE;SFS:(13230040)(4636009);DIR:INB;\r\n"+
+			"X-Spam-Status: No, score=-0.1 required=5.0 tests=DKIM_SIGNED,DKIM_VALID autolearn=ham\r\n"+
+			"List-Unsubscribe: <mailto:unsub@example.com>, <https://example.com/u/%d>\r\n"+
+			"Message-ID: <%d.employee-4711@corp.example.com>\r\n"+
+			"From: Sender <sender@example.com>\r\nTo: a@example.org, b@example.org\r\nSubject: report %d\r\nDate: Mon, 2 Jan 2006 15:04:00 -0700\r\n\r\nbody\r\n",
+			i, i, i, i, i, i, i, i, i, i, i, i)))
+	}
+	redactor, err := NewRedactor([]string{`employee-\d+`, `corp\.example\.com`})
+	if err != nil {
+		b.Fatal(err)
+	}
+	a := NewAnalyzer()
+
+	b.ReportAllocs()
+	for b.Loop() {
+		for _, data := range messages {
+			report, err := a.AnalyzeMessage(data)
+			if err != nil {
+				b.Fatal(err)
+			}
+			redactor.Redact(report)
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(messages)), "ns/msg")
+}
+
+func TestAnalyzeParts(t *testing.T) {
+	header := mail.Header{
+		"From":                        {"a@example.com"},
+		"Content-Type":                {"multipart/mixed; boundary=b"},
+		"X-Forefront-Antispam-Report": {"SCL:5;"},
+	}
+	body := "--b\r\nContent-Type: text/plain\r\n\r\nhi\r\n" +
+		"--b\r\nContent-Type: application/zip\r\nContent-Disposition: attachment; filename=invoice.zip\r\n\r\nPK\r\n--b--\r\n"
+
+	a := NewAnalyzer()
+	report, err := a.AnalyzeParts(header, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.SCL == nil || report.SCL.Score != 5 || report.Attachments != nil {
+		t.Errorf("Expected SCL 5 and no attachments without Deep, got %+v", report)
+	}
+
+	a.Deep = true
+	report, err = a.AnalyzeParts(header, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Attachments) != 1 || report.Attachments[0].Filename != "invoice.zip" {
+		t.Errorf("Expected the invoice.zip attachment, got %+v", report.Attachments)
+	}
+
+	// The same message through AnalyzeMessage yields the same attachments
+	var raw strings.Builder
+	for _, name := range []string{"From", "Content-Type", "X-Forefront-Antispam-Report"} {
+		fmt.Fprintf(&raw, "%s: %s\r\n", name, header.Get(name))
+	}
+	whole, err := a.AnalyzeMessage([]byte(raw.String() + "\r\n" + body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.EqualFunc(whole.Attachments, report.Attachments, func(x, y Attachment) bool { return x.Filename == y.Filename && x.Size == y.Size }) {
+		t.Errorf("Expected matching attachments, got %+v and %+v", whole.Attachments, report.Attachments)
+	}
+
+	a.StrictMIME = true
+	if _, err := a.AnalyzeParts(header, strings.NewReader("--b\r\nContent-Type: text/plain\r\n\r\nunterminated\r\n")); err == nil {
+		t.Error("Expected StrictMIME to reject an unterminated body")
+	}
+}
+
+// TestDedupe tests that -dedupe skips repeated Message-IDs and, for
+// messages without one, repeated content
+func TestDedupe(t *testing.T) {
+	dir := t.TempDir()
+	mbox := filepath.Join(dir, "box.mbox")
+	mboxContent := "From x Mon Jan  1 00:00:00 2024\nFrom: a@example.com\nMessage-ID: <one@example.com>\nSubject: one\n\nbody\n\n" +
+		"From y Mon Jan  1 00:00:00 2024\nFrom: a@example.com\nMessage-ID: <one@example.com>\nSubject: one again\n\nbody\n\n" +
+		"From z Mon Jan  1 00:00:00 2024\nFrom: b@example.com\nSubject: no id\n\nbody\n"
+	if err := os.WriteFile(mbox, []byte(mboxContent), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	noID := filepath.Join(dir, "copy.eml")
+	if err := os.WriteFile(noID, []byte("From: b@example.com\nSubject: no id\n\nbody\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(dir, "other.eml")
+	if err := os.WriteFile(other, []byte("From: b@example.com\nSubject: no id\n\ndifferent body\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	deduper := NewDeduper()
+	a := NewAnalyzer()
+	a.Dedupe = deduper
+
+	sink := &collectingSink{}
+	failed, err := a.AnalyzeFiles(context.Background(), []string{mbox, noID, other, mbox}, sink, nil)
+	if err != nil || failed != 0 {
+		t.Fatalf("AnalyzeFiles failed: failed=%d err=%v", failed, err)
+	}
+	var subjects []string
+	for _, report := range sink.reports {
+		subjects = append(subjects, report.Subject)
+	}
+	// copy.eml matches the mbox message without an ID by content, and the
+	// second pass over the mbox is all repeats
+	if want := []string{"one", "no id", "no id"}; !slices.Equal(subjects, want) || sink.reports[2].File != other {
+		t.Errorf("Expected subjects %q ending with other.eml, got %q", want, subjects)
+	}
+	if deduper.Skipped() != 5 {
+		t.Errorf("Expected 5 skipped duplicates, got %d", deduper.Skipped())
+	}
+
+	// Copies that do not parse are never skipped: each one is a failure
+	broken := filepath.Join(dir, "broken.eml")
+	if err := os.WriteFile(broken, []byte("From: b@example.com\ngarbage\n\nbody\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	deduper = NewDeduper()
+	a.Dedupe = deduper
+	sink = &collectingSink{}
+	failed, err = a.AnalyzeFiles(context.Background(), []string{broken, broken}, sink, nil)
+	if err != nil || failed != 2 || len(sink.reports) != 0 || deduper.Skipped() != 0 {
+		t.Errorf("Expected both broken copies to fail, got failed=%d reports=%d skipped=%d err=%v", failed, len(sink.reports), deduper.Skipped(), err)
+	}
+}
+
+func TestParseWebappOrigin(t *testing.T) {
+	tests := []struct {
+		name   string
+		header mail.Header
+		want   *WebappOrigin
+	}{
+		{"absent", mail.Header{"Subject": {"hi"}}, nil},
+		{
+			"php mail()",
+			mail.Header{"X-Php-Originating-Script": {"1000:class-mailer.php"}},
+			&WebappOrigin{Script: "class-mailer.php", ScriptUID: "1000"},
+		},
+		{"no uid", mail.Header{"X-Php-Originating-Script": {" mailer.php "}}, &WebappOrigin{Script: "mailer.php"}},
+		{"non-numeric prefix", mail.Header{"X-Php-Originating-Script": {"C:\\www\\send.php"}}, &WebappOrigin{Script: "C:\\www\\send.php"}},
+		{"legacy php", mail.Header{"X-Php-Script": {"example.com/contact.php for 192.0.2.7"}}, &WebappOrigin{PHPScript: "example.com/contact.php for 192.0.2.7"}},
+		{
+			"cpanel",
+			mail.Header{
+				"X-Source":      {"/opt/cpanel/ea-php81/root/usr/bin/php-cgi"},
+				"X-Source-Args": {"/opt/cpanel/ea-php81/root/usr/bin/php-cgi /home/shop/public_html/wp-content/uploads/x.php"},
+				"X-Source-Dir":  {"shop.example:/public_html/wp-content/uploads"},
+			},
+			&WebappOrigin{
+				Source:     "/opt/cpanel/ea-php81/root/usr/bin/php-cgi",
+				SourceArgs: "/opt/cpanel/ea-php81/root/usr/bin/php-cgi /home/shop/public_html/wp-content/uploads/x.php",
+				SourceDir:  "shop.example:/public_html/wp-content/uploads",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseWebappOrigin(tt.header)
+			if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+				t.Errorf("parseWebappOrigin() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestParseScoreBands tests -verdict-map parsing and mapping SpamAssassin
+// scores into the shared verdict categories
+func TestParseScoreBands(t *testing.T) {
+	bands, err := parseScoreBands([]byte(`{"spamassassin": {"low_spam": 3, "spam": 5, "high_confidence": 7}}`))
+	if err != nil {
+		t.Fatalf("parseScoreBands failed: %v", err)
+	}
+	if bands["mimecast"] != defaultScoreBands["mimecast"] {
+		t.Errorf("Expected mimecast to keep its default bands, got %+v", bands["mimecast"])
+	}
+	partial, err := parseScoreBands([]byte(`{"mimecast": {"high_confidence": 20}}`))
+	if err != nil || partial["mimecast"] != (ScoreBands{LowSpam: 3, Spam: 5, HighConfidence: 20}) {
+		t.Errorf("Expected omitted bands to keep their defaults, got %+v, %v", partial["mimecast"], err)
+	}
+
+	for name, input := range map[string]string{
+		"not an object":  `[]`,
+		"scl":            `{"scl": {"spam": 5}}`,
+		"unknown key":    `{"spamassassin": {"spam": 5, "hihg_confidence": 9}}`,
+		"out of order":   `{"spamassassin": {"low_spam": 6, "spam": 5}}`,
+		"non-numeric":    `{"mimecast": {"spam": "five"}}`,
+		"invalid JSON":   `{"spamassassin":`,
+		"bands not dict": `{"spamassassin": 5}`,
+	} {
+		if _, err := parseScoreBands([]byte(input)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	a := NewAnalyzer()
+	a.ScoreBands = bands
+	tests := []struct {
+		name    string
+		sa      SpamAssassinResult
+		verdict string
+	}{
+		{"clean", SpamAssassinResult{Score: -0.1}, VerdictNotSpam},
+		{"low", SpamAssassinResult{Score: 3.5}, VerdictLowSpam},
+		{"matches SCL 7", SpamAssassinResult{Score: 7.0, IsSpam: true}, VerdictHighConfidence},
+		{"flag without score", SpamAssassinResult{IsSpam: true}, VerdictSpam},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verdicts := a.collectVerdicts(&EmailSecurityReport{SpamAssassin: &tt.sa})
+			if len(verdicts) != 1 || verdicts[0].Verdict != tt.verdict {
+				t.Errorf("Expected %s, got %+v", tt.verdict, verdicts)
+			}
+		})
+	}
+}
+
+// TestNewAnalyzerScoreBands tests that each analyzer gets its own copy of
+// the default score bands
+func TestNewAnalyzerScoreBands(t *testing.T) {
+	first, second := NewAnalyzer(), NewAnalyzer()
+	first.ScoreBands["mimecast"] = ScoreBands{LowSpam: 1, Spam: 2, HighConfidence: 3}
+	if second.ScoreBands["mimecast"] != (ScoreBands{LowSpam: 3, Spam: 5, HighConfidence: 10}) {
+		t.Errorf("Changing one analyzer's bands changed another's: %+v", second.ScoreBands["mimecast"])
+	}
+	if defaultScoreBands["mimecast"] != second.ScoreBands["mimecast"] {
+		t.Errorf("Changing an analyzer's bands changed the defaults: %+v", defaultScoreBands["mimecast"])
+	}
+}
+
+// TestProbeHeaderFiles tests the -probe header frequency table
+func TestProbeHeaderFiles(t *testing.T) {
+	dir := t.TempDir()
+	mbox := filepath.Join(dir, "box.mbox")
+	mboxContent := "From x Mon Jan  1 00:00:00 2024\nFrom: a@example.com\nX-Forefront-Antispam-Report: SCL:1;\nX-Mimecast-Spam-Score: 2\nAuthentication-Results: mx; spf=pass\n\nbody\n\n" +
+		"From y Mon Jan  1 00:00:00 2024\nFrom: b@example.com\nX-Forefront-Antispam-Report: SCL:5;\nX-Proofpoint-Spam-Details: rule=notspam\nX-Proofpoint-Virus-Version: 1\n\nbody\n"
+	if err := os.WriteFile(mbox, []byte(mboxContent), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.eml")
+
+	probe, err := probeHeaderFiles(context.Background(), []string{mbox, missing}, nil)
+	if err != nil {
+		t.Fatalf("probeHeaderFiles failed: %v", err)
+	}
+	if probe.Messages != 2 || probe.Errors != 1 || len(probe.Headers) != len(probeHeaders) {
+		t.Fatalf("Expected 2 messages, 1 error and every header, got %d, %d, %d", probe.Messages, probe.Errors, len(probe.Headers))
+	}
+	want := []ProbedHeader{
+		{Header: "X-Forefront-Antispam-Report", Parser: "scl", Messages: 2},
+		{Header: "Authentication-Results", Parser: "authentication-results", Messages: 1},
+		{Header: "X-Mimecast-*", Parser: "mimecast", Messages: 1},
+		{Header: "X-Proofpoint-*", Parser: "gateways", Messages: 1}, // Two matching headers, one message
+		{Header: "X-Forefront-Antispam-Report-Untrusted", Parser: "scl", Messages: 0},
+	}
+	if !slices.Equal(probe.Headers[:len(want)], want) {
+		t.Errorf("Expected %+v, got %+v", want, probe.Headers[:len(want)])
+	}
+
+	var out bytes.Buffer
+	outputProbeText(&out, probe)
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) < 5 || !slices.Equal(strings.Fields(lines[4]), []string{"X-Forefront-Antispam-Report", "scl", "2", "100.0%"}) {
+		t.Errorf("Unexpected probe table:\n%s", out.String())
+	}
+
+	// Every gateway the report names must show up in the probe
+	for _, gateway := range gatewayHeaderPrefixes {
+		covered := slices.ContainsFunc(probeHeaders, func(h struct{ name, parser string }) bool {
+			return strings.HasPrefix(gateway.prefix, strings.TrimSuffix(strings.ToLower(h.name), "*"))
+		})
+		if !covered {
+			t.Errorf("Gateway header prefix %q has no probeHeaders entry", gateway.prefix)
+		}
+	}
+}
+
+// TestParseARCChain tests ARC set grouping and chain structure checks
+func TestParseARCChain(t *testing.T) {
+	seal := func(i int, cv string) string {
+		return fmt.Sprintf("i=%d; a=rsa-sha256; t=1700000000; cv=%s; d=hop%d.example; s=arc;\r\n\tb=c2lnbmF0dXJl", i, cv, i)
+	}
+	signature := func(i int) string {
+		return fmt.Sprintf("i=%d; a=rsa-sha256; c=relaxed/relaxed; d=hop%d.example; s=arc; h=from:to;\r\n\tbh=Ym9keWhhc2g=; b=c2ln", i, i)
+	}
+	results := func(i int) string {
+		return fmt.Sprintf("i=%d; mx.hop%d.example; spf=pass smtp.mailfrom=example.com; dkim=pass header.i=@example.com", i, i)
+	}
+	set := func(i int, cv string) mail.Header {
+		return mail.Header{"Arc-Seal": {seal(i, cv)}, "Arc-Message-Signature": {signature(i)}, "Arc-Authentication-Results": {results(i)}}
+	}
+	merge := func(headers ...mail.Header) mail.Header {
+		merged := mail.Header{}
+		for _, h := range headers {
+			for name, values := range h {
+				// Later hops are prepended, as each intermediary adds its set on top
+				merged[name] = append(slices.Clone(values), merged[name]...)
+			}
+		}
+		return merged
+	}
+
+	tests := []struct {
+		name      string
+		header    mail.Header
+		status    string
+		instances []int
+		gaps      []int
+		problems  int
+	}{
+		{name: "absent", header: mail.Header{"Subject": {"hi"}}},
+		{name: "single hop", header: set(1, "none"), status: "pass", instances: []int{1}},
+		{name: "two hops", header: merge(set(1, "none"), set(2, "pass")), status: "pass", instances: []int{1, 2}},
+		{name: "broken chain", header: merge(set(1, "none"), set(2, "fail")), status: "fail", instances: []int{1, 2}, problems: 1},
+		{name: "gap", header: merge(set(1, "none"), set(3, "pass")), status: "fail", instances: []int{1, 3}, gaps: []int{2}, problems: 1},
+		{name: "first hop claims pass", header: set(1, "pass"), status: "fail", instances: []int{1}, problems: 1},
+		{
+			name:   "missing signature",
+			header: mail.Header{"Arc-Seal": {seal(1, "none")}, "Arc-Authentication-Results": {results(1)}},
+			status: "fail", instances: []int{1}, problems: 1,
+		},
+		{
+			name:   "duplicate seal",
+			header: merge(set(1, "none"), mail.Header{"Arc-Seal": {seal(1, "none")}}),
+			status: "fail", instances: []int{1}, problems: 1,
+		},
+		{
+			name:   "invalid instance",
+			header: merge(set(1, "none"), mail.Header{"Arc-Seal": {seal(51, "pass")}}),
+			status: "fail", instances: []int{1}, problems: 1,
+		},
+		{name: "results only", header: mail.Header{"Arc-Authentication-Results": {results(1)}}, status: "none", instances: []int{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := parseARCChain(tt.header)
+			if tt.status == "" {
+				if chain != nil {
+					t.Errorf("Expected nil, got %+v", chain)
+				}
+				return
+			}
+			if chain == nil {
+				t.Fatal("Expected a chain, got nil")
+			}
+			var instances []int
+			for _, s := range chain.Sets {
+				instances = append(instances, s.Instance)
+			}
+			if chain.Status != tt.status || !slices.Equal(instances, tt.instances) || !slices.Equal(chain.Gaps, tt.gaps) || len(chain.Problems) != tt.problems {
+				t.Errorf("Expected %s %v gaps %v with %d problems, got %s %v gaps %v %q",
+					tt.status, tt.instances, tt.gaps, tt.problems, chain.Status, instances, chain.Gaps, chain.Problems)
+			}
+		})
+	}
+
+	chain := parseARCChain(merge(set(1, "none"), set(2, "pass")))
+	if second := chain.Sets[1]; second.ChainValidation != "pass" || second.SealDomain != "hop2.example" || second.SignatureDomain != "hop2.example" || !second.HasResults {
+		t.Errorf("Unexpected second set: %+v", second)
+	}
+}
+
+// TestLocale tests localized descriptions and that codes and scores stay
+// unchanged
+func TestLocale(t *testing.T) {
+	// Shipped locales translate every English entry and nothing else
+	for locale, tables := range localeDescriptions {
+		for kind, english := range localeDescriptions["en"] {
+			if !slices.Equal(slices.Sorted(maps.Keys(tables[kind])), slices.Sorted(maps.Keys(english))) {
+				t.Errorf("Locale %s: %s table keys differ from English", locale, kind)
+			}
+		}
+	}
+
+	header := mail.Header{"X-Forefront-Antispam-Report": {"CIP:192.0.2.1;CTRY:DE;SFV:SPM;CAT:PHSH;IPV:NLI;SRV:BULK,NEWCODE;SCL:5;"}}
+	a := NewAnalyzer()
+	english := a.Analyze(header)
+	a.Locale = "de"
+	german := a.Analyze(header)
+
+	if english.SCL.Description != "Spam" || german.SCL.Description != "Spam" {
+		t.Errorf("Expected Spam in both locales, got %q and %q", english.SCL.Description, german.SCL.Description)
+	}
+	if german.SCL.Score != english.SCL.Score || german.SCL.SFV != "SPM" || german.SCL.CAT != "PHSH" {
+		t.Errorf("Expected codes and scores unchanged, got %+v", german.SCL)
+	}
+	if got := german.SCL.Services; len(got) != 2 || got[0].Code != "BULK" || !strings.HasPrefix(got[0].Description, "Anhand") || got[1].Description != "Unbekannte Dienstklassifizierung" {
+		t.Errorf("Expected German service descriptions, got %+v", got)
+	}
+	if desc := localizedSCL("de", 9, a.Thresholds); desc != "Spam mit hoher Konfidenz" {
+		t.Errorf("Expected German high confidence description, got %q", desc)
+	}
+	if desc := describeToken("de", "cat", "PHSH"); desc != "Phishing" {
+		t.Errorf("Expected Phishing, got %q", desc)
+	}
+	if desc := describeToken("de", "sfv", "ZZZ"); desc != "Unbekannter Code" {
+		t.Errorf("Expected the German unknown code text, got %q", desc)
+	}
+	if catalog := a.Catalog(); catalog.IPV["NLI"] != "Quell-IP steht auf keiner IP-Reputationsliste" || catalog.SCL["-1"] != localizedSCL("de", -1, a.Thresholds) {
+		t.Errorf("Expected a German catalog, got %+v", catalog.IPV)
+	}
+
+	// A partial locale falls back to English for the entries it lacks
+	localeDescriptions["test"] = Descriptions{"cat": {"SPM": "Pourriel"}}
+	defer delete(localeDescriptions, "test")
+	if describeToken("test", "cat", "SPM") != "Pourriel" || describeToken("test", "cat", "PHSH") != "Phishing" || describeToken("test", "sfv", "ZZZ") != "Unknown code" {
+		t.Error("Expected a partial locale to fall back to English")
+	}
+}
+
+// TestReplyToMismatch tests Reply-To domain extraction and comparison with From
+func TestReplyToMismatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		replyTo  []string
+		domains  []string
+		mismatch bool
+	}{
+		{"absent", nil, nil, false},
+		{"same domain", []string{"Alice <alice@example.co.uk>"}, []string{"example.co.uk"}, false},
+		{"same organization", []string{"<billing@mail.example.co.uk>"}, []string{"mail.example.co.uk"}, false},
+		{"other organization", []string{"Alice <alice.finance@gmail.com>"}, []string{"gmail.com"}, true},
+		{"list with one outsider", []string{"alice@example.co.uk, Payments <pay@other.co.uk>"}, []string{"example.co.uk", "other.co.uk"}, true},
+		{"multiple headers", []string{"alice@example.co.uk", "ALICE@Example.co.uk"}, []string{"example.co.uk"}, false},
+		{"unparseable list", []string{"bad address <x@evil.test>, alice@example.co.uk"}, []string{"evil.test", "example.co.uk"}, true},
+		{"no domain", []string{"undisclosed-recipients:;"}, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := mail.Header{"From": {"Alice <alice@example.co.uk>"}}
+			if tt.replyTo != nil {
+				header["Reply-To"] = tt.replyTo
+			}
+			report := NewAnalyzer().Analyze(header)
+			if !slices.Equal(report.ReplyToDomains, tt.domains) {
+				t.Errorf("Expected domains %v, got %v", tt.domains, report.ReplyToDomains)
+			}
+			if report.ReplyToMismatch != tt.mismatch {
+				t.Errorf("Expected mismatch=%v, got %v", tt.mismatch, report.ReplyToMismatch)
+			}
+			if report.FromDomain != "example.co.uk" {
+				t.Errorf("Expected from domain example.co.uk, got %q", report.FromDomain)
+			}
+		})
+	}
+}
+
+// TestStartProfiling tests that both profiles are written and stop is idempotent
+func TestStartProfiling(t *testing.T) {
+	dir := t.TempDir()
+	cpuPath := filepath.Join(dir, "cpu.prof")
+	memPath := filepath.Join(dir, "mem.prof")
+
+	stop, err := startProfiling(cpuPath, memPath)
+	if err != nil {
+		t.Fatalf("startProfiling failed: %v", err)
+	}
+	NewAnalyzer().Analyze(mail.Header{"From": {"alice@example.com"}})
+	stop()
+	stop()
+
+	for _, path := range []string{cpuPath, memPath} {
+		info, err := os.Stat(path)
+		if err != nil || info.Size() == 0 {
+			t.Errorf("Expected a non-empty profile at %s (err=%v)", path, err)
+		}
+	}
+
+	if _, err := startProfiling(filepath.Join(dir, "missing", "cpu.prof"), ""); err == nil {
+		t.Error("Expected an error for an uncreatable profile path")
+	}
+	// A failed start must not leave the CPU profiler running
+	stop, err = startProfiling(cpuPath, "")
+	if err != nil {
+		t.Fatalf("Expected profiling to restart, got %v", err)
+	}
+	stop()
+
+	stop, err = startProfiling("", "")
+	if err != nil {
+		t.Fatalf("Expected no-op profiling to succeed, got %v", err)
+	}
+	stop()
+}
+
+// TestParseSenderSoftware tests X-Mailer, User-Agent and Organization parsing
+// and spam tool matching
+func TestParseSenderSoftware(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   mail.Header
+		tools    []string
+		expected *SenderSoftware
+	}{
+		{"absent", mail.Header{"Subject": {"hi"}}, defaultSpamTools, nil},
+		{
+			"legitimate client",
+			mail.Header{"User-Agent": {"Mozilla Thunderbird"}, "Organization": {" Example Corp "}},
+			defaultSpamTools,
+			&SenderSoftware{UserAgent: "Mozilla Thunderbird", Organization: "Example Corp"},
+		},
+		{
+			"spam tool in X-Mailer",
+			mail.Header{"X-Mailer": {"ATOMIC MAIL SENDER 9.61"}},
+			defaultSpamTools,
+			&SenderSoftware{Mailer: "ATOMIC MAIL SENDER 9.61", SpamTool: "Atomic Mail Sender"},
+		},
+		{
+			"spam tool in User-Agent",
+			mail.Header{"X-Mailer": {"Microsoft Outlook 16.0"}, "User-Agent": {"SendBlaster 4"}},
+			defaultSpamTools,
+			&SenderSoftware{Mailer: "Microsoft Outlook 16.0", UserAgent: "SendBlaster 4", SpamTool: "SendBlaster"},
+		},
+		{
+			"custom list replaces defaults",
+			mail.Header{"X-Mailer": {"SendBlaster 4"}},
+			[]string{"MailerKing"},
+			&SenderSoftware{Mailer: "SendBlaster 4"},
+		},
+		{
+			"empty entries ignored",
+			mail.Header{"X-Mailer": {"PHPMailer 6.9"}},
+			[]string{""},
+			&SenderSoftware{Mailer: "PHPMailer 6.9"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := parseSenderSoftware(tt.header, tt.tools)
+			if (result == nil) != (tt.expected == nil) || (result != nil && *result != *tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, result)
+			}
+		})
+	}
+
+	path := filepath.Join(t.TempDir(), "tools.txt")
+	if err := os.WriteFile(path, []byte("# local list\n\nMailerKing\n  Bulk Blaster  \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tools, err := loadSpamTools(path)
+	if err != nil || !slices.Equal(tools, []string{"MailerKing", "Bulk Blaster"}) {
+		t.Errorf("Expected the listed tools, got %v (err=%v)", tools, err)
+	}
+	if report := (&Analyzer{SpamTools: tools}).Analyze(mail.Header{"X-Mailer": {"bulk blaster pro"}}); report.Software == nil || report.Software.SpamTool != "Bulk Blaster" {
+		t.Errorf("Expected the custom list to flag the mailer, got %+v", report.Software)
+	}
+}
+
+// TestSummarySink tests the running batch summary, printed concurrently with
+// analysis (run with -race)
+func TestSummarySink(t *testing.T) {
+	var buf bytes.Buffer
+	summary := newSummarySink(&buf, false, sclProfiles["balanced"])
+	start := summary.start
+	summary.now = func() time.Time { return start.Add(90 * time.Second) }
+	next := &collectingSink{}
+	summary.ResultSink = next
+
+	stop := summary.Run(context.Background(), time.Millisecond)
+	for i := range 50 {
+		if err := summary.Write(&EmailSecurityReport{SCL: &SCLResult{Score: i % 10}}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		summary.Progress(i+1, 50)
+	}
+	// Give the ticker a chance to print a running summary
+	time.Sleep(20 * time.Millisecond)
+	stop()
+	running := buf.String()
+	buf.Reset()
+
+	if len(next.reports) != 50 {
+		t.Errorf("Expected every report forwarded, got %d", len(next.reports))
+	}
+	if !strings.Contains(running, "Running summary after 1m30s: ") || strings.Contains(running, "errors") {
+		t.Errorf("Expected a running summary without an error count, got %q", running)
+	}
+
+	summary.Print("Summary", 2)
+	expected := "Summary after 1m30s: 50/50 files, 50 messages, 2 errors (not spam 10, low spam 15, spam 10, high confidence 15, skipped 0, no SCL 0)\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+// TestAuthResultReason tests reason= capture from Authentication-Results
+func TestAuthResultReason(t *testing.T) {
+	tests := []struct {
+		name   string
+		clause string
+		reason string
+	}{
+		{"quoted", `spf=pass reason="ip allowlisted" smtp.mailfrom=example.com`, "ip allowlisted"},
+		{"unquoted", "compauth=pass reason=100", "100"},
+		{"escaped quote", `dmarc=fail reason="no \"aligned\" identifier" header.from=example.com`, `no "aligned" identifier`},
+		{"uppercase key", "dkim=fail REASON=bad_signature header.d=example.com", "bad_signature"},
+		{"absent", "dkim=pass header.d=example.com header.s=s1", ""},
+		{"empty quoted", `spf=none reason=""`, ""},
+		{"not a reason property", "spf=pass smtp.reason=x", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := authResultReason(tt.clause); got != tt.reason {
+				t.Errorf("Expected %q, got %q", tt.reason, got)
+			}
+		})
+	}
+
+	header := mail.Header{"Authentication-Results": {`mx.example.net; spf=pass reason="ip allowlisted; trusted" smtp.mailfrom=example.com; ` +
+		`dkim=fail reason=bad_signature header.d=example.com header.s=s1; dmarc=fail header.from=example.com; compauth=softpass reason=201`}}
+	report := NewAnalyzer().Analyze(header)
+	if len(report.SPFResults) != 1 || report.SPFResults[0].Reason != "ip allowlisted; trusted" || report.SPFResults[0].Domain != "example.com" {
+		t.Errorf("Unexpected SPF results: %+v", report.SPFResults)
+	}
+	if len(report.DKIMResults) != 1 || report.DKIMResults[0].Reason != "bad_signature" {
+		t.Errorf("Unexpected DKIM results: %+v", report.DKIMResults)
+	}
+	if len(report.DMARCResults) != 1 || report.DMARCResults[0].Reason != "" {
+		t.Errorf("Expected a DMARC result without a reason, got %+v", report.DMARCResults)
+	}
+
+	var methods []string
+	for _, method := range report.AuthResults[0].Methods {
+		methods = append(methods, method.Method+":"+method.Reason)
+	}
+	// "arc" must not be read out of "dmarc"
+	expected := []string{"spf:ip allowlisted; trusted", "dkim:bad_signature", "dmarc:", "compauth:201"}
+	if !slices.Equal(methods, expected) {
+		t.Errorf("Expected methods %v, got %v", expected, methods)
+	}
+}
+
+// TestParseGraphMessage tests Microsoft Graph internetMessageHeaders input
+func TestParseGraphMessage(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		expected  mail.Header
+		expectErr string
+	}{
+		{
+			name: "headers",
+			input: `{"id": "AAMk", "subject": "ignored", "internetMessageHeaders": [
+				{"name": "received", "value": "from a by b"},
+				{"name": "Received", "value": "from c by d"},
+				{"name": "X-Forefront-Antispam-Report", "value": "CIP:203.0.113.5;SCL:5;"}]}`,
+			expected: mail.Header{
+				"Received":                    {"from a by b", "from c by d"},
+				"X-Forefront-Antispam-Report": {"CIP:203.0.113.5;SCL:5;"},
+			},
+		},
+		{
+			name:     "PowerShell casing",
+			input:    `{"InternetMessageHeaders": [{"Name": "Subject", "Value": "hi"}]}`,
+			expected: mail.Header{"Subject": {"hi"}},
+		},
+		{name: "array absent", input: `{"id": "AAMk", "subject": "no headers"}`, expected: mail.Header{}},
+		{name: "array null", input: `{"internetMessageHeaders": null}`, expected: mail.Header{}},
+		{name: "empty array", input: `{"internetMessageHeaders": []}`, expected: mail.Header{}},
+		{name: "not an object", input: `[{"name": "From", "value": "a@example.com"}]`, expectErr: "must be an object"},
+		{name: "malformed", input: `{"internetMessageHeaders": [`, expectErr: "must be an object"},
+		{name: "not an array", input: `{"internetMessageHeaders": {"From": "a"}}`, expectErr: "must be an array"},
+		{name: "missing value", input: `{"internetMessageHeaders": [{"name": "From"}]}`, expectErr: "internetMessageHeaders[0] must be an object"},
+		{name: "non-string value", input: `{"internetMessageHeaders": [{"name": "A", "value": "x"}, {"name": "B", "value": 1}]}`, expectErr: "internetMessageHeaders[1]"},
+		{name: "invalid name", input: `{"internetMessageHeaders": [{"name": "Bad Name", "value": "x"}]}`, expectErr: "invalid header name"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := parseGraphMessage([]byte(tt.input))
+			if tt.expectErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectErr) {
+					t.Errorf("Expected error containing %q, got %v", tt.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !maps.EqualFunc(header, tt.expected, slices.Equal[[]string]) {
+				t.Errorf("Expected %v, got %v", tt.expected, header)
+			}
+		})
+	}
+
+	// End to end through a forced input format
+	path := filepath.Join(t.TempDir(), "message.json")
+	data := `{"internetMessageHeaders": [{"name": "Subject", "value": "graph"}, {"name": "X-Forefront-Antispam-Report", "value": "CIP:203.0.113.5;SCL:6;"}]}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a := NewAnalyzer()
+	a.InputFormat = "graph-json"
+	report, err := a.AnalyzeFile(path)
+	if err != nil {
+		t.Fatalf("graph-json analysis failed: %v", err)
+	}
+	if report.Subject != "graph" || report.SCL == nil || report.SCL.Score != 6 {
+		t.Errorf("Unexpected report: subject=%q scl=%+v", report.Subject, report.SCL)
+	}
+}
+
+func TestEmailOptionsNewAnalyzer(t *testing.T) {
+	build := func(args ...string) (*Analyzer, error) {
+		var o emailOptions
+		fs := newEmailFlagSet(&o)
+		fs.SetOutput(io.Discard)
+		if err := fs.Parse(args); err != nil {
+			t.Fatalf("Parse(%q) failed: %v", args, err)
+		}
+		explicit := make(map[string]bool)
+		fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+		return o.newAnalyzer(explicit)
+	}
+
+	a, err := build("-v", "-profile", "strict", "-locale", "de", "-max-hops", "3", "-record-separator", "---", "-lookup-qps", "2", "-timezone", "UTC")
+	if err != nil {
+		t.Fatalf("newAnalyzer failed: %v", err)
+	}
+	if !a.IncludeRawHeaders || !a.Diagnostics || a.Thresholds != sclProfiles["strict"] || a.Locale != "de" || a.MaxHops != 3 {
+		t.Errorf("Flags not applied: %+v", a)
+	}
+	if a.InputFormat != "records" || a.RecordSeparator != "---" || a.Limiter == nil || a.Timezone != time.UTC {
+		t.Errorf("Expected records input, a limiter and UTC, got %q %q %v %v", a.InputFormat, a.RecordSeparator, a.Limiter, a.Timezone)
+	}
+	if defaultAnalyzer.Thresholds != sclProfiles["balanced"] || defaultAnalyzer.Locale != "" || defaultAnalyzer.Limiter != nil {
+		t.Errorf("Building from flags must not configure the default analyzer: %+v", defaultAnalyzer)
+	}
+
+	tests := []struct {
+		args      []string
+		expectErr string
+	}{
+		{args: []string{"-max-hops", "-1"}, expectErr: "-max-hops must not be negative"},
+		{args: []string{"-strict-mime"}, expectErr: "-strict-mime requires -deep"},
+		{args: []string{"-reputation-key", "k"}, expectErr: "-reputation-key requires -reputation-api"},
+		{args: []string{"-record-separator", " "}, expectErr: "-record-separator must not be blank"},
+		{args: []string{"-input-format", "records"}, expectErr: "must be used together"},
+		{args: []string{"-verdict-policy", "loudest"}, expectErr: "unknown verdict policy"},
+		{args: []string{"-locale", "fr"}, expectErr: "unknown locale"},
+		{args: []string{"-lookup-qps", "-1"}, expectErr: "-lookup-qps must be a non-negative number"},
+		{args: []string{"-timezone", "Mars/Olympus"}, expectErr: "unknown timezone"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			if _, err := build(tt.args...); err == nil || !strings.Contains(err.Error(), tt.expectErr) {
+				t.Errorf("Expected error containing %q, got %v", tt.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestPrintFlags(t *testing.T) {
+	var buf bytes.Buffer
+	fs := newEmailFlagSet(&emailOptions{})
+	printFlags(&buf, fs)
+	help := buf.String()
+	fs.VisitAll(func(f *flag.Flag) {
+		if !strings.Contains(help, "  -"+f.Name+" ") {
+			t.Errorf("Help is missing -%s", f.Name)
+		}
+	})
+	if !strings.Contains(help, "(default: balanced)") {
+		t.Error("Expected non-zero defaults in the help")
+	}
+	if strings.Contains(help, "(default: false)") || strings.Contains(help, "(default: 0)") {
+		t.Error("Zero defaults should not be listed")
+	}
+}